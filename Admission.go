@@ -0,0 +1,216 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Admission holds the admission control, which limits the engine resources, so that a
+// buggy caller can't exhaust the memory by starting unlimited Pingers
+//
+// The limits are off ( zero ) by default, and are set with SetAdmissionLimits:
+// - MaxOutstanding limits the probes waiting for a reply or an expiry, over all the Pingers
+// - MaxSessions limits the concurrent Pingers
+// - MaxSessionsPerTarget limits the concurrent Pingers per target IP.  The replies are matched
+//   to a single Session per target, so MaxSessionsPerTarget of 1 stops concurrent Pingers to
+//   the same target from taking each other's replies
+//
+// When a limit is reached:
+// - TryPingerWithConfig returns ErrEngineBusy, without waiting
+// - PingerWithContext waits for capacity, until the context is done
+// - The original Pinger functions wait for capacity, until the Pinger is stopped
+//
+// The outstanding probes are tracked by the Pingers, which take a probe before each send, and
+// release it when the result arrives, or when the Pinger ends.  So the Receivers and Expirers
+// don't need to know about the admission control at all.
+//
+// Status() returns the current utilization
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"inet.af/netaddr"
+)
+
+var (
+	// ErrEngineBusy is returned when the admission limits are reached
+	ErrEngineBusy = errors.New("icmpengine: engine busy, admission limits reached")
+	// ErrPingerStopped is returned when the Pinger is stopped while waiting for admission
+	ErrPingerStopped = errors.New("icmpengine: Pinger stopped while waiting for admission")
+)
+
+// AdmissionLimitsT are the admission limits, where zero is unlimited
+type AdmissionLimitsT struct {
+	MaxOutstanding       int
+	MaxSessions          int
+	MaxSessionsPerTarget int
+}
+
+// AdmissionT holds the admission control state
+// changed is closed and replaced whenever capacity is released while there are waiters
+type AdmissionT struct {
+	sync.Mutex
+	Limits      AdmissionLimitsT
+	Outstanding int
+	Sessions    int
+	Targets     map[netaddr.IP]int
+	Waiting     int
+	changed     chan struct{}
+}
+
+// EngineStatus is the current utilization of the engine, from Status()
+// Outstanding, Sessions and Targets are the admitted counts, and Pings is the
+// outstanding pings actually in the shards
+type EngineStatus struct {
+	Limits           AdmissionLimitsT
+	Outstanding      int
+	Sessions         int
+	Targets          int
+	Waiting          int
+	Rejected         uint64
+	Pings            int
+	ReceiversRunning bool
+}
+
+// SetAdmissionLimits sets the admission limits
+// Lowering the limits doesn't affect the already admitted Pingers or probes
+func (ie *ICMPEngine) SetAdmissionLimits(limits AdmissionLimitsT) {
+	a := &ie.Admission
+	a.Lock()
+	defer a.Unlock()
+	a.Limits = limits
+	a.notify()
+}
+
+// Status returns the current utilization of the engine
+func (ie *ICMPEngine) Status() (status EngineStatus) {
+
+	ie.RLock()
+	status.ReceiversRunning = ie.Receivers.Running
+	ie.RUnlock()
+
+	status.Pings, _, _ = ie.engineGauges()
+
+	a := &ie.Admission
+	a.Lock()
+	status.Limits = a.Limits
+	status.Outstanding = a.Outstanding
+	status.Sessions = a.Sessions
+	status.Targets = len(a.Targets)
+	status.Waiting = a.Waiting
+	a.Unlock()
+
+	status.Rejected = atomic.LoadUint64(&ie.Counters.AdmissionRejected)
+	return status
+}
+
+// admit takes the capacity, if it fits, otherwise returns ErrEngineBusy, or waits if block
+// admit returns ErrPingerStopped if a done channel closes, or the context error, while waiting
+func (ie *ICMPEngine) admit(ctx context.Context, block bool, done <-chan struct{}, allDone <-chan struct{}, fits func(a *AdmissionT) bool, take func(a *AdmissionT)) (err error) {
+
+	a := &ie.Admission
+	waiting := false
+	defer func() {
+		if waiting {
+			a.Lock()
+			a.Waiting--
+			a.Unlock()
+		}
+	}()
+
+	for {
+		a.Lock() // <-------------------------- LOCK!!
+		if fits(a) {
+			take(a)
+			a.Unlock() // <-------------------- UNLOCK!!
+			return nil
+		}
+		if !block {
+			a.Unlock() // <-------------------- UNLOCK!!
+			atomic.AddUint64(&ie.Counters.AdmissionRejected, 1)
+			return ErrEngineBusy
+		}
+		if !waiting {
+			waiting = true
+			a.Waiting++
+		}
+		if a.changed == nil {
+			a.changed = make(chan struct{})
+		}
+		changed := a.changed
+		a.Unlock() // <------------------------ UNLOCK!!
+
+		select {
+		case <-changed:
+		case <-done:
+			return ErrPingerStopped
+		case <-allDone:
+			return ErrPingerStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notify wakes all the waiters, to check if they now fit
+// notify assumes the Admission LOCK is already held
+func (a *AdmissionT) notify() {
+	if a.changed != nil {
+		close(a.changed)
+		a.changed = nil
+	}
+}
+
+// admitSession admits a new Pinger session for the IP
+func (ie *ICMPEngine) admitSession(ctx context.Context, block bool, IP netaddr.IP, done <-chan struct{}, allDone <-chan struct{}) (err error) {
+	return ie.admit(ctx, block, done, allDone,
+		func(a *AdmissionT) bool {
+			if a.Limits.MaxSessions > 0 && a.Sessions >= a.Limits.MaxSessions {
+				return false
+			}
+			if a.Limits.MaxSessionsPerTarget > 0 && a.Targets[IP] >= a.Limits.MaxSessionsPerTarget {
+				return false
+			}
+			return true
+		},
+		func(a *AdmissionT) {
+			a.Sessions++
+			a.Targets[IP]++
+		})
+}
+
+// releaseSession releases the Pinger session for the IP
+func (ie *ICMPEngine) releaseSession(IP netaddr.IP) {
+	a := &ie.Admission
+	a.Lock()
+	defer a.Unlock()
+	a.Sessions--
+	a.Targets[IP]--
+	if a.Targets[IP] <= 0 {
+		delete(a.Targets, IP)
+	}
+	a.notify()
+}
+
+// admitProbe admits a single outstanding probe
+func (ie *ICMPEngine) admitProbe(ctx context.Context, block bool, done <-chan struct{}, allDone <-chan struct{}) (err error) {
+	return ie.admit(ctx, block, done, allDone,
+		func(a *AdmissionT) bool {
+			return a.Limits.MaxOutstanding <= 0 || a.Outstanding < a.Limits.MaxOutstanding
+		},
+		func(a *AdmissionT) {
+			a.Outstanding++
+		})
+}
+
+// releaseProbes releases n outstanding probes
+func (ie *ICMPEngine) releaseProbes(n int) {
+	if n <= 0 {
+		return
+	}
+	a := &ie.Admission
+	a.Lock()
+	defer a.Unlock()
+	a.Outstanding -= n
+	a.notify()
+}
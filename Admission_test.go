@@ -0,0 +1,173 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+// newAdmissionEngine returns a running fake success engine
+func newAdmissionEngine(timeout time.Duration) (ie *ICMPEngine, wg *sync.WaitGroup) {
+	ie = NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), timeout, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+	ie.Start()
+	wg = new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+	return ie, wg
+}
+
+// waitStatus waits for the Status to match
+func waitStatus(ie *ICMPEngine, match func(s EngineStatus) bool) bool {
+	for i := 0; i < 1000; i++ {
+		if match(ie.Status()) {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+// TestAdmissionSessions checks the session limits return ErrEngineBusy, or wait with the context
+func TestAdmissionSessions(t *testing.T) {
+
+	ie, wg := newAdmissionEngine(time.Second)
+	ie.SetAdmissionLimits(AdmissionLimitsT{MaxSessions: 2, MaxSessionsPerTarget: 1})
+
+	a := netaddr.MustParseIP("192.0.2.1")
+	b := netaddr.MustParseIP("192.0.2.2")
+	c := netaddr.MustParseIP("192.0.2.3")
+	config := PingerConfigT{SummaryOnly: true}
+
+	// two long running Pingers
+	running := new(sync.WaitGroup)
+	doneA := make(chan struct{})
+	doneB := make(chan struct{})
+	for IP, done := range map[netaddr.IP]chan struct{}{a: doneA, b: doneB} {
+		running.Add(1)
+		go func(IP netaddr.IP, done chan struct{}) {
+			defer running.Done()
+			if _, err := ie.TryPingerWithConfig(IP, 1000, 10*time.Millisecond, done, config); err != nil {
+				t.Errorf(fmt.Sprintf("TestAdmissionSessions [%s] err:%v", IP, err))
+			}
+		}(IP, done)
+	}
+	if !waitStatus(ie, func(s EngineStatus) bool { return s.Sessions == 2 }) {
+		t.Fatalf("TestAdmissionSessions Pingers not running")
+	}
+
+	// per target limit
+	if _, err := ie.TryPingerWithConfig(a, 1, time.Millisecond, make(chan struct{}), config); err != ErrEngineBusy {
+		t.Errorf(fmt.Sprintf("TestAdmissionSessions per target err:%v", err))
+	}
+	// sessions limit
+	if _, err := ie.TryPingerWithConfig(c, 1, time.Millisecond, make(chan struct{}), config); err != ErrEngineBusy {
+		t.Errorf(fmt.Sprintf("TestAdmissionSessions sessions err:%v", err))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	if _, err := ie.PingerWithContext(ctx, c, 1, time.Millisecond, make(chan struct{}), config); err != context.DeadlineExceeded {
+		t.Errorf(fmt.Sprintf("TestAdmissionSessions context err:%v", err))
+	}
+	cancel()
+
+	status := ie.Status()
+	if status.Rejected != 2 || status.Targets != 2 || status.Waiting != 0 {
+		t.Errorf(fmt.Sprintf("TestAdmissionSessions status:%+v", status))
+	}
+
+	// the waiting Pinger is admitted, when a running Pinger ends
+	admitted := make(chan PingerResults)
+	go func() {
+		results, err := ie.PingerWithContext(context.Background(), c, 3, time.Millisecond, make(chan struct{}), config)
+		if err != nil {
+			t.Errorf(fmt.Sprintf("TestAdmissionSessions waiting err:%v", err))
+		}
+		admitted <- results
+	}()
+	if !waitStatus(ie, func(s EngineStatus) bool { return s.Waiting == 1 }) {
+		t.Errorf("TestAdmissionSessions Pinger not waiting")
+	}
+	close(doneA)
+	if results := <-admitted; results.Successes != 3 {
+		t.Errorf(fmt.Sprintf("TestAdmissionSessions waiting Successes:%d", results.Successes))
+	}
+
+	close(doneB)
+	running.Wait()
+	if status := ie.Status(); status.Sessions != 0 || status.Targets != 0 || status.Outstanding != 0 {
+		t.Errorf(fmt.Sprintf("TestAdmissionSessions after status:%+v", status))
+	}
+
+	ie.DoneCh <- struct{}{}
+	wg.Wait()
+}
+
+// TestAdmissionOutstanding checks the outstanding probes limit is never exceeded
+func TestAdmissionOutstanding(t *testing.T) {
+
+	timeout := 20 * time.Millisecond
+	ie, wg := newAdmissionEngine(timeout)
+	max := 2
+	ie.SetAdmissionLimits(AdmissionLimitsT{MaxOutstanding: max})
+
+	pingers := 4
+	count := 3
+	start := time.Now()
+	pWG := new(sync.WaitGroup)
+	resultsCh := make(chan PingerResults, pingers)
+	for i := 0; i < pingers; i++ {
+		pWG.Add(1)
+		go func(i int) {
+			defer pWG.Done()
+			// all the probes are dropped, so each is outstanding for the timeout
+			results := ie.PingerWithConfig(benchIP(i), Sequence(count), time.Microsecond, make(chan struct{}), PingerConfigT{DropProb: 1})
+			resultsCh <- results
+		}(i)
+	}
+
+	stop := make(chan struct{})
+	exceeded := make(chan int, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(exceeded)
+				return
+			default:
+			}
+			if s := ie.Status(); s.Outstanding > max {
+				exceeded <- s.Outstanding
+				return
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	pWG.Wait()
+	elapsed := time.Since(start)
+	close(stop)
+	if n, ok := <-exceeded; ok {
+		t.Errorf(fmt.Sprintf("TestAdmissionOutstanding Outstanding:%d > max:%d", n, max))
+	}
+	close(resultsCh)
+	for results := range resultsCh {
+		if results.Failures != count {
+			t.Errorf(fmt.Sprintf("TestAdmissionOutstanding [%s] Failures:%d", results.IP, results.Failures))
+		}
+	}
+	if minimum := time.Duration(pingers*count/max) * timeout; elapsed < minimum {
+		t.Errorf(fmt.Sprintf("TestAdmissionOutstanding elapsed:%s < minimum:%s", elapsed, minimum))
+	}
+	if status := ie.Status(); status.Outstanding != 0 {
+		t.Errorf(fmt.Sprintf("TestAdmissionOutstanding after Outstanding:%d", status.Outstanding))
+	}
+
+	ie.DoneCh <- struct{}{}
+	wg.Wait()
+}
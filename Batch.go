@@ -0,0 +1,366 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Batch holds the batched socket I/O, using recvmmsg and sendmmsg
+// https://man7.org/linux/man-pages/man2/recvmmsg.2.html
+// https://man7.org/linux/man-pages/man2/sendmmsg.2.html
+//
+// The ipv4 and ipv6 PacketConn ReadBatch/WriteBatch are used, which on Linux
+// are recvmmsg/sendmmsg, and on other platforms fall back to a single message per call
+// https://pkg.go.dev/golang.org/x/net/ipv4#PacketConn.ReadBatch
+//
+// Batching is off by default, and is enabled with SetBatchSize() before Start()
+// - The ReceiverBatch replaces the Receiver, reading up to BatchSize packets per syscall
+// - The Pingers queue the echo requests to a Writer per socket, which writes all
+//   the queued requests, up to BatchSize, per syscall
+//
+// The Writer never waits to fill a batch.  It blocks for the first request, then takes
+// whatever else is already queued, so batching only happens when there is load, and
+// doesn't add latency when there isn't.
+//
+// The Pinger records the send time before queuing, so the Writer re-stamps the send times
+// immediately before SendBatch, and the time waiting in the Writer queue isn't in the RTTs.
+// StopWriters closes the done channel, and each Writer then writes everything still queued
+// before returning.  A Pinger still sending after StopWriters falls back to the Transport Send,
+// and a Pinger which queued just as the done channel closed sends anything left in the queue,
+// in case the Writer had already drained the queue and returned.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"inet.af/netaddr"
+)
+
+const (
+	BatchSizeCst = 64
+
+	// WriterQueueMultiplierCst * BatchSize is the Writer queue size
+	WriterQueueMultiplierCst = 4
+)
+
+// WritersT holds the batch Writers state
+type WritersT struct {
+	WG         sync.WaitGroup
+	DoneCh     chan struct{}
+	BatchSize  int
+	Chs        map[Protocol][]chan writeRequest
+	DebugLevel int
+}
+
+// writeRequest is a single echo request queued for the Writer
+// The packet is copied into the request, so the Pinger can reuse its buffer
+// IP and seq identify the outstanding ping, to re-stamp the send time
+type writeRequest struct {
+	wb   [EchoLenCst]byte
+	n    int
+	addr net.Addr
+	IP   netaddr.IP
+	seq  Sequence
+}
+
+// batchConn is implemented by both ipv4.PacketConn and ipv6.PacketConn,
+// because ipv4.Message and ipv6.Message are both socket.Message
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// SetBatchSize enables batched receive and send, with up to size messages per syscall
+// size <= 1 disables batching.  SetBatchSize must be called before Start()
+func (ie *ICMPEngine) SetBatchSize(size int) {
+	ie.Lock()
+	defer ie.Unlock()
+	if ie.Receivers.Running || ie.Sockets.Open {
+		log.Fatal("SetBatchSize must be called before Start()")
+	}
+	ie.Receivers.BatchSize = size
+	ie.Writers.BatchSize = size
+}
+
+// StartWriters starts a Writer per socket, if batching is enabled
+// The Transports which don't support batching don't get a Writer, so have a nil channel
+func (ie *ICMPEngine) StartWriters() {
+
+	ie.Lock()
+	defer ie.Unlock()
+
+	if ie.Writers.BatchSize <= 1 {
+		return
+	}
+
+	ie.Writers.DoneCh = make(chan struct{}, 2)
+	var writers int
+	for _, p := range ie.Protocols {
+		for _, transport := range ie.Sockets.Transports[p] {
+			bt, ok := batchTransport(transport)
+			if !ok {
+				ie.Writers.Chs[p] = append(ie.Writers.Chs[p], nil)
+				continue
+			}
+			ch := make(chan writeRequest, ie.Writers.BatchSize*WriterQueueMultiplierCst)
+			ie.Writers.Chs[p] = append(ie.Writers.Chs[p], ch)
+			ie.Writers.WG.Add(1)
+			go ie.Writer(p, bt, ie.Writers.BatchSize, ch, ie.Writers.DoneCh)
+			writers++
+		}
+	}
+
+	if ie.Writers.DebugLevel > 10 {
+		ie.Log.Info(fmt.Sprintf("StartWriters started \t writers:%d \t BatchSize:%d", writers, ie.Writers.BatchSize))
+	}
+}
+
+// StopWriters stops the Writers, after writing any queued requests
+// StopWriters must only be called after the Pingers have stopped
+func (ie *ICMPEngine) StopWriters() {
+
+	ie.Lock()
+	done := ie.Writers.DoneCh
+	ie.Writers.DoneCh = nil
+	ie.Unlock()
+
+	if done == nil {
+		return
+	}
+	close(done)
+	ie.Writers.WG.Wait()
+
+	ie.Lock()
+	for p := range ie.Writers.Chs {
+		delete(ie.Writers.Chs, p)
+	}
+	ie.Unlock()
+
+	if ie.Writers.DebugLevel > 10 {
+		ie.Log.Info("StopWriters complete")
+	}
+}
+
+// send sends the echo request, either queuing to the Writer, or with the Transport Send
+// The writer channel is looked up by the Pinger at start, so nil means not batching, and
+// writerDone is closed by StopWriters, after which the requests are sent with the Transport
+func (ie *ICMPEngine) send(IP netaddr.IP, seq Sequence, wb []byte, addr net.Addr, transport Transport, writer chan writeRequest, writerDone <-chan struct{}) {
+	if ie.Capture != nil {
+		ie.capture(ie.Clock.Now(), addr, true, wb)
+	}
+	if writer != nil {
+		req := writeRequest{addr: addr, IP: IP, seq: seq}
+		req.n = copy(req.wb[:], wb)
+		select {
+		case <-writerDone:
+		default:
+			select {
+			case writer <- req:
+				// select is random when both are ready, so re-check the done channel, because
+				// the Writer may have already drained the queue and returned
+				select {
+				case <-writerDone:
+					ie.drainWriter(writer, transport)
+				default:
+				}
+				return
+			case <-writerDone:
+			}
+		}
+	}
+	ie.transportSend(wb, addr, transport)
+}
+
+// transportSend sends the echo request with the Transport Send, counting any error
+func (ie *ICMPEngine) transportSend(wb []byte, addr net.Addr, transport Transport) {
+	if err := transport.Send(wb, addr); err != nil {
+		if ie.Pingers.DebugLevel > 100 {
+			ie.Log.Error(fmt.Sprintf("Pinger [%s] \t Send error:%s", addr, err))
+		}
+		ie.sendError(err)
+	}
+}
+
+// drainWriter sends anything left in the stopped Writer queue with the Transport Send
+// The Writer queue is per Transport, so the requests all go to the same Transport
+func (ie *ICMPEngine) drainWriter(writer chan writeRequest, transport Transport) {
+	for {
+		select {
+		case req := <-writer:
+			ie.transportSend(req.wb[:req.n], req.addr, transport)
+		default:
+			return
+		}
+	}
+}
+
+// restampSends sets the send time of the queued requests which are still outstanding,
+// immediately before the SendBatch, so the time in the Writer queue isn't in the RTTs
+// The expiry isn't moved, so the timeout still includes the time in the queue
+func (ie *ICMPEngine) restampSends(reqs []writeRequest, send time.Time) {
+	for i := range reqs {
+		shard := ie.shard(reqs[i].IP)
+		shard.Lock() // <------------------------- LOCK!!
+		if e, exists := shard.Pings[reqs[i].IP][reqs[i].seq]; exists {
+			e.Ping.Send = send
+		}
+		shard.Unlock() // <----------------------- UNLOCK!!
+	}
+}
+
+// Writer writes the queued echo requests, using SendBatch ( sendmmsg )
+func (ie *ICMPEngine) Writer(proto Protocol, conn BatchTransport, batchSize int, ch <-chan writeRequest, done <-chan struct{}) {
+
+	defer ie.Writers.WG.Done()
+
+	if ie.Writers.DebugLevel > 10 {
+		ie.Log.Info(fmt.Sprintf("Writer \t proto:%d \t start \t batchSize:%d", proto, batchSize))
+	}
+
+	msgs := make([]ipv4.Message, batchSize)
+	reqs := make([]writeRequest, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = make([][]byte, 1)
+	}
+
+	// after done, keep writing until the queue is empty, so the queued requests aren't lost
+	for keepLooping, draining := true, false; keepLooping; {
+
+		var n int
+		if !draining {
+			select {
+			case reqs[0] = <-ch:
+				msgs[0].Buffers[0] = reqs[0].wb[:reqs[0].n]
+				msgs[0].Addr = reqs[0].addr
+				n = 1
+			case <-done:
+				draining = true
+			}
+		}
+
+		// take whatever else is already queued, without blocking
+		for gathering := true; gathering && n < batchSize; {
+			select {
+			case reqs[n] = <-ch:
+				msgs[n].Buffers[0] = reqs[n].wb[:reqs[n].n]
+				msgs[n].Addr = reqs[n].addr
+				n++
+			default:
+				gathering = false
+			}
+		}
+
+		if n > 0 {
+			ie.restampSends(reqs[:n], ie.Clock.Now())
+			ie.writeBatch(proto, conn, msgs[:n])
+		}
+		if draining && n == 0 {
+			keepLooping = false
+		}
+	}
+
+	if ie.Writers.DebugLevel > 10 {
+		ie.Log.Info(fmt.Sprintf("Writer \t proto:%d \t done", proto))
+	}
+}
+
+// writeBatch writes all the messages, retrying for partial writes
+// The error handling matches WriteTo, and the failed message is left to expire
+func (ie *ICMPEngine) writeBatch(proto Protocol, conn BatchTransport, msgs []ipv4.Message) {
+
+	for len(msgs) > 0 {
+		n, err := conn.SendBatch(msgs) // ------------------------<< SendBatch ( sendmmsg )
+		if err != nil {
+			ie.sendError(err)
+			if ie.Writers.DebugLevel > 100 {
+				ie.Log.Error(fmt.Sprintf("Writer \t proto:%d \t WriteBatch error:%s", proto, err))
+			}
+			// skip the failed message, which would otherwise be retried forever
+			n++
+		}
+		for i := 0; i < n && i < len(msgs); i++ {
+			if err == nil && msgs[i].N != len(msgs[i].Buffers[0]) {
+				log.Fatal("Writer WriteBatch error. Bytes sent does not match packet length.")
+			}
+			msgs[i].Buffers[0] = nil
+			msgs[i].Addr = nil
+		}
+		if n > len(msgs) {
+			n = len(msgs)
+		}
+		if ie.Writers.DebugLevel > 100 {
+			ie.Log.Info(fmt.Sprintf("Writer \t proto:%d \t WriteBatch messages:%d/%d", proto, n, len(msgs)))
+		}
+		msgs = msgs[n:]
+	}
+}
+
+// ReceiverBatch is the same as the Receiver, except uses ReceiveBatch ( recvmmsg )
+// to read up to BatchSize packets per syscall
+func (ie *ICMPEngine) ReceiverBatch(proto Protocol, sock int, index int, conn BatchTransport, allDone <-chan struct{}, done <-chan struct{}) {
+
+	ie.RLock()
+	batchSize := ie.Receivers.BatchSize
+	ie.RUnlock()
+
+	if ie.Receivers.DebugLevel > 100 {
+		ie.Log.Info(fmt.Sprintf("ReceiverBatch\t proto:%d \t index:%d, start \t batchSize:%d \t c:%s", proto, index, batchSize, conn.LocalAddr()))
+	}
+
+	defer ie.Receivers.WG.Done()
+
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, ReceiveBufferMax)}
+	}
+
+	for i, keepLooping := 0, true; keepLooping; i++ {
+
+		n, err := conn.ReceiveBatch(msgs) // <------------------------- ReceiveBatch ( recvmmsg, blocking until packets, or the Transport is closed )
+		receiveTime := ie.Clock.Now()
+		if err != nil {
+			if receiverClosed(err, allDone, done) {
+				break
+			}
+			log.Fatal(fmt.Sprintf("ReceiverBatch\t proto:%d \t index:%d \t err:%v", proto, index, err))
+		}
+
+		if ie.Receivers.DebugLevel > 1000 {
+			ie.Log.Info(fmt.Sprintf("ReceiverBatch\t proto:%d \t index:%d, i:%d \t ReadBatch n:%d", proto, index, i, n))
+		}
+
+		for m := 0; m < n; m++ {
+			if msgs[m].N > 0 {
+				ie.receivePacket(proto, index, msgs[m].Buffers[0][:msgs[m].N], msgs[m].Addr, receiveTime)
+			}
+		}
+
+		select {
+		case <-allDone:
+			keepLooping = false
+		case <-done:
+			keepLooping = false
+		default:
+			// non-block
+		}
+	}
+
+	if ie.Receivers.DebugLevel > 10 {
+		ie.Log.Info(fmt.Sprintf("ReceiverBatch \t proto:%d \t index:%d, done", proto, index))
+	}
+}
+
+// sendError counts the send error, and backs off the send queue for ENOBUFS
+// The probe is left to expire, so is counted as lost
+// ENOBUFS used to be fatal, but is expected when bursting, without SetRateLimit()
+func (ie *ICMPEngine) sendError(err error) {
+	atomic.AddUint64(&ie.Counters.SendErrors, 1)
+	if errors.Is(err, syscall.ENOBUFS) {
+		atomic.AddUint64(&ie.Counters.SendENOBUFS, 1)
+		ie.backoffENOBUFS()
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Capture holds the packet capture, which writes every sent and received ICMP packet to a
+// pcap or pcapng file, or any io.Writer, so the captures can be opened in Wireshark or tcpdump,
+// rather than running tcpdump alongside the process, and correlating the packets by hand
+//
+// The capture is optional, and is set with SetCapture before Start().  The hooks are:
+// - The Pinger send(), for the echo requests, before the Transport Send or the batch Writer
+// - The Receiver receivePacket(), for every packet read from the Transport, before the
+//   fault injection ( see Faults.go ) and the parsing, so the rejected packets are included
+//
+// The timestamps are the engine Clock times used for the RTTs, so the capture shows exactly
+// what the engine saw.  The Transports don't have the kernel timestamps, so these are user
+// space timestamps.
+//
+// The datagram sockets don't have the IP headers, and the raw socket strips them, so the IP
+// headers are synthesized, using Local4 and Local6 as the local address.  The ICMPv6 checksums
+// are from the kernel with the real local address, so Wireshark may flag them as incorrect,
+// unless Local6 is set to the real address.
+//
+// The link type is LINKTYPE_RAW, which allows both IPv4 and IPv6 in the same capture.
+// pcap uses the nanosecond timestamp magic, and pcapng has the nanosecond if_tsresol, and the
+// direction in the epb_flags.
+//
+// SetFilter limits the capture to the target prefixes.  The writes are serialized with the
+// Capture lock, and the write errors are counted, and never stop the engine.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// CaptureFormat is the capture file format
+type CaptureFormat int
+
+const (
+	// CapturePcap is the classic libpcap format, with nanosecond timestamps
+	CapturePcap CaptureFormat = iota
+	// CapturePcapng is the pcapng format
+	CapturePcapng
+)
+
+const (
+	// CaptureSnapLenCst is the snapshot length in the capture headers
+	CaptureSnapLenCst = 65535
+
+	// LinkTypeRawCst is LINKTYPE_RAW, where the packets start with the IPv4 or IPv6 header
+	LinkTypeRawCst = 101
+
+	// PcapMagicNanoCst is the pcap magic for nanosecond timestamps
+	PcapMagicNanoCst = 0xa1b23c4d
+
+	pcapHeaderLenCst       = 24
+	pcapRecordHeaderLenCst = 16
+
+	pcapngSHBTypeCst     = 0x0A0D0D0A
+	pcapngIDBTypeCst     = 0x00000001
+	pcapngEPBTypeCst     = 0x00000006
+	pcapngByteOrderCst   = 0x1A2B3C4D
+	pcapngTsresolCst     = 9
+	pcapngEPBFlagsCst    = 2
+	pcapngInboundCst     = 1
+	pcapngOutboundCst    = 2
+	pcapngTsresolNanoCst = 9
+)
+
+var (
+	errCaptureFormat = errors.New("icmpengine: unknown capture format")
+)
+
+// Capture writes the ICMP packets to the io.Writer in the CaptureFormat
+type Capture struct {
+	sync.Mutex
+	Format   CaptureFormat
+	Local4   netaddr.IP
+	Local6   netaddr.IP
+	Packets  uint64
+	Filtered uint64
+	Errors   uint64
+	w        io.Writer
+	bw       *bufio.Writer
+	closer   io.Closer
+	filter   []netaddr.IPPrefix
+	err      error
+	buf      []byte
+}
+
+// NewCapture creates the Capture, and writes the file header to w
+// The writes are not buffered, so w should usually be a bufio.Writer, see NewCaptureFile
+func NewCapture(w io.Writer, format CaptureFormat) (c *Capture, err error) {
+	c = &Capture{
+		Format: format,
+		Local4: netaddr.IPv4(0, 0, 0, 0),
+		Local6: netaddr.IPv6Unspecified(),
+		w:      w,
+	}
+	switch format {
+	case CapturePcap:
+		c.buf = pcapHeader(c.buf[:0])
+	case CapturePcapng:
+		c.buf = pcapngHeader(c.buf[:0])
+	default:
+		return nil, errCaptureFormat
+	}
+	if _, err = w.Write(c.buf); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewCaptureFile creates the capture file, which is buffered, so must be closed with Close()
+func NewCaptureFile(path string, format CaptureFormat) (c *Capture, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(f)
+	c, err = NewCapture(bw, format)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.bw = bw
+	c.closer = f
+	return c, nil
+}
+
+// SetCapture sets the Capture for the sent and received packets
+// SetCapture must be called before Start(), and nil disables the capture
+func (ie *ICMPEngine) SetCapture(c *Capture) {
+	ie.Lock()
+	defer ie.Unlock()
+	if ie.Sockets.Open {
+		log.Fatal("SetCapture must be called before Start()")
+	}
+	ie.Capture = c
+}
+
+// SetFilter limits the capture to the packets to and from the prefixes
+// No prefixes captures all the packets
+func (c *Capture) SetFilter(prefixes ...netaddr.IPPrefix) {
+	c.Lock()
+	defer c.Unlock()
+	c.filter = append([]netaddr.IPPrefix(nil), prefixes...)
+}
+
+// SetTargets limits the capture to the packets to and from the target IPs
+func (c *Capture) SetTargets(IPs ...netaddr.IP) {
+	prefixes := make([]netaddr.IPPrefix, 0, len(IPs))
+	for _, IP := range IPs {
+		prefixes = append(prefixes, netaddr.IPPrefixFrom(IP, IP.BitLen()))
+	}
+	c.SetFilter(prefixes...)
+}
+
+// Err returns the first write error
+func (c *Capture) Err() (err error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
+
+// Flush flushes the buffered writer, if the Capture was created with NewCaptureFile
+func (c *Capture) Flush() (err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.bw == nil {
+		return nil
+	}
+	return c.bw.Flush()
+}
+
+// Close flushes and closes the file, if the Capture was created with NewCaptureFile
+// Close must be called after the engine is stopped
+func (c *Capture) Close() (err error) {
+	err = c.Flush()
+	c.Lock()
+	defer c.Unlock()
+	if c.closer != nil {
+		if cerr := c.closer.Close(); err == nil {
+			err = cerr
+		}
+		c.closer = nil
+	}
+	return err
+}
+
+// matches returns if the target is in the filter, with the Capture locked
+func (c *Capture) matches(IP netaddr.IP) bool {
+	if len(c.filter) == 0 {
+		return true
+	}
+	for _, p := range c.filter {
+		if p.Contains(IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the ICMP message to or from the target, with the synthesized IP header
+// sent is the direction, where sent is from the local address to the target
+func (c *Capture) Write(ts time.Time, proto Protocol, target netaddr.IP, sent bool, icmp []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.matches(target) {
+		c.Filtered++
+		return
+	}
+
+	src, dst := target, c.Local4
+	if proto == Protocol(6) {
+		dst = c.Local6
+	}
+	if sent {
+		src, dst = dst, src
+	}
+	var packet []byte
+	if proto == Protocol(6) {
+		packet = putIPv6Header(nil, src, dst, ProtocolICMPv6Cst, len(icmp), ipv4DefaultTTLCst)
+	} else {
+		packet = putIPv4Header(nil, src, dst, ProtocolICMPCst, len(icmp), ipv4DefaultTTLCst)
+	}
+	packet = append(packet, icmp...)
+
+	switch c.Format {
+	case CapturePcapng:
+		c.buf = pcapngRecord(c.buf[:0], ts, sent, packet)
+	default:
+		c.buf = pcapRecord(c.buf[:0], ts, packet)
+	}
+	if _, err := c.w.Write(c.buf); err != nil {
+		c.Errors++
+		if c.err == nil {
+			c.err = err
+		}
+		return
+	}
+	c.Packets++
+}
+
+// capture writes the packet to or from the peer to the Capture
+func (ie *ICMPEngine) capture(ts time.Time, peer net.Addr, sent bool, b []byte) {
+	IP, ok := peerIP(peer)
+	if !ok {
+		return
+	}
+	proto := Protocol(4)
+	if IP.Is6() {
+		proto = Protocol(6)
+	}
+	ie.Capture.Write(ts, proto, IP, sent, b)
+}
+
+// pcapHeader appends the pcap file header
+func pcapHeader(b []byte) []byte {
+	h := make([]byte, pcapHeaderLenCst)
+	binary.LittleEndian.PutUint32(h[0:4], PcapMagicNanoCst)
+	binary.LittleEndian.PutUint16(h[4:6], 2)
+	binary.LittleEndian.PutUint16(h[6:8], 4)
+	binary.LittleEndian.PutUint32(h[16:20], CaptureSnapLenCst)
+	binary.LittleEndian.PutUint32(h[20:24], LinkTypeRawCst)
+	return append(b, h...)
+}
+
+// pcapRecord appends the pcap record
+func pcapRecord(b []byte, ts time.Time, packet []byte) []byte {
+	h := make([]byte, pcapRecordHeaderLenCst)
+	binary.LittleEndian.PutUint32(h[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(h[4:8], uint32(ts.Nanosecond()))
+	binary.LittleEndian.PutUint32(h[8:12], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(h[12:16], uint32(len(packet)))
+	b = append(b, h...)
+	return append(b, packet...)
+}
+
+// pcapngHeader appends the pcapng section header block, and the interface description block
+func pcapngHeader(b []byte) []byte {
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:4], pcapngSHBTypeCst)
+	binary.LittleEndian.PutUint32(shb[4:8], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:12], pcapngByteOrderCst)
+	binary.LittleEndian.PutUint16(shb[12:14], 1)
+	binary.LittleEndian.PutUint64(shb[16:24], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:28], uint32(len(shb)))
+
+	// the if_tsresol option is padded to 4 bytes, and then the opt_endofopt
+	idb := make([]byte, 32)
+	binary.LittleEndian.PutUint32(idb[0:4], pcapngIDBTypeCst)
+	binary.LittleEndian.PutUint32(idb[4:8], uint32(len(idb)))
+	binary.LittleEndian.PutUint16(idb[8:10], LinkTypeRawCst)
+	binary.LittleEndian.PutUint32(idb[12:16], CaptureSnapLenCst)
+	binary.LittleEndian.PutUint16(idb[16:18], pcapngTsresolCst)
+	binary.LittleEndian.PutUint16(idb[18:20], 1)
+	idb[20] = pcapngTsresolNanoCst
+	binary.LittleEndian.PutUint32(idb[28:32], uint32(len(idb)))
+
+	b = append(b, shb...)
+	return append(b, idb...)
+}
+
+// pcapngRecord appends the pcapng enhanced packet block, with the direction in the epb_flags
+func pcapngRecord(b []byte, ts time.Time, sent bool, packet []byte) []byte {
+	padded := (len(packet) + 3) &^ 3
+	total := 28 + padded + 8 + 4 + 4
+	epb := make([]byte, total)
+	binary.LittleEndian.PutUint32(epb[0:4], pcapngEPBTypeCst)
+	binary.LittleEndian.PutUint32(epb[4:8], uint32(total))
+	ns := uint64(ts.UnixNano())
+	binary.LittleEndian.PutUint32(epb[12:16], uint32(ns>>32))
+	binary.LittleEndian.PutUint32(epb[16:20], uint32(ns))
+	binary.LittleEndian.PutUint32(epb[20:24], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(epb[24:28], uint32(len(packet)))
+	copy(epb[28:], packet)
+	o := 28 + padded
+	binary.LittleEndian.PutUint16(epb[o:o+2], pcapngEPBFlagsCst)
+	binary.LittleEndian.PutUint16(epb[o+2:o+4], 4)
+	direction := uint32(pcapngInboundCst)
+	if sent {
+		direction = pcapngOutboundCst
+	}
+	binary.LittleEndian.PutUint32(epb[o+4:o+8], direction)
+	binary.LittleEndian.PutUint32(epb[total-4:], uint32(total))
+	return append(b, epb...)
+}
@@ -0,0 +1,319 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// CaptureReader reads the ICMP packets from pcap and pcapng files, for the ReplayNetwork,
+// see Replay.go
+//
+// The files can be from the Capture ( see Capture.go ), or from tcpdump or Wireshark, so:
+// - pcap in either byte order, with microsecond or nanosecond timestamps
+// - pcapng in either byte order, with the if_tsresol of each interface, and the enhanced and
+//   the obsolete packet blocks.  The other blocks are skipped
+// - LINKTYPE_RAW, LINKTYPE_ETHERNET ( with 802.1Q VLAN tags ), and LINKTYPE_LINUX_SLL, which
+//   is tcpdump -i any
+//
+// Only the ICMP packets are returned, and the non-ICMP packets, IPv6 extension headers,
+// and IP fragments are skipped
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+const (
+	// LinkTypeEthernetCst is LINKTYPE_ETHERNET
+	LinkTypeEthernetCst = 1
+
+	// LinkTypeLinuxSLLCst is LINKTYPE_LINUX_SLL, the Linux "cooked" capture
+	LinkTypeLinuxSLLCst = 113
+
+	// PcapMagicMicroCst is the pcap magic for microsecond timestamps
+	PcapMagicMicroCst = 0xa1b2c3d4
+
+	pcapngPBTypeCst = 0x00000002
+
+	ethernetHeaderLenCst = 14
+	linuxSLLHeaderLenCst = 16
+	etherTypeIPv4Cst     = 0x0800
+	etherTypeIPv6Cst     = 0x86DD
+	etherTypeVLANCst     = 0x8100
+)
+
+var (
+	errCaptureMagic     = errors.New("icmpengine: not a pcap or pcapng capture")
+	errCaptureTruncated = errors.New("icmpengine: truncated capture")
+	errCaptureLinkType  = errors.New("icmpengine: unsupported capture link type")
+)
+
+// CapturedPacket is an ICMP packet read from a capture
+type CapturedPacket struct {
+	Time  time.Time
+	Proto Protocol
+	Src   netaddr.IP
+	Dst   netaddr.IP
+	ICMP  []byte
+}
+
+// ReadCaptureFile reads the ICMP packets from the pcap or pcapng file
+func ReadCaptureFile(path string) (packets []CapturedPacket, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCapture(f)
+}
+
+// ReadCapture reads the ICMP packets from the pcap or pcapng capture, in the capture order
+func ReadCapture(r io.Reader) (packets []CapturedPacket, err error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4 {
+		return nil, errCaptureMagic
+	}
+	if binary.LittleEndian.Uint32(b[0:4]) == pcapngSHBTypeCst {
+		return readPcapng(b)
+	}
+	return readPcap(b)
+}
+
+// readPcap reads the classic pcap
+func readPcap(b []byte) (packets []CapturedPacket, err error) {
+	if len(b) < pcapHeaderLenCst {
+		return nil, errCaptureTruncated
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	var nano bool
+	switch {
+	case binary.LittleEndian.Uint32(b[0:4]) == PcapMagicMicroCst:
+	case binary.LittleEndian.Uint32(b[0:4]) == PcapMagicNanoCst:
+		nano = true
+	case binary.BigEndian.Uint32(b[0:4]) == PcapMagicMicroCst:
+		order = binary.BigEndian
+	case binary.BigEndian.Uint32(b[0:4]) == PcapMagicNanoCst:
+		order = binary.BigEndian
+		nano = true
+	default:
+		return nil, errCaptureMagic
+	}
+	linkType := int(order.Uint32(b[20:24]))
+
+	for b = b[pcapHeaderLenCst:]; len(b) > 0; {
+		if len(b) < pcapRecordHeaderLenCst {
+			return packets, errCaptureTruncated
+		}
+		n := int(order.Uint32(b[8:12]))
+		if n > len(b)-pcapRecordHeaderLenCst {
+			return packets, errCaptureTruncated
+		}
+		frac := time.Duration(order.Uint32(b[4:8]))
+		if !nano {
+			frac *= time.Microsecond
+		}
+		ts := time.Unix(int64(order.Uint32(b[0:4])), int64(frac))
+		p, ok, err := parseCapturedFrame(linkType, b[pcapRecordHeaderLenCst:pcapRecordHeaderLenCst+n])
+		if err != nil {
+			return packets, err
+		}
+		if ok {
+			p.Time = ts
+			packets = append(packets, p)
+		}
+		b = b[pcapRecordHeaderLenCst+n:]
+	}
+	return packets, nil
+}
+
+// pcapngInterface is the link type and timestamp resolution of a pcapng interface
+type pcapngInterface struct {
+	linkType int
+	unit     time.Duration
+	perUnit  uint64
+}
+
+// timestamp converts the pcapng timestamp to the time
+// The resolution is either a power of 10, or if the high bit is set, a power of 2
+func (i pcapngInterface) timestamp(ts uint64) time.Time {
+	if i.perUnit == 0 {
+		return time.Unix(0, int64(ts)*int64(i.unit))
+	}
+	seconds := ts / i.perUnit
+	frac := ts % i.perUnit
+	return time.Unix(int64(seconds), int64(float64(frac)/float64(i.perUnit)*float64(time.Second)))
+}
+
+// newPcapngInterface parses the if_tsresol option, where the default is microseconds
+func newPcapngInterface(linkType int, options []byte, order binary.ByteOrder) (i pcapngInterface) {
+	i = pcapngInterface{linkType: linkType, unit: time.Microsecond}
+	for len(options) >= 4 {
+		code, length := order.Uint16(options[0:2]), int(order.Uint16(options[2:4]))
+		if code == 0 || 4+length > len(options) {
+			break
+		}
+		if code == pcapngTsresolCst && length >= 1 {
+			resol := options[4]
+			switch {
+			case resol&0x80 != 0:
+				i.perUnit = uint64(1) << (resol & 0x7f)
+			case resol <= 9:
+				i.unit = time.Second
+				for r := uint8(0); r < resol; r++ {
+					i.unit /= 10
+				}
+			default:
+				i.perUnit = 1
+				for r := uint8(0); r < resol && i.perUnit < 1<<60; r++ {
+					i.perUnit *= 10
+				}
+			}
+		}
+		next := 4 + ((length + 3) &^ 3)
+		if next > len(options) {
+			break
+		}
+		options = options[next:]
+	}
+	return i
+}
+
+// readPcapng reads the pcapng, with the byte order from each section header
+func readPcapng(b []byte) (packets []CapturedPacket, err error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []pcapngInterface
+
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return packets, errCaptureTruncated
+		}
+		if binary.LittleEndian.Uint32(b[0:4]) == pcapngSHBTypeCst {
+			switch {
+			case binary.LittleEndian.Uint32(b[8:12]) == pcapngByteOrderCst:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(b[8:12]) == pcapngByteOrderCst:
+				order = binary.BigEndian
+			default:
+				return packets, errCaptureMagic
+			}
+			interfaces = interfaces[:0]
+		}
+		blockType, total := order.Uint32(b[0:4]), int(order.Uint32(b[4:8]))
+		if total < 12 || total%4 != 0 || total > len(b) {
+			return packets, errCaptureTruncated
+		}
+		body := b[8 : total-4]
+		b = b[total:]
+
+		switch blockType {
+		case pcapngIDBTypeCst:
+			if len(body) < 8 {
+				return packets, errCaptureTruncated
+			}
+			interfaces = append(interfaces, newPcapngInterface(int(order.Uint16(body[0:2])), body[8:], order))
+		case pcapngEPBTypeCst, pcapngPBTypeCst:
+			if len(body) < 20 {
+				return packets, errCaptureTruncated
+			}
+			var index int
+			if blockType == pcapngEPBTypeCst {
+				index = int(order.Uint32(body[0:4]))
+			} else {
+				index = int(order.Uint16(body[0:2]))
+			}
+			if index >= len(interfaces) {
+				return packets, fmt.Errorf("%w: packet for unknown interface:%d", errCaptureTruncated, index)
+			}
+			n := int(order.Uint32(body[12:16]))
+			if n > len(body)-20 {
+				return packets, errCaptureTruncated
+			}
+			p, ok, err := parseCapturedFrame(interfaces[index].linkType, body[20:20+n])
+			if err != nil {
+				return packets, err
+			}
+			if ok {
+				p.Time = interfaces[index].timestamp(uint64(order.Uint32(body[4:8]))<<32 | uint64(order.Uint32(body[8:12])))
+				packets = append(packets, p)
+			}
+		}
+	}
+	return packets, nil
+}
+
+// parseCapturedFrame strips the link layer, and parses the IP header
+// ok is false for anything other than an unfragmented ICMP packet
+func parseCapturedFrame(linkType int, frame []byte) (p CapturedPacket, ok bool, err error) {
+	var etherType uint16
+	switch linkType {
+	case LinkTypeRawCst:
+	case LinkTypeEthernetCst:
+		if len(frame) < ethernetHeaderLenCst {
+			return p, false, nil
+		}
+		etherType = binary.BigEndian.Uint16(frame[12:14])
+		frame = frame[ethernetHeaderLenCst:]
+		for etherType == etherTypeVLANCst && len(frame) >= 4 {
+			etherType = binary.BigEndian.Uint16(frame[2:4])
+			frame = frame[4:]
+		}
+	case LinkTypeLinuxSLLCst:
+		if len(frame) < linuxSLLHeaderLenCst {
+			return p, false, nil
+		}
+		etherType = binary.BigEndian.Uint16(frame[14:16])
+		frame = frame[linuxSLLHeaderLenCst:]
+	default:
+		return p, false, fmt.Errorf("%w:%d", errCaptureLinkType, linkType)
+	}
+	if etherType != 0 && etherType != etherTypeIPv4Cst && etherType != etherTypeIPv6Cst {
+		return p, false, nil
+	}
+	if len(frame) < 1 {
+		return p, false, nil
+	}
+
+	switch frame[0] >> 4 {
+	case 4:
+		var h IPv4Header
+		if ParseIPv4Header(frame, &h) != nil || h.Protocol != ProtocolICMPCst || ipv4Fragment(frame) {
+			return p, false, nil
+		}
+		end := h.TotalLen
+		if end > len(frame) || end < h.Len {
+			end = len(frame)
+		}
+		p = CapturedPacket{Proto: Protocol(4), Src: h.Src, Dst: h.Dst, ICMP: frame[h.Len:end]}
+	case 6:
+		if len(frame) < IPv6HeaderLenCst || frame[6] != ProtocolICMPv6Cst {
+			return p, false, nil
+		}
+		end := IPv6HeaderLenCst + int(binary.BigEndian.Uint16(frame[4:6]))
+		if end > len(frame) {
+			end = len(frame)
+		}
+		var src, dst [16]byte
+		copy(src[:], frame[8:24])
+		copy(dst[:], frame[24:40])
+		p = CapturedPacket{Proto: Protocol(6), Src: netaddr.IPv6Raw(src), Dst: netaddr.IPv6Raw(dst), ICMP: frame[IPv6HeaderLenCst:end]}
+	default:
+		return p, false, nil
+	}
+	if len(p.ICMP) < EchoLenCst {
+		return p, false, nil
+	}
+	p.ICMP = append([]byte(nil), p.ICMP...)
+	return p, true, nil
+}
+
+// ipv4Fragment returns if the IPv4 packet is a fragment, other than the first
+func ipv4Fragment(b []byte) bool {
+	return binary.BigEndian.Uint16(b[6:8])&0x1fff != 0
+}
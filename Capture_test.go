@@ -0,0 +1,149 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+// capturedPacket is a packet read back from the capture
+type capturedPacket struct {
+	ts        time.Time
+	packet    []byte
+	direction uint32
+}
+
+// readCapture parses the pcap or pcapng written by the Capture
+func readCapture(t *testing.T, b []byte, format CaptureFormat) (packets []capturedPacket) {
+	le := binary.LittleEndian
+	if format == CapturePcap {
+		if len(b) < pcapHeaderLenCst || le.Uint32(b[0:4]) != PcapMagicNanoCst || le.Uint32(b[20:24]) != LinkTypeRawCst {
+			t.Fatalf("readCapture invalid pcap header")
+		}
+		for b = b[pcapHeaderLenCst:]; len(b) >= pcapRecordHeaderLenCst; {
+			n := int(le.Uint32(b[8:12]))
+			ts := time.Unix(int64(le.Uint32(b[0:4])), int64(le.Uint32(b[4:8])))
+			packets = append(packets, capturedPacket{ts: ts, packet: b[pcapRecordHeaderLenCst : pcapRecordHeaderLenCst+n]})
+			b = b[pcapRecordHeaderLenCst+n:]
+		}
+		return packets
+	}
+	for len(b) >= 12 {
+		blockType, total := le.Uint32(b[0:4]), int(le.Uint32(b[4:8]))
+		if total < 12 || total > len(b) || le.Uint32(b[total-4:total]) != uint32(total) {
+			t.Fatalf(fmt.Sprintf("readCapture invalid pcapng block type:%x total:%d", blockType, total))
+		}
+		switch blockType {
+		case pcapngIDBTypeCst:
+			if le.Uint16(b[8:10]) != LinkTypeRawCst || b[20] != pcapngTsresolNanoCst {
+				t.Errorf("readCapture invalid pcapng interface")
+			}
+		case pcapngEPBTypeCst:
+			ns := int64(le.Uint32(b[12:16]))<<32 | int64(le.Uint32(b[16:20]))
+			n := int(le.Uint32(b[20:24]))
+			o := 28 + (n+3)&^3
+			packets = append(packets, capturedPacket{ts: time.Unix(0, ns), packet: b[28 : 28+n], direction: le.Uint32(b[o+4 : o+8])})
+		}
+		b = b[total:]
+	}
+	return packets
+}
+
+// TestCaptureFormats checks the records, and the synthesized IP headers, in both formats
+func TestCaptureFormats(t *testing.T) {
+
+	ts := time.Date(2021, 1, 1, 0, 0, 1, 123456789, time.UTC)
+	request := NewEchoTemplate(Protocol(4), 7).Put(make([]byte, EchoLenCst), 3)
+	target := netaddr.MustParseIP("192.0.2.1")
+	target6 := netaddr.MustParseIP("2001:db8::1")
+
+	for _, format := range []CaptureFormat{CapturePcap, CapturePcapng} {
+		var buf bytes.Buffer
+		c, err := NewCapture(&buf, format)
+		if err != nil {
+			t.Fatalf(fmt.Sprintf("TestCaptureFormats format:%d err:%s", format, err))
+		}
+		c.Local4 = netaddr.MustParseIP("198.51.100.1")
+		c.Write(ts, Protocol(4), target, true, request)
+		c.Write(ts.Add(time.Millisecond), Protocol(4), target, false, request)
+		c.Write(ts, Protocol(6), target6, false, request)
+
+		packets := readCapture(t, buf.Bytes(), format)
+		if len(packets) != 3 || c.Packets != 3 {
+			t.Fatalf(fmt.Sprintf("TestCaptureFormats format:%d packets:%d", format, len(packets)))
+		}
+		var h IPv4Header
+		if err := ParseIPv4Header(packets[0].packet, &h); err != nil || h.Src != c.Local4 || h.Dst != target || h.Protocol != ProtocolICMPCst {
+			t.Errorf(fmt.Sprintf("TestCaptureFormats format:%d sent header:%+v err:%v", format, h, err))
+		}
+		if err := ParseIPv4Header(packets[1].packet, &h); err != nil || h.Src != target || h.Dst != c.Local4 || !bytes.Equal(packets[1].packet[h.Len:], request) {
+			t.Errorf(fmt.Sprintf("TestCaptureFormats format:%d received header:%+v err:%v", format, h, err))
+		}
+		if p := packets[2].packet; len(p) != IPv6HeaderLenCst+EchoLenCst || p[0]>>4 != 6 || p[6] != ProtocolICMPv6Cst {
+			t.Errorf(fmt.Sprintf("TestCaptureFormats format:%d IPv6 header:%x", format, p))
+		}
+		if !packets[0].ts.Equal(ts) || packets[1].ts.Sub(packets[0].ts) != time.Millisecond {
+			t.Errorf(fmt.Sprintf("TestCaptureFormats format:%d timestamps:%s %s", format, packets[0].ts, packets[1].ts))
+		}
+		if format == CapturePcapng && (packets[0].direction != pcapngOutboundCst || packets[1].direction != pcapngInboundCst) {
+			t.Errorf(fmt.Sprintf("TestCaptureFormats directions:%d %d", packets[0].direction, packets[1].direction))
+		}
+	}
+
+	if _, err := NewCapture(&bytes.Buffer{}, CaptureFormat(9)); err == nil {
+		t.Errorf("TestCaptureFormats unknown format")
+	}
+}
+
+// TestCaptureEngine captures the probes to one of two targets through the full engine
+func TestCaptureEngine(t *testing.T) {
+
+	var buf bytes.Buffer
+	c, err := NewCapture(&buf, CapturePcapng)
+	if err != nil {
+		t.Fatalf(fmt.Sprintf("TestCaptureEngine err:%s", err))
+	}
+	captured := netaddr.MustParseIP("2001:db8::1")
+	c.SetTargets(captured)
+
+	sim := NewSimNetwork(1, SimProfile{Latency: FixedLatency(time.Millisecond)})
+	done := make(chan struct{}, 2)
+	ie := NewFullConfig(hclog.NewNullLogger(), done, 200*time.Millisecond, time.Second, false, 1, 1, false, GetDebugLevels(1), false)
+	ie.SetTransportFactory(sim.Factory)
+	ie.SetCapture(c)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	count := 4
+	for _, IP := range []netaddr.IP{captured, netaddr.MustParseIP("2001:db8::2")} {
+		if results := ie.Pinger(IP, Sequence(count), time.Millisecond, false, make(chan struct{})); results.Successes != count {
+			t.Errorf(fmt.Sprintf("TestCaptureEngine [%s] Successes:%d", IP, results.Successes))
+		}
+	}
+	done <- struct{}{}
+	wg.Wait()
+
+	packets := readCapture(t, buf.Bytes(), CapturePcapng)
+	if len(packets) != 2*count || c.Filtered != uint64(2*count) {
+		t.Fatalf(fmt.Sprintf("TestCaptureEngine packets:%d Filtered:%d", len(packets), c.Filtered))
+	}
+	for i, p := range packets {
+		src, _ := netaddr.FromStdIP(p.packet[8:24])
+		dst, _ := netaddr.FromStdIP(p.packet[24:40])
+		icmpType := p.packet[IPv6HeaderLenCst]
+		sent := p.direction == pcapngOutboundCst
+		if sent && (dst != captured || icmpType != echoRequestType(Protocol(6))) || !sent && (src != captured || icmpType != echoReplyType(Protocol(6))) {
+			t.Errorf(fmt.Sprintf("TestCaptureEngine i:%d sent:%t src:%s dst:%s type:%d", i, sent, src, dst, icmpType))
+		}
+	}
+}
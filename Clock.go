@@ -0,0 +1,255 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Clock is the source of time for the Pingers, Expirers, Receivers and the rate limiting
+//
+// Originally these called time.Now, time.After and time.Until directly, so the tests took
+// real wall clock time, e.g. a 10 packet Pinger with a 1s interval took 10s.  Now the
+// engine only uses the Clock, which is RealClock by default, and can be injected at
+// construction with NewFullConfigWithClock.
+//
+// FakeClock only moves when Advance() is called, firing the timers in deadline order, so
+// the tests can drive the timeouts and intervals instantly, and get exactly reproducible RTTs
+// and durations.  BlockUntil() waits for the engine goroutines to be waiting on the timers,
+// so the test knows when it's safe to Advance().
+//
+// The SimNetwork also has a Clock, for the latency timers, so the engine and the SimNetwork
+// can share the FakeClock.  Note the Receivers splay ( SplayReceivers ) also uses the Clock,
+// so with the FakeClock, Start() blocks until the clock is advanced, unless the splay is off.
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time, and creates the timers
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the time.Timer, as an interface
+// Chan is the timer channel, and is nil for the AfterFunc timers
+type Timer interface {
+	Chan() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// RealClock is the Clock using the time package
+type RealClock struct{}
+
+// realTimer is the time.Timer
+type realTimer struct {
+	*time.Timer
+}
+
+// Chan implements Timer
+func (t realTimer) Chan() <-chan time.Time {
+	return t.C
+}
+
+// Now implements Clock
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer implements Clock
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// AfterFunc implements Clock
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+// stopTimer stops the timer, and drains the channel if the timer had already fired,
+// so the timer can be safely Reset()
+func stopTimer(timer Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.Chan():
+		default:
+		}
+	}
+}
+
+// FakeClock is the Clock for the tests, which only moves with Advance() or Set()
+type FakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	cond   *sync.Cond
+}
+
+// fakeTimer is the FakeClock Timer, which is active while it's in the FakeClock timers
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+	f        func()
+}
+
+// NewFakeClock creates the FakeClock, starting at start
+func NewFakeClock(start time.Time) (c *FakeClock) {
+	c = &FakeClock{
+		now: start,
+	}
+	c.cond = sync.NewCond(&c.Mutex)
+	return c
+}
+
+// Now implements Clock
+func (c *FakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// NewTimer implements Clock
+// Like time.NewTimer, the channel has a buffer of one, so the timer never blocks the clock
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		clock: c,
+		c:     make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+// AfterFunc implements Clock
+// Unlike time.AfterFunc, f is called by Advance(), rather than in its own goroutine, so f must not block
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{
+		clock: c,
+		f:     f,
+	}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers in deadline order, with Now() at
+// each timer's deadline as it fires
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	target := c.now.Add(d)
+	c.Unlock()
+	c.Set(target)
+}
+
+// Set moves the clock forward to target, firing the timers, see Advance
+// The clock never goes backwards, so a target before Now() doesn't change the time
+func (c *FakeClock) Set(target time.Time) {
+	for {
+		c.Lock() // <------------------------------ LOCK!!
+		if len(c.timers) == 0 || c.timers[0].deadline.After(target) {
+			if target.After(c.now) {
+				c.now = target
+			}
+			c.Unlock() // <------------------------ UNLOCK!!
+			return
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.deadline.After(c.now) {
+			c.now = t.deadline
+		}
+		now := c.now
+		c.cond.Broadcast()
+		c.Unlock() // <---------------------------- UNLOCK!!
+
+		// fire after the unlock, so f can use the clock
+		t.fire(now)
+	}
+}
+
+// Next returns the deadline of the next timer, if there is one
+func (c *FakeClock) Next() (deadline time.Time, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.timers) == 0 {
+		return deadline, false
+	}
+	return c.timers[0].deadline, true
+}
+
+// Timers returns the number of active timers
+func (c *FakeClock) Timers() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil blocks until there are at least n active timers
+func (c *FakeClock) BlockUntil(n int) {
+	c.Lock()
+	defer c.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// fire sends on the channel without blocking, like time.Timer, or calls f
+func (t *fakeTimer) fire(now time.Time) {
+	if t.f != nil {
+		t.f()
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+// Chan implements Timer
+func (t *fakeTimer) Chan() <-chan time.Time {
+	return t.c
+}
+
+// Stop implements Timer, returning if the timer was active
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.Lock()
+	defer c.Unlock()
+	return c.remove(t)
+}
+
+// Reset implements Timer, returning if the timer was active
+// A timer with d <= 0 fires immediately
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.Lock() // <---------------------------------- LOCK!!
+	active := c.remove(t)
+	if d <= 0 {
+		now := c.now
+		c.Unlock() // <---------------------------- UNLOCK!!
+		t.fire(now)
+		return active
+	}
+	t.deadline = c.now.Add(d)
+	// insert after any timers with the same deadline, so timers fire in the order they were set
+	i := sort.Search(len(c.timers), func(i int) bool { return c.timers[i].deadline.After(t.deadline) })
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	c.cond.Broadcast()
+	c.Unlock() // <-------------------------------- UNLOCK!!
+	return active
+}
+
+// remove removes the timer, returning if it was active
+// remove assumes the FakeClock LOCK is already held
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, ct := range c.timers {
+		if ct == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+// TestFakeClock checks the timers fire in deadline order, and Stop and Reset
+func TestFakeClock(t *testing.T) {
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+
+	var fired []time.Duration
+	for _, d := range []time.Duration{3 * time.Second, time.Second, 2 * time.Second} {
+		d := d
+		c.AfterFunc(d, func() { fired = append(fired, c.Now().Sub(start)) })
+	}
+	stopped := c.AfterFunc(time.Second, func() { t.Errorf("TestFakeClock stopped timer fired") })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Errorf("TestFakeClock Stop() active")
+	}
+
+	timer := c.NewTimer(5 * time.Second)
+	if c.Timers() != 4 {
+		t.Errorf(fmt.Sprintf("TestFakeClock Timers():%d", c.Timers()))
+	}
+
+	c.Advance(4 * time.Second)
+	if len(fired) != 3 || fired[0] != time.Second || fired[1] != 2*time.Second || fired[2] != 3*time.Second {
+		t.Errorf(fmt.Sprintf("TestFakeClock fired:%v", fired))
+	}
+	if c.Now() != start.Add(4*time.Second) {
+		t.Errorf(fmt.Sprintf("TestFakeClock Now():%s", c.Now().Sub(start)))
+	}
+	select {
+	case <-timer.Chan():
+		t.Errorf("TestFakeClock timer fired early")
+	default:
+	}
+
+	// Reset moves the timer from 5s to 4s+2s
+	if !timer.Reset(2 * time.Second) {
+		t.Errorf("TestFakeClock Reset() not active")
+	}
+	c.Advance(time.Second + time.Second/2)
+	select {
+	case <-timer.Chan():
+		t.Errorf("TestFakeClock timer fired before the Reset deadline")
+	default:
+	}
+	c.Advance(time.Second)
+	if now := <-timer.Chan(); now != start.Add(6*time.Second) {
+		t.Errorf(fmt.Sprintf("TestFakeClock timer fired at:%s", now.Sub(start)))
+	}
+
+	// d <= 0 fires immediately
+	immediate := c.NewTimer(-time.Second)
+	select {
+	case <-immediate.Chan():
+	default:
+		t.Errorf("TestFakeClock negative duration timer didn't fire")
+	}
+	if c.Timers() != 0 {
+		t.Errorf(fmt.Sprintf("TestFakeClock Timers():%d != 0", c.Timers()))
+	}
+}
+
+// TestFakeClockExpirer runs the full engine on the FakeClock with total loss, so each probe
+// waits for the timeout, and the Pinger takes exactly packets*timeout of fake time
+func TestFakeClockExpirer(t *testing.T) {
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sim := NewSimNetwork(1, SimProfile{Loss: &BernoulliLoss{P: 1}})
+	sim.Clock = clock
+
+	timeout := 10 * time.Second
+	done := make(chan struct{}, 2)
+	ie := NewFullConfigWithClock(hclog.NewNullLogger(), done, timeout, timeout, false, 1, 1, false, GetDebugLevels(1), false, clock)
+	ie.SetTransportFactory(sim.Factory)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	packets := 5
+	resultsCh := make(chan PingerResults, 1)
+	go func() {
+		resultsCh <- ie.Pinger(netaddr.MustParseIP("192.0.2.1"), Sequence(packets), time.Second, false, make(chan struct{}))
+	}()
+
+	// the only timer is the Expirer's, for the single outstanding probe
+	for i := 0; i < packets; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(timeout)
+	}
+	results := <-resultsCh
+
+	if results.Failures != packets || results.PingerDuration != time.Duration(packets)*timeout {
+		t.Errorf(fmt.Sprintf("TestFakeClockExpirer Failures:%d PingerDuration:%s", results.Failures, results.PingerDuration))
+	}
+
+	done <- struct{}{}
+	wg.Wait()
+}
+
+// TestFakeClockLatency runs the full engine and the SimNetwork on the FakeClock, so the RTTs
+// are exactly the simulated latency, and the intervals take no real time
+func TestFakeClockLatency(t *testing.T) {
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	latency := 200 * time.Millisecond
+	sim := NewSimNetwork(1, SimProfile{Latency: FixedLatency(latency)})
+	sim.Clock = clock
+
+	timeout := time.Minute
+	done := make(chan struct{}, 2)
+	ie := NewFullConfigWithClock(hclog.NewNullLogger(), done, timeout, timeout, false, 1, 1, false, GetDebugLevels(1), false, clock)
+	ie.SetTransportFactory(sim.Factory)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	packets := 5
+	interval := time.Second
+	resultsCh := make(chan PingerResults, 1)
+	go func() {
+		resultsCh <- ie.Pinger(netaddr.MustParseIP("2001:db8::1"), Sequence(packets), interval, false, make(chan struct{}))
+	}()
+
+	// after each send, the timers are the SimNetwork latency and the Expirer
+	// after each reply, the Expirer timer is still set for the first probe, plus the Pinger interval,
+	// which the Pinger also waits after the last probe
+	for i := 0; i < packets; i++ {
+		clock.BlockUntil(2)
+		clock.Advance(latency)
+		clock.BlockUntil(2)
+		clock.Advance(interval - latency)
+	}
+	results := <-resultsCh
+
+	if results.Successes != packets || results.Min != latency || results.Max != latency {
+		t.Errorf(fmt.Sprintf("TestFakeClockLatency Successes:%d Min:%s Max:%s", results.Successes, results.Min, results.Max))
+	}
+	want := time.Duration(packets) * interval
+	if results.PingerDuration != want {
+		t.Errorf(fmt.Sprintf("TestFakeClockLatency PingerDuration:%s want:%s", results.PingerDuration, want))
+	}
+
+	done <- struct{}{}
+	wg.Wait()
+}
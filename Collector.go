@@ -0,0 +1,207 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Collector is a prometheus.Collector for the ICMPEngine
+// https://pkg.go.dev/github.com/prometheus/client_golang/prometheus#Collector
+//
+// e.g.
+// prometheus.MustRegister(icmpengine.NewCollector(ie, icmpengine.CollectorConfigT{}))
+//
+// The per target metrics are labeled with TargetLabels, and the values come from
+// TargetLabelValues, which defaults to the target IP.  This allows adding labels
+// like site or role for the targets, or returning nil to not export a target.
+// A target where TargetLabelValues returns the wrong number of values is skipped, and
+// counted in LabelErrors and target_label_errors_total, rather than panicking in the scrape.
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"inet.af/netaddr"
+)
+
+const (
+	CollectorNamespaceCst = "icmpengine"
+)
+
+// CollectorConfigT holds the Collector options, the zero value is the defaults
+type CollectorConfigT struct {
+	Namespace         string
+	ConstLabels       prometheus.Labels
+	TargetLabels      []string
+	TargetLabelValues func(IP netaddr.IP) []string
+}
+
+// Collector exports the ICMPEngine Counters and internals
+type Collector struct {
+	LabelErrors uint64 // atomic, first for 64 bit alignment
+	ie          *ICMPEngine
+	config      CollectorConfigT
+
+	sent       *prometheus.Desc
+	received   *prometheus.Desc
+	lost       *prometheus.Desc
+	duplicates *prometheus.Desc
+	rtt        *prometheus.Desc
+
+	outstanding      *prometheus.Desc
+	expires          *prometheus.Desc
+	pingers          *prometheus.Desc
+	receiverTimeouts *prometheus.Desc
+	receiverPackets  *prometheus.Desc
+	rejected         *prometheus.Desc
+	faults           *prometheus.Desc
+	dispatchDropped  *prometheus.Desc
+	sendQueueWaits   *prometheus.Desc
+	sendQueueDelay   *prometheus.Desc
+	sendErrors       *prometheus.Desc
+	admissionRej     *prometheus.Desc
+	labelErrors      *prometheus.Desc
+}
+
+// defaultTargetLabelValues is the default TargetLabelValues, which is just the IP
+func defaultTargetLabelValues(IP netaddr.IP) []string {
+	return []string{IP.String()}
+}
+
+// NewCollector creates the Collector
+// The per target metrics are for the most recently sent targets, up to Counters.TargetsMax
+// ( default TargetCountersMaxCst ), see Counters.go, so the output is bounded for the sweeps
+func NewCollector(ie *ICMPEngine, config CollectorConfigT) (c *Collector) {
+
+	if config.Namespace == "" {
+		config.Namespace = CollectorNamespaceCst
+	}
+	if config.TargetLabels == nil {
+		config.TargetLabels = []string{"target"}
+	}
+	if config.TargetLabelValues == nil {
+		config.TargetLabelValues = defaultTargetLabelValues
+	}
+
+	desc := func(name string, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(config.Namespace, "", name), help, labels, config.ConstLabels)
+	}
+
+	c = &Collector{
+		ie:     ie,
+		config: config,
+
+		sent:       desc("sent_total", "ICMP echo requests sent", config.TargetLabels),
+		received:   desc("received_total", "ICMP echo replies received", config.TargetLabels),
+		lost:       desc("lost_total", "ICMP echo requests expired without a reply", config.TargetLabels),
+		duplicates: desc("duplicates_total", "Duplicate ICMP echo replies received", config.TargetLabels),
+		rtt:        desc("rtt_seconds", "ICMP echo round trip time", config.TargetLabels),
+
+		outstanding: desc("outstanding_pings", "ICMP echo requests waiting for a reply or expiry", nil),
+		expires:     desc("expires_dll_length", "Length of the expiry queues ( ExpiresDLL or timing wheel )", nil),
+		pingers:     desc("pingers", "Running Pingers", nil),
+		// the Receivers no longer use read deadlines, but the metric is kept for the existing dashboards
+		receiverTimeouts: desc("receiver_timeouts_total", "Deprecated, always 0, because the Receivers no longer use socket read deadlines", nil),
+		receiverPackets:  desc("receiver_packets_total", "Packets read by the Receivers", nil),
+		rejected:         desc("rejected_packets_total", "Packets rejected by the Receivers", []string{"reason"}),
+		faults:           desc("faults_injected_total", "Faults injected into the received replies by the fault policies", []string{"fault"}),
+		dispatchDropped:  desc("dispatch_dropped_total", "Results not delivered to the Pingers", []string{"reason"}),
+		sendQueueWaits:   desc("send_queue_waits_total", "ICMP echo requests which waited in the rate limited send queue", nil),
+		sendQueueDelay:   desc("send_queue_delay_seconds_total", "Time waited in the rate limited send queue, which is excluded from the RTTs", nil),
+		sendErrors:       desc("send_errors_total", "ICMP echo requests which failed to send", []string{"reason"}),
+		admissionRej:     desc("admission_rejected_total", "Pingers and probes rejected with ErrEngineBusy by the admission limits", nil),
+		labelErrors:      desc("target_label_errors_total", "Targets not exported because TargetLabelValues returned the wrong number of values", nil),
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sent
+	ch <- c.received
+	ch <- c.lost
+	ch <- c.duplicates
+	ch <- c.rtt
+	ch <- c.outstanding
+	ch <- c.expires
+	ch <- c.pingers
+	ch <- c.receiverTimeouts
+	ch <- c.receiverPackets
+	ch <- c.rejected
+	ch <- c.faults
+	ch <- c.dispatchDropped
+	ch <- c.sendQueueWaits
+	ch <- c.sendQueueDelay
+	ch <- c.sendErrors
+	ch <- c.admissionRej
+	ch <- c.labelErrors
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+
+	counters := c.ie.Counters
+
+	for _, t := range counters.Snapshot() {
+		labels := c.config.TargetLabelValues(t.IP)
+		if labels == nil {
+			continue
+		}
+		if len(labels) != len(c.config.TargetLabels) {
+			atomic.AddUint64(&c.LabelErrors, 1)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.sent, prometheus.CounterValue, float64(t.Sent), labels...)
+		ch <- prometheus.MustNewConstMetric(c.received, prometheus.CounterValue, float64(t.Received), labels...)
+		ch <- prometheus.MustNewConstMetric(c.lost, prometheus.CounterValue, float64(t.Lost), labels...)
+		ch <- prometheus.MustNewConstMetric(c.duplicates, prometheus.CounterValue, float64(t.Duplicates), labels...)
+
+		buckets := make(map[float64]uint64, len(counters.Buckets))
+		var cumulative uint64
+		for i, upper := range counters.Buckets {
+			cumulative += t.RTTBuckets[i]
+			buckets[upper] = cumulative
+		}
+		ch <- prometheus.MustNewConstHistogram(c.rtt, t.Received, t.RTTSum.Seconds(), buckets, labels...)
+	}
+
+	outstanding, expires, pingers := c.ie.engineGauges()
+	ch <- prometheus.MustNewConstMetric(c.outstanding, prometheus.GaugeValue, float64(outstanding))
+	ch <- prometheus.MustNewConstMetric(c.expires, prometheus.GaugeValue, float64(expires))
+	ch <- prometheus.MustNewConstMetric(c.pingers, prometheus.GaugeValue, float64(pingers))
+	ch <- prometheus.MustNewConstMetric(c.receiverTimeouts, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.ReceiverTimeouts)))
+
+	ch <- prometheus.MustNewConstMetric(c.receiverPackets, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.ReceiverPackets)))
+	ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.RejectedParse)), "parse")
+	ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.RejectedUnknown)), "unknown")
+	ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.RejectedDuplicates)), "duplicate")
+	ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.RejectedType)), "type")
+	ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.ICMPErrors)), "icmp_error")
+	ch <- prometheus.MustNewConstMetric(c.faults, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.FaultDrops)), "drop")
+	ch <- prometheus.MustNewConstMetric(c.faults, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.FaultDelays)), "delay")
+	ch <- prometheus.MustNewConstMetric(c.faults, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.FaultCorrupts)), "corrupt")
+	ch <- prometheus.MustNewConstMetric(c.faults, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.FaultErrors)), "icmp_error")
+	ch <- prometheus.MustNewConstMetric(c.faults, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.FaultDuplicates)), "duplicate")
+	ch <- prometheus.MustNewConstMetric(c.dispatchDropped, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.DispatchDropped)), "overflow")
+	ch <- prometheus.MustNewConstMetric(c.dispatchDropped, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.DispatchLate)), "closed")
+	ch <- prometheus.MustNewConstMetric(c.sendQueueWaits, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.SendQueueWaits)))
+	ch <- prometheus.MustNewConstMetric(c.sendQueueDelay, prometheus.CounterValue, time.Duration(atomic.LoadUint64(&counters.SendQueueDelayNs)).Seconds())
+	enobufs := atomic.LoadUint64(&counters.SendENOBUFS)
+	ch <- prometheus.MustNewConstMetric(c.sendErrors, prometheus.CounterValue, float64(enobufs), "enobufs")
+	ch <- prometheus.MustNewConstMetric(c.sendErrors, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.SendErrors)-enobufs), "other")
+	ch <- prometheus.MustNewConstMetric(c.admissionRej, prometheus.CounterValue, float64(atomic.LoadUint64(&counters.AdmissionRejected)))
+	ch <- prometheus.MustNewConstMetric(c.labelErrors, prometheus.CounterValue, float64(atomic.LoadUint64(&c.LabelErrors)))
+}
+
+// engineGauges returns the current outstanding pings, the expiry queues length, and running Pingers
+// summed over all the shards
+func (ie *ICMPEngine) engineGauges() (outstanding int, expires int, pingers int) {
+	ie.forEachShard(func(shard *PingShard) {
+		shard.Lock()
+		for _, seqs := range shard.Pings {
+			outstanding += len(seqs)
+		}
+		expires += shard.Expiries.Len()
+		pingers += len(shard.Sessions)
+		shard.Unlock()
+	})
+	return outstanding, expires, pingers
+}
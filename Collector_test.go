@@ -0,0 +1,179 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edgioinc/icmpengine"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"inet.af/netaddr"
+)
+
+// TestCollector runs some fake success Pingers, and checks the Collector exports the counters
+func TestCollector(t *testing.T) {
+	logger := hclog.Default()
+
+	doneAll := make(chan struct{}, 2)
+	ie := icmpengine.NewFullConfig(logger, doneAll, 10*time.Millisecond, 500*time.Millisecond, false, 2, 2, false, icmpengine.GetDebugLevels(1), true)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(icmpengine.NewCollector(ie, icmpengine.CollectorConfigT{
+		TargetLabels: []string{"target", "site"},
+		TargetLabelValues: func(IP netaddr.IP) []string {
+			return []string{IP.String(), "test"}
+		},
+	}))
+
+	count := 20
+	pDone := make(chan struct{}, 2)
+	for _, IP := range []string{`127.0.0.1`, `::1`} {
+		results := ie.Pinger(netaddr.MustParseIP(IP), icmpengine.Sequence(count), time.Microsecond, false, pDone)
+		if results.Successes != count {
+			t.Errorf(fmt.Sprintf("TestCollector [%s] results.Successes:%d", IP, results.Successes))
+		}
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("TestCollector registry.Gather() err:%v", err)
+	}
+
+	found := make(map[string]int)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			found[family.GetName()]++
+			switch family.GetName() {
+			case "icmpengine_sent_total", "icmpengine_received_total":
+				if m.GetCounter().GetValue() != float64(count) {
+					t.Errorf(fmt.Sprintf("TestCollector %s %v != count:%d", family.GetName(), m.GetCounter().GetValue(), count))
+				}
+			case "icmpengine_rtt_seconds":
+				if m.GetHistogram().GetSampleCount() != uint64(count) {
+					t.Errorf(fmt.Sprintf("TestCollector %s sample count:%d != count:%d", family.GetName(), m.GetHistogram().GetSampleCount(), count))
+				}
+			case "icmpengine_outstanding_pings", "icmpengine_receiver_timeouts_total":
+				if m.GetGauge().GetValue() != 0 || m.GetCounter().GetValue() != 0 {
+					t.Errorf(fmt.Sprintf("TestCollector %s %s != 0", family.GetName(), m.String()))
+				}
+			}
+		}
+	}
+	for _, name := range []string{"icmpengine_sent_total", "icmpengine_received_total", "icmpengine_lost_total", "icmpengine_rtt_seconds"} {
+		if found[name] != 2 {
+			t.Errorf(fmt.Sprintf("TestCollector %s targets:%d != 2", name, found[name]))
+		}
+	}
+	if found["icmpengine_receiver_timeouts_total"] != 1 {
+		t.Errorf("TestCollector icmpengine_receiver_timeouts_total missing")
+	}
+	if found["icmpengine_rejected_packets_total"] != 5 {
+		t.Errorf(fmt.Sprintf("TestCollector icmpengine_rejected_packets_total reasons:%d", found["icmpengine_rejected_packets_total"]))
+	}
+
+	doneAll <- struct{}{}
+	wg.Wait()
+}
+
+// TestCollectorLabels checks a TargetLabelValues without TargetLabels is kept, and a
+// TargetLabelValues returning the wrong number of values skips the target, rather than
+// panicking in the scrape
+func TestCollectorLabels(t *testing.T) {
+
+	doneAll := make(chan struct{}, 2)
+	ie := icmpengine.NewFullConfig(hclog.NewNullLogger(), doneAll, 10*time.Millisecond, 500*time.Millisecond, false, 1, 1, false, icmpengine.GetDebugLevels(1), true)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	count := 5
+	for _, IP := range []string{`127.0.0.1`, `::1`} {
+		ie.Pinger(netaddr.MustParseIP(IP), icmpengine.Sequence(count), time.Microsecond, false, make(chan struct{}, 2))
+	}
+
+	renamed := icmpengine.NewCollector(ie, icmpengine.CollectorConfigT{
+		Namespace: "renamed",
+		TargetLabelValues: func(IP netaddr.IP) []string {
+			return []string{"host-" + IP.String()}
+		},
+	})
+	invalid := icmpengine.NewCollector(ie, icmpengine.CollectorConfigT{
+		Namespace: "invalid",
+		TargetLabelValues: func(IP netaddr.IP) []string {
+			if IP.Is6() {
+				return []string{IP.String(), "extra"}
+			}
+			return []string{IP.String()}
+		},
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(renamed, invalid)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf(fmt.Sprintf("TestCollectorLabels registry.Gather() err:%v", err))
+	}
+	found := make(map[string][]string)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "target" {
+					found[family.GetName()] = append(found[family.GetName()], l.GetValue())
+				}
+			}
+		}
+	}
+	if targets := found["renamed_sent_total"]; len(targets) != 2 || targets[0][:5] != "host-" {
+		t.Errorf(fmt.Sprintf("TestCollectorLabels renamed targets:%v", targets))
+	}
+	if targets := found["invalid_sent_total"]; len(targets) != 1 || targets[0] != "127.0.0.1" {
+		t.Errorf(fmt.Sprintf("TestCollectorLabels invalid targets:%v", targets))
+	}
+	if invalid.LabelErrors != 1 || renamed.LabelErrors != 0 {
+		t.Errorf(fmt.Sprintf("TestCollectorLabels LabelErrors invalid:%d renamed:%d", invalid.LabelErrors, renamed.LabelErrors))
+	}
+
+	doneAll <- struct{}{}
+	wg.Wait()
+}
+
+// TestCollectorTargetsBounded checks the per target counters are bounded to the most recently
+// sent targets, and ForgetTarget removes them
+func TestCollectorTargetsBounded(t *testing.T) {
+
+	ie := icmpengine.NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, icmpengine.GetDebugLevels(1), true)
+	ie.Counters.TargetsMax = 2
+
+	IPs := []netaddr.IP{netaddr.MustParseIP("192.0.2.1"), netaddr.MustParseIP("192.0.2.2"), netaddr.MustParseIP("192.0.2.3")}
+	ie.Counters.Sent(IPs[0])
+	ie.Counters.Sent(IPs[1])
+	ie.Counters.Sent(IPs[0])
+	ie.Counters.Sent(IPs[2])
+
+	snapshots := ie.Counters.Snapshot()
+	if len(snapshots) != 2 || ie.Counters.LRU.Len() != 2 {
+		t.Fatalf(fmt.Sprintf("TestCollectorTargetsBounded snapshots:%d lru:%d", len(snapshots), ie.Counters.LRU.Len()))
+	}
+	for _, s := range snapshots {
+		if s.IP == IPs[1] {
+			t.Errorf("TestCollectorTargetsBounded least recently sent target not evicted")
+		}
+		if s.IP == IPs[0] && s.Sent != 2 {
+			t.Errorf(fmt.Sprintf("TestCollectorTargetsBounded [%s] Sent:%d", s.IP, s.Sent))
+		}
+	}
+
+	ie.ForgetTarget(IPs[0])
+	if snapshots = ie.Counters.Snapshot(); len(snapshots) != 1 || ie.Counters.LRU.Len() != 1 {
+		t.Errorf(fmt.Sprintf("TestCollectorTargetsBounded ForgetTarget snapshots:%d lru:%d", len(snapshots), ie.Counters.LRU.Len()))
+	}
+}
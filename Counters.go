@@ -0,0 +1,242 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Counters holds the per target, and engine wide, counters
+// which are exported by the Prometheus Collector
+//
+// The counters have their own locks, so updating the counters
+// does not need the main ICMPEngine lock
+//
+// The per target counters are kept in least recently sent order, and bounded to TargetsMax
+// ( default TargetCountersMaxCst ), like the RTTEstimators, so sweeps over large address
+// ranges don't grow the map, and the Collector output, without bound
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+const (
+	// RecentSeqsCst is the number of recently received sequence numbers
+	// kept per target, to detect duplicate replies
+	RecentSeqsCst = 64
+
+	// TargetCountersMaxCst is the default maximum number of targets with counters
+	TargetCountersMaxCst = 65536
+)
+
+// RTTBucketsCst are the default RTT histogram buckets in seconds, 100us to ~3.3s
+var RTTBucketsCst = []float64{0.0001, 0.0002, 0.0004, 0.0008, 0.0016, 0.0032, 0.0064, 0.0128, 0.0256, 0.0512, 0.1024, 0.2048, 0.4096, 0.8192, 1.6384, 3.2768}
+
+// CountersT holds the engine wide counters
+// The uint64s are first in the struct for the 64 bit alignment required by sync/atomic,
+// and ICMPEngine holds a pointer, so the struct itself is allocated aligned
+type CountersT struct {
+	// Deprecated: ReceiverTimeouts is always 0, because the Receivers no longer use read deadlines
+	ReceiverTimeouts   uint64
+	ReceiverPackets    uint64
+	RejectedParse      uint64
+	RejectedUnknown    uint64
+	RejectedDuplicates uint64
+	RejectedType       uint64
+	ICMPErrors         uint64
+	DispatchDropped    uint64
+	DispatchLate       uint64
+	ExpirerStarts      uint64
+	SendQueueWaits     uint64
+	SendQueueDelayNs   uint64
+	SendENOBUFS        uint64
+	SendErrors         uint64
+	AdmissionRejected  uint64
+	FaultDrops         uint64
+	FaultDelays        uint64
+	FaultCorrupts      uint64
+	FaultErrors        uint64
+	FaultDuplicates    uint64
+	sync.RWMutex
+	Buckets    []float64
+	Targets    map[netaddr.IP]*TargetCounters
+	LRU        *list.List
+	TargetsMax int
+}
+
+// TargetCounters holds the counters for a single target
+type TargetCounters struct {
+	sync.Mutex
+	Sent       uint64
+	Received   uint64
+	Lost       uint64
+	Duplicates uint64
+	RTTSum     time.Duration
+	RTTBuckets []uint64
+	recent     [RecentSeqsCst]Sequence
+	recentLen  int
+	recentNext int
+	lru        *list.Element
+}
+
+// TargetCountersSnapshot is a copy of the TargetCounters, for the Collector
+type TargetCountersSnapshot struct {
+	IP         netaddr.IP
+	Sent       uint64
+	Received   uint64
+	Lost       uint64
+	Duplicates uint64
+	RTTSum     time.Duration
+	RTTBuckets []uint64
+}
+
+// newCounters creates the CountersT
+func newCounters(buckets []float64) *CountersT {
+	return &CountersT{
+		Buckets:    buckets,
+		Targets:    make(map[netaddr.IP]*TargetCounters),
+		LRU:        list.New(),
+		TargetsMax: TargetCountersMaxCst,
+	}
+}
+
+// target returns the TargetCounters for the IP, creating them if required, and evicting
+// the least recently sent targets beyond TargetsMax
+// touch moves the target to the front of the LRU, which needs the write LOCK, so it's only
+// done for the sends, and the replies and expiries use the RLock
+func (c *CountersT) target(IP netaddr.IP, touch bool) (t *TargetCounters) {
+	if !touch {
+		c.RLock()
+		t, exists := c.Targets[IP]
+		c.RUnlock()
+		if exists {
+			return t
+		}
+	}
+
+	c.Lock() // <------------------------------ LOCK!!
+	defer c.Unlock()
+	t, exists := c.Targets[IP]
+	if exists {
+		c.LRU.MoveToFront(t.lru)
+		return t
+	}
+	t = &TargetCounters{
+		RTTBuckets: make([]uint64, len(c.Buckets)),
+	}
+	t.lru = c.LRU.PushFront(IP)
+	c.Targets[IP] = t
+
+	max := c.TargetsMax
+	if max <= 0 {
+		max = TargetCountersMaxCst
+	}
+	for c.LRU.Len() > max {
+		oldest := c.LRU.Back()
+		delete(c.Targets, oldest.Value.(netaddr.IP))
+		c.LRU.Remove(oldest)
+	}
+	return t
+}
+
+// lookup returns the TargetCounters for the IP, or nil
+func (c *CountersT) lookup(IP netaddr.IP) (t *TargetCounters) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.Targets[IP]
+}
+
+// Sent counts a probe being sent
+func (c *CountersT) Sent(IP netaddr.IP) {
+	t := c.target(IP, true)
+	t.Lock()
+	t.Sent++
+	t.Unlock()
+}
+
+// Received counts a reply, and the RTT in the histogram
+func (c *CountersT) Received(IP netaddr.IP, seq Sequence, rtt time.Duration) {
+	t := c.target(IP, false)
+	i := sort.SearchFloat64s(c.Buckets, rtt.Seconds())
+	t.Lock()
+	t.Received++
+	t.RTTSum += rtt
+	if i < len(t.RTTBuckets) {
+		t.RTTBuckets[i]++
+	}
+	t.recent[t.recentNext] = seq
+	t.recentNext = (t.recentNext + 1) % RecentSeqsCst
+	if t.recentLen < RecentSeqsCst {
+		t.recentLen++
+	}
+	t.Unlock()
+}
+
+// Lost counts a probe expiring
+func (c *CountersT) Lost(IP netaddr.IP) {
+	t := c.target(IP, false)
+	t.Lock()
+	t.Lost++
+	t.Unlock()
+}
+
+// Unknown counts a reply which doesn't match an outstanding probe
+// If the sequence number was recently received, it's a duplicate
+// otherwise it's rejected as unknown ( e.g. a reply after the probe expired )
+// returns if the reply was a duplicate
+func (c *CountersT) Unknown(IP netaddr.IP, seq Sequence) (duplicate bool) {
+	t := c.lookup(IP)
+	if t != nil {
+		t.Lock()
+		for i := 0; i < t.recentLen; i++ {
+			if t.recent[i] == seq {
+				duplicate = true
+				t.Duplicates++
+				break
+			}
+		}
+		t.Unlock()
+	}
+	if duplicate {
+		atomic.AddUint64(&c.RejectedDuplicates, 1)
+	} else {
+		atomic.AddUint64(&c.RejectedUnknown, 1)
+	}
+	return duplicate
+}
+
+// Snapshot returns copies of all the TargetCounters
+func (c *CountersT) Snapshot() (snapshots []TargetCountersSnapshot) {
+	c.RLock()
+	defer c.RUnlock()
+	for IP, t := range c.Targets {
+		t.Lock()
+		s := TargetCountersSnapshot{
+			IP:         IP,
+			Sent:       t.Sent,
+			Received:   t.Received,
+			Lost:       t.Lost,
+			Duplicates: t.Duplicates,
+			RTTSum:     t.RTTSum,
+			RTTBuckets: make([]uint64, len(t.RTTBuckets)),
+		}
+		copy(s.RTTBuckets, t.RTTBuckets)
+		t.Unlock()
+		snapshots = append(snapshots, s)
+	}
+	return snapshots
+}
+
+// ForgetTarget removes the counters for a target, e.g. when a target is
+// no longer being monitored, so the Collector stops exporting it, and its RTTEstimator
+func (ie *ICMPEngine) ForgetTarget(IP netaddr.IP) {
+	ie.Counters.Lock()
+	if t, exists := ie.Counters.Targets[IP]; exists {
+		ie.Counters.LRU.Remove(t.lru)
+		delete(ie.Counters.Targets, IP)
+	}
+	ie.Counters.Unlock()
+	ie.forgetRTTEstimator(IP)
+}
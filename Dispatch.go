@@ -0,0 +1,135 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Dispatch delivers the results from the Receivers and Expirers to the Pinger sessions
+//
+// Originally the Receiver sent on the Pinger's channel while holding the lock, so
+// a slow Pinger could stall all the Receivers, and the Expirer sent after unlocking,
+// so it could block forever on the channel of a Pinger that had already returned.
+//
+// Now each Pinger registers a Session, and the results are delivered with
+// non-blocking sends into the Session's bounded queues ( buffered channels ).
+// If a queue is full, the DispatchPolicy decides which result is dropped, and
+// the drop is counted.  Once the Pinger closes the Session, any late results
+// are counted and discarded, so the receive path never blocks.
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"inet.af/netaddr"
+)
+
+// DispatchPolicy is what to do when a Session queue is full
+type DispatchPolicy int
+
+const (
+	// DispatchDropNewest drops the result being delivered ( the default )
+	DispatchDropNewest DispatchPolicy = iota
+	// DispatchDropOldest drops the oldest queued result, to make room for the new result
+	DispatchDropOldest
+)
+
+// Session is a Pinger's registration for results for a target
+type Session struct {
+	Dropped uint64 // atomic, first for 64 bit alignment
+	Late    uint64 // atomic
+	sync.Mutex
+	IP        netaddr.IP
+	Policy    DispatchPolicy
+	SuccessCh chan PingSuccess
+	ExpiredCh chan PingExpired
+	DoneCh    chan struct{}
+	Faults    *FaultPolicy
+	closed    bool
+}
+
+// newSession creates a Session with queues of size
+func newSession(IP netaddr.IP, size int, policy DispatchPolicy, done chan struct{}) (s *Session) {
+	if size < 1 {
+		size = 1
+	}
+	return &Session{
+		IP:        IP,
+		Policy:    policy,
+		SuccessCh: make(chan PingSuccess, size),
+		ExpiredCh: make(chan PingExpired, size),
+		DoneCh:    done,
+	}
+}
+
+// close stops any further deliveries to the Session
+func (s *Session) close() {
+	s.Lock()
+	s.closed = true
+	s.Unlock()
+}
+
+// deliverSuccess queues the PingSuccess for the Pinger, without blocking
+// returns if the result was queued
+// The Session lock is only held for the non-blocking channel operations,
+// and makes sure nothing is delivered after the Session is closed
+func (s *Session) deliverSuccess(ps PingSuccess, c *CountersT) (queued bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		atomic.AddUint64(&s.Late, 1)
+		atomic.AddUint64(&c.DispatchLate, 1)
+		return false
+	}
+	select {
+	case s.SuccessCh <- ps:
+		return true
+	default:
+	}
+
+	atomic.AddUint64(&s.Dropped, 1)
+	atomic.AddUint64(&c.DispatchDropped, 1)
+	if s.Policy == DispatchDropOldest {
+		select {
+		case <-s.SuccessCh:
+		default:
+		}
+		select {
+		case s.SuccessCh <- ps:
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// deliverExpired queues the PingExpired for the Pinger, without blocking
+// returns if the result was queued
+func (s *Session) deliverExpired(pe PingExpired, c *CountersT) (queued bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		atomic.AddUint64(&s.Late, 1)
+		atomic.AddUint64(&c.DispatchLate, 1)
+		return false
+	}
+	select {
+	case s.ExpiredCh <- pe:
+		return true
+	default:
+	}
+
+	atomic.AddUint64(&s.Dropped, 1)
+	atomic.AddUint64(&c.DispatchDropped, 1)
+	if s.Policy == DispatchDropOldest {
+		select {
+		case <-s.ExpiredCh:
+		default:
+		}
+		select {
+		case s.ExpiredCh <- pe:
+			return true
+		default:
+		}
+	}
+	return false
+}
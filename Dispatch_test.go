@@ -0,0 +1,92 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+// TestDispatchOverflow checks full queues never block, and the policies drop the right result
+func TestDispatchOverflow(t *testing.T) {
+
+	IP := netaddr.MustParseIP("192.0.2.1")
+
+	var tests = []struct {
+		policy DispatchPolicy
+		want   Sequence
+	}{
+		{DispatchDropNewest, 0},
+		{DispatchDropOldest, 3},
+	}
+	for _, test := range tests {
+		c := newCounters(RTTBucketsCst)
+		s := newSession(IP, 2, test.policy, nil)
+		for i := 0; i < 5; i++ {
+			s.deliverSuccess(PingSuccess{Seq: Sequence(i)}, c)
+		}
+		if s.Dropped != 3 || c.DispatchDropped != 3 {
+			t.Errorf(fmt.Sprintf("TestDispatchOverflow policy:%d Dropped:%d DispatchDropped:%d", test.policy, s.Dropped, c.DispatchDropped))
+		}
+		ps := <-s.SuccessCh
+		if ps.Seq != test.want {
+			t.Errorf(fmt.Sprintf("TestDispatchOverflow policy:%d first Seq:%d want:%d", test.policy, ps.Seq, test.want))
+		}
+
+		s.close()
+		if s.deliverExpired(PingExpired{Seq: 9}, c) || s.Late != 1 || c.DispatchLate != 1 {
+			t.Errorf(fmt.Sprintf("TestDispatchOverflow policy:%d delivered after close, Late:%d", test.policy, s.Late))
+		}
+	}
+}
+
+// TestDispatchSessionEnding races replies against the Session being closed and removed,
+// which previously could block the Receiver, or send on a deleted channel
+func TestDispatchSessionEnding(t *testing.T) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Hour, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+	IP := netaddr.MustParseIP("192.0.2.1")
+	shard := ie.shard(IP)
+
+	for round := 0; round < 100; round++ {
+		session := newSession(IP, 1, DispatchDropNewest, nil)
+		shard.Lock()
+		shard.Sessions[IP] = session
+		shard.Pings[IP] = make(map[Sequence]*ExpiryEntry)
+		now := time.Now()
+		for seq := Sequence(0); seq < 10; seq++ {
+			shard.Pings[IP][seq] = ie.insertExpiry(shard, Pings{NetaddrIP: IP, Seq: seq, Send: now, Expiry: now.Add(time.Hour)})
+		}
+		shard.Unlock()
+
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := Sequence(0); seq < 10; seq++ {
+				ie.matchReply(IP, seq, time.Now())
+			}
+		}()
+
+		// the Pinger ending, without reading any results
+		shard.Lock()
+		for _, el := range shard.Pings[IP] {
+			shard.Expiries.Remove(el)
+		}
+		delete(shard.Pings, IP)
+		delete(shard.Sessions, IP)
+		shard.Unlock()
+		session.close()
+
+		wg.Wait()
+	}
+
+	if shard.Expiries.Len() != 0 {
+		t.Errorf(fmt.Sprintf("TestDispatchSessionEnding Expiries.Len():%d", shard.Expiries.Len()))
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// EchoTemplate is a precomputed ICMP echo request, for the zero allocation send path
+//
+// Originally every probe called buildICMPMessage and msg.Marshal(nil), which allocated
+// the icmp.Message, the icmp.Echo body, and the marshalled buffer, and calculated the full
+// checksum.  The echo request only differs by the sequence number, so the template is
+// marshalled once per Pinger, and each probe just writes the sequence number and updates
+// the checksum incrementally, per rfc1624
+// https://tools.ietf.org/html/rfc1624
+//
+// The IPv6 checksum is left as zero, the same as msg.Marshal(nil), because the kernel
+// calculates the ICMPv6 checksum, which includes the pseudo header
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+)
+
+const (
+	// EchoLenCst is the echo request length, which is just the header, because
+	// there is no data ( packet size is not currently supported )
+	EchoLenCst = 8
+)
+
+// EchoTemplate holds the marshalled echo request with sequence number zero
+type EchoTemplate struct {
+	Proto    Protocol
+	ID       int
+	b        [EchoLenCst]byte
+	checksum uint16
+}
+
+// NewEchoTemplate marshals the echo request template, for the protocol and identifier
+func NewEchoTemplate(proto Protocol, id int) (t *EchoTemplate) {
+
+	wb, err := buildICMPMessage(id, 0, proto).Marshal(nil)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("NewEchoTemplate msg.Marshal(nil):%v", err))
+	}
+	if len(wb) != EchoLenCst {
+		log.Fatal(fmt.Sprintf("NewEchoTemplate unexpected len(wb):%d", len(wb)))
+	}
+
+	t = &EchoTemplate{
+		Proto: proto,
+		ID:    id,
+	}
+	copy(t.b[:], wb)
+	t.checksum = binary.BigEndian.Uint16(t.b[2:4])
+	return t
+}
+
+// Put writes the echo request for the sequence into b, without allocating, and
+// returns b[:EchoLenCst].  b must be at least EchoLenCst
+func (t *EchoTemplate) Put(b []byte, seq Sequence) []byte {
+
+	b = b[:EchoLenCst]
+	copy(b, t.b[:])
+	binary.BigEndian.PutUint16(b[6:8], uint16(seq))
+	if t.Proto == Protocol(4) {
+		binary.BigEndian.PutUint16(b[2:4], checksumUpdate(t.checksum, 0, uint16(seq)))
+	}
+	return b
+}
+
+// checksumUpdate returns the updated internet checksum, for a 16 bit field changing
+// from old to new, per rfc1624 equation 3: HC' = ~(~HC + ~m + m')
+func checksumUpdate(checksum uint16, old uint16, new uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^old) + uint32(new)
+	sum = (sum >> 16) + (sum & 0xffff)
+	sum += sum >> 16
+	return ^uint16(sum)
+}
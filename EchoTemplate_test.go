@@ -0,0 +1,66 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// TestEchoTemplate checks the template with the incremental checksum matches
+// msg.Marshal(nil), for every sequence number
+func TestEchoTemplate(t *testing.T) {
+
+	for _, proto := range []Protocol{Protocol(4), Protocol(6)} {
+		for _, id := range []int{0, 1, 0x1234, 0xffff} {
+			template := NewEchoTemplate(proto, id)
+			var b [EchoLenCst]byte
+			for seq := 0; seq <= 0xffff; seq++ {
+				want, err := buildICMPMessage(id, Sequence(seq), proto).Marshal(nil)
+				if err != nil {
+					t.Fatalf("TestEchoTemplate Marshal:%v", err)
+				}
+				got := template.Put(b[:], Sequence(seq))
+				if !bytes.Equal(got, want) {
+					t.Fatalf(fmt.Sprintf("TestEchoTemplate proto:%d id:%d seq:%d got:%x want:%x", proto, id, seq, got, want))
+				}
+			}
+		}
+	}
+}
+
+// TestEchoTemplateAllocs checks the send path packet building doesn't allocate
+func TestEchoTemplateAllocs(t *testing.T) {
+
+	if IsRaceEnabled {
+		t.Skip("allocations are not accurate with the race detector")
+	}
+
+	template := NewEchoTemplate(Protocol(4), 1)
+	var b [EchoLenCst]byte
+	var seq Sequence
+	allocs := testing.AllocsPerRun(1000, func() {
+		template.Put(b[:], seq)
+		seq++
+	})
+	if allocs != 0 {
+		t.Errorf(fmt.Sprintf("TestEchoTemplateAllocs allocs:%f", allocs))
+	}
+}
+
+func BenchmarkEchoTemplate(b *testing.B) {
+	template := NewEchoTemplate(Protocol(4), 1)
+	var wb [EchoLenCst]byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		template.Put(wb[:], Sequence(i))
+	}
+}
+
+func BenchmarkEchoMarshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buildICMPMessage(1, Sequence(i), Protocol(4)).Marshal(nil)
+	}
+}
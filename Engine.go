@@ -0,0 +1,33 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Engine is the Pinger interface of the ICMPEngine, so the code built on icmpengine can
+// depend on the interface, rather than the *ICMPEngine, and be unit tested with the FakeEngine
+// from the icmpenginetest package, without sending any real pings, or using FakeSuccess
+//
+// The engine lifecycle ( NewFullConfig, Start, Run and Stop ) and the Set* configuration
+// are NOT in the interface, because they are done once by the main program
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// Engine is implemented by the *ICMPEngine, and by icmpenginetest.FakeEngine
+type Engine interface {
+	Pinger(IP netaddr.IP, packets Sequence, interval time.Duration, sortRTTs bool, DoneCh chan struct{}) (results PingerResults)
+	PingerConfig(IP netaddr.IP, packets Sequence, interval time.Duration, sortRTTs bool, DoneCh chan struct{}, dropProb float64) (results PingerResults)
+	PingerWithConfig(IP netaddr.IP, packets Sequence, interval time.Duration, DoneCh chan struct{}, config PingerConfigT) (results PingerResults)
+	PingerWithContext(ctx context.Context, IP netaddr.IP, packets Sequence, interval time.Duration, DoneCh chan struct{}, config PingerConfigT) (results PingerResults, err error)
+	TryPingerWithConfig(IP netaddr.IP, packets Sequence, interval time.Duration, DoneCh chan struct{}, config PingerConfigT) (results PingerResults, err error)
+	PingerWithStatsChannel(IP netaddr.IP, packets Sequence, interval time.Duration, sortRTTs bool, DoneCh chan struct{}, wg *sync.WaitGroup, pingerResultsCh chan<- PingerResults)
+	PingerWithConfigAndStatsChannel(IP netaddr.IP, packets Sequence, interval time.Duration, DoneCh chan struct{}, config PingerConfigT, wg *sync.WaitGroup, pingerResultsCh chan<- PingerResults)
+	Status() (status EngineStatus)
+}
+
+// the ICMPEngine must always implement the Engine interface
+var _ Engine = (*ICMPEngine)(nil)
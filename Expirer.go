@@ -3,18 +3,30 @@
 package icmpengine
 
 // Expirer holds a sinlge sleep timer
+//
+// Each PingShard has a single long lived Expirer, which is started with the first ping
+// in the shard, and then runs until Stop(), rather than exiting whenever the ExpiryQueue
+// is empty and being started again by the next Pinger.  The Expirer uses one timer, which
+// is Reset() to the soonest expiry, rather than a new time.After() per expiry, and
+// insertExpiry wakes the Expirer when an earlier expiry is inserted, so it can re-arm the timer.
+// All the pings that have expired are handled per wake up, which helps with bursts.
 
 // Socketsider using heap, rather than ordered DLL, which would allow for different timeout values
 // https://golang.org/pkg/container/heap/
 
 // Notes
-// Currently have a single expirer, but could easily have one per protocol which would provide more parallelism
-// The other suggestion is to make a single expiry for a batch of packets, rather than one per packet.
-// Both these ideas could help if performance becomes an issue, which currnetly it is not.
+// There is an Expirer per PingShard ( ShardsPerProtocolCst per protocol ), rather than one per
+// protocol.  Each Expirer only takes its own shard lock, and only walks its own ExpiryQueue, so
+// expiring a burst in one shard never holds up the Pingers and the Receiver in the other shards.
+// A single Expirer per protocol would need to take every shard lock to find the soonest expiry.
+// The idle cost is a parked goroutine and a stopped timer per shard.
+// BenchmarkSendReceiveShards1 vs BenchmarkSendReceiveShards ( see Shards_test.go ), on a single
+// CPU, were ~560 ns/op with 1 shard and ~540 ns/op with 16 shards, so the extra Expirers cost
+// nothing measurable.  The parallelism gain needs more CPUs to show up.
 
 import (
-	"container/list"
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,23 +34,24 @@ const (
 	EdebugLevel = 111
 )
 
-// CheckExpirerIsRunning checks Expirers is running, and starts it if required
-// returns if Expirers was started
-// CheckExpirerIsRunning assumes the LOCK is already held by Pinger
-func (ie *ICMPEngine) CheckExpirerIsRunning() (started bool) {
+// CheckExpirerIsRunning checks the shard Expirer is running, and starts it if required
+// returns if Expirer was started
+// CheckExpirerIsRunning assumes the shard LOCK is already held by Pinger
+func (ie *ICMPEngine) CheckExpirerIsRunning(shard *PingShard) (started bool) {
 
 	if ie.Expirers.DebugLevel > 100 {
 		ie.Log.Info("CheckExpirerIsRunning() start")
 	}
-	if ie.Expirers.Running {
+	if shard.ExpirerRunning {
 		if ie.Expirers.DebugLevel > 100 {
-			ie.Log.Info("CheckExpirerIsRunning ie.Expirers.Running")
+			ie.Log.Info("CheckExpirerIsRunning shard.ExpirerRunning")
 		}
 		started = false
 	} else {
 		ie.Expirers.WG.Add(1)
-		go ie.ExpirerConfig(ie.Expirers.FakeSuccess)
-		ie.Expirers.Running = true
+		go ie.ExpirerConfig(shard, ie.Expirers.FakeSuccess)
+		shard.ExpirerRunning = true
+		atomic.AddUint64(&ie.Counters.ExpirerStarts, 1)
 
 		if ie.Expirers.DebugLevel > 100 {
 			ie.Log.Info("CheckExpirerIsRunning started")
@@ -48,13 +61,13 @@ func (ie *ICMPEngine) CheckExpirerIsRunning() (started bool) {
 	return started
 }
 
-// Expirer tracks the ICMP echo timeouts
+// Expirer tracks the ICMP echo timeouts for a single PingShard
 // The idea is to just have the single and nearest timer running at any single moment
 // The "Config" implies that we can configure the FakeSuccess, which is used for testing
-func (ie *ICMPEngine) ExpirerConfig(FakeSuccess bool) {
+func (ie *ICMPEngine) ExpirerConfig(shard *PingShard, FakeSuccess bool) {
 
 	if ie.Expirers.DebugLevel > 100 {
-		ie.Log.Info(fmt.Sprintf("Expirer start \t FakeSuccess:%t", FakeSuccess))
+		ie.Log.Info(fmt.Sprintf("Expirer start \t proto:%d \t shard:%d \t FakeSuccess:%t", shard.Protocol, shard.Index, FakeSuccess))
 	}
 
 	defer ie.Expirers.WG.Done()
@@ -62,157 +75,161 @@ func (ie *ICMPEngine) ExpirerConfig(FakeSuccess bool) {
 	ie.RLock()
 	done := ie.Expirers.DoneCh
 	ie.RUnlock()
+	wake := shard.WakeCh
 
-	for i, keepLooping := 0, true; keepLooping; i++ {
+	// The single timer, which starts stopped, and is Reset() to the soonest expiry
+	timer := ie.Clock.NewTimer(time.Hour)
+	stopTimer(timer)
+	defer timer.Stop()
+
+	// expired and pending are reused, to collect the results while holding the lock, for delivery after the unlock
+	var expired []Pings
+	var pending []expiredDelivery
 
-		var el *list.Element
-		var exists bool
-		var len int
-		var SoonestPing Pings
-		var sleepDuration time.Duration
+	for i, keepLooping := 0, true; keepLooping; i++ {
 
 		if ie.Expirers.DebugLevel > 100 {
-			ie.Log.Info(fmt.Sprintf("Expirer \t i:%d", i))
+			ie.Log.Info(fmt.Sprintf("Expirer trying to acquire shard.Lock() \t i:%d", i))
 		}
-		select {
-		case <-done:
-			if ie.Expirers.DebugLevel > 10 {
-				ie.Log.Info("Expirer received done")
-			}
-			keepLooping = false
-			continue
-		default:
-			// non-block
+
+		now := ie.Clock.Now()
+		var soonest time.Time
+		pending = pending[:0]
+
+		shard.Lock() // <----------------------- LOCK!!
+		// Delete and remove with the single lock, so the Receiver can't also match these pings
+		expired = shard.Expiries.PopExpired(now, expired[:0])
+		for _, ping := range expired {
+			delete(shard.Pings[ping.NetaddrIP], ping.Seq)
+			pending = append(pending, expiredDelivery{
+				session: shard.Sessions[ping.NetaddrIP],
+				ping:    ping,
+				success: FakeSuccess && !ping.FakeDrop,
+			})
+		}
+		if next, ok := shard.Expiries.Next(); ok {
+			soonest = next
 		}
+		// insertExpiry wakes the Expirer if it inserts an expiry before NextWake
+		shard.NextWake = soonest
+		remaining := shard.Expiries.Len()
+		shard.Unlock() // <--------------------- UNLOCK!!
 
 		if ie.Expirers.DebugLevel > 100 {
-			ie.Log.Info(fmt.Sprintf("Expirer trying to acquire ie.Lock() to check len\t i:%d", i))
-		}
-		ie.Lock() // <-------------------------- LOCK!!
-		len = ie.Pingers.ExpiresDLL.Len()
-		if len == 0 {
-			ie.Expirers.Running = false
-			ie.Unlock() // <-------------------- UNLOCK!!
-			if ie.Expirers.DebugLevel > 100 {
-				ie.Log.Info(fmt.Sprintf("Expirer ie.Unlock(). No more elements in expires list, len:%d.  Returning", len))
-			}
-			keepLooping = false
-			return
+			ie.Log.Info(fmt.Sprintf("Expirer shard.Unlock() \t i:%d \t expired:%d \t remaining:%d", i, len(pending), remaining))
 		}
 
-		el = ie.Pingers.ExpiresDLL.Front()
-		SoonestPing = copyPing(ie.Pingers.ExpiresDLL.Front())
+		// Deliver after the unlock, and the delivery never blocks, see Dispatch.go
+		for _, p := range pending {
+			ie.deliverExpiry(p)
+		}
 
-		if FakeSuccess && !SoonestPing.FakeDrop {
-			if ie.Expirers.DebugLevel > 100 {
-				ie.Log.Info("Expirer FakeSuccess doing delete")
-			}
-			successCh := ie.Pingers.SuccessChs[SoonestPing.NetaddrIP]
-			ie.Pingers.ExpiresDLL.Remove(el)
-			delete(ie.Pingers.Pings[SoonestPing.NetaddrIP], SoonestPing.Seq)
-			ie.Unlock() // <-------------------- UNLOCK!!
+		if soonest.IsZero() {
 			if ie.Expirers.DebugLevel > 100 {
-				ie.Log.Info("Expirer FakeSuccess ie.Unlock()")
+				ie.Log.Info(fmt.Sprintf("Expirer \t i:%d no more elements in expires list, waiting to be woken", i))
 			}
-			fakeReceivedTime := time.Now()
-			rttDuration := fakeReceivedTime.Sub(SoonestPing.Send)
-			successCh <- PingSuccess{
-				Seq:      SoonestPing.Seq,
-				Send:     SoonestPing.Send,
-				Received: fakeReceivedTime,
-				RTT:      rttDuration,
-			}
-			if ie.Expirers.DebugLevel > 100 {
-				ie.Log.Info(fmt.Sprintf("Expirer \t i:%d Sent <- PingSuccess FakeSuccess", i))
+			select {
+			case <-wake:
+				if ie.Expirers.DebugLevel > 100 {
+					ie.Log.Info("Expirer woken, because an expiry was inserted")
+				}
+			case <-done:
+				if ie.Expirers.DebugLevel > 10 {
+					ie.Log.Info("Expirer <-done")
+				}
+				keepLooping = false
 			}
 			continue
 		}
-		ie.Unlock() // <------------------------ UNLOCK!!
-
-		sleepDuration = time.Until(SoonestPing.Expiry)
 
+		sleepDuration := soonest.Sub(ie.Clock.Now())
 		if ie.Expirers.DebugLevel > 1000 {
-			ie.Log.Info(fmt.Sprintf("Expirer \t i:%d going to sleep duration:%s", i, sleepDuration.String()))
+			ie.Log.Info(fmt.Sprintf("Expirer \t i:%d timer.Reset duration:%s", i, sleepDuration.String()))
 		}
+		timer.Reset(sleepDuration)
 
 		select {
-		case <-time.After(sleepDuration):
+		case <-timer.Chan():
 			if ie.Expirers.DebugLevel > 100 {
 				ie.Log.Info(fmt.Sprintf("Expirer wakes up after duration:%s", sleepDuration.String()))
 			}
+		case <-wake:
+			if ie.Expirers.DebugLevel > 100 {
+				ie.Log.Info("Expirer woken, because a sooner expiry was inserted")
+			}
+			stopTimer(timer)
 		case <-done:
 			if ie.Expirers.DebugLevel > 10 {
-				ie.Log.Info("Expirer was sleeping, but received done")
+				ie.Log.Info("Expirer <-done")
 			}
 			keepLooping = false
-			// NO DEFAULT - This is BLOCKING
-			//default:
-		}
-
-		if ie.Expirers.DebugLevel > 100 {
-			ie.Log.Info("Expirer trying to acquire ie.RLock() to check exists")
-		}
-		ie.RLock() // <-------------------------- READ LOCK!!
-		el, exists = ie.Pingers.Pings[SoonestPing.NetaddrIP][SoonestPing.Seq]
-		ie.RUnlock() // <------------------------ READ UNLOCK!!
-		if ie.Expirers.DebugLevel > 100 {
-			ie.Log.Info(fmt.Sprintf("Expirer ie.RUnlock(), exists:%t", exists))
 		}
+	}
 
-		// If the key still exists, then the Receiver did NOT get a return packet, so the timeout has expired
-		if exists {
-			if ie.Expirers.DebugLevel > 100 {
-				ie.Log.Info(fmt.Sprintf("Expirer found expired \t IP:%s \t Seq:%d deleting", SoonestPing.NetaddrIP.String(), SoonestPing.Seq))
-			}
+	if ie.Expirers.DebugLevel > 100 {
+		ie.Log.Info("Expirer - trying to acquire shard.Lock() to shard.ExpirerRunning = false, Defer unlock")
+	}
+	shard.Lock()
+	defer shard.Unlock()
+	len := shard.Expiries.Len()
+	shard.ExpirerRunning = false
+	shard.NextWake = time.Time{}
 
-			if ie.Expirers.DebugLevel > 100 {
-				ie.Log.Info("Expirer exists - trying to acquire ie.Lock()")
-			}
+	if ie.Expirers.DebugLevel > 100 {
+		ie.Log.Info(fmt.Sprintf("Expirer len:%d shard.ExpirerRunning = false.  Expirer complete. defer shard.Unlock()", len))
+	}
+}
 
-			ie.Lock() // <----------------------- LOCK!!
-			delete(ie.Pingers.Pings[SoonestPing.NetaddrIP], SoonestPing.Seq)
-			ie.Pingers.ExpiresDLL.Remove(el)
-			expiredCh := ie.Pingers.ExpiredChs[SoonestPing.NetaddrIP]
-			ie.Unlock() // <--------------------- UNLOCK!!
+// expiredDelivery is a result collected by the Expirer, for delivery after the unlock
+type expiredDelivery struct {
+	session *Session
+	ping    Pings
+	success bool
+}
 
-			if ie.Expirers.DebugLevel > 100 {
-				ie.Log.Info("Expirer exists - ie.Unlock()")
-			}
+// deliverExpiry delivers the PingExpired, or the PingSuccess for FakeSuccess, to the Pinger Session
+func (ie *ICMPEngine) deliverExpiry(p expiredDelivery) {
 
-			expiredCh <- PingExpired{
-				Seq:  SoonestPing.Seq,
-				Send: SoonestPing.Send,
-			}
-			if ie.Expirers.DebugLevel > 100 {
-				ie.Log.Info(fmt.Sprintf("Expirer \t i:%d Sent <- PingExpired", i))
-			}
-		} else {
-			if ie.Expirers.DebugLevel > 100 {
-				ie.Log.Info("Expirer expiry no longer exists, so we must have received a response.  Excellent.")
-			}
-		}
+	if p.session == nil {
+		return
 	}
-
-	if ie.Expirers.DebugLevel > 100 {
-		ie.Log.Info("Expirer - trying to acquire ie.Lock() to ie.Expirers.Running = false, Defer unlock")
+	if p.success {
+		fakeReceivedTime := ie.Clock.Now()
+		p.session.deliverSuccess(PingSuccess{
+			Seq:      p.ping.Seq,
+			Send:     p.ping.Send,
+			Received: fakeReceivedTime,
+			RTT:      fakeReceivedTime.Sub(p.ping.Send),
+		}, ie.Counters)
+		return
 	}
-	ie.Lock()
-	defer ie.Unlock()
-	len := ie.Pingers.ExpiresDLL.Len()
-	ie.Expirers.Running = false
-
 	if ie.Expirers.DebugLevel > 100 {
-		ie.Log.Info(fmt.Sprintf("Expirer len:%d ie.ExpirerRunning = false.  Expirer complete. defer ie.Unlock()", len))
+		ie.Log.Info(fmt.Sprintf("Expirer found expired \t IP:%s \t Seq:%d", p.ping.NetaddrIP.String(), p.ping.Seq))
 	}
+	p.session.deliverExpired(PingExpired{
+		Seq:  p.ping.Seq,
+		Send: p.ping.Send,
+	}, ie.Counters)
 }
 
-// copyPing is a small helper to copy by value the ping
-// this is just to help reduce code in the main function
-func copyPing(el *list.Element) (ping Pings) {
-	ping.NetaddrIP = el.Value.(Pings).NetaddrIP
-	ping.Seq = el.Value.(Pings).Seq
-	ping.Send = el.Value.(Pings).Send
-	ping.Expiry = el.Value.(Pings).Expiry
-	ping.FakeDrop = el.Value.(Pings).FakeDrop
-	return ping
+// insertExpiry inserts the ping into the shard ExpiryQueue
+// If the ping expires before the Expirer is next due to wake up, wake the Expirer so it can re-arm the timer
+// insertExpiry assumes the shard LOCK is already held by Pinger
+func (ie *ICMPEngine) insertExpiry(shard *PingShard, ping Pings) (e *ExpiryEntry) {
+
+	e = shard.Expiries.Insert(ping)
+
+	if shard.ExpirerRunning && (shard.NextWake.IsZero() || ping.Expiry.Before(shard.NextWake)) {
+		// stop any more wake ups until the Expirer has re-armed
+		shard.NextWake = ping.Expiry
+		select {
+		case shard.WakeCh <- struct{}{}:
+			if ie.Expirers.DebugLevel > 100 {
+				ie.Log.Info("insertExpiry new soonest expiry, woke Expirer")
+			}
+		default:
+			// non-block, the Expirer already has a wake up pending
+		}
+	}
+	return e
 }
@@ -0,0 +1,131 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+const (
+	burstSizeCst = 64
+)
+
+// burst inserts a burst of pings for the Session, the same way the Pinger does,
+// and then waits for all the PingExpired
+func burst(ie *ICMPEngine, session *Session, seq Sequence, expiry time.Duration) Sequence {
+
+	shard := ie.shard(session.IP)
+	shard.Lock()
+	if _, exists := shard.Pings[session.IP]; !exists {
+		shard.Pings[session.IP] = make(map[Sequence]*ExpiryEntry)
+	}
+	shard.Sessions[session.IP] = session
+	now := time.Now()
+	for i := 0; i < burstSizeCst; i++ {
+		shard.Pings[session.IP][seq] = ie.insertExpiry(shard, Pings{NetaddrIP: session.IP, Seq: seq, Send: now, Expiry: now.Add(expiry)})
+		ie.CheckExpirerIsRunning(shard)
+		seq++
+	}
+	shard.Unlock()
+
+	for i := 0; i < burstSizeCst; i++ {
+		<-session.ExpiredCh
+	}
+	return seq
+}
+
+// TestExpirerPersistent checks the Expirer is started once, and keeps running
+// while the ExpiryQueue is empty between bursts
+func TestExpirerPersistent(t *testing.T) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), false)
+	session := newSession(netaddr.MustParseIP("192.0.2.1"), burstSizeCst, DispatchDropNewest, nil)
+
+	var seq Sequence
+	for i := 0; i < 5; i++ {
+		seq = burst(ie, session, seq, time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// an earlier expiry must wake the Expirer, and not wait for the later expiry
+	shard := ie.shard(session.IP)
+	shard.Lock()
+	now := time.Now()
+	shard.Pings[session.IP][seq] = ie.insertExpiry(shard, Pings{NetaddrIP: session.IP, Seq: seq, Send: now, Expiry: now.Add(time.Hour)})
+	shard.Pings[session.IP][seq+1] = ie.insertExpiry(shard, Pings{NetaddrIP: session.IP, Seq: seq + 1, Send: now, Expiry: now.Add(time.Millisecond)})
+	shard.Unlock()
+	select {
+	case pe := <-session.ExpiredCh:
+		if pe.Seq != seq+1 {
+			t.Errorf(fmt.Sprintf("TestExpirerPersistent expired Seq:%d", pe.Seq))
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TestExpirerPersistent earlier expiry did not wake the Expirer")
+	}
+
+	if starts := atomic.LoadUint64(&ie.Counters.ExpirerStarts); starts != 1 {
+		t.Errorf(fmt.Sprintf("TestExpirerPersistent ExpirerStarts:%d", starts))
+	}
+
+	close(ie.Expirers.DoneCh)
+	ie.Expirers.WG.Wait()
+	if shard.ExpirerRunning {
+		t.Errorf("TestExpirerPersistent ExpirerRunning after done")
+	}
+}
+
+// BenchmarkExpirerBursty is bursts of expiries, with the ExpiryQueue empty between
+// bursts, which is where the Expirer used to exit and be started again
+// expirer_starts/op shows the goroutine churn
+func BenchmarkExpirerBursty(b *testing.B) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), false)
+	session := newSession(netaddr.MustParseIP("192.0.2.1"), burstSizeCst, DispatchDropNewest, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var seq Sequence
+	for i := 0; i < b.N; i++ {
+		seq = burst(ie, session, seq, 50*time.Microsecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadUint64(&ie.Counters.ExpirerStarts))/float64(b.N), "expirer_starts/op")
+
+	close(ie.Expirers.DoneCh)
+	ie.Expirers.WG.Wait()
+}
+
+// TestExpirerAfterReply checks the Expirer skips a ping matched by the Receiver before the
+// soonest expiry, which used to remove a nil element from the expiry list and panic
+func TestExpirerAfterReply(t *testing.T) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), false)
+	session := newSession(netaddr.MustParseIP("192.0.2.1"), burstSizeCst, DispatchDropNewest, nil)
+
+	shard := ie.shard(session.IP)
+	shard.Lock()
+	shard.Pings[session.IP] = make(map[Sequence]*ExpiryEntry)
+	shard.Sessions[session.IP] = session
+	now := time.Now()
+	shard.Pings[session.IP][1] = ie.insertExpiry(shard, Pings{NetaddrIP: session.IP, Seq: 1, Send: now, Expiry: now.Add(20 * time.Millisecond)})
+	ie.CheckExpirerIsRunning(shard)
+	shard.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+	if _, exists := ie.matchReply(session.IP, 1, time.Now()); !exists {
+		t.Fatalf("TestExpirerAfterReply matchReply not found")
+	}
+	time.Sleep(40 * time.Millisecond)
+
+	if len(session.SuccessCh) != 1 || len(session.ExpiredCh) != 0 {
+		t.Errorf(fmt.Sprintf("TestExpirerAfterReply successes:%d expired:%d", len(session.SuccessCh), len(session.ExpiredCh)))
+	}
+	close(ie.Expirers.DoneCh)
+	ie.Expirers.WG.Wait()
+}
@@ -0,0 +1,305 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// ExpiryQueue holds the outstanding ping expiries for a PingShard
+//
+// There are two backends:
+// - ExpiryBackendDLL ( the default ) is the original ordered double linked list,
+//   where Insert walks back from the end of the list, which is cheap when all the
+//   expiries are the same duration, and the soonest expiry is always the Front()
+// - ExpiryBackendWheel is a hashed timing wheel, per Varghese and Lauck "Hashed and
+//   Hierarchical Timing Wheels" scheme 6, with O(1) Insert and Remove regardless of the
+//   expiry order or the number of outstanding pings, which suits sweep jobs with millions
+//   of outstanding probes.  The expiries are rounded up to the wheel tick, so a ping can
+//   expire up to one tick late, but never early.
+//   http://www.cs.columbia.edu/~nahum/w6998/papers/sosp87-timing-wheels.pdf
+//
+// The ExpiryQueue is protected by the PingShard lock
+
+import (
+	"container/list"
+	"math/bits"
+	"time"
+)
+
+// ExpiryBackend selects the ExpiryQueue implementation
+type ExpiryBackend int
+
+const (
+	ExpiryBackendDLL ExpiryBackend = iota
+	ExpiryBackendWheel
+)
+
+const (
+	// ExpiryWheelTickCst is the resolution of the timing wheel
+	ExpiryWheelTickCst = time.Millisecond
+	// ExpiryWheelSlotsCst is the number of slots, which must be a multiple of 64 for the bitmap
+	// Expiries further in the future than the slots just go around the wheel more than once
+	ExpiryWheelSlotsCst = 4096
+)
+
+// ExpiryQueue is the interface for the expiry backends
+type ExpiryQueue interface {
+	// Insert adds the ping, and returns the entry, which is the handle to Remove it
+	Insert(ping Pings) (e *ExpiryEntry)
+	// Remove removes the entry, and is a no-op if the entry was already removed
+	Remove(e *ExpiryEntry)
+	// Len returns the number of entries
+	Len() int
+	// Next returns the time the Expirer should next wake up, or false if empty
+	Next() (next time.Time, ok bool)
+	// PopExpired removes all the entries which have expired at now, appending them to dst
+	PopExpired(now time.Time, dst []Pings) []Pings
+}
+
+// ExpiryEntry is a ping in an ExpiryQueue
+type ExpiryEntry struct {
+	Ping Pings
+
+	// ExpiryDLL
+	el *list.Element
+
+	// ExpiryWheel intrusive slot list
+	tick       int64
+	slot       int
+	next, prev *ExpiryEntry
+	queued     bool
+}
+
+// newExpiryQueue creates the ExpiryQueue for the backend, with the wheel starting at now
+func newExpiryQueue(backend ExpiryBackend, now time.Time) ExpiryQueue {
+	if backend == ExpiryBackendWheel {
+		return NewExpiryWheel(now, ExpiryWheelTickCst, ExpiryWheelSlotsCst)
+	}
+	return NewExpiryDLL()
+}
+
+// ExpiryDLL is the ordered double linked list backend
+type ExpiryDLL struct {
+	list *list.List
+}
+
+// NewExpiryDLL creates the ExpiryDLL
+func NewExpiryDLL() *ExpiryDLL {
+	return &ExpiryDLL{list: list.New()}
+}
+
+// Insert inserts the ping, keeping the list ordered by expiry
+// With a single ie.Timeout this is always the back of the list, but with AdaptiveTimeout
+// the expiry can be earlier, so walk back from the end of the list to find the position.
+func (d *ExpiryDLL) Insert(ping Pings) (e *ExpiryEntry) {
+
+	e = &ExpiryEntry{Ping: ping}
+
+	mark := d.list.Back()
+	for mark != nil && mark.Value.(*ExpiryEntry).Ping.Expiry.After(ping.Expiry) {
+		mark = mark.Prev()
+	}
+	if mark == nil {
+		e.el = d.list.PushFront(e)
+	} else {
+		e.el = d.list.InsertAfter(e, mark)
+	}
+	return e
+}
+
+// Remove removes the entry
+func (d *ExpiryDLL) Remove(e *ExpiryEntry) {
+	if e.el != nil {
+		d.list.Remove(e.el)
+		e.el = nil
+	}
+}
+
+// Len returns the number of entries
+func (d *ExpiryDLL) Len() int {
+	return d.list.Len()
+}
+
+// Next returns the soonest expiry, which is the Front()
+func (d *ExpiryDLL) Next() (next time.Time, ok bool) {
+	front := d.list.Front()
+	if front == nil {
+		return next, false
+	}
+	return front.Value.(*ExpiryEntry).Ping.Expiry, true
+}
+
+// PopExpired pops from the Front() until the expiry is after now
+func (d *ExpiryDLL) PopExpired(now time.Time, dst []Pings) []Pings {
+	for front := d.list.Front(); front != nil; front = d.list.Front() {
+		e := front.Value.(*ExpiryEntry)
+		if e.Ping.Expiry.After(now) {
+			break
+		}
+		d.list.Remove(front)
+		e.el = nil
+		dst = append(dst, e.Ping)
+	}
+	return dst
+}
+
+// Front returns the soonest entry, or nil
+func (d *ExpiryDLL) Front() *ExpiryEntry {
+	front := d.list.Front()
+	if front == nil {
+		return nil
+	}
+	return front.Value.(*ExpiryEntry)
+}
+
+// ExpiryWheel is the hashed timing wheel backend
+// Each slot is an intrusive double linked list of the entries, and the occupied
+// bitmap allows Next() to quickly find the next slot with entries
+type ExpiryWheel struct {
+	Tick     time.Duration
+	start    time.Time
+	slots    []*ExpiryEntry
+	occupied []uint64
+	current  int64 // the last tick processed by PopExpired
+	len      int
+}
+
+// NewExpiryWheel creates the ExpiryWheel, with tick 0 at start
+func NewExpiryWheel(start time.Time, tick time.Duration, slots int) *ExpiryWheel {
+	if slots < 64 {
+		slots = 64
+	}
+	slots = (slots + 63) / 64 * 64
+	return &ExpiryWheel{
+		Tick:     tick,
+		start:    start,
+		slots:    make([]*ExpiryEntry, slots),
+		occupied: make([]uint64, slots/64),
+	}
+}
+
+// tickOf returns the tick at or after t, so expiries are never early
+func (w *ExpiryWheel) tickOf(t time.Time) int64 {
+	d := t.Sub(w.start)
+	tick := int64(d / w.Tick)
+	if d%w.Tick > 0 {
+		tick++
+	}
+	return tick
+}
+
+// Insert adds the ping to the slot for its expiry tick
+func (w *ExpiryWheel) Insert(ping Pings) (e *ExpiryEntry) {
+
+	e = &ExpiryEntry{Ping: ping}
+
+	tick := w.tickOf(ping.Expiry)
+	if tick <= w.current {
+		// already expired, so the next PopExpired will find it
+		tick = w.current + 1
+	}
+	e.tick = tick
+	e.slot = int(tick % int64(len(w.slots)))
+	e.next = w.slots[e.slot]
+	if e.next != nil {
+		e.next.prev = e
+	}
+	w.slots[e.slot] = e
+	w.occupied[e.slot/64] |= 1 << uint(e.slot%64)
+	e.queued = true
+	w.len++
+	return e
+}
+
+// Remove unlinks the entry from its slot
+func (w *ExpiryWheel) Remove(e *ExpiryEntry) {
+
+	if !e.queued {
+		return
+	}
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		w.slots[e.slot] = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	if w.slots[e.slot] == nil {
+		w.occupied[e.slot/64] &^= 1 << uint(e.slot%64)
+	}
+	e.next, e.prev = nil, nil
+	e.queued = false
+	w.len--
+}
+
+// Len returns the number of entries
+func (w *ExpiryWheel) Len() int {
+	return w.len
+}
+
+// Next returns the time of the next occupied slot
+// The entries in the slot may be for a later time around the wheel, in which case
+// the Expirer wakes up, PopExpired finds nothing, and Next() moves on
+func (w *ExpiryWheel) Next() (next time.Time, ok bool) {
+
+	if w.len == 0 {
+		return next, false
+	}
+	n := int64(len(w.slots))
+	from := int((w.current + 1) % n)
+	slot, found := w.nextOccupied(from)
+	if !found {
+		return next, false
+	}
+	distance := int64(slot - from)
+	if distance < 0 {
+		distance += n
+	}
+	return w.start.Add(time.Duration(w.current+1+distance) * w.Tick), true
+}
+
+// nextOccupied returns the first occupied slot at or after from, wrapping around
+func (w *ExpiryWheel) nextOccupied(from int) (slot int, found bool) {
+
+	words := len(w.occupied)
+	word := from / 64
+	// mask off the bits before from in the first word
+	bitsWord := w.occupied[word] &^ (1<<uint(from%64) - 1)
+	for i := 0; i <= words; i++ {
+		if bitsWord != 0 {
+			return word*64 + bits.TrailingZeros64(bitsWord), true
+		}
+		word = (word + 1) % words
+		bitsWord = w.occupied[word]
+	}
+	return 0, false
+}
+
+// PopExpired processes the slots for the ticks up to now, removing the entries which are due
+// Each slot is visited at most once, even if the wheel has gone around more than once
+func (w *ExpiryWheel) PopExpired(now time.Time, dst []Pings) []Pings {
+
+	nowTick := int64(now.Sub(w.start) / w.Tick)
+	if nowTick <= w.current {
+		return dst
+	}
+	n := int64(len(w.slots))
+	steps := nowTick - w.current
+	if steps > n {
+		steps = n
+	}
+	for i := int64(1); i <= steps; i++ {
+		slot := int((w.current + i) % n)
+		if w.occupied[slot/64]&(1<<uint(slot%64)) == 0 {
+			continue
+		}
+		for e := w.slots[slot]; e != nil; {
+			next := e.next
+			if e.tick <= nowTick {
+				w.Remove(e)
+				dst = append(dst, e.Ping)
+			}
+			e = next
+		}
+	}
+	w.current = nowTick
+	return dst
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+const (
+	expiryBenchOutstandingCst = 1000000
+)
+
+// TestExpiryWheel checks the wheel never expires early, expires within a tick, and handles
+// expiries further out than the number of slots
+func TestExpiryWheel(t *testing.T) {
+
+	start := time.Now()
+	tick := time.Millisecond
+	w := NewExpiryWheel(start, tick, 64)
+
+	r := rand.New(rand.NewSource(1))
+	count := 1000
+	for i := 0; i < count; i++ {
+		// up to 10 times around the wheel
+		expiry := start.Add(time.Duration(r.Int63n(int64(640 * tick))))
+		w.Insert(Pings{Seq: Sequence(i), Expiry: expiry})
+	}
+
+	// late is up to the tick rounding, plus the step between the calls to PopExpired
+	step := tick / 3
+	var popped int
+	for now := start; now.Before(start.Add(700 * tick)); now = now.Add(step) {
+		for _, ping := range w.PopExpired(now, nil) {
+			if ping.Expiry.After(now) {
+				t.Errorf(fmt.Sprintf("TestExpiryWheel Seq:%d early by:%s", ping.Seq, ping.Expiry.Sub(now)))
+			}
+			if now.Sub(ping.Expiry) > tick+step {
+				t.Errorf(fmt.Sprintf("TestExpiryWheel Seq:%d late by:%s", ping.Seq, now.Sub(ping.Expiry)))
+			}
+			popped++
+		}
+		if next, ok := w.Next(); ok && !next.After(now) {
+			t.Errorf(fmt.Sprintf("TestExpiryWheel Next:%s not after now:%s", next.Sub(start), now.Sub(start)))
+		}
+	}
+	if popped != count || w.Len() != 0 {
+		t.Errorf(fmt.Sprintf("TestExpiryWheel popped:%d Len():%d", popped, w.Len()))
+	}
+}
+
+// TestExpiryQueueRemove checks Remove for both backends, including removing twice,
+// and removing after the entry was popped
+func TestExpiryQueueRemove(t *testing.T) {
+
+	for _, backend := range []ExpiryBackend{ExpiryBackendDLL, ExpiryBackendWheel} {
+		q := newExpiryQueue(backend, time.Now())
+		now := time.Now()
+		var entries []*ExpiryEntry
+		for i := 0; i < 10; i++ {
+			entries = append(entries, q.Insert(Pings{Seq: Sequence(i), Expiry: now.Add(time.Duration(i+1) * 10 * time.Millisecond)}))
+		}
+		for i := 0; i < 10; i += 2 {
+			q.Remove(entries[i])
+			q.Remove(entries[i])
+		}
+		if q.Len() != 5 {
+			t.Errorf(fmt.Sprintf("TestExpiryQueueRemove backend:%d Len():%d", backend, q.Len()))
+		}
+
+		popped := q.PopExpired(now.Add(time.Second), nil)
+		if len(popped) != 5 {
+			t.Errorf(fmt.Sprintf("TestExpiryQueueRemove backend:%d popped:%d", backend, len(popped)))
+		}
+		for _, ping := range popped {
+			if ping.Seq%2 == 0 {
+				t.Errorf(fmt.Sprintf("TestExpiryQueueRemove backend:%d removed Seq:%d popped", backend, ping.Seq))
+			}
+		}
+		for _, e := range entries {
+			q.Remove(e)
+		}
+		if _, ok := q.Next(); ok || q.Len() != 0 {
+			t.Errorf(fmt.Sprintf("TestExpiryQueueRemove backend:%d not empty Len():%d", backend, q.Len()))
+		}
+	}
+}
+
+// TestExpirerWheel runs the persistent Expirer with the wheel backend
+func TestExpirerWheel(t *testing.T) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), false)
+	ie.SetExpiryBackend(ExpiryBackendWheel)
+	session := newSession(netaddr.MustParseIP("192.0.2.1"), burstSizeCst, DispatchDropNewest, nil)
+
+	var seq Sequence
+	for i := 0; i < 5; i++ {
+		seq = burst(ie, session, seq, time.Millisecond)
+	}
+
+	shard := ie.shard(session.IP)
+	if _, ok := shard.Expiries.(*ExpiryWheel); !ok {
+		t.Errorf("TestExpirerWheel shard is not using the ExpiryWheel")
+	}
+
+	close(ie.Expirers.DoneCh)
+	ie.Expirers.WG.Wait()
+}
+
+// benchmarkExpiryInsertRemove inserts and removes, like a ping being sent and the reply received,
+// with expiryBenchOutstandingCst outstanding pings.  random gives random expiries, which
+// is like adaptive timeouts, where the DLL has to walk back to find the position
+func benchmarkExpiryInsertRemove(b *testing.B, backend ExpiryBackend, random bool) {
+
+	q := newExpiryQueue(backend, time.Now())
+	now := time.Now()
+	r := rand.New(rand.NewSource(1))
+	expiry := func(i int) time.Time {
+		if random {
+			return now.Add(time.Second + time.Duration(r.Int63n(int64(time.Second))))
+		}
+		return now.Add(time.Second + time.Duration(i)*time.Microsecond)
+	}
+
+	// the initial expiries are inserted in order, otherwise the DLL setup alone is O(n^2)
+	expiries := make([]time.Time, expiryBenchOutstandingCst)
+	for i := range expiries {
+		expiries[i] = expiry(i)
+	}
+	sort.Slice(expiries, func(i, j int) bool { return expiries[i].Before(expiries[j]) })
+	outstanding := make([]*ExpiryEntry, expiryBenchOutstandingCst)
+	for i := range outstanding {
+		outstanding[i] = q.Insert(Pings{Seq: Sequence(i), Expiry: expiries[i]})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % expiryBenchOutstandingCst
+		q.Remove(outstanding[j])
+		outstanding[j] = q.Insert(Pings{Seq: Sequence(i), Expiry: expiry(expiryBenchOutstandingCst + i)})
+	}
+}
+
+func BenchmarkExpiryInsertRemoveDLL(b *testing.B) {
+	benchmarkExpiryInsertRemove(b, ExpiryBackendDLL, false)
+}
+
+func BenchmarkExpiryInsertRemoveWheel(b *testing.B) {
+	benchmarkExpiryInsertRemove(b, ExpiryBackendWheel, false)
+}
+
+// the DLL with random expiries is O(n) per insert, so the benchmark is slow
+func BenchmarkExpiryInsertRemoveRandomDLL(b *testing.B) {
+	benchmarkExpiryInsertRemove(b, ExpiryBackendDLL, true)
+}
+
+func BenchmarkExpiryInsertRemoveRandomWheel(b *testing.B) {
+	benchmarkExpiryInsertRemove(b, ExpiryBackendWheel, true)
+}
+
+// benchmarkExpiryPopExpired inserts and then pops in 1ms steps, like the Expirer waking up
+func benchmarkExpiryPopExpired(b *testing.B, backend ExpiryBackend) {
+
+	start := time.Now()
+	q := newExpiryQueue(backend, time.Now())
+	if backend == ExpiryBackendWheel {
+		q = NewExpiryWheel(start, ExpiryWheelTickCst, ExpiryWheelSlotsCst)
+	}
+
+	var popped []Pings
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		now := start.Add(time.Duration(i) * time.Microsecond)
+		q.Insert(Pings{Seq: Sequence(i), Expiry: now.Add(time.Second)})
+		if i%1000 == 0 {
+			popped = q.PopExpired(now, popped[:0])
+		}
+	}
+}
+
+func BenchmarkExpiryPopExpiredDLL(b *testing.B) {
+	benchmarkExpiryPopExpired(b, ExpiryBackendDLL)
+}
+
+func BenchmarkExpiryPopExpiredWheel(b *testing.B) {
+	benchmarkExpiryPopExpired(b, ExpiryBackendWheel)
+}
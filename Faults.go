@@ -0,0 +1,193 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Faults holds the fault injection, which applies a FaultPolicy to the replies from specific
+// targets, alongside the real traffic, e.g. to chaos test the alerting for a few targets in staging
+//
+// Originally the only faults were FakeSuccess, which applies to the whole engine and disables
+// the sockets and Receivers entirely, and the DropProb, which is only in the PingerConfigT.
+//
+// A FaultPolicy can be attached:
+// - Per target, with SetFaultPolicy, for every Pinger to the target
+// - Per session, with PingerConfigT.Faults, for just that Pinger, which takes precedence
+//
+// The faults are injected by the Receivers, after the reply is read from the Transport, and
+// before it's matched, so they work with any Transport, but not with FakeSuccess:
+// - Drop discards the reply, so the probe expires
+// - ICMPError replaces the reply with an ICMP destination unreachable from the target, which
+//   the Receivers count as an ICMP error, and the probe still expires after the full timeout,
+//   so it behaves like a Drop, but exercises the ICMP error parsing and counters
+// - Corrupt flips random bits in a random byte of the reply
+// - Duplicate processes the reply twice
+// - Delay is added to every reply, which is processed later, so it's included in the RTT
+//
+// The Receivers only look up the policies while any are set ( FaultsT.active ), so there's no
+// cost without fault injection.  Each policy has its own random source, seeded with Seed, or
+// from the engine source, see Random.go.  The injected faults are counted, and exported by the Collector.
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// FaultPolicy is the faults to inject, where the probabilities are per reply
+// ICMPError is a Drop which also delivers an ICMP error, counted in Counters.ICMPErrors,
+// because the Receivers don't match the ICMP errors to the probes, so the probe still expires
+type FaultPolicy struct {
+	Delay     time.Duration
+	Drop      float64
+	ICMPError float64
+	Corrupt   float64
+	Duplicate float64
+	Seed      int64
+	mu        sync.Mutex
+	rand      *rand.Rand
+}
+
+// FaultsT holds the per target FaultPolicies
+// active is the number of target and session policies, so the Receivers can skip the lookup
+type FaultsT struct {
+	sync.RWMutex
+	Targets map[netaddr.IP]*FaultPolicy
+	active  int32
+}
+
+// faultDecision is the faults for a single reply
+type faultDecision struct {
+	drop      bool
+	icmpError bool
+	corrupt   bool
+	duplicate bool
+	at        int
+	mask      byte
+}
+
+// SetFaultPolicy sets the FaultPolicy for all the Pingers to the target
+// nil removes the policy
+func (ie *ICMPEngine) SetFaultPolicy(IP netaddr.IP, policy *FaultPolicy) {
+	if policy != nil {
+		ie.initFaultPolicy(policy)
+	}
+	f := &ie.Faults
+	f.Lock()
+	defer f.Unlock()
+	_, exists := f.Targets[IP]
+	switch {
+	case policy == nil && exists:
+		delete(f.Targets, IP)
+		atomic.AddInt32(&f.active, -1)
+	case policy != nil:
+		f.Targets[IP] = policy
+		if !exists {
+			atomic.AddInt32(&f.active, 1)
+		}
+	}
+}
+
+// initFaultPolicy seeds the policy random source, if it isn't already
+func (ie *ICMPEngine) initFaultPolicy(p *FaultPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rand != nil {
+		return
+	}
+	p.rand, p.Seed = ie.pingerRand(p.Seed)
+}
+
+// decide decides the faults for a single reply
+func (p *FaultPolicy) decide() (d faultDecision) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	chance := func(prob float64) bool {
+		return prob > 0 && p.rand.Float64() < prob
+	}
+	d.drop = chance(p.Drop)
+	d.icmpError = chance(p.ICMPError)
+	d.corrupt = chance(p.Corrupt)
+	d.duplicate = chance(p.Duplicate)
+	if d.corrupt {
+		d.at = p.rand.Intn(EchoLenCst)
+		d.mask = byte(1 + p.rand.Intn(255))
+	}
+	return d
+}
+
+// faultPolicy returns the FaultPolicy for the peer, with the session policy taking precedence
+func (ie *ICMPEngine) faultPolicy(ip netaddr.IP) (p *FaultPolicy) {
+	shard := ie.shard(ip)
+	shard.Lock()
+	if session := shard.Sessions[ip]; session != nil {
+		p = session.Faults
+	}
+	shard.Unlock()
+	if p != nil {
+		return p
+	}
+	ie.Faults.RLock()
+	defer ie.Faults.RUnlock()
+	return ie.Faults.Targets[ip]
+}
+
+// injectFaults applies the FaultPolicy for the peer to the reply, if there is one
+// injectFaults returns false if there's no policy, so the Receiver processes the reply as normal,
+// otherwise the reply has been processed, or discarded, by injectFaults
+// b is the pooled receive buffer, so is copied if the reply is processed later
+func (ie *ICMPEngine) injectFaults(proto Protocol, index int, b []byte, peer net.Addr, receiveTime time.Time) (handled bool) {
+
+	ip, ok := peerIP(peer)
+	if !ok {
+		return false
+	}
+	p := ie.faultPolicy(ip)
+	if p == nil {
+		return false
+	}
+	d := p.decide()
+
+	if d.drop {
+		atomic.AddUint64(&ie.Counters.FaultDrops, 1)
+		return true
+	}
+	if d.icmpError && len(b) >= EchoLenCst {
+		atomic.AddUint64(&ie.Counters.FaultErrors, 1)
+		request := append([]byte(nil), b[:EchoLenCst]...)
+		request[0] = echoRequestType(proto)
+		local := netaddr.IPv4(0, 0, 0, 0)
+		if proto == Protocol(6) {
+			local = netaddr.IPv6Unspecified()
+		}
+		b = icmpErrorMessage(proto, local, ip, request)
+	} else if d.corrupt && len(b) > 0 {
+		atomic.AddUint64(&ie.Counters.FaultCorrupts, 1)
+		b = append([]byte(nil), b...)
+		b[d.at%len(b)] ^= d.mask
+	}
+	if d.duplicate {
+		atomic.AddUint64(&ie.Counters.FaultDuplicates, 1)
+	}
+
+	if p.Delay > 0 {
+		atomic.AddUint64(&ie.Counters.FaultDelays, 1)
+		delayed := append([]byte(nil), b...)
+		ie.Clock.AfterFunc(p.Delay, func() {
+			now := ie.Clock.Now()
+			ie.processPacket(proto, index, delayed, peer, now)
+			if d.duplicate {
+				ie.processPacket(proto, index, delayed, peer, now)
+			}
+		})
+		return true
+	}
+
+	ie.processPacket(proto, index, b, peer, receiveTime)
+	if d.duplicate {
+		ie.processPacket(proto, index, b, peer, receiveTime)
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// TestFaultPolicy checks the target and session fault policies, alongside a target without faults
+func TestFaultPolicy(t *testing.T) {
+
+	sim := NewSimNetwork(1, SimProfile{Latency: FixedLatency(time.Millisecond)})
+	ie, stop := startSimEngine(sim, 200*time.Millisecond)
+	defer stop()
+
+	count := 5
+	dropped := netaddr.MustParseIP("192.0.2.1")
+	clean := netaddr.MustParseIP("192.0.2.2")
+	ie.SetFaultPolicy(dropped, &FaultPolicy{Drop: 1})
+
+	// the session policy takes precedence over the target policy
+	sessionIP := netaddr.MustParseIP("2001:db8::1")
+	ie.SetFaultPolicy(sessionIP, &FaultPolicy{Drop: 1})
+
+	tests := []struct {
+		name      string
+		IP        netaddr.IP
+		faults    *FaultPolicy
+		successes int
+		counter   *uint64
+	}{
+		{"target drop", dropped, nil, 0, &ie.Counters.FaultDrops},
+		{"clean", clean, nil, count, nil},
+		{"session delay", sessionIP, &FaultPolicy{Delay: 50 * time.Millisecond}, count, &ie.Counters.FaultDelays},
+		{"session duplicate", sessionIP, &FaultPolicy{Duplicate: 1}, count, &ie.Counters.FaultDuplicates},
+		{"session icmp error", sessionIP, &FaultPolicy{ICMPError: 1, Seed: 3}, 0, &ie.Counters.FaultErrors},
+	}
+
+	for _, test := range tests {
+		var before uint64
+		if test.counter != nil {
+			before = atomic.LoadUint64(test.counter)
+		}
+		results := ie.PingerWithConfig(test.IP, Sequence(count), time.Millisecond, make(chan struct{}), PingerConfigT{Faults: test.faults})
+		if results.Successes != test.successes {
+			t.Errorf(fmt.Sprintf("TestFaultPolicy %s Successes:%d != %d", test.name, results.Successes, test.successes))
+		}
+		if test.counter != nil && atomic.LoadUint64(test.counter)-before != uint64(count) {
+			t.Errorf(fmt.Sprintf("TestFaultPolicy %s faults:%d != %d", test.name, atomic.LoadUint64(test.counter)-before, count))
+		}
+		if test.faults != nil && test.faults.Delay > 0 && results.Min < test.faults.Delay {
+			t.Errorf(fmt.Sprintf("TestFaultPolicy %s Min:%s < Delay:%s", test.name, results.Min, test.faults.Delay))
+		}
+	}
+
+	if atomic.LoadUint64(&ie.Counters.ICMPErrors) < uint64(count) {
+		t.Errorf(fmt.Sprintf("TestFaultPolicy ICMPErrors:%d < %d", atomic.LoadUint64(&ie.Counters.ICMPErrors), count))
+	}
+
+	// removing the target policy restores the replies, and only the session policies remain active
+	ie.SetFaultPolicy(dropped, nil)
+	ie.SetFaultPolicy(sessionIP, nil)
+	if active := atomic.LoadInt32(&ie.Faults.active); active != 0 {
+		t.Errorf(fmt.Sprintf("TestFaultPolicy active:%d != 0", active))
+	}
+	if results := ie.Pinger(dropped, Sequence(count), time.Millisecond, false, make(chan struct{})); results.Successes != count {
+		t.Errorf(fmt.Sprintf("TestFaultPolicy removed policy Successes:%d", results.Successes))
+	}
+}
+
+// TestFaultPolicyConcurrent checks a target policy only affects its target, with concurrent Pingers
+func TestFaultPolicyConcurrent(t *testing.T) {
+
+	sim := NewSimNetwork(1, SimProfile{Latency: FixedLatency(time.Millisecond)})
+	ie, stop := startSimEngine(sim, 200*time.Millisecond)
+	defer stop()
+
+	count := 20
+	faulty := netaddr.MustParseIP("192.0.2.1")
+	ie.SetFaultPolicy(faulty, &FaultPolicy{Drop: 0.5, Seed: 1})
+
+	IPs := []netaddr.IP{faulty, netaddr.MustParseIP("192.0.2.2"), netaddr.MustParseIP("2001:db8::2")}
+	results := make([]PingerResults, len(IPs))
+	wg := new(sync.WaitGroup)
+	for i, IP := range IPs {
+		wg.Add(1)
+		go func(i int, IP netaddr.IP) {
+			defer wg.Done()
+			results[i] = ie.Pinger(IP, Sequence(count), time.Millisecond, false, make(chan struct{}))
+		}(i, IP)
+	}
+	wg.Wait()
+
+	drops := int(atomic.LoadUint64(&ie.Counters.FaultDrops))
+	if drops == 0 || results[0].Failures != drops {
+		t.Errorf(fmt.Sprintf("TestFaultPolicyConcurrent Failures:%d FaultDrops:%d", results[0].Failures, drops))
+	}
+	for _, r := range results[1:] {
+		if r.Successes != count {
+			t.Errorf(fmt.Sprintf("TestFaultPolicyConcurrent [%s] Successes:%d", r.IP, r.Successes))
+		}
+	}
+}
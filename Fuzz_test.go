@@ -0,0 +1,165 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// The native fuzz targets, for the reply parser, the Receiver dispatch path, and the capture
+// reader.  go test runs the seeds as regular tests, and the fuzzing is run with e.g.
+//	go test -run XXX -fuzz FuzzParseICMPMessage -fuzztime 60s
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+// fuzzAddr is a net.Addr with an arbitrary String(), for the peerIP string fallback
+type fuzzAddr string
+
+func (a fuzzAddr) Network() string { return "fuzz" }
+func (a fuzzAddr) String() string  { return string(a) }
+
+// fuzzSeeds returns the echo replies, requests, and ICMP errors for both protocols
+func fuzzSeeds() (seeds [][]byte) {
+	local := map[Protocol]netaddr.IP{4: netaddr.MustParseIP("198.51.100.1"), 6: netaddr.MustParseIP("2001:db8::ff")}
+	target := map[Protocol]netaddr.IP{4: netaddr.MustParseIP("192.0.2.1"), 6: netaddr.MustParseIP("2001:db8::1")}
+	for _, proto := range []Protocol{4, 6} {
+		request := NewEchoTemplate(proto, 0x1234).Put(make([]byte, EchoLenCst), 1)
+		seeds = append(seeds, request, echoReply(proto, request), icmpErrorMessage(proto, local[proto], target[proto], request))
+	}
+	return append(seeds, nil, []byte{0, 0, 0, 0, 0, 0, 0})
+}
+
+// FuzzParseICMPMessage checks the parsers never panic, and the parsed message is consistent with b
+func FuzzParseICMPMessage(f *testing.F) {
+
+	for _, seed := range fuzzSeeds() {
+		f.Add(uint8(4), seed)
+		f.Add(uint8(6), seed)
+	}
+
+	f.Fuzz(func(t *testing.T, p uint8, b []byte) {
+		proto := Protocol(4)
+		if p%2 == 0 {
+			proto = Protocol(6)
+		}
+
+		var m ICMPMessage
+		if err := ParseICMPMessage(proto, b, &m); err == nil {
+			echo := b[m.EchoOffset:]
+			if len(echo) < 8 || m.Seq != binary.BigEndian.Uint16(echo[6:8]) || m.Identifier != binary.BigEndian.Uint16(echo[4:6]) {
+				t.Errorf(fmt.Sprintf("FuzzParseICMPMessage proto:%d m:%+v b:%x", proto, m, b))
+			}
+			if m.Error != (m.EchoOffset > 0) || m.Error != m.Target.IsValid() {
+				t.Errorf(fmt.Sprintf("FuzzParseICMPMessage proto:%d inconsistent m:%+v b:%x", proto, m, b))
+			}
+			if !m.Error && b[0] != echoReplyType(proto) || m.Error && echo[0] != echoRequestType(proto) {
+				t.Errorf(fmt.Sprintf("FuzzParseICMPMessage proto:%d type m:%+v b:%x", proto, m, b))
+			}
+		}
+
+		if er, err := ParseICMPEchoReply(b); err == nil && (er.Type != b[0] || er.Code != 0) {
+			t.Errorf(fmt.Sprintf("FuzzParseICMPMessage ParseICMPEchoReply er:%+v b:%x", er, b))
+		}
+	})
+}
+
+// FuzzReceivePacket pushes arbitrary packets and peers through the Receiver dispatch path,
+// with outstanding pings for the seed targets, and checks every packet is either rejected exactly
+// once, or delivered to the Session
+func FuzzReceivePacket(f *testing.F) {
+
+	for _, seed := range fuzzSeeds() {
+		for _, peer := range []string{"192.0.2.1:0", "[2001:db8::1]:0", "198.51.100.1", ""} {
+			f.Add(uint8(4), seed, peer)
+			f.Add(uint8(6), seed, peer)
+		}
+	}
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Hour, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+	now := time.Now()
+	var sessions []*Session
+	for _, IP := range []netaddr.IP{netaddr.MustParseIP("192.0.2.1"), netaddr.MustParseIP("2001:db8::1")} {
+		shard := ie.shard(IP)
+		shard.Lock()
+		shard.Sessions[IP] = newSession(IP, 64, DispatchDropNewest, nil)
+		sessions = append(sessions, shard.Sessions[IP])
+		shard.Pings[IP] = make(map[Sequence]*ExpiryEntry)
+		for seq := Sequence(0); seq < 16; seq++ {
+			shard.Pings[IP][seq] = ie.insertExpiry(shard, Pings{NetaddrIP: IP, Seq: seq, Send: now, Expiry: now.Add(time.Hour)})
+		}
+		shard.Unlock()
+	}
+
+	f.Fuzz(func(t *testing.T, p uint8, b []byte, peer string) {
+		proto := Protocol(4)
+		if p%2 == 0 {
+			proto = Protocol(6)
+		}
+		counted := func() (n uint64) {
+			for _, c := range []*uint64{&ie.Counters.RejectedParse, &ie.Counters.RejectedType, &ie.Counters.ICMPErrors, &ie.Counters.RejectedUnknown, &ie.Counters.RejectedDuplicates} {
+				n += atomic.LoadUint64(c)
+			}
+			for _, s := range sessions {
+				n += uint64(len(s.SuccessCh))
+			}
+			return n
+		}
+		before := counted()
+		ie.receivePacket(proto, 0, append([]byte(nil), b...), fuzzAddr(peer), now)
+		if after := counted(); after != before+1 {
+			t.Errorf(fmt.Sprintf("FuzzReceivePacket proto:%d counted:%d b:%x peer:%q", proto, after-before, b, peer))
+		}
+	})
+}
+
+// FuzzReadCapture checks the capture reader and the ReplayNetwork never panic on a malformed capture
+func FuzzReadCapture(f *testing.F) {
+
+	var buf bytes.Buffer
+	c, err := NewCapture(&buf, CapturePcapng)
+	if err != nil {
+		f.Fatalf(fmt.Sprintf("FuzzReadCapture err:%s", err))
+	}
+	target := netaddr.MustParseIP("192.0.2.1")
+	request := NewEchoTemplate(Protocol(4), 7).Put(make([]byte, EchoLenCst), 1)
+	c.Write(time.Unix(1, 0), Protocol(4), target, true, request)
+	c.Write(time.Unix(2, 0), Protocol(4), target, false, echoReply(Protocol(4), request))
+	c.Write(time.Unix(3, 0), Protocol(4), netaddr.MustParseIP("198.51.100.1"), false, icmpErrorMessage(Protocol(4), c.Local4, target, request))
+	f.Add(buf.Bytes())
+
+	var pcap bytes.Buffer
+	if c, err = NewCapture(&pcap, CapturePcap); err != nil {
+		f.Fatalf(fmt.Sprintf("FuzzReadCapture err:%s", err))
+	}
+	c.Write(time.Unix(1, 0), Protocol(6), netaddr.MustParseIP("2001:db8::1"), true, NewEchoTemplate(Protocol(6), 7).Put(make([]byte, EchoLenCst), 1))
+	f.Add(pcap.Bytes())
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		packets, _ := ReadCapture(bytes.NewReader(b))
+		for _, p := range packets {
+			if len(p.ICMP) < EchoLenCst {
+				t.Errorf(fmt.Sprintf("FuzzReadCapture short packet:%+v", p))
+			}
+		}
+		NewReplayNetwork(packets, 1)
+	})
+}
+
+// TestPeerIPString checks the peerIP fallback, for the peers which are neither UDPAddr nor IPAddr
+func TestPeerIPString(t *testing.T) {
+
+	for peer, want := range map[string]string{"192.0.2.1:0": "192.0.2.1", "[2001:db8::1]:7": "2001:db8::1"} {
+		if ip, ok := peerIP(fuzzAddr(peer)); !ok || ip.String() != want {
+			t.Errorf(fmt.Sprintf("TestPeerIPString peer:%s ip:%s ok:%t", peer, ip, ok))
+		}
+	}
+	if _, ok := peerIP(fuzzAddr("not an address")); ok {
+		t.Errorf("TestPeerIPString invalid peer")
+	}
+}
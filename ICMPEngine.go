@@ -22,13 +22,11 @@ import (
 	"container/list"
 	"fmt"
 	"log"
-	"math/rand"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
-	"golang.org/x/net/icmp"
 	"inet.af/netaddr"
 )
 
@@ -52,6 +50,15 @@ const (
 // entries to be removed efficently when a ping is recieved.
 // Leveraging https://golang.org/pkg/container/list/
 // Need to move to https://golang.org/pkg/container/heap/
+// Optionally a hashed timing wheel can be used instead of the DLL, see ExpiryQueue.go
+// The pings and DLLs are sharded, each with their own lock, see Shards.go
+// The ICMPEngine lock protects the configuration, sockets, and start/stop
+// Clock is the source of time, which is the RealClock unless injected, see Clock.go
+// Rand is the engine random source, which no longer uses the global rand, see Random.go
+// Faults holds the per target fault policies, see Faults.go
+// Capture is the optional pcap capture of the sent and received packets, see Capture.go
+// ReadDeadline is no longer a socket read deadline, because the Receivers block until
+// Stop() closes the sockets, and is now only the duration to splay the Receivers start
 type ICMPEngine struct {
 	Log hclog.Logger
 	sync.RWMutex
@@ -65,16 +72,30 @@ type ICMPEngine struct {
 	Receivers    ReceiversT
 	Expirers     ExpirersT
 	Pingers      PingersT
+	Writers      WritersT
+	RateLimit    RateLimitT
+	Admission    AdmissionT
+	Counters     *CountersT
+	Clock        Clock
+	Rand         RandT
+	Faults       FaultsT
+	Capture      *Capture
 	DebugLevel   int
 }
 
+// SocketsT holds the sockets, as Transports, and the ICMP identifier of each socket
+// There are PerProtocol sockets for each protocol, see Sockets.go
+// The Transports are opened by the Factory, or the DatagramTransport if nil, see Transport.go
 type SocketsT struct {
-	Open       bool
-	Opens      map[Protocol]bool
-	Networks   map[Protocol]string
-	Addresses  map[Protocol]string
-	Sockets    map[Protocol]*icmp.PacketConn
-	DebugLevel int
+	Open        bool
+	Opens       map[Protocol]bool
+	Networks    map[Protocol]string
+	Addresses   map[Protocol]string
+	PerProtocol int
+	Factory     TransportFactory
+	Transports  map[Protocol][]Transport
+	IDs         map[Protocol][]int
+	DebugLevel  int
 }
 
 type ReceiversT struct {
@@ -85,28 +106,32 @@ type ReceiversT struct {
 	Splay      bool
 	Runnings   map[Protocol]bool
 	Running    bool
+	BatchSize  int
 	DebugLevel int
 }
 
+// ExpirersT holds the Expirers state
+// There is an Expirer per PingShard, and the running state is held in the PingShard
 type ExpirersT struct {
 	WG          sync.WaitGroup
 	DoneCh      chan struct{}
 	DonesChs    map[Protocol]chan struct{}
 	Runnings    map[Protocol]bool
-	Running     bool
 	DebugLevel  int
 	FakeSuccess bool
 }
 
+// PingersT holds the Pingers state
+// The outstanding pings and the Pinger channels are in the Shards, see Shards.go
 type PingersT struct {
-	WG         sync.WaitGroup
-	DoneCh     chan struct{}
-	Pings      map[netaddr.IP]map[Sequence]*list.Element
-	ExpiresDLL *list.List
-	SuccessChs map[netaddr.IP]chan PingSuccess
-	ExpiredChs map[netaddr.IP]chan PingExpired
-	DonesChs   map[netaddr.IP]chan struct{}
-	DebugLevel int
+	WG            sync.WaitGroup
+	DoneCh        chan struct{}
+	Shards        map[Protocol][]*PingShard
+	ExpiryBackend ExpiryBackend
+	Estimators    map[netaddr.IP]*RTTEstimator
+	EstimatorsLRU *list.List
+	EstimatorsMax int
+	DebugLevel    int
 }
 
 type Sequence uint16
@@ -175,8 +200,16 @@ func New(l hclog.Logger, done chan struct{}, to time.Duration, rd time.Duration,
 // It is recommended NOT to actually start until you really need ICMPengine listening for incoming packets
 // e.g. You can defer opening the sockets, and starting the receivers until you actually need them
 func NewFullConfig(logger hclog.Logger, done chan struct{}, timeout time.Duration, deadline time.Duration, start bool, receivers4 int, receivers6 int, SplayReceivers bool, debugLevels DebugLevelsT, fakeSuccess bool) (icmpEngine *ICMPEngine) {
+	return NewFullConfigWithClock(logger, done, timeout, deadline, start, receivers4, receivers6, SplayReceivers, debugLevels, fakeSuccess, RealClock{})
+}
 
-	rand.Seed(time.Now().UnixNano())
+// NewFullConfigWithClock is NewFullConfig, with the Clock, e.g. the FakeClock for the tests, see Clock.go
+// A nil clock is the RealClock
+func NewFullConfigWithClock(logger hclog.Logger, done chan struct{}, timeout time.Duration, deadline time.Duration, start bool, receivers4 int, receivers6 int, SplayReceivers bool, debugLevels DebugLevelsT, fakeSuccess bool, clock Clock) (icmpEngine *ICMPEngine) {
+
+	if clock == nil {
+		clock = RealClock{}
+	}
 
 	// Make all the maps here, but create all the channels as part of Start() in StartChannels()
 	icmpEngine = &ICMPEngine{
@@ -189,11 +222,13 @@ func NewFullConfig(logger hclog.Logger, done chan struct{}, timeout time.Duratio
 		DoneCh:       done,
 		DebugLevel:   debugLevels.IE,
 		Sockets: SocketsT{
-			Networks:   make(map[Protocol]string),
-			Addresses:  make(map[Protocol]string),
-			Sockets:    make(map[Protocol]*icmp.PacketConn),
-			Opens:      make(map[Protocol]bool),
-			DebugLevel: debugLevels.S,
+			Networks:    make(map[Protocol]string),
+			Addresses:   make(map[Protocol]string),
+			PerProtocol: SocketsPerProtocolCst,
+			Transports:  make(map[Protocol][]Transport),
+			IDs:         make(map[Protocol][]int),
+			Opens:       make(map[Protocol]bool),
+			DebugLevel:  debugLevels.S,
 		},
 		Receivers: ReceiversT{
 			DoneCh:     make(chan struct{}, 2),
@@ -211,15 +246,30 @@ func NewFullConfig(logger hclog.Logger, done chan struct{}, timeout time.Duratio
 			FakeSuccess: fakeSuccess,
 		},
 		Pingers: PingersT{
-			Pings:      make(map[netaddr.IP]map[Sequence]*list.Element),
-			ExpiresDLL: list.New(),
-			SuccessChs: make(map[netaddr.IP]chan PingSuccess),
-			ExpiredChs: make(map[netaddr.IP]chan PingExpired),
-			DonesChs:   make(map[netaddr.IP]chan struct{}),
+			Estimators:    make(map[netaddr.IP]*RTTEstimator),
+			EstimatorsLRU: list.New(),
+			EstimatorsMax: RTTEstimatorsMaxCst,
+			DebugLevel:    debugLevels.P,
+		},
+		Writers: WritersT{
+			Chs:        make(map[Protocol][]chan writeRequest),
+			DebugLevel: debugLevels.S,
+		},
+		RateLimit: RateLimitT{
 			DebugLevel: debugLevels.P,
 		},
+		Admission: AdmissionT{
+			Targets: make(map[netaddr.IP]int),
+		},
+		Counters: newCounters(RTTBucketsCst),
+		Clock:    clock,
 	}
 
+	icmpEngine.Rand.reseed(time.Now().UnixNano())
+	icmpEngine.Faults.Targets = make(map[netaddr.IP]*FaultPolicy)
+
+	icmpEngine.Pingers.Shards = newPingShards(icmpEngine.Protocols, ShardsPerProtocolCst, ExpiryBackendDLL, clock.Now())
+
 	icmpEngine.Receivers.Counts[Protocol(4)] = receivers4
 	icmpEngine.Receivers.Counts[Protocol(6)] = receivers6
 
@@ -274,20 +324,28 @@ func (ie *ICMPEngine) StartReceiversSplay() {
 		if ie.DebugLevel > 100 {
 			ie.Log.Info(fmt.Sprintf("StartReceiversSplay ie.Receivers.DoneChs[%d] = make(chan struct{},2)", p))
 		}
-		for r := 0; r < ie.Receivers.Counts[p]; r++ {
+		// Each socket has its own Receivers
+		for r := 0; r < ie.Receivers.Counts[p]*len(ie.Sockets.Transports[p]); r++ {
+			sock := r % len(ie.Sockets.Transports[p])
+			transport := ie.Sockets.Transports[p][sock]
 			ie.Receivers.WG.Add(1)
-			go ie.Receiver(p, r, ie.Receivers.DoneCh, done)
+			if bt, ok := batchTransport(transport); ok && ie.Receivers.BatchSize > 1 {
+				go ie.ReceiverBatch(p, sock, r, bt, ie.Receivers.DoneCh, done)
+			} else {
+				go ie.Receiver(p, sock, r, transport, ie.Receivers.DoneCh, done)
+			}
 			receivers++
 			if ie.DebugLevel > 100 {
-				ie.Log.Info(fmt.Sprintf("StartReceiversSplay go ie.Receiver(p, r) started protocol:%d \t r:%d", p, r))
+				ie.Log.Info(fmt.Sprintf("StartReceiversSplay go ie.Receiver(p, sock, r) started protocol:%d \t sock:%d \t r:%d", p, sock, r))
 			}
 			if splay {
-				sleepDuration := time.Duration(float64(ie.ReadDeadline) / float64(ie.Receivers.Counts[p]))
+				sleepDuration := time.Duration(float64(ie.ReadDeadline) / float64(ie.Receivers.Counts[p]*len(ie.Sockets.Transports[p])))
 				if ie.DebugLevel > 100 {
 					ie.Log.Info(fmt.Sprintf("StartReceiversSplay Receivers start delay:%s", sleepDuration.String()))
 				}
+				timer := ie.Clock.NewTimer(sleepDuration)
 				select {
-				case <-time.After(sleepDuration):
+				case <-timer.Chan():
 					if ie.DebugLevel > 100 {
 						ie.Log.Info("StartReceiversSplay wakes up")
 					}
@@ -295,11 +353,13 @@ func (ie *ICMPEngine) StartReceiversSplay() {
 					if ie.DebugLevel > 100 {
 						ie.Log.Info("StartReceiversSplay <-ie.Receivers.DoneCh")
 					}
+					timer.Stop()
 					return
 				case <-ie.DoneCh:
 					if ie.DebugLevel > 100 {
 						ie.Log.Info("StartReceiversSplay <-ie.DoneCh")
 					}
+					timer.Stop()
 					return
 					// NO DEFAULT - This is a BLOCKING select
 					//default:
@@ -355,6 +415,8 @@ func (ie *ICMPEngine) Start() {
 
 	ie.OpenSockets()
 
+	ie.StartWriters()
+
 	ie.StartReceiversSplay()
 
 	if ie.DebugLevel > 10 {
@@ -400,13 +462,20 @@ func (ie *ICMPEngine) Stop(fakeSuccess bool) {
 		ie.Log.Info("close(ie.Pingers.DoneCh) and ie.Pingers.WG.Wait()")
 	}
 
+	// LOCK!! so a starting Pinger either sees the closed channel, or is in the WG before the Wait
+	ie.Lock()
 	close(ie.Pingers.DoneCh)
+	ie.Unlock()
 	ie.Pingers.WG.Wait()
 
 	if ie.DebugLevel > 10 {
 		ie.Log.Info("Stop() ie.Pingers.WG.Wait() complete")
 	}
 
+	// The Pingers are the only senders to the Writers, so they can stop now.  A Pinger which
+	// started after the close isn't in the WG, but send() falls back to the Transport Send
+	ie.StopWriters()
+
 	if ie.DebugLevel > 10 {
 		ie.Log.Info("close(ie.Expirers.DoneCh) and ie.Expirers.WG.Wait()")
 	}
@@ -426,13 +495,20 @@ func (ie *ICMPEngine) Stop(fakeSuccess bool) {
 		for _, p := range ie.Protocols {
 			close(ie.Receivers.DoneChs[p])
 		}
-		ie.Receivers.WG.Wait()
 
+		// The Receivers block in ReadFrom without a deadline, so closing the sockets
+		// is what wakes them up.  The done channels are closed first, so the Receivers
+		// know the closed socket is a shutdown, rather than an error
 		if ie.DebugLevel > 10 {
-			ie.Log.Info("Stop() ie.Receivers.WG.Wait() complete.  Calling ie.CloseSockets()")
+			ie.Log.Info("Stop() calling ie.CloseSockets() to wake the Receivers")
 		}
-
 		ie.CloseSockets()
+
+		ie.Receivers.WG.Wait()
+
+		if ie.DebugLevel > 10 {
+			ie.Log.Info("Stop() ie.Receivers.WG.Wait() complete")
+		}
 	} else {
 		if ie.DebugLevel > 100 {
 			ie.Log.Info(fmt.Sprintf("Stop() fakeSuccess:%t not stopping receivers, and not closing sockets", fakeSuccess))
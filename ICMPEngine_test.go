@@ -445,6 +445,87 @@ func TestPinger(t *testing.T) {
 	}
 }
 
+// TestPingerBatch is the same as TestPinger, but with the batched recvmmsg/sendmmsg enabled
+func TestPingerBatch(t *testing.T) {
+	logger := hclog.Default()
+	logger.Info("\n\n======================================")
+
+	debugLevels := icmpengine.GetDebugLevels(testDebugLevel)
+
+	doneAll := make(chan struct{}, 2)
+	ie := icmpengine.NewFullConfig(logger, doneAll, 10*time.Millisecond, 500*time.Millisecond, false, 2, 2, false, debugLevels, fakeSuccesCst)
+	ie.SetBatchSize(icmpengine.BatchSizeCst)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	pDone := make(chan struct{}, 2)
+
+	for i, test := range getTests(10) {
+		if !test.expected {
+			continue
+		}
+		for _, IP := range test.IPs {
+			results := ie.Pinger(netaddr.MustParseIP(IP), icmpengine.Sequence(test.count), test.interval, true, pDone)
+			compareResults(t, logger, i, test, results)
+		}
+	}
+	doneAll <- struct{}{}
+	wg.Wait()
+}
+
+// TestPingerMultipleSockets pings several loopback addresses concurrently,
+// with multiple sockets per protocol, so the targets are spread across the sockets
+func TestPingerMultipleSockets(t *testing.T) {
+	logger := hclog.Default()
+	logger.Info("\n\n======================================")
+
+	debugLevels := icmpengine.GetDebugLevels(testDebugLevel)
+
+	doneAll := make(chan struct{}, 2)
+	ie := icmpengine.NewFullConfig(logger, doneAll, 100*time.Millisecond, 500*time.Millisecond, false, 1, 1, false, debugLevels, fakeSuccesCst)
+	ie.SetSocketsPerProtocol(4)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	if !fakeSuccesCst {
+		for _, p := range ie.Protocols {
+			ids := make(map[int]bool)
+			for _, id := range ie.Sockets.IDs[p] {
+				ids[id] = true
+			}
+			if len(ie.Sockets.Transports[p]) != 4 || len(ids) != 4 {
+				t.Errorf(fmt.Sprintf("TestPingerMultipleSockets proto:%d sockets:%d distinct ids:%d", p, len(ie.Sockets.Transports[p]), len(ids)))
+			}
+		}
+	}
+
+	IPs := []string{"::1"}
+	for i := 1; i <= 8; i++ {
+		IPs = append(IPs, fmt.Sprintf("127.0.0.%d", i))
+	}
+
+	pwg := new(sync.WaitGroup)
+	resultsCh := make(chan icmpengine.PingerResults, len(IPs))
+	for _, IP := range IPs {
+		pwg.Add(1)
+		go ie.PingerWithStatsChannel(netaddr.MustParseIP(IP), 10, 10*time.Millisecond, false, make(chan struct{}, 2), pwg, resultsCh)
+	}
+	pwg.Wait()
+	close(resultsCh)
+
+	for results := range resultsCh {
+		if results.Successes != 10 {
+			t.Errorf(fmt.Sprintf("TestPingerMultipleSockets [%s] successes:%d failures:%d", results.IP, results.Successes, results.Failures))
+		}
+	}
+	doneAll <- struct{}{}
+	wg.Wait()
+}
+
 // TestPingerWithStatsChannel tests the non-blocking pinger
 func TestPingerWithStatsChannel(t *testing.T) {
 	logger := hclog.Default()
@@ -551,6 +632,65 @@ func TestPingerWithStatsChannel(t *testing.T) {
 	}
 }
 
+// TestPingerLong runs the long duration (1s) tests on the FakeClock and the SimNetwork,
+// so the intervals take no real time, and the RTTs are exactly the simulated latency
+// Each IP gets its own engine, so the only timers are the Expirer's, the SimNetwork latency,
+// and the Pinger interval, like TestFakeClockLatency
+func TestPingerLong(t *testing.T) {
+	logger := hclog.Default()
+	logger.Info("\n\n======================================")
+
+	timeoutT := time.Hour
+	readDeadlineT := 500 * time.Millisecond
+	latency := time.Millisecond
+
+	for i, test := range getLongTests(10) {
+		logger.Info("======================================")
+		logger.Info(fmt.Sprintf("TestPingerLong \t i:%d \t test.i:%d \ttest.count:%d", i, test.i, test.count))
+
+		for _, IP := range test.IPs {
+
+			clock := icmpengine.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+			sim := icmpengine.NewSimNetwork(1, icmpengine.SimProfile{Latency: icmpengine.FixedLatency(latency)})
+			sim.Clock = clock
+
+			doneAll := make(chan struct{}, 2)
+			ie := icmpengine.NewFullConfigWithClock(logger, doneAll, timeoutT, readDeadlineT, false, 1, 1, false, test.debuglevels, false, clock)
+			ie.SetTransportFactory(sim.Factory)
+			ie.Start()
+			wg := new(sync.WaitGroup)
+			wg.Add(1)
+			go ie.Run(wg)
+
+			resultsCh := make(chan icmpengine.PingerResults, 1)
+			go func(IP netaddr.IP) {
+				resultsCh <- ie.Pinger(IP, icmpengine.Sequence(test.count), test.interval, false, make(chan struct{}))
+			}(netaddr.MustParseIP(IP))
+
+			// after each send, the timers are the SimNetwork latency and the Expirer
+			// after each reply, the Expirer timer is still set for the first probe, plus the Pinger interval
+			for j := 0; j < test.count; j++ {
+				clock.BlockUntil(2)
+				clock.Advance(latency)
+				clock.BlockUntil(2)
+				clock.Advance(test.interval - latency)
+			}
+			results := <-resultsCh
+
+			compareResults(t, logger, i, test, results)
+			if results.Min != latency || results.Max != latency {
+				t.Errorf(fmt.Sprintf("TestPingerLong IP:%s Min:%s Max:%s", IP, results.Min, results.Max))
+			}
+			if want := time.Duration(test.count) * test.interval; results.PingerDuration != want {
+				t.Errorf(fmt.Sprintf("TestPingerLong IP:%s PingerDuration:%s want:%s", IP, results.PingerDuration, want))
+			}
+
+			doneAll <- struct{}{}
+			wg.Wait()
+		}
+	}
+}
+
 // TestRunStopLoop tests starting the 'go ie.Run()'
 // and then sending done to close it down
 func TestRunStopLoop(t *testing.T) {
@@ -561,8 +701,11 @@ func TestRunStopLoop(t *testing.T) {
 	readDeadlineT := 500 * time.Millisecond
 	debugLevels := icmpengine.GetDebugLevels(10)
 
+	// the FakeClock, so the timers never hold up the shutdown
+	clock := icmpengine.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+
 	doneAll := make(chan struct{}, 2)
-	ie := icmpengine.NewFullConfig(logger, doneAll, timeoutT, readDeadlineT, false, 2, 2, false, debugLevels, fakeSuccesCst)
+	ie := icmpengine.NewFullConfigWithClock(logger, doneAll, timeoutT, readDeadlineT, false, 2, 2, false, debugLevels, fakeSuccesCst, clock)
 
 	for i := 0; i < 10; i++ {
 
@@ -887,6 +1030,64 @@ func TestPingerFakeSuccess(t *testing.T) {
 	}
 }
 
+// TestPingerSummaryOnly tests the SummaryOnly mode, which does not keep the RTTs
+// slice, but does keep the streaming statistics
+func TestPingerSummaryOnly(t *testing.T) {
+	logger := hclog.Default()
+	logger.Info("\n\n%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%%")
+
+	timeoutT := 10 * time.Millisecond
+	readDeadlineT := 500 * time.Millisecond
+	debugLevels := icmpengine.GetDebugLevels(10)
+	count := 1000
+	interval := 1 * time.Microsecond
+	ips := []string{`127.0.0.1`, `::1`, `127.0.0.2`}
+
+	doneAll := make(chan struct{}, 2)
+	ie := icmpengine.NewFullConfig(logger, doneAll, timeoutT, readDeadlineT, false, 2, 2, false, debugLevels, true)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	config := icmpengine.PingerConfigT{
+		SummaryOnly: true,
+	}
+
+	pDone := make(chan struct{}, 2)
+	pwg := new(sync.WaitGroup)
+	sCh := make(chan icmpengine.PingerResults, len(ips))
+
+	for _, IP := range ips {
+		destNetAddr, err := netaddr.ParseIP(IP)
+		if err != nil {
+			t.Errorf(fmt.Sprintf("TestPingerSummaryOnly netaddr.ParseIP(IP) failed:%v", err))
+		}
+		pwg.Add(1)
+		go ie.PingerWithConfigAndStatsChannel(destNetAddr, icmpengine.Sequence(count), interval, pDone, config, pwg, sCh)
+	}
+
+	for range ips {
+		results := <-sCh
+		if results.RTTs != nil {
+			t.Errorf(fmt.Sprintf("TestPingerSummaryOnly [%s] results.RTTs != nil, len:%d", results.IP, len(results.RTTs)))
+		}
+		if results.Stats.Count != uint64(results.Successes) {
+			t.Errorf(fmt.Sprintf("TestPingerSummaryOnly [%s] results.Stats.Count:%d != results.Successes:%d", results.IP, results.Stats.Count, results.Successes))
+		}
+		if results.Successes != count {
+			t.Errorf(fmt.Sprintf("TestPingerSummaryOnly [%s] results.Successes:%d != count:%d", results.IP, results.Successes, count))
+		}
+		if testDebugLevel > 10 {
+			logger.Info(fmt.Sprintf("TestPingerSummaryOnly:[%s] \tsuccesses:%d \tmin:%s \tp50:%s \tp99:%s \tmax:%s \tstddev:%s", results.IP.String(), results.Successes, results.Stats.Min, results.Stats.Quantile(0.5), results.Stats.Quantile(0.99), results.Stats.Max, results.Stats.StdDev()))
+		}
+	}
+
+	doneAll <- struct{}{}
+	pwg.Wait()
+	wg.Wait()
+}
+
 // TestIsRace is a tiny function to show the irace.go and norace.go functionality
 func TestIsRace(t *testing.T) {
 	logger := hclog.Default()
@@ -0,0 +1,154 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// MemTransport is the in-memory Transport shared by the SimNetwork and the ReplayNetwork
+//
+// The memTransport has the bounded receive queue ( the inbox ), like the socket receive
+// buffer, where the packets arriving when the queue is full are dropped, and counted as
+// Overflows.  The networks only differ in how Send schedules the deliveries for each echo
+// request, which is the memNetwork schedule(), and the delayed deliveries use the network Clock.
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"inet.af/netaddr"
+)
+
+// memNetwork is the in-memory network behind the memTransports
+type memNetwork interface {
+	// schedule returns the deliveries for the echo request to the IP, sent by the transport id
+	schedule(proto Protocol, id int, IP netaddr.IP, request []byte) (deliveries []simDelivery)
+	// counters returns the network's atomic counters
+	counters() memCounters
+	// clock returns the Clock for the delayed deliveries
+	clock() Clock
+	// local returns the local address for the protocol
+	local(proto Protocol) netaddr.IP
+}
+
+var _ memNetwork = (*SimNetwork)(nil)
+var _ memNetwork = (*ReplayNetwork)(nil)
+
+// memCounters points at the network's atomic counters, for the memTransport
+type memCounters struct {
+	sent      *uint64
+	invalid   *uint64
+	delivered *uint64
+	overflows *uint64
+}
+
+// memTransport is the Transport on a memNetwork, see the top of this file
+// name is the Transport type in the errors, e.g. SimTransport
+type memTransport struct {
+	Proto     Protocol
+	name      string
+	network   memNetwork
+	id        int
+	inbox     chan simPacket
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// init initializes the memTransport on the network, with the receive queue length
+func (t *memTransport) init(name string, proto Protocol, network memNetwork, id int, queueLen int) {
+	t.Proto = proto
+	t.name = name
+	t.network = network
+	t.id = id
+	t.inbox = make(chan simPacket, queueLen)
+	t.closed = make(chan struct{})
+}
+
+// Protocol implements Transport
+func (t *memTransport) Protocol() Protocol {
+	return t.Proto
+}
+
+// ID implements Transport
+func (t *memTransport) ID() int {
+	return t.id
+}
+
+// Addr implements Transport
+func (t *memTransport) Addr(IP netaddr.IP) net.Addr {
+	return IP.IPAddr()
+}
+
+// Send implements Transport, delivering the packets the network schedules for the echo request
+// Anything other than an echo request is counted as Invalid, and dropped
+func (t *memTransport) Send(b []byte, dst net.Addr) (err error) {
+
+	select {
+	case <-t.closed:
+		return fmt.Errorf("%s Send: %w", t.name, net.ErrClosed)
+	default:
+	}
+
+	counters := t.network.counters()
+	atomic.AddUint64(counters.sent, 1)
+	IP, ok := peerIP(dst)
+	if !ok || len(b) < EchoLenCst || b[0] != echoRequestType(t.Proto) {
+		atomic.AddUint64(counters.invalid, 1)
+		return nil
+	}
+
+	for _, d := range t.network.schedule(t.Proto, t.id, IP, b) {
+		if d.delay <= 0 {
+			t.deliver(d.packet)
+			continue
+		}
+		packet := d.packet
+		t.network.clock().AfterFunc(d.delay, func() { t.deliver(packet) })
+	}
+	return nil
+}
+
+// deliver queues the packet for Receive, dropping it if the queue is full, or the Transport is closed
+func (t *memTransport) deliver(packet simPacket) {
+	select {
+	case <-t.closed:
+		return
+	default:
+	}
+	counters := t.network.counters()
+	select {
+	case t.inbox <- packet:
+		atomic.AddUint64(counters.delivered, 1)
+	default:
+		atomic.AddUint64(counters.overflows, 1)
+	}
+}
+
+// Receive implements Transport
+func (t *memTransport) Receive(b []byte) (n int, peer net.Addr, err error) {
+	select {
+	case packet := <-t.inbox:
+		return copy(b, packet.b), packet.peer, nil
+	case <-t.closed:
+		return 0, nil, fmt.Errorf("%s Receive: %w", t.name, net.ErrClosed)
+	}
+}
+
+// Close implements Transport
+func (t *memTransport) Close() (err error) {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+// LocalAddr implements Transport
+func (t *memTransport) LocalAddr() net.Addr {
+	return t.network.local(t.Proto).IPAddr()
+}
+
+// Capabilities implements Transport
+// The network only delivers to the sending memTransport, like the kernel with the datagram sockets
+func (t *memTransport) Capabilities() TransportCapabilities {
+	return TransportCapabilities{
+		KernelID:  true,
+		Simulated: true,
+	}
+}
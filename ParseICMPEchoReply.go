@@ -6,10 +6,20 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"inet.af/netaddr"
 )
 
 var (
 	errMessageTooShort = errors.New("message too short")
+	errNotEchoReply    = errors.New("icmpengine: not an echo reply")
+	errEchoReplyCode   = errors.New("icmpengine: echo reply with non-zero code")
+	errICMPType        = errors.New("icmpengine: unsupported ICMP type")
+	errQuotedHeader    = errors.New("icmpengine: invalid quoted IP header")
+	errQuotedProtocol  = errors.New("icmpengine: quoted packet is not ICMP")
+	errQuotedNotEcho   = errors.New("icmpengine: quoted message is not an echo request")
 )
 
 // ICMPEchoReply represents Echo Reply messages
@@ -29,36 +39,149 @@ type ICMPEchoReply struct {
 // https://github.com/golang/net/blob/7fd8e65b6420/icmp/message.go#L139
 func ParseICMPEchoReply(b []byte) (*ICMPEchoReply, error) {
 
-	if len(b) < 8 {
-		return nil, errMessageTooShort
-	}
 	er := &ICMPEchoReply{}
-	br := bytes.NewReader(b)
-	err := binary.Read(br, binary.BigEndian, er)
-	if err != nil {
+	if err := ParseICMPEchoReplyTo(b, er); err != nil {
 		return nil, err
 	}
-
 	return er, nil
 }
 
+// ParseICMPEchoReplyTo is the zero allocation parser used by the Receivers, which
+// decodes directly from the pooled buffer into er, which can be on the stack
+// Originally this used binary.Read, which uses reflection, and allocated the
+// bytes.Reader and the ICMPEchoReply for every packet
+func ParseICMPEchoReplyTo(b []byte, er *ICMPEchoReply) error {
+
+	if len(b) < 8 {
+		return errMessageTooShort
+	}
+	if b[0] != uint8(ipv4.ICMPTypeEchoReply) && b[0] != uint8(ipv6.ICMPTypeEchoReply) {
+		return errNotEchoReply
+	}
+	if b[1] != 0 {
+		return errEchoReplyCode
+	}
+	parseEcho(b, er)
+	return nil
+}
+
+// parseEcho decodes the first 8 bytes of the echo message, which must be there
+func parseEcho(b []byte, er *ICMPEchoReply) {
+	er.Type = b[0]
+	er.Code = b[1]
+	er.Checksum = binary.BigEndian.Uint16(b[2:4])
+	er.Identifier = binary.BigEndian.Uint16(b[4:6])
+	er.Seq = binary.BigEndian.Uint16(b[6:8])
+}
+
+// ICMPMessage is either an echo reply, or an ICMP error quoting one of the echo requests
+// For the errors, Type and Code are the error's, Identifier and Seq are from the quoted
+// echo request, and Target is the quoted destination, which is the target pinged, rather than
+// the router which sent the error
+// EchoOffset is the offset of the echo reply, or the quoted echo request, in the message
+type ICMPMessage struct {
+	ICMPEchoReply
+	Error      bool
+	Target     netaddr.IP
+	EchoOffset int
+}
+
+// ParseICMPMessage is the unified parser for the echo replies and the ICMP errors, which
+// the simulated and replay Transports can deliver.  Like ParseICMPEchoReplyTo, it
+// decodes into m without allocating, and it never panics, whatever is in b
+//
+// The errors are destination unreachable, time exceeded, and parameter problem, and for IPv6
+// packet too big.  The quoted header must be the same IP version, without IPv6 extension
+// headers, and must carry at least the 8 byte header of an echo request
+//
+// errICMPType is returned for any other type, e.g. redirects, or our own echo requests seen
+// on a raw socket, so the caller can count those separately from the malformed messages
+func ParseICMPMessage(proto Protocol, b []byte, m *ICMPMessage) error {
+
+	*m = ICMPMessage{}
+	if len(b) < 8 {
+		return errMessageTooShort
+	}
+	if b[0] == echoReplyType(proto) {
+		if b[1] != 0 {
+			return errEchoReplyCode
+		}
+		parseEcho(b, &m.ICMPEchoReply)
+		return nil
+	}
+	if !icmpErrorType(proto, b[0]) {
+		return errICMPType
+	}
+
+	inner := b[8:]
+	if proto == Protocol(6) {
+		if len(inner) < IPv6HeaderLenCst || inner[0]>>4 != 6 {
+			return errQuotedHeader
+		}
+		if inner[6] != ProtocolICMPv6Cst {
+			return errQuotedProtocol
+		}
+		var dst [16]byte
+		copy(dst[:], inner[24:40])
+		m.Target = netaddr.IPv6Raw(dst)
+		m.EchoOffset = 8 + IPv6HeaderLenCst
+	} else {
+		var h IPv4Header
+		if ParseIPv4Header(inner, &h) != nil {
+			return errQuotedHeader
+		}
+		if h.Protocol != ProtocolICMPCst {
+			return errQuotedProtocol
+		}
+		m.Target = h.Dst
+		m.EchoOffset = 8 + h.Len
+	}
+
+	echo := b[m.EchoOffset:]
+	if len(echo) < 8 {
+		return errMessageTooShort
+	}
+	if echo[0] != echoRequestType(proto) {
+		return errQuotedNotEcho
+	}
+	parseEcho(echo, &m.ICMPEchoReply)
+	m.Type = b[0]
+	m.Code = b[1]
+	m.Checksum = binary.BigEndian.Uint16(b[2:4])
+	m.Error = true
+	return nil
+}
+
+// icmpErrorType returns if the ICMP type is one of the errors which quote the original packet
+func icmpErrorType(proto Protocol, t uint8) bool {
+	if proto == Protocol(6) {
+		switch ipv6.ICMPType(t) {
+		case ipv6.ICMPTypeDestinationUnreachable, ipv6.ICMPTypePacketTooBig, ipv6.ICMPTypeTimeExceeded, ipv6.ICMPTypeParameterProblem:
+			return true
+		}
+		return false
+	}
+	switch ipv4.ICMPType(t) {
+	case ipv4.ICMPTypeDestinationUnreachable, ipv4.ICMPTypeTimeExceeded, ipv4.ICMPTypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// echoReplyType returns the ICMP echo reply type for the protocol
+func echoReplyType(proto Protocol) uint8 {
+	if proto == Protocol(6) {
+		return uint8(ipv6.ICMPTypeEchoReply)
+	}
+	return uint8(ipv4.ICMPTypeEchoReply)
+}
+
 // ParseICMPEchoReplyBB is the same as ParseICMPEchoReply, except
 // uses bytes.Buffer, instead of []byte
 // This is mostly to allow use of sync.Pool, which should be faster (maybe?)
 // https://www.akshaydeo.com/blog/2017/12/23/How-did-I-improve-latency-by-700-percent-using-syncPool/
 func ParseICMPEchoReplyBB(b bytes.Buffer) (*ICMPEchoReply, error) {
-
-	if b.Len() < 8 {
-		return nil, errMessageTooShort
-	}
-	er := &ICMPEchoReply{}
-	br := bytes.NewReader(b.Bytes())
-	err := binary.Read(br, binary.BigEndian, er)
-	if err != nil {
-		return nil, err
-	}
-
-	return er, nil
+	return ParseICMPEchoReply(b.Bytes())
 }
 
 // IPv4
@@ -0,0 +1,85 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+// TestParseICMPMessage checks the echo replies, the ICMP errors with the quoted headers,
+// and that the malformed messages are rejected with the right errors
+func TestParseICMPMessage(t *testing.T) {
+
+	local4 := netaddr.MustParseIP("198.51.100.1")
+	local6 := netaddr.MustParseIP("2001:db8::ff")
+	target4 := netaddr.MustParseIP("192.0.2.1")
+	target6 := netaddr.MustParseIP("2001:db8::1")
+	request4 := NewEchoTemplate(Protocol(4), 0x1234).Put(make([]byte, EchoLenCst), 5)
+	request6 := NewEchoTemplate(Protocol(6), 0x1234).Put(make([]byte, EchoLenCst), 6)
+	error4 := icmpErrorMessage(Protocol(4), local4, target4, request4)
+	error6 := icmpErrorMessage(Protocol(6), local6, target6, request6)
+
+	// the quoted IPv4 header with 4 bytes of options
+	options4 := append([]byte{3, 1, 0, 0, 0, 0, 0, 0}, rawIPv4Packet(4, request4)...)
+
+	notICMP := append([]byte(nil), error4...)
+	notICMP[8+9] = 17
+	quotedReply := append([]byte(nil), error6...)
+	quotedReply[8+IPv6HeaderLenCst] = echoReplyType(Protocol(6))
+	replyCode := echoReply(Protocol(4), request4)
+	replyCode[1] = 1
+
+	tests := []struct {
+		name   string
+		proto  Protocol
+		b      []byte
+		err    error
+		error  bool
+		target netaddr.IP
+		seq    uint16
+	}{
+		{name: "reply4", proto: 4, b: echoReply(Protocol(4), request4), seq: 5},
+		{name: "reply6", proto: 6, b: echoReply(Protocol(6), request6), seq: 6},
+		{name: "error4", proto: 4, b: error4, error: true, target: target4, seq: 5},
+		{name: "error6", proto: 6, b: error6, error: true, target: target6, seq: 6},
+		{name: "error4 options", proto: 4, b: options4, error: true, target: netaddr.MustParseIP("192.0.2.2"), seq: 5},
+		{name: "reply6 on 4", proto: 4, b: echoReply(Protocol(6), request6), err: errICMPType},
+		{name: "request4", proto: 4, b: request4, err: errICMPType},
+		{name: "reply code", proto: 4, b: replyCode, err: errEchoReplyCode},
+		{name: "short", proto: 4, b: request4[:7], err: errMessageTooShort},
+		{name: "error4 truncated header", proto: 4, b: error4[:8+IPv4HeaderLenCst-1], err: errQuotedHeader},
+		{name: "error4 truncated echo", proto: 4, b: error4[:len(error4)-EchoLenCst+4], err: errMessageTooShort},
+		{name: "error6 truncated header", proto: 6, b: error6[:8+IPv6HeaderLenCst-1], err: errQuotedHeader},
+		{name: "error4 not ICMP", proto: 4, b: notICMP, err: errQuotedProtocol},
+		{name: "error6 quoted reply", proto: 6, b: quotedReply, err: errQuotedNotEcho},
+	}
+	for _, test := range tests {
+		var m ICMPMessage
+		err := ParseICMPMessage(test.proto, test.b, &m)
+		if !errors.Is(err, test.err) {
+			t.Errorf(fmt.Sprintf("TestParseICMPMessage %s err:%v want:%v", test.name, err, test.err))
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if m.Error != test.error || m.Target != test.target || m.Seq != test.seq || m.Identifier != 0x1234 {
+			t.Errorf(fmt.Sprintf("TestParseICMPMessage %s m:%+v", test.name, m))
+		}
+		if m.Type != test.b[0] || m.Code != test.b[1] {
+			t.Errorf(fmt.Sprintf("TestParseICMPMessage %s Type:%d Code:%d", test.name, m.Type, m.Code))
+		}
+	}
+
+	// ParseICMPEchoReply only accepts the echo replies
+	if _, err := ParseICMPEchoReply(error4); !errors.Is(err, errNotEchoReply) {
+		t.Errorf(fmt.Sprintf("TestParseICMPMessage ParseICMPEchoReply error4 err:%v", err))
+	}
+	if er, err := ParseICMPEchoReply(echoReply(Protocol(6), request6)); err != nil || er.Seq != 6 {
+		t.Errorf(fmt.Sprintf("TestParseICMPMessage ParseICMPEchoReply er:%+v err:%v", er, err))
+	}
+}
@@ -3,19 +3,18 @@
 package icmpengine
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"inet.af/netaddr"
 
-	"container/list"
-	"log"
 	"net"
-	"syscall"
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
@@ -25,9 +24,46 @@ import (
 const (
 	PingerFractionModulo = 10
 
+	// SummaryChannelSizeCst is the success/expired channel size in SummaryOnly mode
+	// Each probe results in exactly one success or expiry, and the Pinger consumes
+	// the result before sending the next probe, so these don't need to be large
+	SummaryChannelSizeCst = 4
+
 	PdebugLevel = 111
 )
 
+// PingerConfigT holds the per Pinger options
+// SummaryOnly does NOT keep the RTTs slice, and instead only keeps the constant memory
+// streaming statistics in PingerResults.Stats, which allows probing large numbers of
+// targets with large packet counts
+// Rolling is optional, and if set, is updated for every probe, so the caller
+// can Snapshot() the last 1/5/15 minutes while the Pinger is running
+// AdaptiveTimeout uses the per target RTTEstimator RTO for each probe expiry,
+// clamped between TimeoutFloor ( default AdaptiveTimeoutFloorCst ) and
+// TimeoutCeiling ( default ie.Timeout ).  Only the AdaptiveTimeout Pingers update
+// the estimator
+// QueueSize is the size of the Session result queues ( default packets, or
+// SummaryChannelSizeCst for SummaryOnly ), and Overflow is the DispatchPolicy
+// when a queue is full, see Dispatch.go
+// Seed is the seed for the DropProb random source, where zero takes a seed from the
+// engine source, see Random.go, so zero can't be used as a fixed seed.  PingerResults.Seed
+// is the seed actually used, which is the chosen seed when Seed is zero, and is only set
+// with a DropProb, because the random source isn't created otherwise
+// Faults is an optional FaultPolicy for the replies to this Pinger, see Faults.go
+type PingerConfigT struct {
+	SortRTTs        bool
+	DropProb        float64
+	Seed            int64
+	SummaryOnly     bool
+	Rolling         *RollingStats
+	AdaptiveTimeout bool
+	TimeoutFloor    time.Duration
+	TimeoutCeiling  time.Duration
+	QueueSize       int
+	Overflow        DispatchPolicy
+	Faults          *FaultPolicy
+}
+
 type PingerResults struct {
 	IP             netaddr.IP
 	Successes      int
@@ -41,6 +77,8 @@ type PingerResults struct {
 	Variance       time.Duration
 	Sum            time.Duration
 	PingerDuration time.Duration
+	Stats          *StreamingStats
+	Seed           int64
 }
 
 // PingerWithStatsChannel is the Pinger which sends stats on the output channel, rather than returning the values
@@ -63,6 +101,19 @@ func (ie *ICMPEngine) PingerWithStatsChannel(IP netaddr.IP, packets Sequence, in
 	}
 }
 
+// PingerWithConfigAndStatsChannel is the PingerWithStatsChannel, but with PingerConfigT options
+func (ie *ICMPEngine) PingerWithConfigAndStatsChannel(IP netaddr.IP, packets Sequence, interval time.Duration, DoneCh chan struct{}, config PingerConfigT, wg *sync.WaitGroup, pingerResultsCh chan<- PingerResults) {
+
+	defer wg.Done()
+
+	results := ie.PingerWithConfig(IP, packets, interval, DoneCh, config)
+
+	if ie.Pingers.DebugLevel > 100 {
+		ie.Log.Info(fmt.Sprintf("PingerWithConfigAndStatsChannel recieved results, sending on channel:\t%s", IP.String()))
+	}
+	pingerResultsCh <- results
+}
+
 // Pinger calls PingerConfig with:
 // - zero (0) probability of drop,
 // - no fake success
@@ -86,11 +137,71 @@ func (ie *ICMPEngine) Pinger(IP netaddr.IP, packets Sequence, interval time.Dura
 // Welford's one-pass algorithm for computing the mean and variance
 // of a set of numbers. For more information see Knuth (TAOCP Vol 2, 3rd ed, pg 232)
 func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval time.Duration, sortRTTs bool, DoneCh chan struct{}, dropProb float64) (results PingerResults) {
+	config := PingerConfigT{
+		SortRTTs: sortRTTs,
+		DropProb: dropProb,
+	}
+	results = ie.PingerWithConfig(IP, packets, interval, DoneCh, config)
+	return
+}
+
+// PingerWithConfig is the main Pinger, with the options in PingerConfigT
+// When the admission limits are reached, PingerWithConfig waits for capacity, see Admission.go
+func (ie *ICMPEngine) PingerWithConfig(IP netaddr.IP, packets Sequence, interval time.Duration, DoneCh chan struct{}, config PingerConfigT) (results PingerResults) {
+	results, _ = ie.pinger(context.Background(), true, IP, packets, interval, DoneCh, config)
+	return results
+}
+
+// PingerWithContext is the PingerWithConfig, which waits for the admission limits until
+// the context is done, and is also stopped when the context is done
+// err is the context error if the context is done, or ErrPingerStopped if the Pinger is
+// stopped before it was admitted
+func (ie *ICMPEngine) PingerWithContext(ctx context.Context, IP netaddr.IP, packets Sequence, interval time.Duration, DoneCh chan struct{}, config PingerConfigT) (results PingerResults, err error) {
+	return ie.pinger(ctx, true, IP, packets, interval, DoneCh, config)
+}
+
+// TryPingerWithConfig is the PingerWithConfig, which returns ErrEngineBusy immediately when the
+// admission limits are reached, either at the start, or for any of the probes
+func (ie *ICMPEngine) TryPingerWithConfig(IP netaddr.IP, packets Sequence, interval time.Duration, DoneCh chan struct{}, config PingerConfigT) (results PingerResults, err error) {
+	return ie.pinger(context.Background(), false, IP, packets, interval, DoneCh, config)
+}
+
+// pinger is the Pinger implementation, with the admission control, see Admission.go
+// block waits for the admission limits, otherwise ErrEngineBusy is returned
+func (ie *ICMPEngine) pinger(ctx context.Context, block bool, IP netaddr.IP, packets Sequence, interval time.Duration, DoneCh chan struct{}, config PingerConfigT) (results PingerResults, err error) {
 
 	if ie.Pingers.DebugLevel > 100 {
 		ie.Log.Info(fmt.Sprintf("Pinger started:\t[%s]", IP.String()))
 	}
 
+	// The Pinger is in the Pingers.WG, so Stop() waits for it before stopping the Writers,
+	// unless Stop() has already closed the done channel, so the Pinger is about to return
+	ie.Lock()
+	pingersAllDone := ie.Pingers.DoneCh
+	select {
+	case <-pingersAllDone:
+	default:
+		ie.Pingers.WG.Add(1)
+		defer ie.Pingers.WG.Done()
+	}
+	ie.Unlock()
+	ctxDone := ctx.Done()
+
+	results.IP = IP
+	if err = ie.admitSession(ctx, block, IP, DoneCh, pingersAllDone); err != nil {
+		if ie.Pingers.DebugLevel > 10 {
+			ie.Log.Info(fmt.Sprintf("Pinger [%s] not admitted err:%v", IP.String(), err))
+		}
+		return results, err
+	}
+	defer ie.releaseSession(IP)
+
+	// outstanding is the probes admitted, and not yet released
+	var outstanding int
+	defer func() {
+		ie.releaseProbes(outstanding)
+	}()
+
 	var proto Protocol
 	if IP.Is4() {
 		proto = Protocol(4)
@@ -104,27 +215,90 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 		ie.Log.Info(fmt.Sprintf("Pinger [%s] Trying to acquire lock at start", IP.String()))
 	}
 
-	successCh := make(chan PingSuccess, int(packets))
-	expiredCh := make(chan PingExpired, int(packets))
+	chSize := int(packets)
+	if config.SummaryOnly {
+		chSize = SummaryChannelSizeCst
+	}
+	if config.QueueSize > 0 {
+		chSize = config.QueueSize
+	}
+	session := newSession(IP, chSize, config.Overflow, DoneCh)
+	// The session fault policy takes precedence over any target policy, see Faults.go
+	if config.Faults != nil {
+		ie.initFaultPolicy(config.Faults)
+		session.Faults = config.Faults
+		atomic.AddInt32(&ie.Faults.active, 1)
+		defer atomic.AddInt32(&ie.Faults.active, -1)
+	}
+	successCh := session.SuccessCh
+	expiredCh := session.ExpiredCh
+
+	shard := ie.shard(IP)
+	shard.Lock()
+	shard.Sessions[IP] = session
+	_, exists := shard.Pings[IP]
+	if !exists {
+		shard.Pings[IP] = make(map[Sequence]*ExpiryEntry)
+	}
+	shard.Unlock()
 
 	ie.Lock()
 	fakeSuccess := ie.Expirers.FakeSuccess
-	socket := ie.Sockets.Sockets[proto]
+	// The target always uses the same Transport, and the Transport's identifier
+	var transport Transport
+	var writer chan writeRequest
+	writerDone := ie.Writers.DoneCh
 	id := ie.PID
-	ie.Pingers.SuccessChs[IP] = successCh
-	ie.Pingers.ExpiredChs[IP] = expiredCh
-	ie.Pingers.DonesChs[IP] = DoneCh
-	pingersAllDone := ie.Pingers.DoneCh
+	if len(ie.Sockets.Transports[proto]) > 0 {
+		sock := socketIndex(IP, len(ie.Sockets.Transports[proto]))
+		transport = ie.Sockets.Transports[proto][sock]
+		id = ie.Sockets.IDs[proto][sock]
+		if sock < len(ie.Writers.Chs[proto]) {
+			writer = ie.Writers.Chs[proto][sock]
+		}
+	}
+	timeoutDefault := ie.Timeout
+	// only the adaptive Pingers use and update the estimator, so the losses of a fixed
+	// timeout Pinger don't back off the RTO for the adaptive Pingers to the same target
+	var estimator *RTTEstimator
+	if config.AdaptiveTimeout {
+		estimator = ie.getRTTEstimator(IP)
+	}
+	timeoutFloor := config.TimeoutFloor
+	if timeoutFloor == 0 {
+		timeoutFloor = AdaptiveTimeoutFloorCst
+	}
+	timeoutCeiling := config.TimeoutCeiling
+	if timeoutCeiling == 0 {
+		timeoutCeiling = ie.Timeout
+	}
 	ie.Unlock()
 
 	if ie.Pingers.DebugLevel > 100 {
 		ie.Log.Info(fmt.Sprintf("Pinger [%s] Unlocked", IP.String()))
 	}
 
-	results.IP = IP
-	results.RTTs = make([]time.Duration, int(packets))
+	// The echo request template, address, and buffer are created once, so the
+	// probes don't allocate, see EchoTemplate.go
+	template := NewEchoTemplate(proto, id)
+	var addr net.Addr
+	if transport != nil {
+		addr = transport.Addr(IP)
+	}
+	var wbBuf [EchoLenCst]byte
 
-	startTime := time.Now()
+	results.Stats = NewStreamingStats()
+	if !config.SummaryOnly {
+		results.RTTs = make([]time.Duration, int(packets))
+	}
+
+	// the random source is only needed for the fake drops, so isn't created otherwise
+	var dropRand *rand.Rand
+	if config.DropProb > 0 {
+		dropRand, results.Seed = ie.pingerRand(config.Seed)
+	}
+
+	startTime := ie.Clock.Now()
 
 	var expirerStarted int
 	var expirerRunning int
@@ -132,34 +306,57 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 	// i is uint16, because ICMP sequence number is only 16 bits
 	for i, keepLooping := Sequence(0), true; i < packets && keepLooping; i++ {
 
-		loopStartTime := time.Now()
-		fakeDrop := FakeDrop(dropProb)
+		loopStartTime := ie.Clock.Now()
+		fakeDrop := dropRand != nil && FakeDropRand(dropRand, config.DropProb)
 
 		if ie.Pingers.DebugLevel > 100 {
 			ie.Log.Info("-------------------------------------------------")
 			ie.Log.Info(fmt.Sprintf("Pinger [%s] \t i:%d \t packets:%d \t proto:%d \t keepLooping:%t \t fakeDrop:%t \t fakeSucces:%t", IP.String(), i, int(packets), proto, keepLooping, fakeDrop, fakeSuccess))
 		}
 
-		var addr *net.UDPAddr
 		var wb []byte
-		var merr error
 		if !fakeSuccess || fakeDrop {
-			msg := buildICMPMessage(id, i, proto)
-			addr = &net.UDPAddr{IP: IP.IPAddr().IP, Port: 0}
-			wb, merr = msg.Marshal(nil)
-			if merr != nil {
-				log.Fatal(fmt.Sprintf("Pinger [%s] msg.Marshal(nil):%v", IP.String(), merr))
+			wb = template.Put(wbBuf[:], i)
+		}
+
+		if err = ie.admitProbe(ctx, block, DoneCh, pingersAllDone); err != nil {
+			if ie.Pingers.DebugLevel > 10 {
+				ie.Log.Info(fmt.Sprintf("Pinger [%s] i:%d\t probe not admitted err:%v", IP.String(), i, err))
+			}
+			if err == ErrPingerStopped {
+				// the same as being stopped in the select below
+				err = nil
 			}
+			break
+		}
+		outstanding++
+
+		// Wait in the send queue, when rate limited, BEFORE the send time, so the
+		// queueing delay is not included in the RTT, see RateLimit.go
+		if !ie.waitSend(IP, DoneCh, pingersAllDone, ctxDone) {
+			err = ctx.Err()
+			if ie.Pingers.DebugLevel > 10 {
+				ie.Log.Info(fmt.Sprintf("Pinger [%s] i:%d\t done while waiting in the send queue", IP.String(), i))
+			}
+			break
 		}
 
 		if ie.Pingers.DebugLevel > 100 {
-			ie.Log.Info(fmt.Sprintf("Pinger [%s] Trying to acquire lock, to PushBack(*ps)", IP.String()))
+			ie.Log.Info(fmt.Sprintf("Pinger [%s] Trying to acquire shard lock, to insertExpiry(*ps)", IP.String()))
 		}
-		ie.Lock() // <---------------------- LOCK!!
+		shard.Lock() // <------------------- LOCK!!
 
-		// time.Now() AFTER we have acquired the lock, because it could take time to acquire
-		send := time.Now()
-		expiry := send.Add(ie.Timeout)
+		// Clock.Now() AFTER we have acquired the lock, because it could take time to acquire
+		send := ie.Clock.Now()
+		timeout := timeoutDefault
+		if config.AdaptiveTimeout {
+			timeout = estimator.Timeout(timeoutFloor, timeoutCeiling)
+		}
+		expiry := send.Add(timeout)
+		if fakeSuccess && !fakeDrop {
+			// the Expirer fakes the success as soon as the ping expires, so expire immediately
+			expiry = send
+		}
 		ps := &Pings{
 			NetaddrIP: IP,
 			Seq:       i,
@@ -168,25 +365,24 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 			FakeDrop:  fakeDrop,
 		}
 
-		if i == Sequence(0) {
-			_, exists := ie.Pingers.Pings[IP]
-			if !exists {
-				ie.Pingers.Pings[IP] = make(map[Sequence]*list.Element)
-			}
-		}
-		ie.Pingers.Pings[IP][i] = ie.Pingers.ExpiresDLL.PushBack(*ps)
+		shard.Pings[IP][i] = ie.insertExpiry(shard, *ps)
 
-		if ie.CheckExpirerIsRunning() {
+		if ie.CheckExpirerIsRunning(shard) {
 			expirerStarted++
 		} else {
 			expirerRunning++
 		}
 		// Please note we must unlock AFTER we ie.CheckExpirerIsRunning()
 
-		ie.Unlock() // <-------------------- UNLOCK!!
+		shard.Unlock() // <----------------- UNLOCK!!
+
+		ie.Counters.Sent(IP)
+		if config.Rolling != nil {
+			config.Rolling.Sent(send)
+		}
 
 		if ie.Pingers.DebugLevel > 100 {
-			ie.Log.Info(fmt.Sprintf("Pinger [%s] ie.Unlock()", IP.String()))
+			ie.Log.Info(fmt.Sprintf("Pinger [%s] shard.Unlock()", IP.String()))
 		}
 
 		if ie.Pingers.DebugLevel > 100 {
@@ -207,7 +403,7 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 					ie.Log.Info(fmt.Sprintf("Pinger [%s] \t WriteTo len(wb):%d", IP.String(), len(wb)))
 				}
 
-				WriteTo(wb, addr, socket, ie.Pingers.DebugLevel, ie.Log)
+				ie.send(IP, i, wb, addr, transport, writer, writerDone)
 			}
 		}
 
@@ -216,40 +412,25 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 		}
 		select {
 		case ps := <-successCh:
+			outstanding--
+			ie.releaseProbes(1)
 			if ie.Pingers.DebugLevel > 100 {
 				ie.Log.Info(fmt.Sprintf("Pinger [%s] <-ie.SuccessChs[IP]\ti:%d", IP.String(), i))
 			}
 			val := ps.RTT
 
-			if ie.Pingers.DebugLevel > 100 {
-				ie.Log.Info(fmt.Sprintf("Pinger [%s] results.RTTs:%s", IP.String(), results.RTTs))
+			// the RTTs, Min/Max, and Welford's mean and variance, see Results.go
+			results.AddSuccess(i, val)
+			if config.AdaptiveTimeout {
+				estimator.Sample(val)
 			}
-			results.RTTs[i] = val
-			results.Sum += val
-			//{--------------------
-			// Welford's starts
-			if results.Successes == 0 {
-				results.Min = val
-				results.Max = val
-			} else {
-				if val < results.Min {
-					results.Min = val
-				}
-				if val > results.Max {
-					results.Max = val
-				}
+			ie.Counters.Received(IP, ps.Seq, val)
+			if config.Rolling != nil {
+				config.Rolling.Success(ps.Received, val)
 			}
-			results.Successes++
-			oldMean := results.Mean
-			results.Mean += time.Duration(float64(val-oldMean) / float64(results.Successes))
-			//s.s += (val - old_mean) * (val - s.mean)
-			// I'm doing something incorrectly with the variance conversions
-			results.Variance += time.Duration(((val.Seconds() - oldMean.Seconds()) * (val.Seconds() - results.Mean.Seconds()))) * time.Second
 			if ie.Pingers.DebugLevel > 1000 {
-				ie.Log.Info(fmt.Sprintf("Pinger [%s] \ti:%d \tval:%s \tMean:%s \toldMean:%s", IP.String(), i, val.String(), results.Mean.String(), oldMean.String()))
+				ie.Log.Info(fmt.Sprintf("Pinger [%s] \ti:%d \tval:%s \tMean:%s", IP.String(), i, val.String(), results.Mean.String()))
 			}
-			// Welford's ends
-			//}--------------------
 
 			if ie.Pingers.DebugLevel > 100 {
 				if i%(packets/PingerFractionModulo) == 0 {
@@ -263,12 +444,21 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 				}
 			}
 		case pe := <-expiredCh:
+			outstanding--
+			ie.releaseProbes(1)
 			if ie.Pingers.DebugLevel > 100 {
 				ie.Log.Info(fmt.Sprintf("Pinger [%s] <-ie.ExpiredChs[IP]\ti:%d", IP.String(), i))
 			}
-			results.Failures++
+			results.AddFailure()
+			if config.AdaptiveTimeout {
+				estimator.Backoff(timeoutCeiling)
+			}
+			ie.Counters.Lost(IP)
+			if config.Rolling != nil {
+				config.Rolling.Expired(ie.Clock.Now())
+			}
 			if ie.Pingers.DebugLevel > 10 {
-				ie.Log.Info(fmt.Sprintf("Pinger [%s] \t i:%d \t Seq:%d \t Expired/Timed-out after:%s", IP.String(), i, pe.Seq, ie.Timeout.String()))
+				ie.Log.Info(fmt.Sprintf("Pinger [%s] \t i:%d \t Seq:%d \t Expired/Timed-out after:%s", IP.String(), i, pe.Seq, ie.Clock.Now().Sub(pe.Send).String()))
 			}
 		case <-DoneCh:
 			keepLooping = false
@@ -280,6 +470,12 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 			if ie.Pingers.DebugLevel > 10 {
 				ie.Log.Info(fmt.Sprintf("Pinger [%s] i:%d\t <-ie.Pingers.DoneCh", IP.String(), i))
 			}
+		case <-ctxDone:
+			keepLooping = false
+			err = ctx.Err()
+			if ie.Pingers.DebugLevel > 10 {
+				ie.Log.Info(fmt.Sprintf("Pinger [%s] i:%d\t <-ctx.Done()", IP.String(), i))
+			}
 			// NO DEFAULT - This is a BLOCKING select
 			//default:
 		}
@@ -295,14 +491,15 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 		}
 
 		if keepLooping {
-			loopEndTime := time.Now()
+			loopEndTime := ie.Clock.Now()
 			loopDuration := loopEndTime.Sub(loopStartTime)
 			sleepDuration := interval - loopDuration
 			if ie.Pingers.DebugLevel > 100 {
 				ie.Log.Info(fmt.Sprintf("Pinger [%s] \t i:%d \t  \t loopDuration:%s\t sleepDuration:%s", IP.String(), i, loopDuration.String(), sleepDuration.String()))
 			}
+			timer := ie.Clock.NewTimer(sleepDuration)
 			select {
-			case <-time.After(sleepDuration):
+			case <-timer.Chan():
 				if ie.Pingers.DebugLevel > 100 {
 					ie.Log.Info(fmt.Sprintf("Pinger [%s] \t i:%d \t wakes up", IP.String(), i))
 				}
@@ -316,9 +513,13 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 				if ie.Pingers.DebugLevel > 10 {
 					ie.Log.Info(fmt.Sprintf("Pinger [%s] \t i:%d \t <-ie.Pingers.DoneCh", IP.String(), i))
 				}
+			case <-ctxDone:
+				keepLooping = false
+				err = ctx.Err()
 				// NO DEFAULT - This is a BLOCKING select
 				//default:
 			}
+			timer.Stop()
 		}
 	}
 
@@ -326,7 +527,7 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 	// https://golang.org/pkg/math/big/#pkg-overview
 	//bigInt := &big.Int{}
 
-	endTime := time.Now()
+	endTime := ie.Clock.Now()
 	results.PingerDuration = endTime.Sub(startTime)
 
 	results.Count = results.Successes + results.Failures
@@ -343,27 +544,38 @@ func (ie *ICMPEngine) PingerConfig(IP netaddr.IP, packets Sequence, interval tim
 		ie.Log.Info(fmt.Sprintf("Pinger [%s] \tmin:%s \tmax:%s \tmean:%s \tvariance:%s \tsum:%s \tPingerDuration:%s", IP.String(), results.Min.String(), results.Max.String(), results.Mean.String(), results.Variance.String(), results.Sum.String(), results.PingerDuration.String()))
 	}
 
-	if sortRTTs {
+	if config.SortRTTs && !config.SummaryOnly {
 		sort.Slice(results.RTTs, func(i, j int) bool { return results.RTTs[i] < results.RTTs[j] })
 	}
 
 	if EdebugLevel > 10 {
-		ie.Log.Info(fmt.Sprintf("Pinger [%s] \t Acquiring ie.Lock() to delete", IP.String()))
+		ie.Log.Info(fmt.Sprintf("Pinger [%s] \t Acquiring shard.Lock() to delete", IP.String()))
+	}
+	shard.Lock()
+	for _, el := range shard.Pings[IP] {
+		shard.Expiries.Remove(el)
+	}
+	delete(shard.Pings, IP)
+	if shard.Sessions[IP] == session {
+		delete(shard.Sessions, IP)
+	}
+	shard.Unlock()
+	// Any results still being delivered are counted and dropped
+	session.close()
+	if ie.Pingers.DebugLevel > 10 {
+		ie.Log.Info(fmt.Sprintf("Pinger [%s] Session dropped:%d late:%d", IP.String(), atomic.LoadUint64(&session.Dropped), atomic.LoadUint64(&session.Late)))
 	}
-	ie.Lock()
-	delete(ie.Pingers.Pings, IP)
-	delete(ie.Pingers.SuccessChs, IP)
-	delete(ie.Pingers.ExpiredChs, IP)
-	delete(ie.Pingers.DonesChs, IP)
-	ie.Unlock()
 	ie.Log.Info(fmt.Sprintf("Pinger [%s] Map keys deleted, and lock released, returning", IP.String()))
 
-	return results
+	return results, err
 }
 
 // FakeDrop is a simple function to return true based on a probability
 // Looking at this issue, I'm not sure if this is perfect, but should be ok
 // https://github.com/golang/go/issues/12290
+//
+// Deprecated: FakeDrop uses the global rand, so the drops can't be replayed.  Use FakeDropRand,
+// with a seeded source, like the Pingers, see Random.go
 func FakeDrop(dropProb float64) (drop bool) {
 
 	if dropProb > 0 {
@@ -375,7 +587,12 @@ func FakeDrop(dropProb float64) (drop bool) {
 }
 
 // WriteTo performs the socket write, and does error handling
-func WriteTo(wb []byte, addr *net.UDPAddr, socket *icmp.PacketConn, debugLevel int, logger hclog.Logger) {
+// The write error is returned, rather than being fatal, so the caller can count it,
+// and back off for ENOBUFS, see RateLimit.go, and a short write returns errShortWrite
+//
+// Deprecated: the engine sends with the Transport Send, see Transport.go.  Use the
+// DatagramTransport or RawTransport Send.
+func WriteTo(wb []byte, addr *net.UDPAddr, socket *icmp.PacketConn, debugLevel int, logger hclog.Logger) (err error) {
 
 	var bw int
 	var we error
@@ -384,18 +601,15 @@ func WriteTo(wb []byte, addr *net.UDPAddr, socket *icmp.PacketConn, debugLevel i
 		if debugLevel > 100 {
 			logger.Error(fmt.Sprintf("Pinger [%s] \t Writer bytes error:%s", addr.IP.String(), we))
 		}
-		if neterr, ok := we.(*net.OpError); ok {
-			if neterr.Err == syscall.ENOBUFS {
-				log.Fatal(neterr)
-			}
-		}
+		return we
 	}
 	if bw != len(wb) {
-		log.Fatal("Pinger WriteTo error. Bytes sent does not match packet length.")
+		return fmt.Errorf("Pinger WriteTo to:%s %w", addr, errShortWrite)
 	}
 	if debugLevel > 100 {
 		logger.Info(fmt.Sprintf("Pinger [%s] WriteTo bytes written:%d \t len(wb):%d \t to:[%s]", addr.IP.String(), bw, len(wb), (socket).LocalAddr()))
 	}
+	return nil
 }
 
 // buildICMPMessage builds the icmp.Echo message body and the icmp.Message
@@ -0,0 +1,151 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// RTTEstimator is the TCP style smoothed RTT estimator
+// https://datatracker.ietf.org/doc/html/rfc6298
+//
+// The estimators are per target, and are kept by the ICMPEngine across Pingers,
+// so a new Pinger to a target can use the estimate from the previous Pinger.  The
+// estimators are kept in least recently used order, and bounded to EstimatorsMax, so
+// sweeps over large address ranges don't grow the map without bound
+//
+// With PingerConfigT.AdaptiveTimeout each probe expiry is the RTO, clamped between
+// the floor and ceiling, rather than the single ie.Timeout, so distant targets
+// don't suffer false loss, while loss on nearby targets is detected quickly
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+const (
+	RTTEstimatorAlphaCst       = 0.125 // 1/8
+	RTTEstimatorBetaCst        = 0.25  // 1/4
+	RTTEstimatorKCst           = 4
+	RTTEstimatorGranularityCst = 1 * time.Millisecond
+
+	AdaptiveTimeoutFloorCst = 10 * time.Millisecond
+
+	// RTTEstimatorsMaxCst is the default maximum number of target estimators kept
+	RTTEstimatorsMaxCst = 65536
+)
+
+// RTTEstimator holds the SRTT/RTTVAR for a single target
+type RTTEstimator struct {
+	sync.Mutex
+	SRTT     time.Duration
+	RTTVar   time.Duration
+	RTO      time.Duration
+	Samples  uint64
+	Backoffs int
+	lru      *list.Element
+}
+
+// NewRTTEstimator creates a RTTEstimator, with the initial RTO
+// used until the first RTT sample
+func NewRTTEstimator(initialRTO time.Duration) (e *RTTEstimator) {
+	return &RTTEstimator{
+		RTO: initialRTO,
+	}
+}
+
+// Sample updates the estimator with a new RTT measurement
+// rfc6298 2.2 and 2.3
+func (e *RTTEstimator) Sample(rtt time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.Samples == 0 {
+		e.SRTT = rtt
+		e.RTTVar = rtt / 2
+	} else {
+		delta := e.SRTT - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.RTTVar = time.Duration((1-RTTEstimatorBetaCst)*float64(e.RTTVar) + RTTEstimatorBetaCst*float64(delta))
+		e.SRTT = time.Duration((1-RTTEstimatorAlphaCst)*float64(e.SRTT) + RTTEstimatorAlphaCst*float64(rtt))
+	}
+	e.Samples++
+	e.Backoffs = 0
+
+	variance := RTTEstimatorKCst * e.RTTVar
+	if variance < RTTEstimatorGranularityCst {
+		variance = RTTEstimatorGranularityCst
+	}
+	e.RTO = e.SRTT + variance
+}
+
+// Backoff doubles the RTO after an expiry, up to the ceiling
+// rfc6298 5.5
+func (e *RTTEstimator) Backoff(ceiling time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.Backoffs++
+	e.RTO *= 2
+	if e.RTO > ceiling {
+		e.RTO = ceiling
+	}
+}
+
+// Timeout returns the RTO clamped between the floor and ceiling
+func (e *RTTEstimator) Timeout(floor time.Duration, ceiling time.Duration) (timeout time.Duration) {
+	e.Lock()
+	timeout = e.RTO
+	e.Unlock()
+
+	if timeout < floor {
+		timeout = floor
+	}
+	if timeout > ceiling {
+		timeout = ceiling
+	}
+	return timeout
+}
+
+// getRTTEstimator returns the RTTEstimator for the target, creating it if required
+// The least recently used estimator is removed when there are more than EstimatorsMax
+// getRTTEstimator assumes the LOCK is already held by Pinger
+func (ie *ICMPEngine) getRTTEstimator(IP netaddr.IP) (e *RTTEstimator) {
+	e, exists := ie.Pingers.Estimators[IP]
+	if exists {
+		ie.Pingers.EstimatorsLRU.MoveToFront(e.lru)
+		return e
+	}
+	e = NewRTTEstimator(ie.Timeout)
+	e.lru = ie.Pingers.EstimatorsLRU.PushFront(IP)
+	ie.Pingers.Estimators[IP] = e
+
+	max := ie.Pingers.EstimatorsMax
+	if max <= 0 {
+		max = RTTEstimatorsMaxCst
+	}
+	for ie.Pingers.EstimatorsLRU.Len() > max {
+		oldest := ie.Pingers.EstimatorsLRU.Back()
+		delete(ie.Pingers.Estimators, oldest.Value.(netaddr.IP))
+		ie.Pingers.EstimatorsLRU.Remove(oldest)
+	}
+	return e
+}
+
+// forgetRTTEstimator removes the RTTEstimator for the target
+func (ie *ICMPEngine) forgetRTTEstimator(IP netaddr.IP) {
+	ie.Lock()
+	defer ie.Unlock()
+	if e, exists := ie.Pingers.Estimators[IP]; exists {
+		ie.Pingers.EstimatorsLRU.Remove(e.lru)
+		delete(ie.Pingers.Estimators, IP)
+	}
+}
+
+// GetRTTEstimator returns the RTTEstimator for the target, or nil if the target has not been pinged
+func (ie *ICMPEngine) GetRTTEstimator(IP netaddr.IP) (e *RTTEstimator) {
+	ie.RLock()
+	defer ie.RUnlock()
+	return ie.Pingers.Estimators[IP]
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+// TestRTTEstimator checks the rfc6298 calculations, backoff and clamping
+func TestRTTEstimator(t *testing.T) {
+
+	e := NewRTTEstimator(time.Second)
+	if e.Timeout(10*time.Millisecond, 2*time.Second) != time.Second {
+		t.Errorf(fmt.Sprintf("TestRTTEstimator initial RTO:%s", e.RTO))
+	}
+
+	// First sample SRTT = R, RTTVAR = R/2, RTO = R + 4 * R/2
+	e.Sample(100 * time.Millisecond)
+	if e.SRTT != 100*time.Millisecond || e.RTTVar != 50*time.Millisecond || e.RTO != 300*time.Millisecond {
+		t.Errorf(fmt.Sprintf("TestRTTEstimator first sample SRTT:%s RTTVar:%s RTO:%s", e.SRTT, e.RTTVar, e.RTO))
+	}
+
+	// Constant RTTs converge the RTTVAR towards zero, and the RTO towards SRTT + granularity
+	for i := 0; i < 200; i++ {
+		e.Sample(100 * time.Millisecond)
+	}
+	if e.SRTT != 100*time.Millisecond || e.RTO != 100*time.Millisecond+RTTEstimatorGranularityCst {
+		t.Errorf(fmt.Sprintf("TestRTTEstimator converged SRTT:%s RTTVar:%s RTO:%s", e.SRTT, e.RTTVar, e.RTO))
+	}
+
+	// Clamping
+	if e.Timeout(200*time.Millisecond, time.Second) != 200*time.Millisecond {
+		t.Errorf("TestRTTEstimator floor")
+	}
+	if e.Timeout(time.Millisecond, 50*time.Millisecond) != 50*time.Millisecond {
+		t.Errorf("TestRTTEstimator ceiling")
+	}
+
+	// Backoff doubles up to the ceiling
+	e.Backoff(time.Second)
+	if e.RTO != 2*(100*time.Millisecond+RTTEstimatorGranularityCst) {
+		t.Errorf(fmt.Sprintf("TestRTTEstimator backoff RTO:%s", e.RTO))
+	}
+	for i := 0; i < 10; i++ {
+		e.Backoff(time.Second)
+	}
+	if e.RTO != time.Second || e.Backoffs != 11 {
+		t.Errorf(fmt.Sprintf("TestRTTEstimator backoff ceiling RTO:%s Backoffs:%d", e.RTO, e.Backoffs))
+	}
+}
+
+// TestRTTEstimatorsBounded checks the estimators are bounded, evicting the least recently used,
+// and ForgetTarget removes the estimator
+func TestRTTEstimatorsBounded(t *testing.T) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+	ie.Pingers.EstimatorsMax = 3
+
+	IPs := []netaddr.IP{netaddr.MustParseIP("192.0.2.1"), netaddr.MustParseIP("192.0.2.2"), netaddr.MustParseIP("192.0.2.3"), netaddr.MustParseIP("192.0.2.4")}
+	ie.Lock()
+	first := ie.getRTTEstimator(IPs[0])
+	ie.getRTTEstimator(IPs[1])
+	ie.getRTTEstimator(IPs[2])
+	if ie.getRTTEstimator(IPs[0]) != first {
+		t.Errorf("TestRTTEstimatorsBounded estimator not reused")
+	}
+	ie.getRTTEstimator(IPs[3])
+	ie.Unlock()
+
+	if len(ie.Pingers.Estimators) != 3 || ie.Pingers.EstimatorsLRU.Len() != 3 {
+		t.Errorf(fmt.Sprintf("TestRTTEstimatorsBounded estimators:%d lru:%d", len(ie.Pingers.Estimators), ie.Pingers.EstimatorsLRU.Len()))
+	}
+	if ie.GetRTTEstimator(IPs[1]) != nil || ie.GetRTTEstimator(IPs[0]) != first {
+		t.Errorf("TestRTTEstimatorsBounded least recently used not evicted")
+	}
+
+	ie.ForgetTarget(IPs[0])
+	if ie.GetRTTEstimator(IPs[0]) != nil || ie.Pingers.EstimatorsLRU.Len() != 2 {
+		t.Errorf("TestRTTEstimatorsBounded ForgetTarget")
+	}
+}
+
+// TestInsertExpiry checks the ExpiryDLL stays ordered with different expiry times
+func TestInsertExpiry(t *testing.T) {
+
+	ie := NewFullConfig(hclog.Default(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+
+	shard := ie.Pingers.Shards[Protocol(4)][0]
+	now := time.Now()
+	offsets := []int{5, 1, 9, 3, 3, 0, 7, 10, 2}
+	for i, o := range offsets {
+		ie.insertExpiry(shard, Pings{Seq: Sequence(i), Expiry: now.Add(time.Duration(o) * time.Millisecond)})
+	}
+
+	if shard.Expiries.Len() != len(offsets) {
+		t.Fatalf("TestInsertExpiry Len():%d", shard.Expiries.Len())
+	}
+	var previous time.Time
+	for _, ping := range shard.Expiries.PopExpired(now.Add(time.Hour), nil) {
+		if ping.Expiry.Before(previous) {
+			t.Errorf(fmt.Sprintf("TestInsertExpiry out of order Seq:%d", ping.Seq))
+		}
+		previous = ping.Expiry
+	}
+}
+
+// TestPingerAdaptiveTimeout runs adaptive timeout Pingers with fake drops,
+// so that the expiries are inserted ahead of the longer fixed timeout Pinger,
+// and checks only the adaptive Pinger updates the estimator
+func TestPingerAdaptiveTimeout(t *testing.T) {
+
+	logger := hclog.Default()
+	doneAll := make(chan struct{}, 2)
+	ie := NewFullConfig(logger, doneAll, 50*time.Millisecond, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	count := 50
+	pDone := make(chan struct{}, 2)
+	pwg := new(sync.WaitGroup)
+	sCh := make(chan PingerResults, 2)
+
+	fixed := PingerConfigT{
+		SummaryOnly: true,
+		DropProb:    0.5,
+	}
+	adaptive := PingerConfigT{
+		SummaryOnly:     true,
+		DropProb:        0.5,
+		AdaptiveTimeout: true,
+		TimeoutFloor:    time.Millisecond,
+	}
+
+	pwg.Add(2)
+	go ie.PingerWithConfigAndStatsChannel(netaddr.MustParseIP("127.0.0.1"), Sequence(count), time.Millisecond, pDone, fixed, pwg, sCh)
+	go ie.PingerWithConfigAndStatsChannel(netaddr.MustParseIP("::1"), Sequence(count), time.Millisecond, pDone, adaptive, pwg, sCh)
+
+	for i := 0; i < 2; i++ {
+		results := <-sCh
+		if results.Successes+results.Failures != count {
+			t.Errorf(fmt.Sprintf("TestPingerAdaptiveTimeout [%s] successes:%d + failures:%d != count:%d", results.IP, results.Successes, results.Failures, count))
+		}
+		e := ie.GetRTTEstimator(results.IP)
+		if results.IP.Is4() {
+			if e != nil {
+				t.Errorf(fmt.Sprintf("TestPingerAdaptiveTimeout [%s] fixed timeout estimator:%v", results.IP, e))
+			}
+			continue
+		}
+		if e == nil || e.Samples != uint64(results.Successes) {
+			t.Errorf(fmt.Sprintf("TestPingerAdaptiveTimeout [%s] estimator:%v", results.IP, e))
+		}
+	}
+
+	doneAll <- struct{}{}
+	pwg.Wait()
+	wg.Wait()
+}
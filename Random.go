@@ -0,0 +1,68 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Random holds the engine random source, which is used for the FakeDrop probability
+//
+// Originally NewFullConfig called rand.Seed(time.Now().UnixNano()) on the global source, and
+// FakeDrop used the global rand, so the fake drop tests couldn't be replayed, and creating an
+// engine changed the global state of the host program.
+//
+// Now each engine has its own source, seeded from the time, unless SetSeed is called.  Each
+// Pinger with a DropProb gets its own rand.Rand, seeded with PingerConfigT.Seed, or from the
+// engine source if the Seed is zero.  The seed is returned in PingerResults.Seed, so a failing
+// test can be replayed exactly by setting PingerConfigT.Seed.
+//
+// With SetSeed, the sequence of the Pinger seeds is fixed, but with concurrent Pingers, which
+// Pinger gets which seed depends on the order they start, so use PingerConfigT.Seed for those
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// RandT is the engine random source, which is safe for concurrent use
+type RandT struct {
+	sync.Mutex
+	Seed int64
+	rand *rand.Rand
+}
+
+// reseed resets the source to the seed
+func (r *RandT) reseed(seed int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.Seed = seed
+	r.rand = rand.New(rand.NewSource(seed))
+}
+
+// Int63 returns the next non-negative random int64
+func (r *RandT) Int63() int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Int63()
+}
+
+// SetSeed reseeds the engine random source, so the Pinger seeds are reproducible
+func (ie *ICMPEngine) SetSeed(seed int64) {
+	ie.Rand.reseed(seed)
+}
+
+// pingerRand returns the Pinger random source, and its seed, for the FakeDropRand
+// A zero seed takes the seed from the engine source, and the chosen seed is returned
+func (ie *ICMPEngine) pingerRand(seed int64) (r *rand.Rand, usedSeed int64) {
+	if seed == 0 {
+		seed = ie.Rand.Int63()
+	}
+	return rand.New(rand.NewSource(seed)), seed
+}
+
+// FakeDropRand returns true based on the probability, using the random source
+func FakeDropRand(r *rand.Rand, dropProb float64) (drop bool) {
+	if dropProb > 0 {
+		if r.Float64() >= (1 - dropProb) {
+			drop = true
+		}
+	}
+	return drop
+}
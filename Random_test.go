@@ -0,0 +1,64 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+// fakeDropPattern runs the Pinger with FakeSuccess, and returns which probes were dropped
+func fakeDropPattern(ie *ICMPEngine, seed int64) (dropped []bool, results PingerResults) {
+	packets := 40
+	results = ie.PingerWithConfig(netaddr.MustParseIP("192.0.2.1"), Sequence(packets), 0, make(chan struct{}), PingerConfigT{DropProb: 0.5, Seed: seed})
+	for _, rtt := range results.RTTs {
+		dropped = append(dropped, rtt == 0)
+	}
+	return dropped, results
+}
+
+// TestPingerSeed checks the fake drops are reproducible with PingerConfigT.Seed, and with SetSeed
+func TestPingerSeed(t *testing.T) {
+
+	var patterns [][]bool
+	var seeds []int64
+	for run := 0; run < 2; run++ {
+		done := make(chan struct{}, 2)
+		ie := NewFullConfig(hclog.NewNullLogger(), done, 5*time.Millisecond, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+		ie.SetSeed(7)
+		ie.Start()
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		go ie.Run(wg)
+
+		// the fixed Pinger seed, and then the seed from the engine source
+		for _, seed := range []int64{42, 0} {
+			dropped, results := fakeDropPattern(ie, seed)
+			if results.Failures == 0 || results.Successes == 0 || results.Failures+results.Successes != len(dropped) {
+				t.Errorf(fmt.Sprintf("TestPingerSeed seed:%d Successes:%d Failures:%d", seed, results.Successes, results.Failures))
+			}
+			if seed != 0 && results.Seed != seed {
+				t.Errorf(fmt.Sprintf("TestPingerSeed results.Seed:%d != seed:%d", results.Seed, seed))
+			}
+			patterns = append(patterns, dropped)
+			seeds = append(seeds, results.Seed)
+		}
+
+		done <- struct{}{}
+		wg.Wait()
+	}
+
+	for i := 0; i < 2; i++ {
+		if seeds[i] != seeds[i+2] || fmt.Sprint(patterns[i]) != fmt.Sprint(patterns[i+2]) {
+			t.Errorf(fmt.Sprintf("TestPingerSeed i:%d not reproducible seeds:%v", i, seeds))
+		}
+	}
+	if fmt.Sprint(patterns[0]) == fmt.Sprint(patterns[1]) {
+		t.Errorf("TestPingerSeed different seeds gave the same drops")
+	}
+}
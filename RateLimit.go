@@ -0,0 +1,259 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// RateLimit holds the send rate limiting, which is off by default
+//
+// - SetRateLimit sets an engine wide token bucket, limiting the aggregate packets per second,
+//   so that thousands of Pingers starting at once don't cause ENOBUFS, or trip the kernel
+//   and network ICMP rate limits
+// - SetPrefixRateLimit sets a token bucket per destination prefix ( e.g. /24 and /64 ), to be
+//   polite to any single network, regardless of how many targets in it are being pinged
+//
+// The send queue is a virtual FIFO.  Each send reserves the next slot that conforms with both the
+// global and the prefix buckets, and the Pinger waits until its slot, so bursts are smoothed out
+// to the rate.  Each Pinger only has one reservation at a time, so the queue length is bounded
+// by the number of Pingers, and the waiting Pingers don't hold any locks.
+//
+// The send time of the probe is taken AFTER the wait, so the queueing delay is NOT included in
+// the RTT.  The queueing delay is counted in the Counters, and exported by the Collector.
+//
+// The token buckets are implemented as the equivalent Generic Cell Rate Algorithm, which
+// only needs the theoretical arrival time (TAT) per bucket, rather than a token count
+// https://en.wikipedia.org/wiki/Generic_cell_rate_algorithm
+//
+// ENOBUFS used to be fatal in WriteTo.  Now it's counted, the probe is left to expire
+// as a loss, and the global send queue is paused for ENOBUFSBackoffCst
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+const (
+	// PrefixBits4Cst and PrefixBits6Cst are the default prefix lengths for SetPrefixRateLimit
+	PrefixBits4Cst = 24
+	PrefixBits6Cst = 64
+
+	// PrefixBucketsSweepCst is the number of prefix buckets before the idle buckets are removed
+	PrefixBucketsSweepCst = 4096
+
+	// ENOBUFSBackoffCst is how long the global send queue is paused after ENOBUFS
+	ENOBUFSBackoffCst = 10 * time.Millisecond
+)
+
+// RateLimitT holds the rate limiting state
+// Global is nil without a global limit, and PrefixRate is zero without prefix limits
+type RateLimitT struct {
+	sync.Mutex
+	Global      *TokenBucket
+	PrefixRate  float64
+	PrefixBurst int
+	PrefixBits4 int
+	PrefixBits6 int
+	Prefixes    map[netaddr.IPPrefix]*TokenBucket
+	sweepAt     int
+	DebugLevel  int
+}
+
+// TokenBucket allows Burst packets at once, refilling at Rate packets per second
+type TokenBucket struct {
+	Rate      float64
+	Burst     int
+	interval  time.Duration
+	tolerance time.Duration
+	tat       time.Time
+}
+
+// NewTokenBucket creates the TokenBucket
+// rate must be > 0, and burst is at least 1
+func NewTokenBucket(rate float64, burst int) (b *TokenBucket) {
+	if rate <= 0 {
+		log.Fatal(fmt.Sprintf("NewTokenBucket rate:%f must be > 0", rate))
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	return &TokenBucket{
+		Rate:      rate,
+		Burst:     burst,
+		interval:  interval,
+		tolerance: time.Duration(burst-1) * interval,
+	}
+}
+
+// earliest returns the earliest time at or after now, that a packet conforms
+func (b *TokenBucket) earliest(now time.Time) time.Time {
+	t := b.tat.Add(-b.tolerance)
+	if t.Before(now) {
+		return now
+	}
+	return t
+}
+
+// take takes a token at time at, which must be at or after earliest()
+func (b *TokenBucket) take(at time.Time) {
+	if b.tat.Before(at) {
+		b.tat = at
+	}
+	b.tat = b.tat.Add(b.interval)
+}
+
+// idle returns if the bucket is full, so can be removed and recreated without changing the limiting
+func (b *TokenBucket) idle(now time.Time) bool {
+	return !b.tat.After(now)
+}
+
+// SetRateLimit sets the engine wide rate limit, in packets per second, with the burst
+// rate <= 0 removes the limit
+func (ie *ICMPEngine) SetRateLimit(rate float64, burst int) {
+	ie.RateLimit.Lock()
+	defer ie.RateLimit.Unlock()
+	if rate <= 0 {
+		ie.RateLimit.Global = nil
+		return
+	}
+	ie.RateLimit.Global = NewTokenBucket(rate, burst)
+}
+
+// SetPrefixRateLimit sets the per destination prefix rate limit, in packets per second, with the burst
+// bits4 and bits6 are the prefix lengths, with zero meaning PrefixBits4Cst and PrefixBits6Cst
+// rate <= 0 removes the limit
+func (ie *ICMPEngine) SetPrefixRateLimit(bits4 int, bits6 int, rate float64, burst int) {
+	ie.RateLimit.Lock()
+	defer ie.RateLimit.Unlock()
+	if bits4 == 0 {
+		bits4 = PrefixBits4Cst
+	}
+	if bits6 == 0 {
+		bits6 = PrefixBits6Cst
+	}
+	if bits4 < 0 || bits4 > 32 || bits6 < 0 || bits6 > 128 {
+		log.Fatal(fmt.Sprintf("SetPrefixRateLimit invalid bits4:%d bits6:%d", bits4, bits6))
+	}
+	if rate > 0 {
+		// check the rate, before changing anything
+		NewTokenBucket(rate, burst)
+	}
+	ie.RateLimit.PrefixRate = rate
+	ie.RateLimit.PrefixBurst = burst
+	ie.RateLimit.PrefixBits4 = bits4
+	ie.RateLimit.PrefixBits6 = bits6
+	ie.RateLimit.Prefixes = make(map[netaddr.IPPrefix]*TokenBucket)
+	ie.RateLimit.sweepAt = PrefixBucketsSweepCst
+}
+
+// reserveSend reserves the send slot for the IP, and returns the time to send
+// Without any rate limits this is always now
+// The global token is taken at the global slot, rather than at the later prefix slot, so a send
+// which is delayed by its prefix limit doesn't hold up the sends to all the other prefixes
+func (ie *ICMPEngine) reserveSend(IP netaddr.IP, now time.Time) (sendAt time.Time) {
+
+	rl := &ie.RateLimit
+	rl.Lock() // <------------------------------ LOCK!!
+	defer rl.Unlock()
+
+	sendAt = now
+	if rl.Global != nil {
+		sendAt = rl.Global.earliest(now)
+		rl.Global.take(sendAt)
+	}
+	if rl.PrefixRate > 0 {
+		prefix := rl.prefixBucket(IP, now)
+		if t := prefix.earliest(now); t.After(sendAt) {
+			sendAt = t
+		}
+		prefix.take(sendAt)
+	}
+	return sendAt
+}
+
+// prefixBucket returns the TokenBucket for the prefix of the IP, creating it if required
+// When there are a lot of prefixes, the idle buckets are removed
+// prefixBucket assumes the RateLimit LOCK is already held
+func (rl *RateLimitT) prefixBucket(IP netaddr.IP, now time.Time) (b *TokenBucket) {
+
+	bits := rl.PrefixBits6
+	if IP.Is4() {
+		bits = rl.PrefixBits4
+	}
+	prefix, err := IP.Prefix(uint8(bits))
+	if err != nil {
+		log.Fatal(fmt.Sprintf("prefixBucket IP:%s bits:%d err:%v", IP, bits, err))
+	}
+
+	b, exists := rl.Prefixes[prefix]
+	if exists {
+		return b
+	}
+
+	if len(rl.Prefixes) >= rl.sweepAt {
+		for p, pb := range rl.Prefixes {
+			if pb.idle(now) {
+				delete(rl.Prefixes, p)
+			}
+		}
+		// don't sweep again until the map has doubled, so the sweeps are amortized
+		rl.sweepAt = 2 * len(rl.Prefixes)
+		if rl.sweepAt < PrefixBucketsSweepCst {
+			rl.sweepAt = PrefixBucketsSweepCst
+		}
+	}
+
+	b = NewTokenBucket(rl.PrefixRate, rl.PrefixBurst)
+	rl.Prefixes[prefix] = b
+	return b
+}
+
+// waitSend waits in the send queue for the send slot for the IP
+// returns false if any of the done channels closed while waiting
+func (ie *ICMPEngine) waitSend(IP netaddr.IP, done <-chan struct{}, allDone <-chan struct{}, ctxDone <-chan struct{}) (ok bool) {
+
+	now := ie.Clock.Now()
+	sendAt := ie.reserveSend(IP, now)
+	delay := sendAt.Sub(now)
+	if delay <= 0 {
+		return true
+	}
+
+	atomic.AddUint64(&ie.Counters.SendQueueWaits, 1)
+	atomic.AddUint64(&ie.Counters.SendQueueDelayNs, uint64(delay))
+
+	if ie.RateLimit.DebugLevel > 100 {
+		ie.Log.Info(fmt.Sprintf("waitSend [%s] \t delay:%s", IP.String(), delay.String()))
+	}
+
+	timer := ie.Clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.Chan():
+		return true
+	case <-done:
+		return false
+	case <-allDone:
+		return false
+	case <-ctxDone:
+		return false
+	}
+}
+
+// backoffENOBUFS pauses the global send queue, after the kernel ran out of socket buffers
+func (ie *ICMPEngine) backoffENOBUFS() {
+	rl := &ie.RateLimit
+	rl.Lock()
+	defer rl.Unlock()
+	if rl.Global == nil {
+		return
+	}
+	// the tolerance is added, so no burst is allowed until after the pause
+	pause := ie.Clock.Now().Add(ENOBUFSBackoffCst + rl.Global.tolerance)
+	if rl.Global.tat.Before(pause) {
+		rl.Global.tat = pause
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+// TestRateLimit checks the global and prefix token buckets give the expected send slots
+func TestRateLimit(t *testing.T) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+	ie.SetRateLimit(1000, 10)
+	ie.SetPrefixRateLimit(0, 0, 100, 2)
+
+	now := time.Now()
+	a := netaddr.MustParseIP("192.0.2.1")
+	b := netaddr.MustParseIP("192.0.2.200") // same /24 as a
+	c := netaddr.MustParseIP("198.51.100.1")
+
+	var tests = []struct {
+		IP   netaddr.IP
+		want time.Duration
+	}{
+		{a, 0},                     // prefix burst
+		{b, 0},                     // prefix burst
+		{a, 10 * time.Millisecond}, // prefix rate
+		{c, 0},                     // different prefix, and the global burst
+		{c, 0},
+	}
+	for i, test := range tests {
+		if got := ie.reserveSend(test.IP, now).Sub(now); got != test.want {
+			t.Errorf(fmt.Sprintf("TestRateLimit i:%d IP:%s got:%s want:%s", i, test.IP, got, test.want))
+		}
+	}
+
+	// use up the global burst, after which the global rate applies
+	ie.SetPrefixRateLimit(0, 0, 0, 0)
+	for i := 0; i < 10; i++ {
+		ie.reserveSend(c, now)
+	}
+	if got := ie.reserveSend(c, now).Sub(now); got <= 0 || got > 10*time.Millisecond {
+		t.Errorf(fmt.Sprintf("TestRateLimit global rate got:%s", got))
+	}
+
+	// ENOBUFS pauses the global send queue
+	ie.SetRateLimit(1000, 10)
+	ie.backoffENOBUFS()
+	if got := ie.reserveSend(c, time.Now()).Sub(now); got < ENOBUFSBackoffCst {
+		t.Errorf(fmt.Sprintf("TestRateLimit ENOBUFS backoff got:%s", got))
+	}
+}
+
+// TestPrefixBucketsSweep checks the idle prefix buckets are removed
+func TestPrefixBucketsSweep(t *testing.T) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+	ie.SetPrefixRateLimit(32, 128, 1000, 1)
+
+	now := time.Now()
+	for i := 0; i < 10*PrefixBucketsSweepCst; i++ {
+		ie.reserveSend(benchIP(i), now.Add(time.Duration(i)*time.Second))
+	}
+	if n := len(ie.RateLimit.Prefixes); n > 2*PrefixBucketsSweepCst {
+		t.Errorf(fmt.Sprintf("TestPrefixBucketsSweep prefixes:%d", n))
+	}
+}
+
+// TestPingerRateLimit checks the Pingers are paced by the global rate limit,
+// and the time waiting in the send queue is not included in the RTTs
+func TestPingerRateLimit(t *testing.T) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	rate := 500.0
+	ie.SetRateLimit(rate, 1)
+
+	pingers := 8
+	count := 10
+	start := time.Now()
+	pWG := new(sync.WaitGroup)
+	resultsCh := make(chan PingerResults, pingers)
+	for i := 0; i < pingers; i++ {
+		pWG.Add(1)
+		go ie.PingerWithStatsChannel(benchIP(i), Sequence(count), time.Microsecond, false, make(chan struct{}), pWG, resultsCh)
+	}
+	pWG.Wait()
+	elapsed := time.Since(start)
+	close(resultsCh)
+
+	minimum := time.Duration(float64(pingers*count-1) / rate * float64(time.Second))
+	if elapsed < minimum {
+		t.Errorf(fmt.Sprintf("TestPingerRateLimit elapsed:%s < minimum:%s", elapsed, minimum))
+	}
+	for results := range resultsCh {
+		if results.Successes != count {
+			t.Errorf(fmt.Sprintf("TestPingerRateLimit [%s] Successes:%d", results.IP, results.Successes))
+		}
+		if results.Max > minimum/2 {
+			t.Errorf(fmt.Sprintf("TestPingerRateLimit [%s] Max RTT:%s includes the queueing delay", results.IP, results.Max))
+		}
+	}
+	if atomic.LoadUint64(&ie.Counters.SendQueueWaits) == 0 || atomic.LoadUint64(&ie.Counters.SendQueueDelayNs) == 0 {
+		t.Errorf("TestPingerRateLimit no send queue waits counted")
+	}
+
+	ie.DoneCh <- struct{}{}
+	wg.Wait()
+}
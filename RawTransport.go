@@ -0,0 +1,309 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// RawTransport is the privileged raw ICMP socket ( SOCK_RAW ), for deployments which have
+// root or CAP_NET_RAW, but can't change net.ipv4.ping_group_range for the datagram sockets
+//
+// Unlike the datagram sockets, the kernel doesn't demultiplex the raw sockets by the ICMP
+// identifier.  Every raw socket receives every ICMP message for the host, so:
+// - The identifier is chosen here, rather than by the kernel ( rawID )
+// - A BPF filter is attached, so the kernel only queues the echo replies with our identifier
+// - The identifier is also checked in user space, because the BPF filter is only supported on
+//   Linux, and there is a window between opening the socket and attaching the filter
+// - The ICMP errors quoting our echo requests are filtered too, so they never reach the
+//   Receivers on the raw socket, and the probes expire, like the datagram sockets
+//
+// The IPv4 raw socket receives the IP header, which is parsed and removed ( ParseIPv4Header ),
+// so the Receivers get the ICMP message only, like every other Transport.  The IPv6 raw socket
+// never includes the IPv6 header.  The kernel calculates the ICMPv6 checksum, so the
+// EchoTemplate works unchanged.
+//
+// SetTransportMode selects between the datagram and raw sockets, including TransportModeAuto
+// which tries the raw socket, and falls back to the datagram socket without the privileges
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"inet.af/netaddr"
+)
+
+const (
+	// RawNetwork4Cst and RawNetwork6Cst are the networks for the raw ICMP sockets
+	RawNetwork4Cst = "ip4:icmp"
+	RawNetwork6Cst = "ip6:ipv6-icmp"
+
+	// IPv4HeaderLenCst is the minimum IPv4 header length, without options
+	IPv4HeaderLenCst = 20
+
+	// ProtocolICMPCst is the IPv4 protocol number for ICMP
+	ProtocolICMPCst = 1
+
+	// rawSnapLenCst is the BPF accept length, which is larger than any ICMP message
+	rawSnapLenCst = 0xffff
+)
+
+var (
+	errIPv4HeaderShort   = errors.New("IPv4 header too short")
+	errIPv4HeaderVersion = errors.New("IPv4 header version is not 4")
+	errIPv4HeaderLen     = errors.New("IPv4 header length invalid")
+
+	// rawIDs makes the identifiers unique per RawTransport within the process
+	rawIDs uint32
+)
+
+// TransportMode selects the socket type, see SetTransportMode
+type TransportMode int
+
+const (
+	// TransportModeDatagram is the non-privileged datagram socket, the default
+	TransportModeDatagram TransportMode = iota
+	// TransportModeRaw is the raw socket only, so OpenSockets is fatal without the privileges
+	TransportModeRaw
+	// TransportModeAuto tries the raw socket, and falls back to the datagram socket
+	TransportModeAuto
+)
+
+// IPv4Header is the parsed IPv4 header, from the raw socket
+type IPv4Header struct {
+	Len      int
+	TotalLen int
+	TTL      int
+	Protocol int
+	Src      netaddr.IP
+	Dst      netaddr.IP
+}
+
+// ParseIPv4Header parses the IPv4 header at the start of b into h, without allocating
+// The total length isn't checked, because some kernels give it in host byte order
+func ParseIPv4Header(b []byte, h *IPv4Header) (err error) {
+	if len(b) < IPv4HeaderLenCst {
+		return errIPv4HeaderShort
+	}
+	if b[0]>>4 != 4 {
+		return errIPv4HeaderVersion
+	}
+	h.Len = int(b[0]&0x0f) << 2
+	if h.Len < IPv4HeaderLenCst || h.Len > len(b) {
+		return errIPv4HeaderLen
+	}
+	h.TotalLen = int(binary.BigEndian.Uint16(b[2:4]))
+	h.TTL = int(b[8])
+	h.Protocol = int(b[9])
+	h.Src = netaddr.IPv4(b[12], b[13], b[14], b[15])
+	h.Dst = netaddr.IPv4(b[16], b[17], b[18], b[19])
+	return nil
+}
+
+// SetTransportMode selects the socket type used by Start()
+// TransportModeDatagram restores the default, and SetTransportMode must be called before Start()
+func (ie *ICMPEngine) SetTransportMode(mode TransportMode) {
+	switch mode {
+	case TransportModeDatagram:
+		ie.SetTransportFactory(nil)
+	case TransportModeRaw:
+		ie.SetTransportFactory(RawTransportFactory)
+	case TransportModeAuto:
+		ie.SetTransportFactory(FallbackTransportFactory(RawTransportFactory, DatagramTransportFactory))
+	default:
+		log.Fatal(fmt.Sprintf("SetTransportMode unknown mode:%d", mode))
+	}
+}
+
+// FallbackTransportFactory returns a TransportFactory which tries each of the factories
+// in order, returning the first Transport that opens, or the last error
+func FallbackTransportFactory(factories ...TransportFactory) TransportFactory {
+	return func(ie *ICMPEngine, proto Protocol, index int) (t Transport, err error) {
+		for i, factory := range factories {
+			t, err = factory(ie, proto, index)
+			if err == nil {
+				return t, nil
+			}
+			if ie.Sockets.DebugLevel > 10 {
+				ie.Log.Info(fmt.Sprintf("FallbackTransportFactory protocol:%d \t socket:%d \t factory:%d \t err:%v", proto, index, i, err))
+			}
+		}
+		if err == nil {
+			err = errors.New("FallbackTransportFactory no factories")
+		}
+		return nil, err
+	}
+}
+
+// RawTransportFactory is the TransportFactory for the RawTransport
+func RawTransportFactory(ie *ICMPEngine, proto Protocol, index int) (t Transport, err error) {
+	network := RawNetwork4Cst
+	if proto == Protocol(6) {
+		network = RawNetwork6Cst
+	}
+	rt, err := NewRawTransport(proto, network, ie.Sockets.Addresses[proto], rawID(ie.PID))
+	if err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// rawID returns the next identifier, starting from the PID
+func rawID(pid int) (id int) {
+	return (pid + int(atomic.AddUint32(&rawIDs, 1)) - 1) & 0xffff
+}
+
+// RawTransport is the raw ICMP socket, see the top of this file
+// Filtered is the count of the received messages dropped by the user space filter
+type RawTransport struct {
+	Proto    Protocol
+	conn     *net.IPConn
+	id       int
+	bpf      bool
+	Filtered uint64
+}
+
+// NewRawTransport opens the raw ICMP socket, on the network ( RawNetwork4Cst or RawNetwork6Cst )
+// and address, and attaches the BPF filter for the echo replies with the identifier
+func NewRawTransport(proto Protocol, network string, address string, id int) (t *RawTransport, err error) {
+
+	c, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := c.(*net.IPConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("NewRawTransport network:%s is not a raw IP network", network)
+	}
+	t = &RawTransport{
+		Proto: proto,
+		conn:  conn,
+		id:    id & 0xffff,
+	}
+
+	// the BPF filter is an optimization, so the error is ignored, and the user space filter is used
+	filter, err := bpf.Assemble(echoReplyFilter(proto, t.id))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if proto == Protocol(4) {
+		t.bpf = ipv4.NewPacketConn(conn).SetBPF(filter) == nil
+	} else {
+		t.bpf = ipv6.NewPacketConn(conn).SetBPF(filter) == nil
+	}
+	return t, nil
+}
+
+// echoReplyFilter is the BPF program, which accepts the echo replies with the identifier
+// The IPv4 raw socket sees the IP header, so the ICMP offsets are relative to the header length
+func echoReplyFilter(proto Protocol, id int) []bpf.Instruction {
+	if proto == Protocol(4) {
+		return []bpf.Instruction{
+			bpf.LoadMemShift{Off: 0},          // X = IPv4 header length
+			bpf.LoadIndirect{Off: 0, Size: 1}, // A = ICMP type
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(ipv4.ICMPTypeEchoReply), SkipFalse: 3},
+			bpf.LoadIndirect{Off: 4, Size: 2}, // A = ICMP identifier
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(id), SkipFalse: 1},
+			bpf.RetConstant{Val: rawSnapLenCst},
+			bpf.RetConstant{Val: 0},
+		}
+	}
+	return []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 0, Size: 1}, // A = ICMPv6 type
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(ipv6.ICMPTypeEchoReply), SkipFalse: 3},
+		bpf.LoadAbsolute{Off: 4, Size: 2}, // A = ICMPv6 identifier
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(id), SkipFalse: 1},
+		bpf.RetConstant{Val: rawSnapLenCst},
+		bpf.RetConstant{Val: 0},
+	}
+}
+
+// matchEchoReply returns if the ICMP message is an echo reply with the identifier
+func matchEchoReply(proto Protocol, id int, m []byte) bool {
+	if len(m) < EchoLenCst {
+		return false
+	}
+	return m[0] == echoReplyType(proto) && m[1] == 0 && int(binary.BigEndian.Uint16(m[4:6])) == id
+}
+
+// Protocol implements Transport
+func (t *RawTransport) Protocol() Protocol {
+	return t.Proto
+}
+
+// ID implements Transport
+func (t *RawTransport) ID() int {
+	return t.id
+}
+
+// BPF returns if the BPF filter is attached
+func (t *RawTransport) BPF() bool {
+	return t.bpf
+}
+
+// Addr implements Transport, the raw sockets use an IPAddr
+func (t *RawTransport) Addr(IP netaddr.IP) net.Addr {
+	return IP.IPAddr()
+}
+
+// Send implements Transport
+func (t *RawTransport) Send(b []byte, dst net.Addr) (err error) {
+	n, err := t.conn.WriteTo(b, dst) // ----------------------------<< WriteTo ( Sends packet to the kernel )
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return fmt.Errorf("RawTransport Send to:%s %w", dst, errShortWrite)
+	}
+	return nil
+}
+
+// Receive implements Transport, blocking until an echo reply with our identifier arrives
+// ReadMsgIP is used rather than ReadFrom, because ReadFrom silently strips the IPv4 header
+func (t *RawTransport) Receive(b []byte) (n int, peer net.Addr, err error) {
+	var h IPv4Header
+	for {
+		n, _, _, addr, err := t.conn.ReadMsgIP(b, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		start := 0
+		if t.Proto == Protocol(4) {
+			if ParseIPv4Header(b[:n], &h) != nil || h.Protocol != ProtocolICMPCst {
+				atomic.AddUint64(&t.Filtered, 1)
+				continue
+			}
+			start = h.Len
+		}
+		if !matchEchoReply(t.Proto, t.id, b[start:n]) {
+			atomic.AddUint64(&t.Filtered, 1)
+			continue
+		}
+		if start > 0 {
+			n = copy(b, b[start:n])
+		}
+		return n, addr, nil
+	}
+}
+
+// Close implements Transport
+func (t *RawTransport) Close() (err error) {
+	return t.conn.Close()
+}
+
+// LocalAddr implements Transport
+func (t *RawTransport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+// Capabilities implements Transport
+func (t *RawTransport) Capabilities() TransportCapabilities {
+	return TransportCapabilities{
+		Privileged: true,
+	}
+}
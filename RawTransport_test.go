@@ -0,0 +1,152 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/net/bpf"
+	"inet.af/netaddr"
+)
+
+// rawIPv4Packet returns the IPv4 header, with optLen bytes of options, followed by the ICMP message
+func rawIPv4Packet(optLen int, icmp []byte) []byte {
+	hl := IPv4HeaderLenCst + optLen
+	b := make([]byte, hl+len(icmp))
+	b[0] = 0x40 | byte(hl>>2)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64
+	b[9] = ProtocolICMPCst
+	copy(b[12:16], []byte{192, 0, 2, 1})
+	copy(b[16:20], []byte{192, 0, 2, 2})
+	copy(b[hl:], icmp)
+	return b
+}
+
+// echoMessage returns an 8 byte echo message, with the type and identifier
+func echoMessage(typ byte, id int) []byte {
+	m := make([]byte, EchoLenCst)
+	m[0] = typ
+	binary.BigEndian.PutUint16(m[4:6], uint16(id))
+	binary.BigEndian.PutUint16(m[6:8], 7)
+	return m
+}
+
+func TestParseIPv4Header(t *testing.T) {
+
+	var h IPv4Header
+	b := rawIPv4Packet(4, echoMessage(0, 1))
+	if err := ParseIPv4Header(b, &h); err != nil {
+		t.Fatalf(fmt.Sprintf("TestParseIPv4Header err:%v", err))
+	}
+	if h.Len != 24 || h.TTL != 64 || h.Protocol != ProtocolICMPCst || h.TotalLen != len(b) ||
+		h.Src != netaddr.MustParseIP("192.0.2.1") || h.Dst != netaddr.MustParseIP("192.0.2.2") {
+		t.Errorf(fmt.Sprintf("TestParseIPv4Header h:%+v", h))
+	}
+
+	invalid := map[string][]byte{
+		"short":   b[:IPv4HeaderLenCst-1],
+		"version": append([]byte{0x65}, b[1:]...),
+		"ihl":     append([]byte{0x44}, b[1:]...),
+		"options": b[:IPv4HeaderLenCst+2],
+	}
+	for name, ib := range invalid {
+		if err := ParseIPv4Header(ib, &h); err == nil {
+			t.Errorf(fmt.Sprintf("TestParseIPv4Header %s parsed", name))
+		}
+	}
+}
+
+// TestEchoReplyFilter runs the BPF filters in the BPF VM, and checks they agree with matchEchoReply
+func TestEchoReplyFilter(t *testing.T) {
+
+	id := 0x1234
+	tests := []struct {
+		typ    byte
+		id     int
+		accept bool
+	}{
+		{typ: 0, id: id, accept: true},
+		{typ: 0, id: id + 1, accept: false},
+		{typ: 8, id: id, accept: false},
+		{typ: 3, id: id, accept: false},
+		{typ: 129, id: id, accept: true},
+		{typ: 128, id: id, accept: false},
+	}
+
+	for _, proto := range []Protocol{4, 6} {
+		vm, err := bpf.NewVM(echoReplyFilter(proto, id))
+		if err != nil {
+			t.Fatalf(fmt.Sprintf("TestEchoReplyFilter proto:%d bpf.NewVM err:%v", proto, err))
+		}
+		for _, test := range tests {
+			if (proto == 4) == (test.typ >= 128) {
+				continue
+			}
+			m := echoMessage(test.typ, test.id)
+			packets := [][]byte{m}
+			if proto == 4 {
+				packets = [][]byte{rawIPv4Packet(0, m), rawIPv4Packet(8, m)}
+			}
+			for _, p := range packets {
+				n, err := vm.Run(p)
+				if err != nil {
+					t.Fatalf(fmt.Sprintf("TestEchoReplyFilter proto:%d vm.Run err:%v", proto, err))
+				}
+				if (n > 0) != test.accept {
+					t.Errorf(fmt.Sprintf("TestEchoReplyFilter proto:%d type:%d id:%d len:%d accept:%t", proto, test.typ, test.id, len(p), n > 0))
+				}
+			}
+			if matchEchoReply(proto, id, m) != test.accept {
+				t.Errorf(fmt.Sprintf("TestEchoReplyFilter matchEchoReply proto:%d type:%d id:%d", proto, test.typ, test.id))
+			}
+		}
+	}
+}
+
+// TestRawTransport pings the loopback over the raw sockets, which requires root or CAP_NET_RAW
+func TestRawTransport(t *testing.T) {
+
+	for proto, network := range map[Protocol]string{4: RawNetwork4Cst, 6: RawNetwork6Cst} {
+		rt, err := NewRawTransport(proto, network, "", 1)
+		if err != nil {
+			t.Skipf("TestRawTransport raw sockets unavailable err:%v", err)
+		}
+		rt.Close()
+	}
+
+	for _, mode := range []TransportMode{TransportModeRaw, TransportModeAuto} {
+		done := make(chan struct{}, 2)
+		ie := NewFullConfig(hclog.NewNullLogger(), done, time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), false)
+		ie.SetTransportMode(mode)
+		ie.SetSocketsPerProtocol(2)
+		ie.Start()
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		go ie.Run(wg)
+
+		for _, p := range ie.Protocols {
+			for _, transport := range ie.Sockets.Transports[p] {
+				if !transport.Capabilities().Privileged {
+					t.Errorf(fmt.Sprintf("TestRawTransport mode:%d protocol:%d not a RawTransport", mode, p))
+				}
+			}
+		}
+
+		count := 3
+		for _, IP := range []string{"127.0.0.1", "::1"} {
+			results := ie.Pinger(netaddr.MustParseIP(IP), Sequence(count), 10*time.Millisecond, false, make(chan struct{}))
+			if results.Successes != count {
+				t.Errorf(fmt.Sprintf("TestRawTransport mode:%d [%s] Successes:%d Failures:%d", mode, IP, results.Successes, results.Failures))
+			}
+		}
+
+		done <- struct{}{}
+		wg.Wait()
+	}
+}
@@ -3,10 +3,12 @@
 package icmpengine
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"inet.af/netaddr"
@@ -16,15 +18,6 @@ const (
 	//ReceiveBufferMax = 1500 // max packet receive size
 	ReceiveBufferMax = 200 // max packet receive size
 
-	// Timeouts In A Row (tiar) to slowly back off the socket deadline timeout
-	tiarLow    = 5
-	tiarMedium = 10
-	tiarHigh   = 20
-
-	multiLow    = 2
-	multiMedium = 10
-	multiHigh   = 20
-
 	RdebugLevel = 111
 )
 
@@ -36,44 +29,20 @@ var bufPool = sync.Pool{
 	},
 }
 
-// timeoutsInARowCalculator (Timeouts In A Row) is just a simple function to return
-// the multiplier amount based on a simple table.
-// This is just a wrapper using constants around the tiarCalculator
-func timeoutsInARowCalculator(timeoutsInARow int) (multiplier float64) {
-	return tiarCalculator(timeoutsInARow, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh)
-}
-
-// tiarCalculator (Timeouts In A Row) is just a simple function to return
-// the multiplier amount based on a simple table.  Probably a tree structure
-// could be used, or a y = mX+c style function, but this will do the job
-// tiarCalculator is seperated to allow for testing
-func tiarCalculator(tiar int, low int, medium int, high int, mLow float64, mMedium float64, mHigh float64) (multiplier float64) {
-	multiplier = 1
-	if tiar >= high {
-		multiplier = mHigh
-	} else {
-		if tiar >= medium {
-			multiplier = mMedium
-		} else {
-			if tiar >= low {
-				multiplier = mLow
-			}
-		}
-	}
-	return multiplier
-}
-
 // Receiver receives ICMP messages, calculates the round-trip-time(RTT) and then send the response to the requesting Pinger
 // Receiver is also responsible for tracking the timeouts, using the double-linked-list and map
-// ie.ReadDeadline is used to not just block forever on the read call, so we can check the Done channel has been called
-// When choosing the ReadDeadline, it's just changing how quickly the Receiver might detect the Done signal
 //
-// Because ReadFrom syscall is blocking, a SetReadDeadline is used to allow ReadFrom to finish,
-// this is mostly to allow checking for the done signal, and therefore allow closing down the Receivers
-// gracefully.
-// There is [Timeouts In A Row] code that increases these timeouts gradually, to decrease the ReadFrom thrashing
+// The ReadFrom blocks without any deadline, so an idle Receiver doesn't wake up at all.
+// Originally a SetReadDeadline was used, so the Receiver could periodically check the done
+// channels, with [Timeouts In A Row] code to back off the deadline, but this meant idle
+// processes kept waking up, and Stop() could take up to ReadDeadline*20.
+// Now Stop() closes the done channels, and then closes the sockets, which makes the
+// blocked ReadFrom return immediately with net.ErrClosed, and the Receiver returns.
 //
-func (ie *ICMPEngine) Receiver(proto Protocol, index int, allDone <-chan struct{}, done <-chan struct{}) {
+// Receiver reads from the single Transport sock, of the Transports for the protocol
+// The Transport is passed in when the Receiver is started, because a quick Stop() can
+// close and remove the Transports before the Receiver goroutine has even run
+func (ie *ICMPEngine) Receiver(proto Protocol, sock int, index int, transport Transport, allDone <-chan struct{}, done <-chan struct{}) {
 
 	if ie.Sockets.DebugLevel > 100 {
 		ie.Log.Info("Receiver \t proto:%d \t index:%d acquiring ie.RLock()")
@@ -92,95 +61,38 @@ func (ie *ICMPEngine) Receiver(proto Protocol, index int, allDone <-chan struct{
 	}
 
 	if ie.Receivers.DebugLevel > 100 {
-		ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, start \t Receiver c:%s", proto, index, (ie.Sockets.Sockets[proto]).LocalAddr()))
+		ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, start \t Receiver sock:%d \t c:%s", proto, index, sock, transport.LocalAddr()))
 	}
 
 	defer ie.Receivers.WG.Done()
 
-	for i, keepLooping, timeouts, timeoutsInARow := 0, true, 0, 0; keepLooping; i++ {
+	for i, keepLooping := 0, true; keepLooping; i++ {
 
 		//buffer := make([]byte, ReceiveBufferMax)
 		buffer := bufPool.Get().(*[]byte)
 
-		// We increase the timeouts when there have been a lot of timeouts in a row, to reduce thrashing on the syscall
-		var readDealLine time.Duration = time.Duration(float64(ie.ReadDeadline) * timeoutsInARowCalculator(timeoutsInARow))
-
-		(ie.Sockets.Sockets[proto]).SetReadDeadline(time.Now().Add(readDealLine))
 		if ie.Receivers.DebugLevel > 100 {
-			ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, ReadFrom start with timeout, i:%d \t readDealLine:%s \t keepLooping:%t \tTimeouts:%d \t timeoutsInARow:%d", proto, index, i, readDealLine.String(), keepLooping, timeouts, timeoutsInARow))
+			ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, ReadFrom start, i:%d", proto, index, i))
 		}
 
-		n, peer, err := (ie.Sockets.Sockets[proto]).ReadFrom(*buffer) // <------------------------- ReadFrom (blocking until timeout)
-		receiveTime := time.Now()
+		n, peer, err := transport.Receive(*buffer) // <------------------------- Receive (blocking until a packet, or the Transport is closed)
+		receiveTime := ie.Clock.Now()
 		if err != nil {
-			if err.(net.Error).Timeout() {
-				timeouts++
-				timeoutsInARow++
-				if ie.Receivers.DebugLevel > 100 {
-					ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, ReadFrom Timeouts:%d \t timeoutsInARow:%d", proto, index, timeouts, timeoutsInARow))
-				}
-				// Do NOT continue here, because we need to check the done channel below
-			} else {
-				if ie.Receivers.DebugLevel > 100 {
-					ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, ReadFrom actual error", proto, index))
+			if receiverClosed(err, allDone, done) {
+				if ie.Receivers.DebugLevel > 10 {
+					ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, socket closed", proto, index))
 				}
-				log.Fatal(fmt.Sprintf("Receiver\t proto:%d \t index:%d \t err:%v", proto, index, err))
+				bufPool.Put(buffer)
+				break
 			}
-		} else {
-			timeoutsInARow = 0
+			if ie.Receivers.DebugLevel > 100 {
+				ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, ReadFrom actual error", proto, index))
+			}
+			log.Fatal(fmt.Sprintf("Receiver\t proto:%d \t index:%d \t err:%v", proto, index, err))
 		}
 
 		if n > 0 {
-
-			if ie.Receivers.DebugLevel > 1000 {
-				ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, receiveTime:%s\t n:%d\t peer:%s", proto, index, receiveTime, n, peer))
-			}
-
-			echoReply, err := ParseICMPEchoReply(*buffer)
-
-			if err != nil {
-				ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, ParseMessage error:%s", proto, index, err))
-			} else {
-
-				host, _, err := net.SplitHostPort(peer.String())
-				if err != nil {
-					if ie.Receivers.DebugLevel > 100 {
-						ie.Log.Info(fmt.Sprintf("Receiver \t proto:%d \t index:%d, SplitHostPort error::%s", proto, index, err))
-					}
-				}
-				ip := netaddr.MustParseIP(host)
-				s := Sequence(echoReply.Seq)
-
-				ie.RLock() // <------------------ READ LOCK!!
-				el, exists := ie.Pingers.Pings[ip][s]
-				ie.RUnlock() // <---------------- READ UNLOCK!!
-
-				if !exists {
-					if ie.Receivers.DebugLevel > 10 {
-						ie.Log.Info(fmt.Sprintf("Receiver [%s] \t proto:%d \t index:%d, Unknown ICMP reply message.  Where on earth did this come from??!!", ip.String(), proto, index))
-					}
-				} else {
-					rttDuration := receiveTime.Sub(el.Value.(Pings).Send)
-					if ie.Receivers.DebugLevel > 100 {
-						ie.Log.Info(fmt.Sprintf("Receiver [%s] \t Exists \t proto:%d \t index:%d, m.Seq:%d\t rttDuration:%s", ip.String(), proto, index, echoReply.Seq, rttDuration.String()))
-					}
-
-					ps := &PingSuccess{
-						Seq:      s,
-						Send:     el.Value.(Pings).Send,
-						Received: receiveTime,
-						RTT:      rttDuration,
-					}
-					ie.Lock() // <--------------- LOCK!!
-					ie.Pingers.SuccessChs[ip] <- *ps
-					delete(ie.Pingers.Pings[ip], s)
-					ie.Pingers.ExpiresDLL.Remove(el)
-					ie.Unlock() // <------------- UNLOCK!!
-					if ie.Receivers.DebugLevel > 100 {
-						ie.Log.Info(fmt.Sprintf("Receiver [%s] \t proto:%d \t index:%d, ie.SuccessChs[ip] <- *ps, delete, remove from  ExpiresDLL", ip.String(), proto, index))
-					}
-				}
-			}
+			ie.receivePacket(proto, index, (*buffer)[:n], peer, receiveTime)
 		}
 		bufPool.Put(buffer)
 
@@ -207,3 +119,143 @@ func (ie *ICMPEngine) Receiver(proto Protocol, index int, allDone <-chan struct{
 		ie.Log.Info(fmt.Sprintf("Receiver \t proto:%d \t index:%d, done", proto, index))
 	}
 }
+
+// matchReply looks up the outstanding ping for the reply, and if it exists removes the
+// ping from the shard, and delivers the PingSuccess to the Pinger Session
+// The lookup and the delete are done with the single shard lock, so the Expirer
+// can't also expire the ping between them.  The delivery is after the unlock, and
+// never blocks, see Dispatch.go
+func (ie *ICMPEngine) matchReply(ip netaddr.IP, s Sequence, receiveTime time.Time) (ps PingSuccess, exists bool) {
+
+	shard := ie.shard(ip)
+	shard.Lock() // <-------------------------- LOCK!!
+	el, exists := shard.Pings[ip][s]
+	if !exists {
+		shard.Unlock() // <-------------------- UNLOCK!!
+		return ps, false
+	}
+
+	send := el.Ping.Send
+	ps = PingSuccess{
+		Seq:      s,
+		Send:     send,
+		Received: receiveTime,
+		RTT:      receiveTime.Sub(send),
+	}
+	session := shard.Sessions[ip]
+	delete(shard.Pings[ip], s)
+	shard.Expiries.Remove(el)
+	shard.Unlock() // <------------------------ UNLOCK!!
+
+	if session != nil {
+		session.deliverSuccess(ps, ie.Counters)
+	}
+	return ps, true
+}
+
+// receivePacket handles a single received packet, from either the Receiver or the ReceiverBatch
+// receivePacket injects any faults, and then processes the packet
+func (ie *ICMPEngine) receivePacket(proto Protocol, index int, b []byte, peer net.Addr, receiveTime time.Time) {
+
+	if ie.Receivers.DebugLevel > 1000 {
+		ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, receiveTime:%s\t n:%d\t peer:%s", proto, index, receiveTime, len(b), peer))
+	}
+
+	atomic.AddUint64(&ie.Counters.ReceiverPackets, 1)
+
+	if ie.Capture != nil {
+		ie.capture(receiveTime, peer, false, b)
+	}
+
+	// the faults are only looked up while there are fault policies, see Faults.go
+	if atomic.LoadInt32(&ie.Faults.active) > 0 && ie.injectFaults(proto, index, b, peer, receiveTime) {
+		return
+	}
+	ie.processPacket(proto, index, b, peer, receiveTime)
+}
+
+// processPacket parses the ICMP echo reply, and matches it to the outstanding ping
+func (ie *ICMPEngine) processPacket(proto Protocol, index int, b []byte, peer net.Addr, receiveTime time.Time) {
+
+	// m is on the stack, and parsed from the pooled buffer, so this doesn't allocate
+	var m ICMPMessage
+	err := ParseICMPMessage(proto, b, &m)
+
+	if errors.Is(err, errICMPType) {
+		atomic.AddUint64(&ie.Counters.RejectedType, 1)
+		if ie.Receivers.DebugLevel > 10 {
+			ie.Log.Info(fmt.Sprintf("Receiver \t proto:%d \t index:%d, unsupported Type:%d Code:%d peer:%s", proto, index, b[0], b[1], peer))
+		}
+	} else if err != nil {
+		atomic.AddUint64(&ie.Counters.RejectedParse, 1)
+		ie.Log.Info(fmt.Sprintf("Receiver\t proto:%d \t index:%d, ParseMessage error:%s", proto, index, err))
+	} else if m.Error {
+		// the ICMP errors, which the simulated and replay Transports can deliver, aren't replies,
+		// so the probe is left to expire.  They are counted separately from the unsupported types
+		atomic.AddUint64(&ie.Counters.ICMPErrors, 1)
+		if ie.Receivers.DebugLevel > 10 {
+			ie.Log.Info(fmt.Sprintf("Receiver [%s] \t proto:%d \t index:%d, ICMP error Type:%d Code:%d Seq:%d peer:%s", m.Target, proto, index, m.Type, m.Code, m.Seq, peer))
+		}
+	} else {
+
+		ip, ok := peerIP(peer)
+		if !ok {
+			atomic.AddUint64(&ie.Counters.RejectedParse, 1)
+			if ie.Receivers.DebugLevel > 10 {
+				ie.Log.Info(fmt.Sprintf("Receiver \t proto:%d \t index:%d, invalid peer:%s", proto, index, peer))
+			}
+			return
+		}
+		s := Sequence(m.Seq)
+
+		ps, exists := ie.matchReply(ip, s, receiveTime)
+
+		if !exists {
+			duplicate := ie.Counters.Unknown(ip, s)
+			if ie.Receivers.DebugLevel > 10 {
+				ie.Log.Info(fmt.Sprintf("Receiver [%s] \t proto:%d \t index:%d, Unknown ICMP reply message, duplicate:%t.  Where on earth did this come from??!!", ip.String(), proto, index, duplicate))
+			}
+		} else {
+			if ie.Receivers.DebugLevel > 100 {
+				ie.Log.Info(fmt.Sprintf("Receiver [%s] \t Exists \t proto:%d \t index:%d, m.Seq:%d\t rttDuration:%s, delete, remove from Expiries, deliverSuccess", ip.String(), proto, index, m.Seq, ps.RTT.String()))
+			}
+		}
+	}
+}
+
+// receiverClosed returns if the read error is because Stop() closed the socket
+// A closed socket without the done channels being closed is still an error
+func receiverClosed(err error, allDone <-chan struct{}, done <-chan struct{}) (closed bool) {
+	if !errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	select {
+	case <-allDone:
+		return true
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// peerIP returns the IP of the peer address, without allocating
+// Originally this was netaddr.MustParseIP of the SplitHostPort of peer.String(),
+// which allocated the strings for every packet
+func peerIP(peer net.Addr) (ip netaddr.IP, ok bool) {
+	switch a := peer.(type) {
+	case *net.UDPAddr:
+		return netaddr.FromStdIP(a.IP)
+	case *net.IPAddr:
+		return netaddr.FromStdIP(a.IP)
+	}
+	if peer == nil {
+		return ip, false
+	}
+	host, _, err := net.SplitHostPort(peer.String())
+	if err != nil {
+		return ip, false
+	}
+	ip, err = netaddr.ParseIP(host)
+	return ip, err == nil
+}
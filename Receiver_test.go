@@ -3,93 +3,134 @@
 package icmpengine
 
 import (
+	"encoding/binary"
 	"fmt"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"inet.af/netaddr"
 )
 
 const (
 	testDebugLevel int = 11
 )
 
-// testsT struct defines the inputs for the tests
-type rTestT struct {
-	i        float32
-	tiar     int
-	low      int
-	medium   int
-	high     int
-	mLow     float64
-	mMedium  float64
-	mHigh    float64
-	result   float64
-	expected bool
-}
+// TestReceiverStop checks Stop() returns promptly, even with a very long ReadDeadline,
+// because closing the sockets wakes up the Receivers blocked in ReadFrom
+// This needs the non-privileged ICMP sockets, so is skipped if they can't be opened
+func TestReceiverStop(t *testing.T) {
 
-// TestTiarCalculator tests receiver.go tiarCalculator function
-func TestTiarCalculator(t *testing.T) {
-	var tests = []rTestT{
-		{0.10, 0, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, 1, true},
-		{0.20, 1, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, 1, true},
-		{0.30, tiarLow - 1, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, 1, true},
-		{0.40, 100, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, multiHigh, true},
-		{0.50, 1000, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, multiHigh, true},
-		//
-		{1.10, tiarLow, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, multiLow, true},
-		{1.20, tiarLow + 1, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, multiLow, true},
-		//
-		{2.10, tiarMedium - 1, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, multiLow, true},
-		{2.20, tiarMedium, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, multiMedium, true},
-		{2.30, tiarMedium + 1, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, multiMedium, true},
-		//
-		{3.10, tiarHigh - 1, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, multiMedium, true},
-		{3.20, tiarHigh, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, multiHigh, true},
-		{3.30, tiarHigh + 1, tiarLow, tiarMedium, tiarHigh, multiLow, multiMedium, multiHigh, multiHigh, true},
-		//
-		{4.00, 0, 10, 20, 30, 1, 2, 3, 1, true},
-		{4.10, 1, 10, 20, 30, 1, 2, 3, 1, true},
-		{4.20, 2, 10, 20, 30, 1, 2, 3, 1, true},
-		{4.30, 10, 10, 20, 30, 1, 2, 3, 1, true},
-		{4.40, 19, 10, 20, 30, 1, 2, 3, 1, true},
-		{4.50, 20, 10, 20, 30, 1, 2, 3, 2, true},
-		{4.60, 29, 10, 20, 30, 1, 2, 3, 2, true},
-		{4.70, 30, 10, 20, 30, 1, 2, 3, 3, true},
-		{4.80, 31, 10, 20, 30, 1, 2, 3, 3, true},
-		//
-		{5.00, 0, 100, 200, 300, 2, 3, 4, 1, true},
-		{5.10, 1, 100, 200, 300, 2, 3, 4, 1, true},
-		{5.20, 2, 100, 200, 300, 2, 3, 4, 1, true},
-		{5.30, 100, 100, 200, 300, 2, 3, 4, 2, true},
-		{5.40, 200, 100, 200, 300, 2, 3, 4, 3, true},
-		{5.50, 300, 100, 200, 300, 2, 3, 4, 4, true},
+	probe, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		t.Skip(fmt.Sprintf("TestReceiverStop can't open ICMP socket:%v", err))
 	}
+	probe.Close()
 
 	logger := hclog.Default()
-	if testDebugLevel > 100 {
-		logger.Info("\n\n======================================")
+	done := make(chan struct{}, 2)
+	ie := NewFullConfig(logger, done, time.Second, time.Hour, false, 2, 2, false, GetDebugLevels(testDebugLevel), false)
+	ie.SetSocketsPerProtocol(2)
+	ie.Start()
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+
+	// let the Receivers block in ReadFrom
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	done <- struct{}{}
+	wg.Wait()
+	stopDuration := time.Since(start)
+
+	if stopDuration > time.Second {
+		t.Errorf(fmt.Sprintf("TestReceiverStop took:%s", stopDuration))
+	}
+	if ie.Sockets.Open {
+		t.Errorf("TestReceiverStop sockets still open")
 	}
+}
 
-	for i, test := range tests {
-		if testDebugLevel > 100 {
-			logger.Info("======================================")
-		}
-		if testDebugLevel > 100 {
-			logger.Info(fmt.Sprintf("TesttimeoutsInARowCalculator \t i:%d \t test.i:%.2f \t test.result:%.2f", i, test.i, test.result))
-		}
+// TestReceivePacketAllocs checks the receive path, from the pooled buffer, through the
+// parsing and matching, to the delivery to the Session, doesn't allocate
+func TestReceivePacketAllocs(t *testing.T) {
 
-		result := tiarCalculator(test.tiar, test.low, test.medium, test.high, test.mLow, test.mMedium, test.mHigh)
+	if IsRaceEnabled {
+		t.Skip("allocations are not accurate with the race detector")
+	}
 
-		if result != test.result {
-			t.Errorf(fmt.Sprintf("TesttimeoutsInARowCalculator\ti:%d\ttest.i:%f", i, test.i))
-		}
+	runs := 1000
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Hour, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+	IP := netaddr.MustParseIP("192.0.2.1")
+	peer := &net.UDPAddr{IP: IP.IPAddr().IP}
+	session := newSession(IP, runs+1, DispatchDropNewest, nil)
 
-		if testDebugLevel > 10 {
-			logger.Info(fmt.Sprintf("TesttimeoutsInARowCalculator \t i:%d \t test.i:%.2f \t test.result:%.2f \t result:%.2f", i, test.i, test.result, result))
-		}
+	shard := ie.shard(IP)
+	shard.Lock()
+	shard.Sessions[IP] = session
+	shard.Pings[IP] = make(map[Sequence]*ExpiryEntry)
+	now := time.Now()
+	for seq := Sequence(0); int(seq) <= runs; seq++ {
+		shard.Pings[IP][seq] = ie.insertExpiry(shard, Pings{NetaddrIP: IP, Seq: seq, Send: now, Expiry: now.Add(time.Hour)})
+	}
+	shard.Unlock()
+
+	reply, err := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 1}}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("TestReceivePacketAllocs Marshal:%v", err)
+	}
+	buffer := bufPool.Get().(*[]byte)
+	b := (*buffer)[:copy(*buffer, reply)]
+
+	var seq Sequence
+	allocs := testing.AllocsPerRun(runs, func() {
+		binary.BigEndian.PutUint16(b[6:8], uint16(seq))
+		ie.receivePacket(Protocol(4), 0, b, peer, now)
+		seq++
+	})
+	if allocs != 0 {
+		t.Errorf(fmt.Sprintf("TestReceivePacketAllocs allocs:%f", allocs))
+	}
+	if len(session.SuccessCh) != runs+1 {
+		t.Errorf(fmt.Sprintf("TestReceivePacketAllocs delivered:%d", len(session.SuccessCh)))
+	}
 
-		if testDebugLevel > 100 {
-			logger.Info("======================================")
+	// unknown replies, which are now all duplicates
+	allocs = testing.AllocsPerRun(runs, func() {
+		binary.BigEndian.PutUint16(b[6:8], uint16(seq%Sequence(runs)))
+		ie.receivePacket(Protocol(4), 0, b, peer, now)
+		seq++
+	})
+	if allocs != 0 {
+		t.Errorf(fmt.Sprintf("TestReceivePacketAllocs unknown allocs:%f", allocs))
+	}
+	bufPool.Put(buffer)
+}
+
+// TestPeerIP checks the peer address types, including IPv4 mapped
+func TestPeerIP(t *testing.T) {
+
+	var tests = []struct {
+		peer net.Addr
+		want string
+		ok   bool
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, "192.0.2.1", true},
+		{&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4()}, "192.0.2.1", true},
+		{&net.IPAddr{IP: net.ParseIP("2001:db8::1")}, "2001:db8::1", true},
+		{&net.UDPAddr{IP: nil}, "", false},
+		{nil, "", false},
+	}
+	for _, test := range tests {
+		ip, ok := peerIP(test.peer)
+		if ok != test.ok || (ok && ip.String() != test.want) {
+			t.Errorf(fmt.Sprintf("TestPeerIP peer:%v got:%s ok:%t", test.peer, ip, ok))
 		}
 	}
 }
@@ -0,0 +1,281 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Replay holds the ReplayNetwork, which replays the ICMP replies from a recorded capture back
+// into the engine, through the ReplayTransport, so the bugs seen in production, e.g. odd
+// reordering or duplicates, can be reproduced in the unit tests, against the real Receiver
+// and Expirer code paths
+//
+// The ReplayTransport is the in-memory transport shared with the SimNetwork, see MemTransport.go
+//
+// The engine sends its own echo requests, so the recorded replies are replayed relative to
+// the engine's probes, rather than at the absolute recorded times:
+// - The recorded echo requests to each target are numbered from the first recorded sequence
+//   number to the target, so the engine's probe with sequence 0 is the first recorded request
+// - Each recorded reply, and each ICMP error quoting a request, is matched to the recorded
+//   request by the target, identifier and sequence number, and is replayed at the recorded
+//   offset after the request, divided by the Speed, after the engine sends the probe
+// - The recorded replies without a request, e.g. replies to requests from before the capture
+//   started, are replayed relative to the first request to the target, when the engine sends
+//   its first probe to the target
+//
+// So the losses, RTTs, duplicates and reordering are all replayed as recorded.  The replies
+// are rewritten with the ReplayTransport identifier, and the engine's sequence numbers, and the
+// IPv4 checksums are recalculated.  The ICMP errors are delivered from the recorded source.
+//
+// Speed is the replay speed, where 1 ( the default ) is the original timing, and 2 is twice as
+// fast.  The Clock can be the FakeClock, see Clock.go.  The engine probes beyond the recorded
+// requests are not answered, so they expire.  The replies are relative to each probe, so to
+// reproduce the recorded reordering across the probes, the Pinger interval should be the
+// recorded interval divided by the Speed.
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// ReplayStats are the ReplayNetwork counters
+// Skipped is the recorded packets which couldn't be replayed, and Unmatched is the engine
+// probes which don't have a recorded request
+type ReplayStats struct {
+	Sent      uint64
+	Replayed  uint64
+	Unmatched uint64
+	Overflows uint64
+	Invalid   uint64
+	Skipped   uint64
+}
+
+// replayReply is a recorded reply, or ICMP error, and its offset after the request
+// quoted is the offset of the quoted echo request in an ICMP error, or zero for a reply
+type replayReply struct {
+	offset time.Duration
+	peer   netaddr.IP
+	icmp   []byte
+	quoted int
+	seq    Sequence
+}
+
+// replayTarget is the recorded requests to a target, by the engine sequence number
+type replayTarget struct {
+	first    time.Time
+	firstSeq uint16
+	requests map[Sequence][]replayReply
+	orphans  []replayReply
+	started  bool
+}
+
+// replayKey matches the replies to the recorded requests
+type replayKey struct {
+	IP  netaddr.IP
+	ID  uint16
+	Seq uint16
+}
+
+// replayRequest is a recorded request
+type replayRequest struct {
+	time time.Time
+	seq  Sequence
+}
+
+// ReplayNetwork is the replayed network, see the top of this file
+// Stats is first, like the SimNetwork
+type ReplayNetwork struct {
+	Stats ReplayStats
+	sync.Mutex
+	Speed    float64
+	Local4   netaddr.IP
+	Local6   netaddr.IP
+	QueueLen int
+	Clock    Clock
+	targets  map[netaddr.IP]*replayTarget
+	nextID   int
+}
+
+// NewReplayNetwork creates the ReplayNetwork from the captured packets, see ReadCapture
+// speed is the replay speed, where zero is the original timing
+func NewReplayNetwork(packets []CapturedPacket, speed float64) (n *ReplayNetwork) {
+	if speed <= 0 {
+		speed = 1
+	}
+	n = &ReplayNetwork{
+		Speed:    speed,
+		Local4:   netaddr.IPv4(127, 0, 0, 1),
+		Local6:   netaddr.IPv6Raw([16]byte{15: 1}),
+		QueueLen: SimQueueLenCst,
+		Clock:    RealClock{},
+		targets:  make(map[netaddr.IP]*replayTarget),
+		nextID:   1,
+	}
+
+	var sorted []CapturedPacket
+	for _, p := range packets {
+		if len(p.ICMP) < EchoLenCst {
+			n.Stats.Skipped++
+			continue
+		}
+		sorted = append(sorted, p)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	// the requests first, so the replies can be matched regardless of the order
+	requests := make(map[replayKey]replayRequest)
+	for _, p := range sorted {
+		if p.ICMP[0] != echoRequestType(p.Proto) {
+			continue
+		}
+		t, exists := n.targets[p.Dst]
+		if !exists {
+			t = &replayTarget{
+				first:    p.Time,
+				firstSeq: binary.BigEndian.Uint16(p.ICMP[6:8]),
+				requests: make(map[Sequence][]replayReply),
+			}
+			n.targets[p.Dst] = t
+		}
+		key := replayKey{IP: p.Dst, ID: binary.BigEndian.Uint16(p.ICMP[4:6]), Seq: binary.BigEndian.Uint16(p.ICMP[6:8])}
+		if _, exists := requests[key]; exists {
+			continue
+		}
+		seq := Sequence(key.Seq - t.firstSeq)
+		requests[key] = replayRequest{time: p.Time, seq: seq}
+		if _, exists := t.requests[seq]; !exists {
+			t.requests[seq] = nil
+		}
+	}
+
+	for _, p := range sorted {
+		if p.ICMP[0] == echoRequestType(p.Proto) {
+			continue
+		}
+		// the ICMP error quotes the IP header and the echo request, so the target is the quoted destination
+		var m ICMPMessage
+		if ParseICMPMessage(p.Proto, p.ICMP, &m) != nil {
+			n.Stats.Skipped++
+			continue
+		}
+		target := p.Src
+		if m.Error {
+			target = m.Target
+		}
+		t, exists := n.targets[target]
+		if !exists {
+			n.Stats.Skipped++
+			continue
+		}
+		key := replayKey{IP: target, ID: m.Identifier, Seq: m.Seq}
+		reply := replayReply{peer: p.Src, icmp: p.ICMP, quoted: m.EchoOffset}
+		if request, exists := requests[key]; exists {
+			reply.offset = p.Time.Sub(request.time)
+			reply.seq = request.seq
+			t.requests[request.seq] = append(t.requests[request.seq], reply)
+			continue
+		}
+		reply.offset = p.Time.Sub(t.first)
+		reply.seq = Sequence(key.Seq - t.firstSeq)
+		t.orphans = append(t.orphans, reply)
+	}
+	return n
+}
+
+// GetStats returns a copy of the ReplayStats
+func (n *ReplayNetwork) GetStats() (stats ReplayStats) {
+	return ReplayStats{
+		Sent:      atomic.LoadUint64(&n.Stats.Sent),
+		Replayed:  atomic.LoadUint64(&n.Stats.Replayed),
+		Unmatched: atomic.LoadUint64(&n.Stats.Unmatched),
+		Overflows: atomic.LoadUint64(&n.Stats.Overflows),
+		Invalid:   atomic.LoadUint64(&n.Stats.Invalid),
+		Skipped:   atomic.LoadUint64(&n.Stats.Skipped),
+	}
+}
+
+// Factory is the TransportFactory for the ReplayTransports
+func (n *ReplayNetwork) Factory(ie *ICMPEngine, proto Protocol, index int) (t Transport, err error) {
+	return n.NewTransport(proto), nil
+}
+
+// NewTransport creates a ReplayTransport on the ReplayNetwork, with the next identifier
+func (n *ReplayNetwork) NewTransport(proto Protocol) (t *ReplayTransport) {
+	n.Lock()
+	defer n.Unlock()
+	t = &ReplayTransport{}
+	t.init("ReplayTransport", proto, n, n.nextID, n.QueueLen)
+	n.nextID++
+	return t
+}
+
+// schedule implements memNetwork, scheduling the recorded replies for the echo request
+// The replies are delayed by the recorded offset, divided by the Speed
+func (n *ReplayNetwork) schedule(proto Protocol, id int, IP netaddr.IP, request []byte) (deliveries []simDelivery) {
+	replies, exists := n.replies(IP, Sequence(binary.BigEndian.Uint16(request[6:8])))
+	if !exists {
+		atomic.AddUint64(&n.Stats.Unmatched, 1)
+	}
+	for _, r := range replies {
+		deliveries = append(deliveries, simDelivery{
+			packet: simPacket{b: r.rewrite(proto, id), peer: r.peer.IPAddr()},
+			delay:  time.Duration(float64(r.offset) / n.Speed),
+		})
+	}
+	return deliveries
+}
+
+// counters implements memNetwork, where the delivered packets are the Replayed
+func (n *ReplayNetwork) counters() memCounters {
+	return memCounters{sent: &n.Stats.Sent, invalid: &n.Stats.Invalid, delivered: &n.Stats.Replayed, overflows: &n.Stats.Overflows}
+}
+
+// clock implements memNetwork
+func (n *ReplayNetwork) clock() Clock {
+	return n.Clock
+}
+
+// local implements memNetwork
+func (n *ReplayNetwork) local(proto Protocol) netaddr.IP {
+	if proto == Protocol(6) {
+		return n.Local6
+	}
+	return n.Local4
+}
+
+// replies returns the recorded replies for the engine probe, plus the orphans for the first probe
+// exists is false if there is no recorded request for the probe
+func (n *ReplayNetwork) replies(IP netaddr.IP, seq Sequence) (replies []replayReply, exists bool) {
+	n.Lock()
+	defer n.Unlock()
+	t, exists := n.targets[IP]
+	if !exists {
+		return nil, false
+	}
+	if !t.started {
+		t.started = true
+		replies = append(replies, t.orphans...)
+	}
+	recorded, exists := t.requests[seq]
+	return append(replies, recorded...), exists
+}
+
+// rewrite returns a copy of the recorded reply, with the identifier and sequence number of the probe
+func (r replayReply) rewrite(proto Protocol, id int) (b []byte) {
+	b = append([]byte(nil), r.icmp...)
+	echo := b[r.quoted:]
+	binary.BigEndian.PutUint16(echo[4:6], uint16(id))
+	binary.BigEndian.PutUint16(echo[6:8], uint16(r.seq))
+	if proto == Protocol(4) {
+		binary.BigEndian.PutUint16(b[2:4], 0)
+		binary.BigEndian.PutUint16(b[2:4], internetChecksum(b))
+	}
+	return b
+}
+
+// ReplayTransport is the Transport on the ReplayNetwork, see MemTransport.go
+type ReplayTransport struct {
+	memTransport
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// pcapFrames builds a microsecond pcap in the byte order, with the frames at one second intervals
+func pcapFrames(order binary.ByteOrder, linkType int, start time.Time, frames ...[]byte) []byte {
+	h := make([]byte, pcapHeaderLenCst)
+	order.PutUint32(h[0:4], PcapMagicMicroCst)
+	order.PutUint16(h[4:6], 2)
+	order.PutUint16(h[6:8], 4)
+	order.PutUint32(h[16:20], CaptureSnapLenCst)
+	order.PutUint32(h[20:24], uint32(linkType))
+	for i, f := range frames {
+		ts := start.Add(time.Duration(i) * time.Second)
+		r := make([]byte, pcapRecordHeaderLenCst)
+		order.PutUint32(r[0:4], uint32(ts.Unix()))
+		order.PutUint32(r[4:8], uint32(ts.Nanosecond()/1000))
+		order.PutUint32(r[8:12], uint32(len(f)))
+		order.PutUint32(r[12:16], uint32(len(f)))
+		h = append(append(h, r...), f...)
+	}
+	return h
+}
+
+// TestReadCapture checks the link types, the byte orders, and the skipped packets
+func TestReadCapture(t *testing.T) {
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 123456000, time.UTC)
+	src := netaddr.MustParseIP("198.51.100.1")
+	dst4 := netaddr.MustParseIP("192.0.2.1")
+	dst6 := netaddr.MustParseIP("2001:db8::1")
+	echo4 := NewEchoTemplate(Protocol(4), 7).Put(make([]byte, EchoLenCst), 1)
+	echo6 := NewEchoTemplate(Protocol(6), 7).Put(make([]byte, EchoLenCst), 2)
+
+	ip4 := append(putIPv4Header(nil, src, dst4, ProtocolICMPCst, EchoLenCst, ipv4DefaultTTLCst), echo4...)
+	ip6 := append(putIPv6Header(nil, netaddr.IPv6Unspecified(), dst6, ProtocolICMPv6Cst, EchoLenCst, ipv4DefaultTTLCst), echo6...)
+	udp := putIPv4Header(nil, src, dst4, 17, EchoLenCst, ipv4DefaultTTLCst)
+	udp = append(udp, make([]byte, EchoLenCst)...)
+
+	ethernet := func(etherType uint16, vlan bool, payload []byte) []byte {
+		f := make([]byte, 12, 64)
+		if vlan {
+			f = append(f, 0x81, 0x00, 0, 1)
+		}
+		f = append(f, byte(etherType>>8), byte(etherType))
+		return append(f, payload...)
+	}
+	sll := make([]byte, linuxSLLHeaderLenCst)
+	binary.BigEndian.PutUint16(sll[14:16], etherTypeIPv4Cst)
+
+	tests := []struct {
+		name    string
+		capture []byte
+		want    []netaddr.IP
+	}{
+		{"ethernet big endian", pcapFrames(binary.BigEndian, LinkTypeEthernetCst, start, ethernet(etherTypeIPv4Cst, false, ip4), ethernet(0x0806, false, ip4), ethernet(etherTypeIPv6Cst, true, ip6), ethernet(etherTypeIPv4Cst, false, udp)), []netaddr.IP{dst4, dst6}},
+		{"linux sll", pcapFrames(binary.LittleEndian, LinkTypeLinuxSLLCst, start, append(sll, ip4...)), []netaddr.IP{dst4}},
+		{"raw", pcapFrames(binary.LittleEndian, LinkTypeRawCst, start, ip6, ip4[:IPv4HeaderLenCst+4]), []netaddr.IP{dst6}},
+	}
+	for _, test := range tests {
+		packets, err := ReadCapture(bytes.NewReader(test.capture))
+		if err != nil || len(packets) != len(test.want) {
+			t.Errorf(fmt.Sprintf("TestReadCapture %s packets:%d err:%v", test.name, len(packets), err))
+			continue
+		}
+		for i, p := range packets {
+			if p.Dst != test.want[i] || len(p.ICMP) != EchoLenCst || !p.Time.After(start.Add(-time.Nanosecond)) {
+				t.Errorf(fmt.Sprintf("TestReadCapture %s i:%d packet:%+v", test.name, i, p))
+			}
+		}
+		if !packets[0].Time.Equal(start) {
+			t.Errorf(fmt.Sprintf("TestReadCapture %s Time:%s", test.name, packets[0].Time))
+		}
+	}
+
+	for _, invalid := range [][]byte{nil, []byte("not a capture at all"), pcapFrames(binary.LittleEndian, 228, start, ip4)} {
+		if _, err := ReadCapture(bytes.NewReader(invalid)); err == nil {
+			t.Errorf(fmt.Sprintf("TestReadCapture invalid:%x no error", invalid))
+		}
+	}
+}
+
+// TestReplayNetwork replays a recorded capture, with an RTT change, a duplicate, a loss,
+// an ICMP error, and a reply from before the capture started, through the full engine
+func TestReplayNetwork(t *testing.T) {
+
+	var buf bytes.Buffer
+	c, err := NewCapture(&buf, CapturePcapng)
+	if err != nil {
+		t.Fatalf(fmt.Sprintf("TestReplayNetwork err:%s", err))
+	}
+	target := netaddr.MustParseIP("192.0.2.1")
+	router := netaddr.MustParseIP("198.51.100.254")
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	template := NewEchoTemplate(Protocol(4), 999)
+	interval := 100 * time.Millisecond
+
+	// the recorded sequence numbers start at 100, and the recorded replies are offsets after each request
+	recorded := [][]time.Duration{{50 * time.Millisecond}, {50 * time.Millisecond, 60 * time.Millisecond}, nil, {150 * time.Millisecond}}
+	for i, offsets := range recorded {
+		sent := start.Add(time.Duration(i) * interval)
+		request := template.Put(make([]byte, EchoLenCst), Sequence(100+i))
+		c.Write(sent, Protocol(4), target, true, request)
+		for _, offset := range offsets {
+			c.Write(sent.Add(offset), Protocol(4), target, false, echoReply(Protocol(4), request))
+		}
+	}
+	errorSent := start.Add(4 * interval)
+	request := template.Put(make([]byte, EchoLenCst), Sequence(104))
+	c.Write(errorSent, Protocol(4), target, true, request)
+	c.Write(errorSent.Add(20*time.Millisecond), Protocol(4), router, false, icmpErrorMessage(Protocol(4), c.Local4, target, request))
+	orphan := echoReply(Protocol(4), template.Put(make([]byte, EchoLenCst), Sequence(90)))
+	c.Write(start.Add(-10*time.Millisecond), Protocol(4), target, false, orphan)
+
+	packets, err := ReadCapture(&buf)
+	if err != nil || len(packets) != 11 {
+		t.Fatalf(fmt.Sprintf("TestReplayNetwork packets:%d err:%v", len(packets), err))
+	}
+
+	speed := 5.0
+	replay := NewReplayNetwork(packets, speed)
+	ie, stop := startFactoryEngine(replay.Factory, 100*time.Millisecond)
+	defer stop()
+
+	// one more probe than recorded, which isn't answered
+	results := ie.Pinger(target, 6, time.Duration(float64(interval)/speed), false, make(chan struct{}))
+
+	if results.Successes != 3 || results.Failures != 3 {
+		t.Errorf(fmt.Sprintf("TestReplayNetwork Successes:%d Failures:%d", results.Successes, results.Failures))
+	}
+	if results.RTTs[0] < 10*time.Millisecond || results.RTTs[3] < 30*time.Millisecond || results.RTTs[3] > 80*time.Millisecond {
+		t.Errorf(fmt.Sprintf("TestReplayNetwork RTTs:%v", results.RTTs))
+	}
+	stats := replay.GetStats()
+	if stats.Sent != 6 || stats.Replayed != 6 || stats.Unmatched != 1 || stats.Skipped != 0 {
+		t.Errorf(fmt.Sprintf("TestReplayNetwork stats:%+v", stats))
+	}
+	if atomic.LoadUint64(&ie.Counters.ICMPErrors) != 1 {
+		t.Errorf(fmt.Sprintf("TestReplayNetwork ICMPErrors:%d", atomic.LoadUint64(&ie.Counters.ICMPErrors)))
+	}
+	// the duplicate, and the reply from before the capture
+	if unknown := atomic.LoadUint64(&ie.Counters.RejectedUnknown) + atomic.LoadUint64(&ie.Counters.RejectedDuplicates); unknown != 2 {
+		t.Errorf(fmt.Sprintf("TestReplayNetwork unknown and duplicates:%d", unknown))
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Results holds the serialization and merging of PingerResults
+//
+// The JSON and protobuf encodings are versioned with ResultsSchemaVersionCst,
+// and all durations have the units in the field name, e.g. min_ns.
+// The protobuf schema is in PingerResults.proto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+const (
+	ResultsSchemaVersionCst = 1
+)
+
+var (
+	errResultsIPMismatch     = errors.New("results IP mismatch")
+	errResultsSchemaVersion  = errors.New("results unsupported schema version")
+	errResultsInvalidIP      = errors.New("results invalid IP")
+	errResultsInvalidEncoded = errors.New("results invalid encoding")
+)
+
+// pingerResultsJSON is the stable JSON format of PingerResults
+// Variance is the sample variance in seconds squared, from the streaming statistics
+type pingerResultsJSON struct {
+	SchemaVersion    int        `json:"schema_version"`
+	IP               string     `json:"ip"`
+	Successes        int        `json:"successes"`
+	Failures         int        `json:"failures"`
+	OutOfOrder       int        `json:"out_of_order"`
+	Count            int        `json:"count"`
+	RTTsNs           []int64    `json:"rtts_ns,omitempty"`
+	MinNs            int64      `json:"min_ns"`
+	MaxNs            int64      `json:"max_ns"`
+	MeanNs           int64      `json:"mean_ns"`
+	SumNs            int64      `json:"sum_ns"`
+	PingerDurationNs int64      `json:"pinger_duration_ns"`
+	Stats            *statsJSON `json:"stats,omitempty"`
+	VarianceS2       float64    `json:"variance_s2"`
+	Seed             int64      `json:"seed,omitempty"`
+}
+
+// statsJSON is the stable JSON format of StreamingStats
+type statsJSON struct {
+	Count  uint64        `json:"count"`
+	MinNs  int64         `json:"min_ns"`
+	MaxNs  int64         `json:"max_ns"`
+	SumNs  int64         `json:"sum_ns"`
+	MeanS  float64       `json:"mean_s"`
+	M2S2   float64       `json:"m2_s2"`
+	Sketch *ddSketchJSON `json:"sketch,omitempty"`
+}
+
+// ddSketchJSON is the stable JSON format of DDSketch
+// The bin values are in nanoseconds
+type ddSketchJSON struct {
+	RelativeAccuracy float64  `json:"relative_accuracy"`
+	MaxBins          int      `json:"max_bins"`
+	Offset           int      `json:"offset"`
+	Bins             []uint64 `json:"bins"`
+	ZeroCount        uint64   `json:"zero_count"`
+	Count            uint64   `json:"count"`
+}
+
+// MarshalJSON encodes PingerResults in the stable JSON format
+func (r PingerResults) MarshalJSON() ([]byte, error) {
+
+	j := pingerResultsJSON{
+		SchemaVersion:    ResultsSchemaVersionCst,
+		Successes:        r.Successes,
+		Failures:         r.Failures,
+		OutOfOrder:       r.OutOfOrder,
+		Count:            r.Count,
+		MinNs:            int64(r.Min),
+		MaxNs:            int64(r.Max),
+		MeanNs:           int64(r.Mean),
+		SumNs:            int64(r.Sum),
+		PingerDurationNs: int64(r.PingerDuration),
+		Seed:             r.Seed,
+	}
+	if !r.IP.IsZero() {
+		j.IP = r.IP.String()
+	}
+	if r.RTTs != nil {
+		j.RTTsNs = make([]int64, len(r.RTTs))
+		for i, rtt := range r.RTTs {
+			j.RTTsNs[i] = int64(rtt)
+		}
+	}
+	if r.Stats != nil {
+		j.VarianceS2 = r.Stats.Variance()
+		j.Stats = &statsJSON{
+			Count: r.Stats.Count,
+			MinNs: int64(r.Stats.Min),
+			MaxNs: int64(r.Stats.Max),
+			SumNs: int64(r.Stats.Sum),
+			MeanS: r.Stats.Mean,
+			M2S2:  r.Stats.M2,
+		}
+		if r.Stats.Sketch != nil {
+			j.Stats.Sketch = &ddSketchJSON{
+				RelativeAccuracy: r.Stats.Sketch.RelativeAccuracy,
+				MaxBins:          r.Stats.Sketch.MaxBins,
+				Offset:           r.Stats.Sketch.Offset,
+				Bins:             r.Stats.Sketch.Bins,
+				ZeroCount:        r.Stats.Sketch.ZeroCount,
+				Count:            r.Stats.Sketch.Count,
+			}
+		}
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes PingerResults from the stable JSON format
+func (r *PingerResults) UnmarshalJSON(b []byte) (err error) {
+
+	var j pingerResultsJSON
+	err = json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	if j.SchemaVersion != ResultsSchemaVersionCst {
+		return fmt.Errorf("%w:%d", errResultsSchemaVersion, j.SchemaVersion)
+	}
+
+	*r = PingerResults{
+		Successes:      j.Successes,
+		Failures:       j.Failures,
+		OutOfOrder:     j.OutOfOrder,
+		Count:          j.Count,
+		Min:            time.Duration(j.MinNs),
+		Max:            time.Duration(j.MaxNs),
+		Mean:           time.Duration(j.MeanNs),
+		Sum:            time.Duration(j.SumNs),
+		PingerDuration: time.Duration(j.PingerDurationNs),
+		Seed:           j.Seed,
+	}
+	if j.IP != "" {
+		r.IP, err = netaddr.ParseIP(j.IP)
+		if err != nil {
+			return fmt.Errorf("%w:%v", errResultsInvalidIP, err)
+		}
+	}
+	if j.RTTsNs != nil {
+		r.RTTs = make([]time.Duration, len(j.RTTsNs))
+		for i, rtt := range j.RTTsNs {
+			r.RTTs[i] = time.Duration(rtt)
+		}
+	}
+	if j.Stats != nil {
+		r.Stats = &StreamingStats{
+			Count: j.Stats.Count,
+			Min:   time.Duration(j.Stats.MinNs),
+			Max:   time.Duration(j.Stats.MaxNs),
+			Sum:   time.Duration(j.Stats.SumNs),
+			Mean:  j.Stats.MeanS,
+			M2:    j.Stats.M2S2,
+		}
+		if j.Stats.Sketch != nil {
+			r.Stats.Sketch = NewDDSketch(j.Stats.Sketch.RelativeAccuracy, j.Stats.Sketch.MaxBins)
+			r.Stats.Sketch.Offset = j.Stats.Sketch.Offset
+			r.Stats.Sketch.Bins = j.Stats.Sketch.Bins
+			r.Stats.Sketch.ZeroCount = j.Stats.Sketch.ZeroCount
+			r.Stats.Sketch.Count = j.Stats.Sketch.Count
+			if err = r.Stats.Sketch.validate(); err != nil {
+				return fmt.Errorf("%w:%v", errResultsInvalidEncoded, err)
+			}
+		}
+		r.Variance = time.Duration(r.Stats.Variance() * float64(time.Second))
+	}
+	return nil
+}
+
+// AddSuccess records the RTT of the successful probe i, updating the statistics the same
+// way for the Pinger and the fake engines, see icmpenginetest
+// RTTs and Stats are only updated if they are allocated, e.g. RTTs is nil for SummaryOnly
+func (r *PingerResults) AddSuccess(i Sequence, rtt time.Duration) {
+	if int(i) < len(r.RTTs) {
+		r.RTTs[i] = rtt
+	}
+	if r.Stats != nil {
+		r.Stats.Add(rtt)
+	}
+	r.Sum += rtt
+	//{--------------------
+	// Welford's starts
+	if r.Successes == 0 {
+		r.Min = rtt
+		r.Max = rtt
+	} else {
+		if rtt < r.Min {
+			r.Min = rtt
+		}
+		if rtt > r.Max {
+			r.Max = rtt
+		}
+	}
+	r.Successes++
+	oldMean := r.Mean
+	r.Mean += time.Duration(float64(rtt-oldMean) / float64(r.Successes))
+	//s.s += (val - old_mean) * (val - s.mean)
+	// I'm doing something incorrectly with the variance conversions
+	r.Variance += time.Duration(((rtt.Seconds() - oldMean.Seconds()) * (rtt.Seconds() - r.Mean.Seconds()))) * time.Second
+	// Welford's ends
+	//}--------------------
+}
+
+// AddFailure records an expired probe
+func (r *PingerResults) AddFailure() {
+	r.Failures++
+}
+
+// Merge combines the other PingerResults into r, e.g. to aggregate the results
+// for the same target from many hosts or many runs
+// Counts and Sum are added, Min/Max are the extremes, and the Mean, Variance and
+// quantile sketch are combined from the streaming statistics
+// RTTs are appended ( if both results kept the RTTs ), and PingerDuration is the longest
+// The merge is into a copy, so r is unchanged if Merge returns an error
+func (r *PingerResults) Merge(o PingerResults) (err error) {
+
+	m := *r
+	if m.IP.IsZero() {
+		m.IP = o.IP
+	}
+	if !o.IP.IsZero() && o.IP != m.IP {
+		return fmt.Errorf("%w:%s != %s", errResultsIPMismatch, m.IP, o.IP)
+	}
+
+	if o.Successes > 0 {
+		if m.Successes == 0 || o.Min < m.Min {
+			m.Min = o.Min
+		}
+		if m.Successes == 0 || o.Max > m.Max {
+			m.Max = o.Max
+		}
+	}
+
+	// the results without Stats, e.g. decoded from older encodings, are rebuilt from the summary
+	switch {
+	case r.Stats != nil:
+		m.Stats = r.Stats.clone()
+	case r.Successes > 0:
+		m.Stats = r.summaryStats()
+	default:
+		m.Stats = NewStreamingStats()
+	}
+	stats := o.Stats
+	if stats == nil && o.Successes > 0 {
+		stats = o.summaryStats()
+	}
+	err = m.Stats.Merge(stats)
+	if err != nil {
+		return err
+	}
+
+	m.Successes += o.Successes
+	m.Failures += o.Failures
+	m.OutOfOrder += o.OutOfOrder
+	m.Count += o.Count
+	m.Sum += o.Sum
+	if o.PingerDuration > m.PingerDuration {
+		m.PingerDuration = o.PingerDuration
+	}
+	if r.RTTs != nil && o.RTTs != nil {
+		m.RTTs = append(append(make([]time.Duration, 0, len(r.RTTs)+len(o.RTTs)), r.RTTs...), o.RTTs...)
+	} else {
+		m.RTTs = nil
+	}
+
+	m.Mean = m.Stats.MeanDuration()
+	m.Variance = time.Duration(m.Stats.Variance() * float64(time.Second))
+
+	*r = m
+	return nil
+}
+
+// summaryStats rebuilds the streaming statistics from the Min, Max and Mean, for results
+// without Stats, so the merged Successes and Stats.Count stay consistent
+// The spread isn't known, so M2 is zero, and the sketch has the Mean for every success
+func (r *PingerResults) summaryStats() (s *StreamingStats) {
+	s = NewStreamingStats()
+	s.Count = uint64(r.Successes)
+	s.Min = r.Min
+	s.Max = r.Max
+	s.Sum = r.Sum
+	s.Mean = r.Mean.Seconds()
+	s.Sketch.addCount(float64(r.Mean), s.Count)
+	return s
+}
+
+// MergePingerResults merges all the results into a new PingerResults
+func MergePingerResults(results ...PingerResults) (merged PingerResults, err error) {
+	for i, r := range results {
+		if i == 0 {
+			merged.RTTs = []time.Duration{}
+		}
+		err = merged.Merge(r)
+		if err != nil {
+			return merged, err
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,354 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// ResultsProto holds the protobuf encoding of PingerResults
+// The schema is PingerResults.proto
+// https://developers.google.com/protocol-buffers/docs/encoding
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoBuffer is a tiny protobuf wire format encoder
+type protoBuffer struct {
+	b []byte
+}
+
+func (p *protoBuffer) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	p.b = append(p.b, tmp[:n]...)
+}
+
+func (p *protoBuffer) tag(field int, wire int) {
+	p.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// uint writes a varint field, skipping zero values like proto3
+func (p *protoBuffer) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, wireVarint)
+	p.varint(v)
+}
+
+func (p *protoBuffer) int(field int, v int64) {
+	p.uint(field, uint64(v))
+}
+
+// sint uses zigzag encoding
+func (p *protoBuffer) sint(field int, v int64) {
+	p.uint(field, uint64((v<<1)^(v>>63)))
+}
+
+func (p *protoBuffer) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, wireFixed64)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+	p.b = append(p.b, tmp[:]...)
+}
+
+func (p *protoBuffer) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	p.tag(field, wireBytes)
+	p.varint(uint64(len(v)))
+	p.b = append(p.b, v...)
+}
+
+// packed writes a packed repeated varint field
+func (p *protoBuffer) packed(field int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	var inner protoBuffer
+	for _, v := range vs {
+		inner.varint(v)
+	}
+	p.bytes(field, inner.b)
+}
+
+// protoReader is a tiny protobuf wire format decoder
+type protoReader struct {
+	b []byte
+}
+
+func (r *protoReader) varint() (v uint64, err error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errResultsInvalidEncoded
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// next returns the next field number, wire type, and the value
+// varint and fixed values are returned in v, and length delimited in data
+func (r *protoReader) next() (field int, wire int, v uint64, data []byte, err error) {
+
+	t, err := r.varint()
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+	field = int(t >> 3)
+	wire = int(t & 0x7)
+
+	switch wire {
+	case wireVarint:
+		v, err = r.varint()
+	case wireFixed64:
+		if len(r.b) < 8 {
+			return 0, 0, 0, nil, errResultsInvalidEncoded
+		}
+		v = binary.LittleEndian.Uint64(r.b)
+		r.b = r.b[8:]
+	case wireFixed32:
+		if len(r.b) < 4 {
+			return 0, 0, 0, nil, errResultsInvalidEncoded
+		}
+		v = uint64(binary.LittleEndian.Uint32(r.b))
+		r.b = r.b[4:]
+	case wireBytes:
+		var l uint64
+		l, err = r.varint()
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		if l > uint64(len(r.b)) {
+			return 0, 0, 0, nil, errResultsInvalidEncoded
+		}
+		data = r.b[:l]
+		r.b = r.b[l:]
+	default:
+		err = fmt.Errorf("%w: wire type:%d", errResultsInvalidEncoded, wire)
+	}
+	return field, wire, v, data, err
+}
+
+// repeated decodes either a packed, or a single unpacked, repeated varint value
+func repeated(wire int, v uint64, data []byte, vs []uint64) ([]uint64, error) {
+	if wire == wireVarint {
+		return append(vs, v), nil
+	}
+	r := protoReader{b: data}
+	for len(r.b) > 0 {
+		pv, err := r.varint()
+		if err != nil {
+			return vs, err
+		}
+		vs = append(vs, pv)
+	}
+	return vs, nil
+}
+
+// MarshalProto encodes PingerResults with the PingerResults.proto schema
+func (r PingerResults) MarshalProto() []byte {
+
+	var p protoBuffer
+	p.uint(1, ResultsSchemaVersionCst)
+	if !r.IP.IsZero() {
+		p.bytes(2, []byte(r.IP.String()))
+	}
+	p.int(3, int64(r.Successes))
+	p.int(4, int64(r.Failures))
+	p.int(5, int64(r.OutOfOrder))
+	p.int(6, int64(r.Count))
+	if len(r.RTTs) > 0 {
+		rtts := make([]uint64, len(r.RTTs))
+		for i, rtt := range r.RTTs {
+			rtts[i] = uint64(rtt)
+		}
+		p.packed(7, rtts)
+	}
+	p.int(8, int64(r.Min))
+	p.int(9, int64(r.Max))
+	p.int(10, int64(r.Mean))
+	p.int(11, int64(r.Sum))
+	p.int(12, int64(r.PingerDuration))
+	if r.Stats != nil {
+		p.bytes(13, marshalStatsProto(r.Stats))
+	}
+	p.int(14, r.Seed)
+	return p.b
+}
+
+// marshalStatsProto encodes the StreamingStats message
+func marshalStatsProto(s *StreamingStats) []byte {
+
+	var p protoBuffer
+	p.uint(1, s.Count)
+	p.int(2, int64(s.Min))
+	p.int(3, int64(s.Max))
+	p.int(4, int64(s.Sum))
+	p.double(5, s.Mean)
+	p.double(6, s.M2)
+	if s.Sketch != nil {
+		var sp protoBuffer
+		sp.double(1, s.Sketch.RelativeAccuracy)
+		sp.int(2, int64(s.Sketch.MaxBins))
+		sp.sint(3, int64(s.Sketch.Offset))
+		sp.packed(4, s.Sketch.Bins)
+		sp.uint(5, s.Sketch.ZeroCount)
+		sp.uint(6, s.Sketch.Count)
+		// always write the sketch, even if empty, so the accuracy is known
+		p.tag(7, wireBytes)
+		p.varint(uint64(len(sp.b)))
+		p.b = append(p.b, sp.b...)
+	}
+	return p.b
+}
+
+// UnmarshalProto decodes PingerResults encoded with MarshalProto
+// Unknown fields are skipped, to allow adding fields in the future
+func (r *PingerResults) UnmarshalProto(b []byte) (err error) {
+
+	*r = PingerResults{}
+	var version uint64
+	var rtts []uint64
+
+	pr := protoReader{b: b}
+	for len(pr.b) > 0 {
+		field, wire, v, data, err := pr.next()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			version = v
+		case 2:
+			r.IP, err = netaddr.ParseIP(string(data))
+			if err != nil {
+				return fmt.Errorf("%w:%v", errResultsInvalidIP, err)
+			}
+		case 3:
+			r.Successes = int(v)
+		case 4:
+			r.Failures = int(v)
+		case 5:
+			r.OutOfOrder = int(v)
+		case 6:
+			r.Count = int(v)
+		case 7:
+			rtts, err = repeated(wire, v, data, rtts)
+			if err != nil {
+				return err
+			}
+		case 8:
+			r.Min = time.Duration(v)
+		case 9:
+			r.Max = time.Duration(v)
+		case 10:
+			r.Mean = time.Duration(v)
+		case 11:
+			r.Sum = time.Duration(v)
+		case 12:
+			r.PingerDuration = time.Duration(v)
+		case 13:
+			r.Stats, err = unmarshalStatsProto(data)
+			if err != nil {
+				return err
+			}
+			r.Variance = time.Duration(r.Stats.Variance() * float64(time.Second))
+		case 14:
+			r.Seed = int64(v)
+		}
+	}
+
+	if version != ResultsSchemaVersionCst {
+		return fmt.Errorf("%w:%d", errResultsSchemaVersion, version)
+	}
+
+	if rtts != nil {
+		r.RTTs = make([]time.Duration, len(rtts))
+		for i, rtt := range rtts {
+			r.RTTs[i] = time.Duration(rtt)
+		}
+	}
+	return nil
+}
+
+// unmarshalStatsProto decodes the StreamingStats message
+func unmarshalStatsProto(b []byte) (s *StreamingStats, err error) {
+
+	s = &StreamingStats{}
+	pr := protoReader{b: b}
+	for len(pr.b) > 0 {
+		field, _, v, data, err := pr.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			s.Count = v
+		case 2:
+			s.Min = time.Duration(v)
+		case 3:
+			s.Max = time.Duration(v)
+		case 4:
+			s.Sum = time.Duration(v)
+		case 5:
+			s.Mean = math.Float64frombits(v)
+		case 6:
+			s.M2 = math.Float64frombits(v)
+		case 7:
+			s.Sketch, err = unmarshalSketchProto(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// unmarshalSketchProto decodes the DDSketch message
+func unmarshalSketchProto(b []byte) (s *DDSketch, err error) {
+
+	s = &DDSketch{}
+	pr := protoReader{b: b}
+	for len(pr.b) > 0 {
+		field, wire, v, data, err := pr.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			s.RelativeAccuracy = math.Float64frombits(v)
+		case 2:
+			s.MaxBins = int(v)
+		case 3:
+			s.Offset = int(int64(v>>1) ^ -int64(v&1))
+		case 4:
+			s.Bins, err = repeated(wire, v, data, s.Bins)
+			if err != nil {
+				return nil, err
+			}
+		case 5:
+			s.ZeroCount = v
+		case 6:
+			s.Count = v
+		}
+	}
+	if err = s.validate(); err != nil {
+		return nil, fmt.Errorf("%w:%v", errResultsInvalidEncoded, err)
+	}
+	s.init()
+	return s, nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// buildTestResults builds PingerResults the same way the Pinger does
+func buildTestResults(ip string, rtts []time.Duration, failures int) (r PingerResults) {
+	r.IP = netaddr.MustParseIP(ip)
+	r.Stats = NewStreamingStats()
+	r.RTTs = rtts
+	for _, rtt := range rtts {
+		if r.Successes == 0 || rtt < r.Min {
+			r.Min = rtt
+		}
+		if r.Successes == 0 || rtt > r.Max {
+			r.Max = rtt
+		}
+		r.Successes++
+		r.Sum += rtt
+		r.Stats.Add(rtt)
+	}
+	r.Failures = failures
+	r.Count = r.Successes + r.Failures
+	r.Mean = r.Stats.MeanDuration()
+	r.PingerDuration = time.Duration(r.Count) * time.Millisecond
+	return r
+}
+
+func testRTTs(count int, offset int) (rtts []time.Duration) {
+	for i := 0; i < count; i++ {
+		rtts = append(rtts, time.Duration((i+offset)%37+1)*time.Millisecond+time.Duration(i*i%1000)*time.Microsecond)
+	}
+	return rtts
+}
+
+// TestResultsEncoding round trips the JSON and protobuf encodings
+func TestResultsEncoding(t *testing.T) {
+
+	r := buildTestResults("2001:db8::1", testRTTs(100, 0), 3)
+	r.OutOfOrder = 2
+	r.Seed = 12345
+
+	j, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("TestResultsEncoding json.Marshal err:%v", err)
+	}
+	for _, field := range []string{`"schema_version":1`, `"ip":"2001:db8::1"`, `"min_ns":`, `"pinger_duration_ns":`, `"variance_s2":`, `"relative_accuracy":`} {
+		if !strings.Contains(string(j), field) {
+			t.Errorf(fmt.Sprintf("TestResultsEncoding json missing:%s", field))
+		}
+	}
+
+	var fromJSON PingerResults
+	err = json.Unmarshal(j, &fromJSON)
+	if err != nil {
+		t.Fatalf("TestResultsEncoding json.Unmarshal err:%v", err)
+	}
+
+	var fromProto PingerResults
+	err = fromProto.UnmarshalProto(r.MarshalProto())
+	if err != nil {
+		t.Fatalf("TestResultsEncoding UnmarshalProto err:%v", err)
+	}
+
+	for name, decoded := range map[string]PingerResults{"json": fromJSON, "proto": fromProto} {
+		if decoded.IP != r.IP || decoded.Successes != r.Successes || decoded.Failures != r.Failures || decoded.OutOfOrder != r.OutOfOrder || decoded.Count != r.Count {
+			t.Errorf(fmt.Sprintf("TestResultsEncoding %s counts:%+v", name, decoded))
+		}
+		if decoded.Min != r.Min || decoded.Max != r.Max || decoded.Mean != r.Mean || decoded.Sum != r.Sum || decoded.PingerDuration != r.PingerDuration || decoded.Seed != r.Seed {
+			t.Errorf(fmt.Sprintf("TestResultsEncoding %s durations:%+v", name, decoded))
+		}
+		if !reflect.DeepEqual(decoded.RTTs, r.RTTs) {
+			t.Errorf(fmt.Sprintf("TestResultsEncoding %s RTTs", name))
+		}
+		if decoded.Stats.Count != r.Stats.Count || decoded.Stats.Mean != r.Stats.Mean || decoded.Stats.M2 != r.Stats.M2 {
+			t.Errorf(fmt.Sprintf("TestResultsEncoding %s Stats:%+v", name, decoded.Stats))
+		}
+		if decoded.Stats.Quantile(0.99) != r.Stats.Quantile(0.99) {
+			t.Errorf(fmt.Sprintf("TestResultsEncoding %s p99:%s != %s", name, decoded.Stats.Quantile(0.99), r.Stats.Quantile(0.99)))
+		}
+	}
+
+	// Schema version mismatch is an error
+	err = json.Unmarshal([]byte(`{"schema_version":99}`), &fromJSON)
+	if err == nil {
+		t.Errorf("TestResultsEncoding schema_version:99 should error")
+	}
+
+	// Truncated protobuf is an error, not a panic
+	b := r.MarshalProto()
+	for i := 1; i < len(b); i += 7 {
+		var truncated PingerResults
+		_ = truncated.UnmarshalProto(b[:i])
+	}
+}
+
+// TestResultsMerge checks merging split results matches the results for the whole set
+func TestResultsMerge(t *testing.T) {
+
+	all := testRTTs(1000, 0)
+	whole := buildTestResults("192.0.2.1", all, 30)
+
+	parts := []PingerResults{
+		buildTestResults("192.0.2.1", all[:100], 10),
+		buildTestResults("192.0.2.1", all[100:700], 5),
+		buildTestResults("192.0.2.1", all[700:], 15),
+	}
+
+	merged, err := MergePingerResults(parts...)
+	if err != nil {
+		t.Fatalf("TestResultsMerge err:%v", err)
+	}
+
+	if merged.Successes != whole.Successes || merged.Failures != whole.Failures || merged.Count != whole.Count {
+		t.Errorf(fmt.Sprintf("TestResultsMerge counts merged:%d/%d/%d whole:%d/%d/%d", merged.Successes, merged.Failures, merged.Count, whole.Successes, whole.Failures, whole.Count))
+	}
+	if merged.Min != whole.Min || merged.Max != whole.Max || merged.Sum != whole.Sum {
+		t.Errorf(fmt.Sprintf("TestResultsMerge min/max/sum merged:%s/%s/%s whole:%s/%s/%s", merged.Min, merged.Max, merged.Sum, whole.Min, whole.Max, whole.Sum))
+	}
+	if math.Abs(merged.Stats.Mean-whole.Stats.Mean) > 1e-12 {
+		t.Errorf(fmt.Sprintf("TestResultsMerge mean merged:%g whole:%g", merged.Stats.Mean, whole.Stats.Mean))
+	}
+	if math.Abs(merged.Stats.Variance()-whole.Stats.Variance()) > whole.Stats.Variance()*1e-9 {
+		t.Errorf(fmt.Sprintf("TestResultsMerge variance merged:%g whole:%g", merged.Stats.Variance(), whole.Stats.Variance()))
+	}
+	for _, q := range []float64{0.01, 0.5, 0.9, 0.99} {
+		if merged.Stats.Quantile(q) != whole.Stats.Quantile(q) {
+			t.Errorf(fmt.Sprintf("TestResultsMerge q:%.2f merged:%s whole:%s", q, merged.Stats.Quantile(q), whole.Stats.Quantile(q)))
+		}
+	}
+	if len(merged.RTTs) != len(all) {
+		t.Errorf(fmt.Sprintf("TestResultsMerge len(merged.RTTs):%d", len(merged.RTTs)))
+	}
+
+	// Different targets can't be merged
+	other := buildTestResults("192.0.2.2", all[:10], 0)
+	err = merged.Merge(other)
+	if err == nil {
+		t.Errorf("TestResultsMerge different IPs should error")
+	}
+}
+
+// TestResultsInvalidSketch checks the decoded sketch parameters are rejected, rather than
+// panicking in the next Add
+func TestResultsInvalidSketch(t *testing.T) {
+
+	for _, sketch := range []string{
+		`{"relative_accuracy":0.01,"max_bins":0,"offset":100,"bins":[1],"count":1}`,
+		`{"relative_accuracy":0.01,"max_bins":1,"offset":100,"bins":[1,1],"count":2}`,
+		`{"relative_accuracy":0,"max_bins":10,"offset":100,"bins":[1],"count":1}`,
+		`{"relative_accuracy":1,"max_bins":10,"offset":100,"bins":[1],"count":1}`,
+	} {
+		var r PingerResults
+		err := json.Unmarshal([]byte(`{"schema_version":1,"stats":{"count":1,"sketch":`+sketch+`}}`), &r)
+		if err == nil {
+			t.Errorf(fmt.Sprintf("TestResultsInvalidSketch json sketch:%s no error", sketch))
+		}
+	}
+
+	for _, invalid := range []func(s *DDSketch){
+		func(s *DDSketch) { s.MaxBins = 0 },
+		func(s *DDSketch) { s.MaxBins = len(s.Bins) - 1 },
+		func(s *DDSketch) { s.RelativeAccuracy = 0 },
+	} {
+		r := buildTestResults("192.0.2.1", testRTTs(100, 0), 0)
+		invalid(r.Stats.Sketch)
+		var decoded PingerResults
+		if err := decoded.UnmarshalProto(r.MarshalProto()); err == nil {
+			t.Errorf(fmt.Sprintf("TestResultsInvalidSketch proto sketch:%+v no error", r.Stats.Sketch))
+		}
+	}
+}
+
+// TestResultsMergeWithoutStats checks results without Stats are merged into the statistics
+func TestResultsMergeWithoutStats(t *testing.T) {
+
+	merged := buildTestResults("192.0.2.1", testRTTs(100, 0), 0)
+	o := buildTestResults("192.0.2.1", testRTTs(50, 100), 0)
+	mean := o.Stats.MeanDuration()
+	o.Stats = nil
+	o.Mean = mean
+
+	if err := merged.Merge(o); err != nil {
+		t.Fatalf(fmt.Sprintf("TestResultsMergeWithoutStats err:%v", err))
+	}
+	if merged.Successes != 150 || merged.Stats.Count != uint64(merged.Successes) || merged.Stats.Sketch.Count != merged.Stats.Count {
+		t.Errorf(fmt.Sprintf("TestResultsMergeWithoutStats Successes:%d Count:%d Sketch.Count:%d", merged.Successes, merged.Stats.Count, merged.Stats.Sketch.Count))
+	}
+	if merged.Min != merged.Stats.Min || merged.Max != merged.Stats.Max {
+		t.Errorf(fmt.Sprintf("TestResultsMergeWithoutStats Min:%s/%s Max:%s/%s", merged.Min, merged.Stats.Min, merged.Max, merged.Stats.Max))
+	}
+}
+
+// TestResultsMergeIntoWithoutStats checks the receiver's own mean is kept when it has no Stats,
+// and a failed merge leaves the receiver unchanged
+func TestResultsMergeIntoWithoutStats(t *testing.T) {
+
+	merged := buildTestResults("192.0.2.1", testRTTs(100, 0), 0)
+	merged.Stats = nil
+	o := buildTestResults("192.0.2.1", testRTTs(100, 0), 0)
+	want := o.Mean
+
+	if err := merged.Merge(o); err != nil {
+		t.Fatalf(fmt.Sprintf("TestResultsMergeIntoWithoutStats err:%v", err))
+	}
+	if merged.Successes != 200 || merged.Stats.Count != 200 || merged.Mean != want {
+		t.Errorf(fmt.Sprintf("TestResultsMergeIntoWithoutStats Successes:%d Count:%d Mean:%s want:%s", merged.Successes, merged.Stats.Count, merged.Mean, want))
+	}
+
+	before := buildTestResults("192.0.2.1", testRTTs(10, 0), 0)
+	r := buildTestResults("192.0.2.1", testRTTs(10, 0), 0)
+	bad := buildTestResults("192.0.2.2", testRTTs(10, 50), 0)
+	bad.IP = netaddr.IP{}
+	bad.Stats.Sketch = NewDDSketch(0.5, DDSketchMaxBinsCst)
+	bad.Stats.Sketch.Add(1)
+	if err := r.Merge(bad); err == nil {
+		t.Errorf("TestResultsMergeIntoWithoutStats accuracy mismatch should error")
+	}
+	if !reflect.DeepEqual(r, before) {
+		t.Errorf(fmt.Sprintf("TestResultsMergeIntoWithoutStats failed merge changed r:%+v", r))
+	}
+}
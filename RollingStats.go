@@ -0,0 +1,183 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// RollingStats holds time windowed statistics, for the "last 1/5/15 minute"
+// style loss and latency, for long running Pingers
+//
+// The window is a ring of fixed width buckets, so memory is constant
+// regardless of how many probes are sent
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	RollingBucketWidthCst = 1 * time.Second
+	RollingMaxWindowCst   = 15 * time.Minute
+)
+
+// RollingWindowsCst are the default windows returned by Snapshots()
+var RollingWindowsCst = []time.Duration{1 * time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// rollingBucketT holds the counters for a single bucket
+// index is the bucket number since the unix epoch, and is used
+// to detect if the bucket is stale and needs to be reset
+type rollingBucketT struct {
+	index    int64
+	sent     uint64
+	received uint64
+	lost     uint64
+	sum      time.Duration
+	sumSq    float64
+	min      time.Duration
+	max      time.Duration
+}
+
+// RollingStats is safe for concurrent use, so the caller can Snapshot()
+// while the Pinger is still running
+type RollingStats struct {
+	sync.Mutex
+	BucketWidth time.Duration
+	buckets     []rollingBucketT
+}
+
+// RollingSnapshot is the summary of a single window
+type RollingSnapshot struct {
+	Window   time.Duration
+	Sent     uint64
+	Received uint64
+	Lost     uint64
+	Loss     float64
+	Min      time.Duration
+	Max      time.Duration
+	Mean     time.Duration
+	StdDev   time.Duration
+}
+
+// NewRollingStats creates RollingStats which can snapshot windows up to maxWindow
+// bucketWidth <= 0 is the default RollingBucketWidthCst
+func NewRollingStats(bucketWidth time.Duration, maxWindow time.Duration) (r *RollingStats) {
+	if bucketWidth <= 0 {
+		bucketWidth = RollingBucketWidthCst
+	}
+	buckets := int(maxWindow / bucketWidth)
+	if buckets < 1 {
+		buckets = 1
+	}
+	r = &RollingStats{
+		BucketWidth: bucketWidth,
+		buckets:     make([]rollingBucketT, buckets),
+	}
+	for i := range r.buckets {
+		r.buckets[i].index = -1
+	}
+	return r
+}
+
+// NewRollingStatsDefault creates RollingStats with 1s buckets, covering 15 minutes
+func NewRollingStatsDefault() (r *RollingStats) {
+	return NewRollingStats(RollingBucketWidthCst, RollingMaxWindowCst)
+}
+
+// bucket returns the bucket for time t, resetting it if it is stale
+// bucket assumes the LOCK is already held
+func (r *RollingStats) bucket(t time.Time) *rollingBucketT {
+	index := t.UnixNano() / int64(r.BucketWidth)
+	b := &r.buckets[index%int64(len(r.buckets))]
+	if b.index != index {
+		*b = rollingBucketT{index: index}
+	}
+	return b
+}
+
+// Sent records a probe being sent
+func (r *RollingStats) Sent(t time.Time) {
+	r.Lock()
+	r.bucket(t).sent++
+	r.Unlock()
+}
+
+// Success records an echo reply received
+func (r *RollingStats) Success(t time.Time, rtt time.Duration) {
+	r.Lock()
+	b := r.bucket(t)
+	if b.received == 0 || rtt < b.min {
+		b.min = rtt
+	}
+	if b.received == 0 || rtt > b.max {
+		b.max = rtt
+	}
+	b.received++
+	b.sum += rtt
+	b.sumSq += rtt.Seconds() * rtt.Seconds()
+	r.Unlock()
+}
+
+// Expired records a probe timing out
+func (r *RollingStats) Expired(t time.Time) {
+	r.Lock()
+	r.bucket(t).lost++
+	r.Unlock()
+}
+
+// Snapshot returns the statistics for the window ending at now
+// Loss is lost / (received + lost), so probes still in flight are not counted as lost
+func (r *RollingStats) Snapshot(now time.Time, window time.Duration) (s RollingSnapshot) {
+
+	s.Window = window
+
+	buckets := int64(window / r.BucketWidth)
+	if buckets > int64(len(r.buckets)) {
+		buckets = int64(len(r.buckets))
+	}
+
+	var sumSq float64
+	var sum time.Duration
+
+	r.Lock()
+	last := now.UnixNano() / int64(r.BucketWidth)
+	for index := last - buckets + 1; index <= last; index++ {
+		b := &r.buckets[index%int64(len(r.buckets))]
+		if b.index != index {
+			continue
+		}
+		s.Sent += b.sent
+		s.Lost += b.lost
+		if b.received > 0 {
+			if s.Received == 0 || b.min < s.Min {
+				s.Min = b.min
+			}
+			if s.Received == 0 || b.max > s.Max {
+				s.Max = b.max
+			}
+			s.Received += b.received
+			sum += b.sum
+			sumSq += b.sumSq
+		}
+	}
+	r.Unlock()
+
+	if s.Received+s.Lost > 0 {
+		s.Loss = float64(s.Lost) / float64(s.Received+s.Lost)
+	}
+	if s.Received > 0 {
+		s.Mean = sum / time.Duration(s.Received)
+		mean := sum.Seconds() / float64(s.Received)
+		variance := sumSq/float64(s.Received) - mean*mean
+		if variance > 0 {
+			s.StdDev = time.Duration(math.Sqrt(variance) * float64(time.Second))
+		}
+	}
+	return s
+}
+
+// Snapshots returns the snapshots for the default RollingWindowsCst windows
+func (r *RollingStats) Snapshots(now time.Time) (snapshots []RollingSnapshot) {
+	for _, w := range RollingWindowsCst {
+		snapshots = append(snapshots, r.Snapshot(now, w))
+	}
+	return snapshots
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// TestRollingStats feeds one probe per second for 20 minutes, with the
+// last 3 minutes all lost, and checks each of the default windows
+func TestRollingStats(t *testing.T) {
+
+	r := NewRollingStatsDefault()
+	start := time.Unix(1600000000, 0)
+	minutes := 20
+	lostMinutes := 3
+
+	var now time.Time
+	for s := 0; s < minutes*60; s++ {
+		now = start.Add(time.Duration(s) * time.Second)
+		r.Sent(now)
+		if s < (minutes-lostMinutes)*60 {
+			r.Success(now, time.Duration(s%10+1)*time.Millisecond)
+		} else {
+			r.Expired(now)
+		}
+	}
+
+	snapshots := r.Snapshots(now)
+	if len(snapshots) != len(RollingWindowsCst) {
+		t.Fatalf("TestRollingStats len(snapshots):%d", len(snapshots))
+	}
+
+	// 1 minute, all lost
+	if snapshots[0].Sent != 60 || snapshots[0].Lost != 60 || snapshots[0].Received != 0 || snapshots[0].Loss != 1 {
+		t.Errorf(fmt.Sprintf("TestRollingStats 1m snapshot:%+v", snapshots[0]))
+	}
+
+	// 5 minutes, 3 lost
+	if snapshots[1].Sent != 300 || snapshots[1].Lost != 180 || snapshots[1].Received != 120 {
+		t.Errorf(fmt.Sprintf("TestRollingStats 5m snapshot:%+v", snapshots[1]))
+	}
+	if math.Abs(snapshots[1].Loss-0.6) > 1e-9 {
+		t.Errorf(fmt.Sprintf("TestRollingStats 5m Loss:%f", snapshots[1].Loss))
+	}
+
+	// 15 minutes, and the earlier 5 minutes have rolled out of the window
+	if snapshots[2].Sent != 900 || snapshots[2].Lost != 180 || snapshots[2].Received != 720 {
+		t.Errorf(fmt.Sprintf("TestRollingStats 15m snapshot:%+v", snapshots[2]))
+	}
+	if snapshots[2].Min != time.Millisecond || snapshots[2].Max != 10*time.Millisecond {
+		t.Errorf(fmt.Sprintf("TestRollingStats 15m Min:%s Max:%s", snapshots[2].Min, snapshots[2].Max))
+	}
+	if snapshots[2].Mean != 5500*time.Microsecond {
+		t.Errorf(fmt.Sprintf("TestRollingStats 15m Mean:%s", snapshots[2].Mean))
+	}
+
+	// Nothing after a long idle period
+	idle := r.Snapshot(now.Add(time.Hour), time.Minute)
+	if idle.Sent != 0 || idle.Received != 0 || idle.Lost != 0 {
+		t.Errorf(fmt.Sprintf("TestRollingStats idle:%+v", idle))
+	}
+}
+
+// TestRollingStatsBucketWidth checks the zero and negative bucket widths use the default width
+func TestRollingStatsBucketWidth(t *testing.T) {
+
+	now := time.Unix(1600000000, 0)
+	for _, width := range []time.Duration{0, -time.Second} {
+		r := NewRollingStats(width, time.Minute)
+		if r.BucketWidth != RollingBucketWidthCst {
+			t.Errorf(fmt.Sprintf("TestRollingStatsBucketWidth width:%s BucketWidth:%s", width, r.BucketWidth))
+		}
+		r.Sent(now)
+		r.Success(now, time.Millisecond)
+		if s := r.Snapshot(now, time.Minute); s.Sent != 1 || s.Received != 1 {
+			t.Errorf(fmt.Sprintf("TestRollingStatsBucketWidth width:%s snapshot:%+v", width, s))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Shards holds the sharded pending ping table
+//
+// Originally there was a single Pings map and ExpiresDLL, protected by the main
+// ICMPEngine lock, so every Pinger send, every Receiver match, and every Expirer step
+// contended on the same lock.  Now the outstanding pings are split per protocol,
+// and then per hash bucket of the target IP, with each PingShard having its own lock,
+// its own ExpiryQueue ( see ExpiryQueue.go ), and its own Expirer.
+//
+// The main ICMPEngine lock is now only used for the engine configuration and
+// starting/stopping, and NOT per packet.
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+const (
+	ShardsPerProtocolCst = 16
+
+	// FNV-1a https://en.wikipedia.org/wiki/Fowler%E2%80%93Noll%E2%80%93Vo_hash_function
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// PingShard holds a shard of the outstanding pings, and the Pinger Sessions for the targets in the shard
+type PingShard struct {
+	sync.Mutex
+	Protocol       Protocol
+	Index          int
+	Pings          map[netaddr.IP]map[Sequence]*ExpiryEntry
+	Expiries       ExpiryQueue
+	Sessions       map[netaddr.IP]*Session
+	ExpirerRunning bool
+	NextWake       time.Time
+	WakeCh         chan struct{}
+}
+
+// newPingShards creates the shards for each protocol, with the ExpiryQueue backend
+func newPingShards(protocols []Protocol, shards int, backend ExpiryBackend, now time.Time) (s map[Protocol][]*PingShard) {
+	s = make(map[Protocol][]*PingShard)
+	for _, p := range protocols {
+		for i := 0; i < shards; i++ {
+			s[p] = append(s[p], &PingShard{
+				Protocol: p,
+				Index:    i,
+				Pings:    make(map[netaddr.IP]map[Sequence]*ExpiryEntry),
+				Expiries: newExpiryQueue(backend, now),
+				Sessions: make(map[netaddr.IP]*Session),
+				WakeCh:   make(chan struct{}, 1),
+			})
+		}
+	}
+	return s
+}
+
+// ipProtocol returns the Protocol for the IP
+func ipProtocol(IP netaddr.IP) (proto Protocol) {
+	if IP.Is4() {
+		return Protocol(4)
+	}
+	return Protocol(6)
+}
+
+// shardIndex hashes the IP into one of the shards
+func shardIndex(IP netaddr.IP, shards int) int {
+	b := IP.As16()
+	h := uint32(fnvOffset32)
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= fnvPrime32
+	}
+	return int(h % uint32(shards))
+}
+
+// shard returns the PingShard for the target IP
+// The shards are created in NewFullConfig and never change, so no lock is required
+func (ie *ICMPEngine) shard(IP netaddr.IP) *PingShard {
+	shards := ie.Pingers.Shards[ipProtocol(IP)]
+	return shards[shardIndex(IP, len(shards))]
+}
+
+// forEachShard calls f for every shard, without holding the shard lock
+func (ie *ICMPEngine) forEachShard(f func(shard *PingShard)) {
+	for _, p := range ie.Protocols {
+		for _, shard := range ie.Pingers.Shards[p] {
+			f(shard)
+		}
+	}
+}
+
+// SetExpiryBackend recreates the shards with the ExpiryQueue backend
+// SetExpiryBackend must be called before any Pingers are started
+func (ie *ICMPEngine) SetExpiryBackend(backend ExpiryBackend) {
+	ie.Lock()
+	defer ie.Unlock()
+	ie.forEachShard(func(shard *PingShard) {
+		shard.Lock()
+		defer shard.Unlock()
+		if len(shard.Sessions) > 0 || shard.Expiries.Len() > 0 || shard.ExpirerRunning {
+			log.Fatal("SetExpiryBackend must be called before any Pingers are started")
+		}
+	})
+	ie.Pingers.ExpiryBackend = backend
+	ie.Pingers.Shards = newPingShards(ie.Protocols, len(ie.Pingers.Shards[ie.Protocols[0]]), backend, ie.Clock.Now())
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+const (
+	benchOutstandingCst = 100000
+	benchTargetsCst     = 1000
+)
+
+// benchIP returns a distinct IPv4 address for the index
+func benchIP(i int) netaddr.IP {
+	return netaddr.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+}
+
+// newBenchEngine creates an engine with the shards, and benchOutstandingCst outstanding pings
+// The Expirers are not started, so the pings just sit in the table like slow targets would
+func newBenchEngine(shards int) (ie *ICMPEngine) {
+
+	ie = NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Hour, time.Second, false, 1, 1, false, GetDebugLevels(1), true)
+	ie.Pingers.Shards = newPingShards(ie.Protocols, shards, ExpiryBackendDLL, time.Now())
+
+	now := time.Now()
+	for i := 0; i < benchOutstandingCst; i++ {
+		IP := benchIP(i % benchTargetsCst)
+		shard := ie.shard(IP)
+		if _, exists := shard.Pings[IP]; !exists {
+			shard.Pings[IP] = make(map[Sequence]*ExpiryEntry)
+		}
+		seq := Sequence(i / benchTargetsCst)
+		shard.Pings[IP][seq] = ie.insertExpiry(shard, Pings{NetaddrIP: IP, Seq: seq, Send: now, Expiry: now.Add(time.Hour)})
+	}
+	return ie
+}
+
+// TestShardIndex checks the targets are spread over all the shards
+func TestShardIndex(t *testing.T) {
+
+	counts := make([]int, ShardsPerProtocolCst)
+	for i := 0; i < benchTargetsCst; i++ {
+		counts[shardIndex(benchIP(i), ShardsPerProtocolCst)]++
+	}
+	for i, c := range counts {
+		if c < benchTargetsCst/ShardsPerProtocolCst/2 {
+			t.Errorf(fmt.Sprintf("TestShardIndex shard:%d count:%d", i, c))
+		}
+	}
+
+	ie := newBenchEngine(ShardsPerProtocolCst)
+	outstanding, expires, _ := ie.engineGauges()
+	if outstanding != benchOutstandingCst || expires != benchOutstandingCst {
+		t.Errorf(fmt.Sprintf("TestShardIndex outstanding:%d expires:%d", outstanding, expires))
+	}
+}
+
+// benchmarkSendReceive is the Pinger insert and Receiver match cycle, from parallel
+// goroutines each with their own target, while benchOutstandingCst pings are outstanding
+func benchmarkSendReceive(b *testing.B, shards int) {
+
+	ie := newBenchEngine(shards)
+	var next int64 = benchTargetsCst
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+
+		IP := benchIP(int(atomic.AddInt64(&next, 1)))
+		shard := ie.shard(IP)
+		session := newSession(IP, 1, DispatchDropNewest, nil)
+		shard.Lock()
+		shard.Pings[IP] = make(map[Sequence]*ExpiryEntry)
+		shard.Sessions[IP] = session
+		shard.Unlock()
+
+		for seq := Sequence(0); pb.Next(); seq++ {
+			send := time.Now()
+			shard.Lock()
+			shard.Pings[IP][seq] = ie.insertExpiry(shard, Pings{NetaddrIP: IP, Seq: seq, Send: send, Expiry: send.Add(time.Hour)})
+			shard.Unlock()
+
+			_, exists := ie.matchReply(IP, seq, time.Now())
+			if !exists {
+				b.Errorf("benchmarkSendReceive matchReply IP:%s seq:%d not found", IP, seq)
+				return
+			}
+			<-session.SuccessCh
+		}
+	})
+}
+
+func BenchmarkSendReceiveShards1(b *testing.B) {
+	benchmarkSendReceive(b, 1)
+}
+
+func BenchmarkSendReceiveShards(b *testing.B) {
+	benchmarkSendReceive(b, ShardsPerProtocolCst)
+}
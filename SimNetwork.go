@@ -0,0 +1,454 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// SimNetwork is an in-memory simulated network, for testing the full engine without any
+// sockets, root, or sysctl changes
+//
+// Originally the only way to test without the network was FakeSuccess, where the Expirer
+// fabricates an instant success, and the FakeDrop probability, which never exercise the
+// Receivers, and can't model latency, jitter, reordering or duplication.
+//
+// The SimNetwork provides the SimTransports, via SimNetwork.Factory, so the Pingers, Writers,
+// Receivers and Expirers all run exactly as they do over the real sockets:
+//   ie.SetTransportFactory(sim.Factory)
+//
+// Each target has a SimProfile, which is the Default profile, unless SetProfile was called:
+// - Latency is the one way request+reply latency distribution, e.g. FixedLatency, UniformLatency, NormalLatency
+// - Loss is the loss model, e.g. BernoulliLoss or the bursty GilbertElliottLoss, where each
+//   target gets its own Clone() of the model, so the loss state is per target
+// - Reorder is the probability the reply is delayed by the extra ReorderDelay, so it arrives
+//   after the replies to the later echo requests
+// - Duplicate is the probability of a second copy of the reply, with its own latency
+// - ICMPError is the probability of an ICMP destination unreachable instead of the reply, from
+//   ErrorFrom, or the target itself
+//
+// The random decisions come from the single seeded source, so the same seed and the same
+// sequence of echo requests gives the same losses, latencies and errors.  The delays use the
+// Clock, which is the RealClock by default, or the FakeClock shared with the engine, see Clock.go
+//
+// Each SimTransport has a bounded receive queue ( QueueLen ), like the socket receive buffer,
+// and replies arriving when the queue is full are dropped, and counted as Overflows.  The
+// SimTransport is the in-memory transport shared with the ReplayNetwork, see MemTransport.go
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"inet.af/netaddr"
+)
+
+const (
+	// SimQueueLenCst is the default SimTransport receive queue length
+	SimQueueLenCst = 4096
+
+	// IPv6HeaderLenCst is the IPv6 header length
+	IPv6HeaderLenCst = 40
+
+	// ProtocolICMPv6Cst is the IPv6 next header for ICMPv6
+	ProtocolICMPv6Cst = 58
+
+	// ipv4DefaultTTLCst is the TTL of the synthesized IPv4 headers
+	ipv4DefaultTTLCst = 64
+)
+
+// LatencyDistribution is the distribution of the latency to a target
+type LatencyDistribution interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+// FixedLatency is a constant latency
+type FixedLatency time.Duration
+
+// Sample implements LatencyDistribution
+func (l FixedLatency) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(l)
+}
+
+// UniformLatency is uniformly distributed between Min and Max
+type UniformLatency struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Sample implements LatencyDistribution
+func (l UniformLatency) Sample(r *rand.Rand) time.Duration {
+	if l.Max <= l.Min {
+		return l.Min
+	}
+	return l.Min + time.Duration(r.Int63n(int64(l.Max-l.Min)))
+}
+
+// NormalLatency is normally distributed, which is the Mean with the StdDev as jitter
+// Negative samples are clamped to zero
+type NormalLatency struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+// Sample implements LatencyDistribution
+func (l NormalLatency) Sample(r *rand.Rand) time.Duration {
+	d := l.Mean + time.Duration(r.NormFloat64()*float64(l.StdDev))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// LossModel decides if each packet to a target is lost
+// Models can hold state, so Clone returns a new model with the same parameters and a fresh state
+type LossModel interface {
+	Lost(r *rand.Rand) bool
+	Clone() LossModel
+}
+
+// BernoulliLoss loses each packet independently with probability P
+type BernoulliLoss struct {
+	P float64
+}
+
+// Lost implements LossModel
+func (l *BernoulliLoss) Lost(r *rand.Rand) bool {
+	return l.P > 0 && r.Float64() < l.P
+}
+
+// Clone implements LossModel
+func (l *BernoulliLoss) Clone() LossModel {
+	c := *l
+	return &c
+}
+
+// GilbertElliottLoss is the two state bursty loss model, with a good and a bad state
+// - PGoodToBad and PBadToGood are the per packet state transition probabilities
+// - LossGood and LossBad are the loss probabilities in each state
+// The long run loss is ( PBadToGood*LossGood + PGoodToBad*LossBad ) / ( PGoodToBad + PBadToGood )
+// https://en.wikipedia.org/wiki/Burst_error
+type GilbertElliottLoss struct {
+	PGoodToBad float64
+	PBadToGood float64
+	LossGood   float64
+	LossBad    float64
+	Bad        bool
+}
+
+// Lost implements LossModel, deciding the loss in the current state, and then the transition
+func (l *GilbertElliottLoss) Lost(r *rand.Rand) (lost bool) {
+	if l.Bad {
+		lost = r.Float64() < l.LossBad
+		if r.Float64() < l.PBadToGood {
+			l.Bad = false
+		}
+		return lost
+	}
+	lost = r.Float64() < l.LossGood
+	if r.Float64() < l.PGoodToBad {
+		l.Bad = true
+	}
+	return lost
+}
+
+// Clone implements LossModel, starting in the good state
+func (l *GilbertElliottLoss) Clone() LossModel {
+	c := *l
+	c.Bad = false
+	return &c
+}
+
+// SimProfile is the simulated network behaviour for a target, see the top of this file
+// A nil Latency is zero latency, and a nil Loss is no loss
+type SimProfile struct {
+	Latency      LatencyDistribution
+	Loss         LossModel
+	Reorder      float64
+	ReorderDelay time.Duration
+	Duplicate    float64
+	ICMPError    float64
+	ErrorFrom    netaddr.IP
+}
+
+// SimStats are the SimNetwork counters
+type SimStats struct {
+	Sent       uint64
+	Delivered  uint64
+	Lost       uint64
+	Reordered  uint64
+	Duplicated uint64
+	Errors     uint64
+	Overflows  uint64
+	Invalid    uint64
+}
+
+// simTarget is the per target state
+type simTarget struct {
+	profile *SimProfile
+	loss    LossModel
+}
+
+// SimNetwork is the simulated network, see the top of this file
+// Local4 and Local6 are the local addresses, used in the ICMP errors quoted IP header
+// Stats is first in the struct for the 64 bit alignment required by sync/atomic
+type SimNetwork struct {
+	Stats SimStats
+	sync.Mutex
+	Default  SimProfile
+	Profiles map[netaddr.IP]*SimProfile
+	Local4   netaddr.IP
+	Local6   netaddr.IP
+	QueueLen int
+	Clock    Clock
+	rand     *rand.Rand
+	targets  map[netaddr.IP]*simTarget
+	nextID   int
+}
+
+// NewSimNetwork creates the SimNetwork, with the default profile for all targets, and the seed
+// for the random source
+func NewSimNetwork(seed int64, profile SimProfile) (n *SimNetwork) {
+	return &SimNetwork{
+		Default:  profile,
+		Profiles: make(map[netaddr.IP]*SimProfile),
+		Local4:   netaddr.IPv4(127, 0, 0, 1),
+		Local6:   netaddr.IPv6Raw([16]byte{15: 1}),
+		QueueLen: SimQueueLenCst,
+		Clock:    RealClock{},
+		rand:     rand.New(rand.NewSource(seed)),
+		targets:  make(map[netaddr.IP]*simTarget),
+		nextID:   1,
+	}
+}
+
+// SetProfile sets the profile for the target, replacing the Default, and resetting the loss state
+func (n *SimNetwork) SetProfile(IP netaddr.IP, profile SimProfile) {
+	n.Lock()
+	defer n.Unlock()
+	n.Profiles[IP] = &profile
+	delete(n.targets, IP)
+}
+
+// GetStats returns a copy of the SimStats
+func (n *SimNetwork) GetStats() (stats SimStats) {
+	return SimStats{
+		Sent:       atomic.LoadUint64(&n.Stats.Sent),
+		Delivered:  atomic.LoadUint64(&n.Stats.Delivered),
+		Lost:       atomic.LoadUint64(&n.Stats.Lost),
+		Reordered:  atomic.LoadUint64(&n.Stats.Reordered),
+		Duplicated: atomic.LoadUint64(&n.Stats.Duplicated),
+		Errors:     atomic.LoadUint64(&n.Stats.Errors),
+		Overflows:  atomic.LoadUint64(&n.Stats.Overflows),
+		Invalid:    atomic.LoadUint64(&n.Stats.Invalid),
+	}
+}
+
+// Factory is the TransportFactory for the SimTransports
+func (n *SimNetwork) Factory(ie *ICMPEngine, proto Protocol, index int) (t Transport, err error) {
+	return n.NewTransport(proto), nil
+}
+
+// NewTransport creates a SimTransport on the SimNetwork, with the next identifier
+func (n *SimNetwork) NewTransport(proto Protocol) (t *SimTransport) {
+	n.Lock()
+	defer n.Unlock()
+	t = &SimTransport{}
+	t.init("SimTransport", proto, n, n.nextID, n.QueueLen)
+	n.nextID++
+	return t
+}
+
+// schedule implements memNetwork, see transmit
+func (n *SimNetwork) schedule(proto Protocol, id int, IP netaddr.IP, request []byte) (deliveries []simDelivery) {
+	return n.transmit(proto, IP, request)
+}
+
+// counters implements memNetwork
+func (n *SimNetwork) counters() memCounters {
+	return memCounters{sent: &n.Stats.Sent, invalid: &n.Stats.Invalid, delivered: &n.Stats.Delivered, overflows: &n.Stats.Overflows}
+}
+
+// clock implements memNetwork
+func (n *SimNetwork) clock() Clock {
+	return n.Clock
+}
+
+// local implements memNetwork
+func (n *SimNetwork) local(proto Protocol) netaddr.IP {
+	if proto == Protocol(6) {
+		return n.Local6
+	}
+	return n.Local4
+}
+
+// target returns the per target state, creating it from the profile if required
+// target assumes the SimNetwork LOCK is already held
+func (n *SimNetwork) target(IP netaddr.IP) (t *simTarget) {
+	t, exists := n.targets[IP]
+	if exists {
+		return t
+	}
+	profile, exists := n.Profiles[IP]
+	if !exists {
+		profile = &n.Default
+	}
+	t = &simTarget{profile: profile}
+	if profile.Loss != nil {
+		t.loss = profile.Loss.Clone()
+	}
+	n.targets[IP] = t
+	return t
+}
+
+// simPacket is a packet in flight, from peer
+type simPacket struct {
+	b    []byte
+	peer net.Addr
+}
+
+// simDelivery is a scheduled packet
+type simDelivery struct {
+	packet simPacket
+	delay  time.Duration
+}
+
+// transmit decides what happens to the echo request to the IP, and returns the deliveries
+func (n *SimNetwork) transmit(proto Protocol, IP netaddr.IP, request []byte) (deliveries []simDelivery) {
+
+	n.Lock() // <------------------------------ LOCK!!
+	defer n.Unlock()
+
+	target := n.target(IP)
+	profile := target.profile
+	if target.loss != nil && target.loss.Lost(n.rand) {
+		atomic.AddUint64(&n.Stats.Lost, 1)
+		return nil
+	}
+
+	latency := n.latency(profile)
+	if profile.ICMPError > 0 && n.rand.Float64() < profile.ICMPError {
+		atomic.AddUint64(&n.Stats.Errors, 1)
+		from := profile.ErrorFrom
+		if from.IsZero() {
+			from = IP
+		}
+		return append(deliveries, simDelivery{
+			packet: simPacket{b: n.icmpError(proto, IP, request), peer: from.IPAddr()},
+			delay:  latency,
+		})
+	}
+
+	if profile.Reorder > 0 && n.rand.Float64() < profile.Reorder {
+		atomic.AddUint64(&n.Stats.Reordered, 1)
+		latency += profile.ReorderDelay
+	}
+	reply := simPacket{b: echoReply(proto, request), peer: IP.IPAddr()}
+	deliveries = append(deliveries, simDelivery{packet: reply, delay: latency})
+
+	if profile.Duplicate > 0 && n.rand.Float64() < profile.Duplicate {
+		atomic.AddUint64(&n.Stats.Duplicated, 1)
+		deliveries = append(deliveries, simDelivery{packet: reply, delay: latency + n.latency(profile)})
+	}
+	return deliveries
+}
+
+// latency samples the latency for the profile
+// latency assumes the SimNetwork LOCK is already held, because rand.Rand isn't safe for concurrent use
+func (n *SimNetwork) latency(profile *SimProfile) time.Duration {
+	if profile.Latency == nil {
+		return 0
+	}
+	return profile.Latency.Sample(n.rand)
+}
+
+// echoReply returns the echo reply for the echo request
+// The IPv4 checksum is updated for the type change, and the IPv6 checksum is left alone,
+// like the EchoTemplate
+func echoReply(proto Protocol, request []byte) (reply []byte) {
+	reply = append([]byte(nil), request...)
+	reply[0] = echoReplyType(proto)
+	if proto == Protocol(4) {
+		old := binary.BigEndian.Uint16(request[0:2])
+		binary.BigEndian.PutUint16(reply[2:4], checksumUpdate(binary.BigEndian.Uint16(reply[2:4]), old, binary.BigEndian.Uint16(reply[0:2])))
+	}
+	return reply
+}
+
+// icmpError returns the ICMP destination unreachable for the echo request to the IP
+func (n *SimNetwork) icmpError(proto Protocol, IP netaddr.IP, request []byte) (b []byte) {
+	return icmpErrorMessage(proto, n.local(proto), IP, request)
+}
+
+// icmpErrorMessage returns the ICMP destination unreachable for the echo request from local to the IP
+// The error quotes the IP header of the echo request, and the start of the echo request, per
+// rfc792 and rfc4443, so the Receivers can match the error back to the probe
+func icmpErrorMessage(proto Protocol, local netaddr.IP, IP netaddr.IP, request []byte) (b []byte) {
+	if proto == Protocol(4) {
+		quoted := putIPv4Header(nil, local, IP, ProtocolICMPCst, len(request), ipv4DefaultTTLCst)
+		b = append([]byte{byte(ipv4.ICMPTypeDestinationUnreachable), 1, 0, 0, 0, 0, 0, 0}, quoted...)
+		b = append(b, request...)
+		binary.BigEndian.PutUint16(b[2:4], internetChecksum(b))
+		return b
+	}
+	quoted := putIPv6Header(nil, local, IP, ProtocolICMPv6Cst, len(request), ipv4DefaultTTLCst)
+	b = append([]byte{byte(ipv6.ICMPTypeDestinationUnreachable), 3, 0, 0, 0, 0, 0, 0}, quoted...)
+	return append(b, request...)
+}
+
+// putIPv4Header appends the IPv4 header, without options, with the checksum, to b
+func putIPv4Header(b []byte, src netaddr.IP, dst netaddr.IP, proto int, payloadLen int, ttl int) []byte {
+	h := make([]byte, IPv4HeaderLenCst)
+	h[0] = 0x45
+	binary.BigEndian.PutUint16(h[2:4], uint16(IPv4HeaderLenCst+payloadLen))
+	h[8] = byte(ttl)
+	h[9] = byte(proto)
+	s, d := src.As4(), dst.As4()
+	copy(h[12:16], s[:])
+	copy(h[16:20], d[:])
+	binary.BigEndian.PutUint16(h[10:12], internetChecksum(h))
+	return append(b, h...)
+}
+
+// putIPv6Header appends the IPv6 header, without extension headers, to b
+func putIPv6Header(b []byte, src netaddr.IP, dst netaddr.IP, nextHeader int, payloadLen int, hopLimit int) []byte {
+	h := make([]byte, IPv6HeaderLenCst)
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:6], uint16(payloadLen))
+	h[6] = byte(nextHeader)
+	h[7] = byte(hopLimit)
+	s, d := src.As16(), dst.As16()
+	copy(h[8:24], s[:])
+	copy(h[24:40], d[:])
+	return append(b, h...)
+}
+
+// internetChecksum is the rfc1071 internet checksum, of b with the checksum field zeroed
+// https://tools.ietf.org/html/rfc1071
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// SimTransport is the Transport on the SimNetwork, see MemTransport.go
+type SimTransport struct {
+	memTransport
+}
+
+// echoRequestType returns the ICMP echo request type for the protocol
+func echoRequestType(proto Protocol) uint8 {
+	if proto == Protocol(6) {
+		return uint8(ipv6.ICMPTypeEchoRequest)
+	}
+	return uint8(ipv4.ICMPTypeEcho)
+}
@@ -0,0 +1,225 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"inet.af/netaddr"
+)
+
+// startSimEngine starts the engine on the SimNetwork, and returns the function to stop it
+func startSimEngine(sim *SimNetwork, timeout time.Duration) (ie *ICMPEngine, stop func()) {
+	return startFactoryEngine(sim.Factory, timeout)
+}
+
+// startFactoryEngine starts the engine with the TransportFactory, and returns the function to stop it
+func startFactoryEngine(factory TransportFactory, timeout time.Duration) (ie *ICMPEngine, stop func()) {
+	done := make(chan struct{}, 2)
+	ie = NewFullConfig(hclog.NewNullLogger(), done, timeout, timeout, false, 1, 1, false, GetDebugLevels(1), false)
+	ie.SetTransportFactory(factory)
+	ie.Start()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go ie.Run(wg)
+	return ie, func() {
+		done <- struct{}{}
+		wg.Wait()
+	}
+}
+
+// simSend sends count echo requests over the SimTransport, and returns the sequence
+// numbers of the echo replies in the order received, waiting up to wait
+func simSend(t *SimTransport, IP netaddr.IP, count int, wait time.Duration) (seqs []Sequence) {
+	template := NewEchoTemplate(t.Proto, t.ID())
+	b := make([]byte, EchoLenCst)
+	for i := 0; i < count; i++ {
+		t.Send(template.Put(b, Sequence(i)), t.Addr(IP))
+	}
+	received := make(chan Sequence, count*2)
+	go func() {
+		rb := make([]byte, ReceiveBufferMax)
+		for {
+			n, _, err := t.Receive(rb)
+			if err != nil {
+				close(received)
+				return
+			}
+			if n >= EchoLenCst && rb[0] == echoReplyType(t.Proto) {
+				received <- Sequence(binary.BigEndian.Uint16(rb[6:8]))
+			}
+		}
+	}()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case seq := <-received:
+			seqs = append(seqs, seq)
+		case <-timer.C:
+			t.Close()
+			return seqs
+		}
+	}
+}
+
+// TestSimNetworkLatency checks the RTTs through the full engine follow the per target latency
+func TestSimNetworkLatency(t *testing.T) {
+
+	sim := NewSimNetwork(1, SimProfile{Latency: FixedLatency(20 * time.Millisecond)})
+	fast := netaddr.MustParseIP("2001:db8::1")
+	sim.SetProfile(fast, SimProfile{Latency: UniformLatency{Min: time.Millisecond, Max: 2 * time.Millisecond}})
+
+	ie, stop := startSimEngine(sim, time.Second)
+	defer stop()
+
+	count := 5
+	slow := ie.Pinger(netaddr.MustParseIP("192.0.2.1"), Sequence(count), time.Millisecond, false, make(chan struct{}))
+	if slow.Successes != count || slow.Min < 20*time.Millisecond {
+		t.Errorf(fmt.Sprintf("TestSimNetworkLatency slow Successes:%d Min:%s", slow.Successes, slow.Min))
+	}
+	quick := ie.Pinger(fast, Sequence(count), time.Millisecond, false, make(chan struct{}))
+	if quick.Successes != count || quick.Min < time.Millisecond || quick.Max > 20*time.Millisecond {
+		t.Errorf(fmt.Sprintf("TestSimNetworkLatency fast Successes:%d Min:%s Max:%s", quick.Successes, quick.Min, quick.Max))
+	}
+}
+
+// TestSimNetworkLoss checks the losses through the full engine, and that the same seed gives the same losses
+func TestSimNetworkLoss(t *testing.T) {
+
+	count := 50
+	var failures []int
+	for run := 0; run < 2; run++ {
+		sim := NewSimNetwork(7, SimProfile{Loss: &BernoulliLoss{P: 0.3}})
+		ie, stop := startSimEngine(sim, 20*time.Millisecond)
+		results := ie.Pinger(netaddr.MustParseIP("192.0.2.1"), Sequence(count), time.Millisecond, false, make(chan struct{}))
+		stop()
+		if results.Successes+results.Failures != count || uint64(results.Failures) != sim.GetStats().Lost {
+			t.Errorf(fmt.Sprintf("TestSimNetworkLoss Successes:%d Failures:%d Lost:%d", results.Successes, results.Failures, sim.GetStats().Lost))
+		}
+		failures = append(failures, results.Failures)
+	}
+	if failures[0] != failures[1] || failures[0] == 0 || failures[0] == count {
+		t.Errorf(fmt.Sprintf("TestSimNetworkLoss failures:%v", failures))
+	}
+}
+
+// TestGilbertElliottLoss checks the long run loss, and that the losses are bursty
+func TestGilbertElliottLoss(t *testing.T) {
+
+	model := &GilbertElliottLoss{PGoodToBad: 0.05, PBadToGood: 0.25, LossGood: 0.01, LossBad: 0.9}
+	l := model.Clone()
+	r := rand.New(rand.NewSource(1))
+
+	packets := 200000
+	var lost, bursts int
+	previous := false
+	for i := 0; i < packets; i++ {
+		lose := l.Lost(r)
+		if lose {
+			lost++
+			if !previous {
+				bursts++
+			}
+		}
+		previous = lose
+	}
+
+	want := (model.PBadToGood*model.LossGood + model.PGoodToBad*model.LossBad) / (model.PGoodToBad + model.PBadToGood)
+	got := float64(lost) / float64(packets)
+	if math.Abs(got-want) > 0.01 {
+		t.Errorf(fmt.Sprintf("TestGilbertElliottLoss loss got:%f want:%f", got, want))
+	}
+	// Bernoulli loss at the same rate would have a mean burst length of 1/(1-loss) ~= 1.2
+	if meanBurst := float64(lost) / float64(bursts); meanBurst < 2 {
+		t.Errorf(fmt.Sprintf("TestGilbertElliottLoss mean burst:%f not bursty", meanBurst))
+	}
+}
+
+// TestSimNetworkReorderDuplicate checks the reordering and duplication
+func TestSimNetworkReorderDuplicate(t *testing.T) {
+
+	sim := NewSimNetwork(1, SimProfile{
+		Latency:      FixedLatency(time.Millisecond),
+		Reorder:      0.3,
+		ReorderDelay: 20 * time.Millisecond,
+		Duplicate:    0.2,
+	})
+	count := 100
+	seqs := simSend(sim.NewTransport(Protocol(4)), netaddr.MustParseIP("192.0.2.1"), count, 200*time.Millisecond)
+
+	stats := sim.GetStats()
+	if len(seqs) != count+int(stats.Duplicated) || stats.Duplicated == 0 {
+		t.Errorf(fmt.Sprintf("TestSimNetworkReorderDuplicate received:%d Duplicated:%d", len(seqs), stats.Duplicated))
+	}
+	outOfOrder := 0
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] < seqs[i-1] {
+			outOfOrder++
+		}
+	}
+	if stats.Reordered == 0 || outOfOrder == 0 {
+		t.Errorf(fmt.Sprintf("TestSimNetworkReorderDuplicate Reordered:%d outOfOrder:%d", stats.Reordered, outOfOrder))
+	}
+}
+
+// TestSimNetworkErrors checks the ICMP errors are rejected by the Receivers, and the probes expire
+// and that the duplicate replies are counted through the full engine
+func TestSimNetworkErrors(t *testing.T) {
+
+	sim := NewSimNetwork(1, SimProfile{ICMPError: 1, ErrorFrom: netaddr.MustParseIP("198.51.100.1")})
+	duplicated := netaddr.MustParseIP("2001:db8::2")
+	sim.SetProfile(duplicated, SimProfile{Latency: FixedLatency(2 * time.Millisecond), Duplicate: 1})
+	ie, stop := startSimEngine(sim, 20*time.Millisecond)
+	defer stop()
+
+	count := 3
+	for _, IP := range []string{"192.0.2.1", "2001:db8::1"} {
+		results := ie.Pinger(netaddr.MustParseIP(IP), Sequence(count), time.Millisecond, false, make(chan struct{}))
+		if results.Failures != count {
+			t.Errorf(fmt.Sprintf("TestSimNetworkErrors [%s] Failures:%d", IP, results.Failures))
+		}
+	}
+	if icmpErrors := atomic.LoadUint64(&ie.Counters.ICMPErrors); icmpErrors != uint64(2*count) {
+		t.Errorf(fmt.Sprintf("TestSimNetworkErrors ICMPErrors:%d", icmpErrors))
+	}
+
+	// a duplicate arriving before the Pinger has recorded the first reply is counted as unknown
+	results := ie.Pinger(duplicated, Sequence(count), time.Millisecond, false, make(chan struct{}))
+	time.Sleep(10 * time.Millisecond)
+	duplicates := atomic.LoadUint64(&ie.Counters.RejectedDuplicates)
+	unknown := atomic.LoadUint64(&ie.Counters.RejectedUnknown)
+	if results.Successes != count || duplicates == 0 || duplicates+unknown != uint64(count) {
+		t.Errorf(fmt.Sprintf("TestSimNetworkErrors duplicate Successes:%d RejectedDuplicates:%d RejectedUnknown:%d", results.Successes, duplicates, unknown))
+	}
+}
+
+// TestSimNetworkICMPError checks the ICMP error quotes the echo request
+func TestSimNetworkICMPError(t *testing.T) {
+
+	sim := NewSimNetwork(1, SimProfile{})
+	request := NewEchoTemplate(Protocol(4), 9).Put(make([]byte, EchoLenCst), 5)
+	b := sim.icmpError(Protocol(4), netaddr.MustParseIP("192.0.2.1"), request)
+
+	if b[0] != 3 || internetChecksum(b) != 0 {
+		t.Errorf(fmt.Sprintf("TestSimNetworkICMPError type:%d checksum:%x", b[0], internetChecksum(b)))
+	}
+	var h IPv4Header
+	if err := ParseIPv4Header(b[8:], &h); err != nil || h.Dst != netaddr.MustParseIP("192.0.2.1") || h.Protocol != ProtocolICMPCst {
+		t.Errorf(fmt.Sprintf("TestSimNetworkICMPError quoted header:%+v err:%v", h, err))
+	}
+	if internetChecksum(b[8:8+IPv4HeaderLenCst]) != 0 {
+		t.Errorf("TestSimNetworkICMPError quoted header checksum")
+	}
+	if quoted := b[8+IPv4HeaderLenCst:]; string(quoted) != string(request) {
+		t.Errorf(fmt.Sprintf("TestSimNetworkICMPError quoted:%x request:%x", quoted, request))
+	}
+}
@@ -3,20 +3,30 @@
 package icmpengine
 
 // Sockets holds the OpenSockets/CloseSockets functions
+// The sockets are Transports, which are the DatagramTransport by default, see Transport.go
 
 // IPPROTO_ICMP sockets which are NonPrivilegedPing
 // https://lwn.net/Articles/422330/
+//
+// There can be multiple sockets per protocol ( SetSocketsPerProtocol ).  The kernel
+// demultiplexes the ping sockets by the ICMP identifier, which is the socket's local
+// "port", so each socket gets its own identifier, and its own Receivers, and the
+// targets are spread across the sockets by a hash of the IP ( socketIndex )
 
 import (
 	"fmt"
 	"log"
+	"net"
 
 	"github.com/go-cmd/cmd"
 	"golang.org/x/net/icmp"
+	"inet.af/netaddr"
 )
 
 const (
 	SdebugLevel = 111
+
+	SocketsPerProtocolCst = 1
 )
 
 // OpenSockets opens non-privleged ICMP sockets for sending echo requests/replies
@@ -59,38 +69,58 @@ func (ie *ICMPEngine) OpenSockets() {
 		return
 	}
 
+	perProtocol := ie.Sockets.PerProtocol
+	if perProtocol < 1 {
+		perProtocol = SocketsPerProtocolCst
+	}
+
+	factory := ie.Sockets.Factory
+	custom := factory != nil
+	if !custom {
+		factory = DatagramTransportFactory
+	}
+
 	var sockets int
 	for _, p := range ie.Protocols {
-		for retries := 0; retries < OpenSocketsRetriesCst && !ie.Sockets.Opens[p]; retries++ {
-			if ie.Sockets.Opens[p] {
-				if ie.Sockets.DebugLevel > 10 {
-					ie.Log.Info(fmt.Sprintf("OpenSockets ie.Sockets.Opens[%d] sockets are already open. ??!", p))
+		if ie.Sockets.Opens[p] {
+			if ie.Sockets.DebugLevel > 10 {
+				ie.Log.Info(fmt.Sprintf("OpenSockets ie.Sockets.Opens[%d] sockets are already open. ??!", p))
 
-				}
-				//return
-				log.Fatal(fmt.Sprintf("OpenSockets ie.Sockets.Opens[%d] sockets are already open. ??!", p))
 			}
-			var sockErr error
-			ie.Sockets.Sockets[p], sockErr = icmp.ListenPacket(ie.Sockets.Networks[p], ie.Sockets.Addresses[p])
-			if sockErr != nil {
-
-				if ie.HackSysctl() {
-					continue
+			//return
+			log.Fatal(fmt.Sprintf("OpenSockets ie.Sockets.Opens[%d] sockets are already open. ??!", p))
+		}
+		ie.Sockets.Transports[p] = nil
+		ie.Sockets.IDs[p] = nil
+		for s := 0; s < perProtocol; s++ {
+			opened := false
+			for retries := 0; retries < OpenSocketsRetriesCst && !opened; retries++ {
+				transport, sockErr := factory(ie, p, s)
+				if sockErr != nil {
+
+					if !custom {
+						if ie.HackSysctl() {
+							continue
+						}
+						ie.Log.Error("Please run: sudo sysctl -w net.ipv4.ping_group_range=\"0 2147483647\"")
+					}
+					log.Fatal("OpenSockets Transport sockErr:", sockErr)
+				}
+				ie.Sockets.Transports[p] = append(ie.Sockets.Transports[p], transport)
+				ie.Sockets.IDs[p] = append(ie.Sockets.IDs[p], transport.ID())
+				opened = true
+				sockets++
+				if ie.Sockets.DebugLevel > 10 {
+					ie.Log.Info(fmt.Sprintf("OpenSockets() Socket Open \t protocol:%d \t socket:%d \t id:%d \t retries:%d", p, s, ie.Sockets.IDs[p][s], retries))
 				}
-				ie.Log.Error("Please run: sudo sysctl -w net.ipv4.ping_group_range=\"0 2147483647\"")
-				log.Fatal("icmp.ListenPacket sockErr:", sockErr)
-			}
-			ie.Sockets.Opens[p] = true
-			sockets++
-			if ie.Sockets.DebugLevel > 10 {
-				ie.Log.Info(fmt.Sprintf("OpenSockets() Socket Open \t protocol:%d \t retries:%d", p, retries))
 			}
 		}
+		ie.Sockets.Opens[p] = true
 	}
 
 	// Assertion
-	if sockets != len(ie.Protocols) {
-		log.Fatal(fmt.Sprintf("OpenSockets() failed to open both IPv4 and IPv6 sockets. !! sockets:%d", sockets))
+	if sockets != len(ie.Protocols)*perProtocol {
+		log.Fatal(fmt.Sprintf("OpenSockets() failed to open all the IPv4 and IPv6 sockets. !! sockets:%d", sockets))
 	}
 	ie.Sockets.Open = true
 
@@ -113,16 +143,19 @@ func (ie *ICMPEngine) CloseSockets() {
 		ie.Log.Info("CloseSockets() lock acquired")
 	}
 
-	var sockets int
+	var protocols int
 	for _, p := range ie.Protocols {
-		(*ie.Sockets.Sockets[p]).Close()
-		delete(ie.Sockets.Sockets, p)
+		for _, transport := range ie.Sockets.Transports[p] {
+			transport.Close()
+		}
+		delete(ie.Sockets.Transports, p)
+		delete(ie.Sockets.IDs, p)
 		ie.Sockets.Opens[p] = false
-		sockets++
+		protocols++
 	}
 	// Assertion
-	if sockets != len(ie.Protocols) {
-		log.Fatal(fmt.Sprintf("Shutdown() closing failed to close both IPv4 and IPv6 sockets. !! sockets:%d", sockets))
+	if protocols != len(ie.Protocols) {
+		log.Fatal(fmt.Sprintf("Shutdown() closing failed to close both IPv4 and IPv6 sockets. !! protocols:%d", protocols))
 	}
 	ie.Sockets.Open = false
 
@@ -131,6 +164,35 @@ func (ie *ICMPEngine) CloseSockets() {
 	}
 }
 
+// SetSocketsPerProtocol sets the number of sockets opened per protocol
+// SetSocketsPerProtocol must be called before Start()
+func (ie *ICMPEngine) SetSocketsPerProtocol(n int) {
+	ie.Lock()
+	defer ie.Unlock()
+	if ie.Sockets.Open {
+		log.Fatal("SetSocketsPerProtocol must be called before Start()")
+	}
+	ie.Sockets.PerProtocol = n
+}
+
+// socketID returns the ICMP identifier for the socket
+// For the non-privileged ping sockets the kernel uses the local "port" as the identifier,
+// and overwrites whatever identifier is in the echo request.  Otherwise, use the default
+func socketID(socket *icmp.PacketConn, defaultID int) (id int) {
+	if addr, ok := socket.LocalAddr().(*net.UDPAddr); ok && addr.Port != 0 {
+		return addr.Port
+	}
+	return defaultID
+}
+
+// socketIndex returns which of the sockets is used for the target IP
+func socketIndex(IP netaddr.IP, sockets int) int {
+	if sockets <= 1 {
+		return 0
+	}
+	return shardIndex(IP, sockets)
+}
+
 // HackSysctl does sysctl -w net.ipv4.ping_group_range=0 2147483647
 // This requires root
 func (ie *ICMPEngine) HackSysctl() (success bool) {
@@ -0,0 +1,314 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Stats holds the constant memory streaming statistics used by the Pingers
+//
+// Welford's one-pass algorithm for computing the mean and variance
+// Knuth (TAOCP Vol 2, 3rd ed, pg 232)
+//
+// DDSketch is a fixed size quantile sketch with relative error guarantees
+// https://arxiv.org/abs/1908.10693
+// https://github.com/DataDog/sketches-go
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// DDSketchRelativeAccuracyCst of 1% means the p50/p99 etc are within 1% of the true RTT
+	DDSketchRelativeAccuracyCst = 0.01
+	// DDSketchMaxBinsCst bounds the memory of the sketch.  With 1% accuracy 2048 bins
+	// covers ~1ns to many hours, so collapsing the lowest bins should basically never happen
+	DDSketchMaxBinsCst = 2048
+)
+
+var (
+	errSketchAccuracyMismatch = errors.New("sketch relative accuracy mismatch")
+	errSketchInvalid          = errors.New("sketch invalid parameters")
+)
+
+// StreamingStats holds constant memory summary statistics of RTTs
+// Mean and M2 are held as float64 seconds, to avoid the time.Duration
+// overflow/truncation issues when squaring durations
+type StreamingStats struct {
+	Count  uint64
+	Min    time.Duration
+	Max    time.Duration
+	Sum    time.Duration
+	Mean   float64
+	M2     float64
+	Sketch *DDSketch
+}
+
+// NewStreamingStats creates StreamingStats with the default sketch settings
+func NewStreamingStats() (s *StreamingStats) {
+	return &StreamingStats{
+		Sketch: NewDDSketch(DDSketchRelativeAccuracyCst, DDSketchMaxBinsCst),
+	}
+}
+
+// clone returns a deep copy of the statistics, including the sketch
+func (s *StreamingStats) clone() (c *StreamingStats) {
+	c = &StreamingStats{}
+	*c = *s
+	if s.Sketch != nil {
+		c.Sketch = &DDSketch{}
+		*c.Sketch = *s.Sketch
+		c.Sketch.Bins = append([]uint64(nil), s.Sketch.Bins...)
+	}
+	return c
+}
+
+// Add adds a single RTT to the statistics
+func (s *StreamingStats) Add(rtt time.Duration) {
+
+	if s.Count == 0 || rtt < s.Min {
+		s.Min = rtt
+	}
+	if s.Count == 0 || rtt > s.Max {
+		s.Max = rtt
+	}
+	s.Count++
+	s.Sum += rtt
+
+	val := rtt.Seconds()
+	oldMean := s.Mean
+	s.Mean += (val - oldMean) / float64(s.Count)
+	s.M2 += (val - oldMean) * (val - s.Mean)
+
+	if s.Sketch != nil {
+		s.Sketch.Add(float64(rtt))
+	}
+}
+
+// Merge combines the other StreamingStats into s
+// Using the parallel algorithm from Chan et al, so the variance is correctly combined
+// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Parallel_algorithm
+func (s *StreamingStats) Merge(o *StreamingStats) (err error) {
+
+	if o == nil || o.Count == 0 {
+		return nil
+	}
+
+	if o.Sketch != nil {
+		if s.Sketch == nil {
+			s.Sketch = NewDDSketch(o.Sketch.RelativeAccuracy, o.Sketch.MaxBins)
+		}
+		err = s.Sketch.Merge(o.Sketch)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Count == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if s.Count == 0 || o.Max > s.Max {
+		s.Max = o.Max
+	}
+
+	count := s.Count + o.Count
+	delta := o.Mean - s.Mean
+	s.Mean += delta * float64(o.Count) / float64(count)
+	s.M2 += o.M2 + delta*delta*float64(s.Count)*float64(o.Count)/float64(count)
+	s.Count = count
+	s.Sum += o.Sum
+
+	return nil
+}
+
+// MeanDuration returns the mean as a time.Duration
+func (s *StreamingStats) MeanDuration() time.Duration {
+	return time.Duration(s.Mean * float64(time.Second))
+}
+
+// Variance returns the sample variance in seconds^2
+func (s *StreamingStats) Variance() float64 {
+	if s.Count < 2 {
+		return 0
+	}
+	return s.M2 / float64(s.Count-1)
+}
+
+// StdDev returns the sample standard deviation as a time.Duration
+func (s *StreamingStats) StdDev() time.Duration {
+	return time.Duration(math.Sqrt(s.Variance()) * float64(time.Second))
+}
+
+// Quantile returns the approximate RTT at quantile q (0 <= q <= 1)
+func (s *StreamingStats) Quantile(q float64) time.Duration {
+	if s.Sketch == nil {
+		return 0
+	}
+	return time.Duration(s.Sketch.Quantile(q))
+}
+
+// DDSketch is a fixed size, mergeable quantile sketch
+// Values are mapped to logarithmically sized bins, so any quantile
+// is returned within RelativeAccuracy of the real value
+// Bins[0] holds the count for bin index Offset
+type DDSketch struct {
+	RelativeAccuracy float64
+	MaxBins          int
+	Offset           int
+	Bins             []uint64
+	ZeroCount        uint64
+	Count            uint64
+	gamma            float64
+	lnGamma          float64
+}
+
+// NewDDSketch creates a DDSketch
+func NewDDSketch(relativeAccuracy float64, maxBins int) (s *DDSketch) {
+	s = &DDSketch{
+		RelativeAccuracy: relativeAccuracy,
+		MaxBins:          maxBins,
+	}
+	s.init()
+	return s
+}
+
+// init calculates the gamma values, which are not exported
+func (s *DDSketch) init() {
+	s.gamma = (1 + s.RelativeAccuracy) / (1 - s.RelativeAccuracy)
+	s.lnGamma = math.Log(s.gamma)
+}
+
+// validate checks the parameters of a decoded sketch, which would otherwise panic in Add
+// RelativeAccuracy must be in (0,1), or lnGamma is zero or NaN and index() is int(+Inf),
+// and the Bins must fit in MaxBins, or collapse() indexes past the end of the Bins
+func (s *DDSketch) validate() (err error) {
+	if !(s.RelativeAccuracy > 0 && s.RelativeAccuracy < 1) {
+		return fmt.Errorf("%w: relative accuracy:%f", errSketchInvalid, s.RelativeAccuracy)
+	}
+	if s.MaxBins < 1 || len(s.Bins) > s.MaxBins {
+		return fmt.Errorf("%w: max bins:%d bins:%d", errSketchInvalid, s.MaxBins, len(s.Bins))
+	}
+	return nil
+}
+
+// index maps the value to the bin index
+func (s *DDSketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.lnGamma))
+}
+
+// value returns the representative value for bin index i
+func (s *DDSketch) value(i int) float64 {
+	return 2 * math.Pow(s.gamma, float64(i)) / (1 + s.gamma)
+}
+
+// Add adds a value (must be >= 0) to the sketch
+func (s *DDSketch) Add(v float64) {
+	s.addCount(v, 1)
+}
+
+// addCount adds count values v to the sketch
+func (s *DDSketch) addCount(v float64, count uint64) {
+	if s.gamma == 0 {
+		s.init()
+	}
+	s.Count += count
+	if v <= 0 {
+		s.ZeroCount += count
+		return
+	}
+	s.addIndex(s.index(v), count)
+}
+
+// addIndex adds to the bin, growing the Bins slice as required,
+// and collapsing the lowest bins if growing would exceed MaxBins
+func (s *DDSketch) addIndex(i int, count uint64) {
+
+	if len(s.Bins) == 0 {
+		s.Offset = i
+		s.Bins = append(s.Bins, count)
+		return
+	}
+
+	if i < s.Offset {
+		// Below the lowest bin, so either prepend, or if full, add to the lowest bin
+		grow := s.Offset - i
+		if len(s.Bins)+grow > s.MaxBins {
+			grow = s.MaxBins - len(s.Bins)
+		}
+		if grow > 0 {
+			bins := make([]uint64, len(s.Bins)+grow)
+			copy(bins[grow:], s.Bins)
+			s.Bins = bins
+			s.Offset -= grow
+		}
+		s.Bins[0] += count
+		return
+	}
+
+	last := s.Offset + len(s.Bins) - 1
+	if i > last {
+		s.Bins = append(s.Bins, make([]uint64, i-last)...)
+		if len(s.Bins) > s.MaxBins {
+			s.collapse(len(s.Bins) - s.MaxBins)
+		}
+	}
+	s.Bins[i-s.Offset] += count
+}
+
+// collapse merges the lowest n+1 bins into a single bin
+func (s *DDSketch) collapse(n int) {
+	var sum uint64
+	for _, c := range s.Bins[:n+1] {
+		sum += c
+	}
+	s.Bins = s.Bins[n:]
+	s.Bins[0] = sum
+	s.Offset += n
+}
+
+// Merge adds the counts from the other sketch, which must have the same RelativeAccuracy
+func (s *DDSketch) Merge(o *DDSketch) (err error) {
+
+	if s.RelativeAccuracy != o.RelativeAccuracy {
+		return errSketchAccuracyMismatch
+	}
+	if s.gamma == 0 {
+		s.init()
+	}
+
+	s.Count += o.ZeroCount
+	s.ZeroCount += o.ZeroCount
+	for i, c := range o.Bins {
+		if c == 0 {
+			continue
+		}
+		s.Count += c
+		s.addIndex(i+o.Offset, c)
+	}
+	return nil
+}
+
+// Quantile returns the approximate value at quantile q (0 <= q <= 1)
+func (s *DDSketch) Quantile(q float64) float64 {
+
+	if s.Count == 0 || q < 0 || q > 1 {
+		return 0
+	}
+	if s.gamma == 0 {
+		s.init()
+	}
+
+	rank := uint64(q * float64(s.Count-1))
+	if rank < s.ZeroCount {
+		return 0
+	}
+
+	cumulative := s.ZeroCount
+	for i, c := range s.Bins {
+		cumulative += c
+		if cumulative > rank {
+			return s.value(i + s.Offset)
+		}
+	}
+	return s.value(s.Offset + len(s.Bins) - 1)
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+// sTestT struct defines the inputs for the stats tests
+type sTestT struct {
+	i     int
+	count int
+	step  time.Duration
+	maxQ  float64
+}
+
+// TestStreamingStats compares the StreamingStats with the simple
+// calculations on the full RTTs slice
+func TestStreamingStats(t *testing.T) {
+	var tests = []sTestT{
+		{0, 1, time.Millisecond, 1},
+		{1, 10, time.Millisecond, 1},
+		{2, 1000, 10 * time.Microsecond, 1},
+		{3, 65535, 1 * time.Microsecond, 1},
+		{4, 10000, 3 * time.Millisecond, 1},
+	}
+
+	for _, test := range tests {
+
+		s := NewStreamingStats()
+		rtts := make([]time.Duration, test.count)
+		var sum float64
+		for j := 0; j < test.count; j++ {
+			// spread the values out a bit, with a long tail
+			rtts[j] = time.Duration(j+1)*test.step + time.Duration(j*j%97)*time.Microsecond
+			sum += rtts[j].Seconds()
+			s.Add(rtts[j])
+		}
+		mean := sum / float64(test.count)
+		var m2 float64
+		for _, rtt := range rtts {
+			m2 += (rtt.Seconds() - mean) * (rtt.Seconds() - mean)
+		}
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+
+		if s.Count != uint64(test.count) {
+			t.Errorf(fmt.Sprintf("TestStreamingStats test:%d \t s.Count:%d != test.count:%d", test.i, s.Count, test.count))
+		}
+		if s.Min != rtts[0] || s.Max != rtts[len(rtts)-1] {
+			t.Errorf(fmt.Sprintf("TestStreamingStats test:%d \t s.Min:%s s.Max:%s != %s %s", test.i, s.Min, s.Max, rtts[0], rtts[len(rtts)-1]))
+		}
+		if math.Abs(s.Mean-mean) > 1e-9 {
+			t.Errorf(fmt.Sprintf("TestStreamingStats test:%d \t s.Mean:%g != mean:%g", test.i, s.Mean, mean))
+		}
+		if test.count > 1 {
+			variance := m2 / float64(test.count-1)
+			if math.Abs(s.Variance()-variance) > variance*1e-6 {
+				t.Errorf(fmt.Sprintf("TestStreamingStats test:%d \t s.Variance():%g != variance:%g", test.i, s.Variance(), variance))
+			}
+		}
+
+		for _, q := range []float64{0, 0.5, 0.9, 0.99, test.maxQ} {
+			exact := rtts[int(q*float64(test.count-1))]
+			approx := s.Quantile(q)
+			if math.Abs(float64(approx-exact)) > float64(exact)*DDSketchRelativeAccuracyCst*1.0001 {
+				t.Errorf(fmt.Sprintf("TestStreamingStats test:%d \t q:%.2f \t approx:%s \t exact:%s", test.i, q, approx, exact))
+			}
+		}
+	}
+}
+
+// TestDDSketchMaxBins checks the sketch stays bounded, and the high quantiles
+// are still accurate after the lowest bins are collapsed
+func TestDDSketchMaxBins(t *testing.T) {
+
+	maxBins := 64
+	s := NewDDSketch(DDSketchRelativeAccuracyCst, maxBins)
+
+	for v := 1.0; v < 1e12; v *= 1.01 {
+		s.Add(v)
+	}
+	for v := 1e12; v > 1; v /= 1.03 {
+		s.Add(v)
+	}
+
+	if len(s.Bins) > maxBins {
+		t.Errorf(fmt.Sprintf("TestDDSketchMaxBins len(s.Bins):%d > maxBins:%d", len(s.Bins), maxBins))
+	}
+
+	p100 := s.Quantile(1)
+	if math.Abs(p100-1e12) > 1e12*DDSketchRelativeAccuracyCst {
+		t.Errorf(fmt.Sprintf("TestDDSketchMaxBins p100:%g", p100))
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+// Transport is the seam between the engine and the ICMP sockets
+//
+// Originally SocketsT.Sockets was a map of *icmp.PacketConn, which the Receivers and WriteTo
+// used directly.  Now the Pingers, Receivers and Writers only use the Transport interface, so
+// other socket types, simulated networks, or recorded traffic can be plugged in with
+// SetTransportFactory(), without touching the Pinger or Expirer logic.
+//
+// The DatagramTransport is the original non-privileged datagram ICMP socket, and is the default
+//
+// A Transport must:
+// - Receive the ICMP message only, starting at the ICMP type, without any IP header
+// - Block in Receive until a message arrives, or the Transport is closed, when Receive must
+//   return an error wrapping net.ErrClosed, which is how the Receivers know to exit
+// - Allow Send and Receive to be called concurrently, from multiple goroutines
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"inet.af/netaddr"
+)
+
+var (
+	errShortWrite = errors.New("bytes sent does not match packet length")
+)
+
+// TransportCapabilities describes what the Transport supports
+//   - Batch is if the Transport is a BatchTransport, so can be used with SetBatchSize
+//   - KernelID is if the kernel sets the ICMP identifier, and only delivers the replies for the
+//     identifier, like the datagram ping sockets.  Otherwise the Transport must filter the replies
+//   - Privileged is if the Transport requires root, or CAP_NET_RAW
+//   - Simulated is if the Transport isn't a real network
+type TransportCapabilities struct {
+	Batch      bool
+	KernelID   bool
+	Privileged bool
+	Simulated  bool
+}
+
+// Transport sends and receives the ICMP messages for a single protocol
+type Transport interface {
+	// Protocol is the IP protocol of the Transport, 4 or 6
+	Protocol() Protocol
+	// ID is the ICMP identifier for the echo requests
+	ID() int
+	// Addr returns the destination address for the IP, which is created once per Pinger, and reused for every Send
+	Addr(IP netaddr.IP) net.Addr
+	// Send sends the ICMP message to the destination address
+	Send(b []byte, dst net.Addr) (err error)
+	// Receive blocks until an ICMP message is received, and returns the length and the peer address
+	Receive(b []byte) (n int, peer net.Addr, err error)
+	// Close closes the Transport, unblocking any Receive
+	Close() (err error)
+	// LocalAddr is the local address, for logging
+	LocalAddr() net.Addr
+	// Capabilities describes the Transport
+	Capabilities() TransportCapabilities
+}
+
+// BatchTransport is a Transport with batched receive and send, see Batch.go
+type BatchTransport interface {
+	Transport
+	// ReceiveBatch is the batch Receive, returning the number of messages received
+	ReceiveBatch(ms []ipv4.Message) (n int, err error)
+	// SendBatch is the batch Send, returning the number of messages sent
+	SendBatch(ms []ipv4.Message) (n int, err error)
+}
+
+// TransportFactory opens the Transport for the protocol, which is the index'th of the
+// SocketsT.PerProtocol Transports for the protocol
+// The TransportFactory is called by OpenSockets with the ICMPEngine lock held, so must not lock it
+type TransportFactory func(ie *ICMPEngine, proto Protocol, index int) (t Transport, err error)
+
+// DatagramTransportFactory is the default TransportFactory, which opens the DatagramTransport
+func DatagramTransportFactory(ie *ICMPEngine, proto Protocol, index int) (t Transport, err error) {
+	dt, err := NewDatagramTransport(proto, ie.Sockets.Networks[proto], ie.Sockets.Addresses[proto], ie.PID)
+	if err != nil {
+		return nil, err
+	}
+	return dt, nil
+}
+
+// SetTransportFactory sets the TransportFactory used by Start(), replacing the default
+// DatagramTransport.  SetTransportFactory must be called before Start()
+// nil restores the default
+func (ie *ICMPEngine) SetTransportFactory(factory TransportFactory) {
+	ie.Lock()
+	defer ie.Unlock()
+	if ie.Sockets.Open {
+		log.Fatal("SetTransportFactory must be called before Start()")
+	}
+	ie.Sockets.Factory = factory
+}
+
+// DatagramTransport is the non-privileged datagram ICMP socket ( IPPROTO_ICMP )
+// https://lwn.net/Articles/422330/
+type DatagramTransport struct {
+	Proto Protocol
+	conn  *icmp.PacketConn
+	batch batchConn
+	id    int
+}
+
+// NewDatagramTransport opens the datagram ICMP socket, on the network ( "udp4" or "udp6" ) and address
+// defaultID is the identifier, if the kernel doesn't assign one
+func NewDatagramTransport(proto Protocol, network string, address string, defaultID int) (t *DatagramTransport, err error) {
+
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	t = &DatagramTransport{
+		Proto: proto,
+		conn:  conn,
+		id:    socketID(conn, defaultID),
+	}
+	if proto == Protocol(4) {
+		t.batch = conn.IPv4PacketConn()
+	} else {
+		t.batch = conn.IPv6PacketConn()
+	}
+	return t, nil
+}
+
+// Conn returns the underlying socket
+func (t *DatagramTransport) Conn() *icmp.PacketConn {
+	return t.conn
+}
+
+// Protocol implements Transport
+func (t *DatagramTransport) Protocol() Protocol {
+	return t.Proto
+}
+
+// ID implements Transport
+func (t *DatagramTransport) ID() int {
+	return t.id
+}
+
+// Addr implements Transport, the datagram sockets use a UDPAddr, with the port ignored
+func (t *DatagramTransport) Addr(IP netaddr.IP) net.Addr {
+	return &net.UDPAddr{IP: IP.IPAddr().IP, Port: 0}
+}
+
+// Send implements Transport
+func (t *DatagramTransport) Send(b []byte, dst net.Addr) (err error) {
+	n, err := t.conn.WriteTo(b, dst) // ----------------------------<< WriteTo ( Sends packet to the kernel )
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return fmt.Errorf("DatagramTransport Send to:%s %w", dst, errShortWrite)
+	}
+	return nil
+}
+
+// Receive implements Transport
+func (t *DatagramTransport) Receive(b []byte) (n int, peer net.Addr, err error) {
+	return t.conn.ReadFrom(b)
+}
+
+// Close implements Transport
+func (t *DatagramTransport) Close() (err error) {
+	return t.conn.Close()
+}
+
+// LocalAddr implements Transport
+func (t *DatagramTransport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+// Capabilities implements Transport
+func (t *DatagramTransport) Capabilities() TransportCapabilities {
+	return TransportCapabilities{
+		Batch:    true,
+		KernelID: true,
+	}
+}
+
+// ReceiveBatch implements BatchTransport, using recvmmsg
+func (t *DatagramTransport) ReceiveBatch(ms []ipv4.Message) (n int, err error) {
+	return t.batch.ReadBatch(ms, 0)
+}
+
+// SendBatch implements BatchTransport, using sendmmsg
+func (t *DatagramTransport) SendBatch(ms []ipv4.Message) (n int, err error) {
+	return t.batch.WriteBatch(ms, 0)
+}
+
+// batchTransport returns the BatchTransport, if the Transport supports batching
+func batchTransport(t Transport) (bt BatchTransport, ok bool) {
+	if !t.Capabilities().Batch {
+		return nil, false
+	}
+	bt, ok = t.(BatchTransport)
+	return bt, ok
+}
@@ -0,0 +1,201 @@
+// Copyright 2021 Edgio Inc
+
+package icmpengine
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"inet.af/netaddr"
+)
+
+// loopbackTransport is a minimal Transport, which replies to every echo request
+type loopbackTransport struct {
+	proto   Protocol
+	replies chan loopbackReply
+	closeMu sync.Mutex
+	closed  chan struct{}
+}
+
+type loopbackReply struct {
+	b    []byte
+	peer net.Addr
+}
+
+func newLoopbackTransport(ie *ICMPEngine, proto Protocol, index int) (Transport, error) {
+	return &loopbackTransport{
+		proto:   proto,
+		replies: make(chan loopbackReply, 64),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+func (t *loopbackTransport) Protocol() Protocol { return t.proto }
+func (t *loopbackTransport) ID() int            { return 1 }
+func (t *loopbackTransport) LocalAddr() net.Addr {
+	return &net.IPAddr{}
+}
+func (t *loopbackTransport) Capabilities() TransportCapabilities {
+	return TransportCapabilities{Simulated: true}
+}
+func (t *loopbackTransport) Addr(IP netaddr.IP) net.Addr {
+	return &net.IPAddr{IP: IP.IPAddr().IP}
+}
+
+func (t *loopbackTransport) Send(b []byte, dst net.Addr) error {
+	reply := append([]byte(nil), b...)
+	reply[0] = byte(ipv4.ICMPTypeEchoReply)
+	if t.proto == Protocol(6) {
+		reply[0] = byte(ipv6.ICMPTypeEchoReply)
+	}
+	select {
+	case t.replies <- loopbackReply{b: reply, peer: dst}:
+	case <-t.closed:
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func (t *loopbackTransport) Receive(b []byte) (int, net.Addr, error) {
+	select {
+	case r := <-t.replies:
+		return copy(b, r.b), r.peer, nil
+	case <-t.closed:
+		return 0, nil, fmt.Errorf("loopbackTransport Receive: %w", net.ErrClosed)
+	}
+}
+
+func (t *loopbackTransport) Close() error {
+	t.closeMu.Lock()
+	defer t.closeMu.Unlock()
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+	}
+	return nil
+}
+
+// TestTransportFactory runs the Pingers, Receivers and Expirers over a Transport
+// which isn't a socket, including with batching, which the Transport doesn't support
+func TestTransportFactory(t *testing.T) {
+
+	for _, batchSize := range []int{0, BatchSizeCst} {
+		done := make(chan struct{}, 2)
+		ie := NewFullConfig(hclog.NewNullLogger(), done, time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), false)
+		ie.SetTransportFactory(newLoopbackTransport)
+		ie.SetBatchSize(batchSize)
+		ie.Start()
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		go ie.Run(wg)
+
+		count := 10
+		for _, IP := range []string{"192.0.2.1", "2001:db8::1"} {
+			results := ie.Pinger(netaddr.MustParseIP(IP), Sequence(count), time.Millisecond, false, make(chan struct{}))
+			if results.Successes != count {
+				t.Errorf(fmt.Sprintf("TestTransportFactory batchSize:%d [%s] Successes:%d", batchSize, IP, results.Successes))
+			}
+		}
+
+		done <- struct{}{}
+		wg.Wait()
+	}
+}
+
+// TestBatchSend checks the Writer's re-stamped send time is used for the RTT, and that a
+// send after StopWriters falls back to the Transport, rather than blocking on the Writer queue
+func TestBatchSend(t *testing.T) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), false)
+	IP := netaddr.MustParseIP("192.0.2.1")
+	queued := time.Now()
+	shard := ie.shard(IP)
+	shard.Lock()
+	shard.Pings[IP] = make(map[Sequence]*ExpiryEntry)
+	shard.Pings[IP][3] = ie.insertExpiry(shard, Pings{NetaddrIP: IP, Seq: 3, Send: queued, Expiry: queued.Add(time.Hour)})
+	shard.Unlock()
+
+	ie.restampSends([]writeRequest{{IP: IP, seq: 3}, {IP: IP, seq: 4}}, queued.Add(50*time.Millisecond))
+	if ps, exists := ie.matchReply(IP, 3, queued.Add(60*time.Millisecond)); !exists || ps.RTT != 10*time.Millisecond {
+		t.Errorf(fmt.Sprintf("TestBatchSend restamped exists:%t RTT:%s", exists, ps.RTT))
+	}
+
+	transport, _ := newLoopbackTransport(ie, Protocol(4), 0)
+	writer := make(chan writeRequest)
+	writerDone := make(chan struct{})
+	close(writerDone)
+	sent := make(chan struct{})
+	go func() {
+		ie.send(IP, 5, NewEchoTemplate(Protocol(4), 1).Put(make([]byte, EchoLenCst), 5), transport.Addr(IP), transport, writer, writerDone)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		if n := len(transport.(*loopbackTransport).replies); n != 1 {
+			t.Errorf(fmt.Sprintf("TestBatchSend fallback sent:%d", n))
+		}
+	case <-time.After(time.Second):
+		t.Errorf("TestBatchSend blocked on the stopped Writer")
+	}
+}
+
+// batchLoopbackTransport is the loopbackTransport with SendBatch, counting the messages sent
+type batchLoopbackTransport struct {
+	*loopbackTransport
+	sent int
+}
+
+func (t *batchLoopbackTransport) ReceiveBatch(ms []ipv4.Message) (n int, err error) {
+	return 0, net.ErrClosed
+}
+
+func (t *batchLoopbackTransport) SendBatch(ms []ipv4.Message) (n int, err error) {
+	for i := range ms {
+		ms[i].N = len(ms[i].Buffers[0])
+	}
+	t.sent += len(ms)
+	return len(ms), nil
+}
+
+// TestWriterDrain checks the stopped Writer writes everything still queued, rather than just
+// the next batch, and drainWriter sends anything left after the Writer has returned
+func TestWriterDrain(t *testing.T) {
+
+	ie := NewFullConfig(hclog.NewNullLogger(), make(chan struct{}, 2), time.Second, time.Second, false, 1, 1, false, GetDebugLevels(1), false)
+	IP := netaddr.MustParseIP("192.0.2.1")
+	lb, _ := newLoopbackTransport(ie, Protocol(4), 0)
+	transport := &batchLoopbackTransport{loopbackTransport: lb.(*loopbackTransport)}
+
+	batchSize := 4
+	queued := batchSize*WriterQueueMultiplierCst - 1
+	ch := make(chan writeRequest, batchSize*WriterQueueMultiplierCst)
+	for i := 0; i < queued; i++ {
+		req := writeRequest{addr: transport.Addr(IP), IP: IP, seq: Sequence(i)}
+		req.n = copy(req.wb[:], NewEchoTemplate(Protocol(4), 1).Put(make([]byte, EchoLenCst), Sequence(i)))
+		ch <- req
+	}
+	done := make(chan struct{})
+	close(done)
+	ie.Writers.WG.Add(1)
+	ie.Writer(Protocol(4), transport, batchSize, ch, done)
+	if transport.sent != queued || len(ch) != 0 {
+		t.Errorf(fmt.Sprintf("TestWriterDrain Writer sent:%d queued:%d left:%d", transport.sent, queued, len(ch)))
+	}
+
+	for i := 0; i < 2; i++ {
+		req := writeRequest{addr: transport.Addr(IP), IP: IP, seq: Sequence(i)}
+		req.n = copy(req.wb[:], NewEchoTemplate(Protocol(4), 1).Put(make([]byte, EchoLenCst), Sequence(i)))
+		ch <- req
+	}
+	ie.drainWriter(ch, transport)
+	if n := len(transport.replies); n != 2 || len(ch) != 0 {
+		t.Errorf(fmt.Sprintf("TestWriterDrain drainWriter sent:%d left:%d", n, len(ch)))
+	}
+}
@@ -38,11 +38,12 @@ func main() {
 	count := flag.Int("count", 10, "Count of icmps to send.")
 	interval := flag.Duration("interval", 10*time.Millisecond, "Interval between icmp echo request message sent.")
 	timeout := flag.Duration("timeout", 200*time.Millisecond, "Timeout to wait for arrival of a echo response message, before declaring it dropped.")
-	readDeadline := flag.Duration("readDeadline", 3*time.Second, "Receiver socket .SetReadDeadline timeout.  Essentailly, how long to wait before checking the done channel.")
+	readDeadline := flag.Duration("readDeadline", 3*time.Second, "Duration to splay the receivers start times over, with -splay.  The receivers no longer use a socket read deadline.")
 	r4 := flag.Int("rPP4", 2, "Receivers IPv4")
 	r6 := flag.Int("rPP6", 2, "Receivers IPv6")
 	splayReceivers := flag.Bool("splay", false, "Splay the receivers")
 	blocking := flag.Bool("blocking", false, "blocking or channel mode")
+	summary := flag.Bool("summary", false, "summary only mode, which does not keep every RTT")
 
 	di := flag.Int("di", 1, "ICMPengine debug level")
 	ds := flag.Int("ds", 1, "socket debug level")
@@ -55,6 +56,8 @@ func main() {
 	promBind := flag.String("promBind", ":8889", "Prometheus /metrics HTTP bind socket")
 	promPath := flag.String("promPath", "/metrics", "Prometheus metrics path")
 	pprof := flag.String("pprof", "", "enable profiling mode, options [cpu, mem, mutex, block, trace]")
+	pcap := flag.String("pcap", "", "Capture the sent and received ICMP packets to this pcap file, for Wireshark")
+	pcapng := flag.Bool("pcapng", false, "Write the -pcap capture in the pcapng format")
 
 	flag.Parse()
 
@@ -117,6 +120,20 @@ func main() {
 
 	doneAll := make(chan struct{}, 2)
 	ie := icmpengine.NewFullConfig(logger, doneAll, *timeout, *readDeadline, false, *r4, *r6, *splayReceivers, debugLevels, false)
+	prometheus.MustRegister(icmpengine.NewCollector(ie, icmpengine.CollectorConfigT{}))
+	var capture *icmpengine.Capture
+	if *pcap != "" {
+		format := icmpengine.CapturePcap
+		if *pcapng {
+			format = icmpengine.CapturePcapng
+		}
+		var err error
+		capture, err = icmpengine.NewCaptureFile(*pcap, format)
+		if err != nil {
+			log.Fatal("icmpengine.NewCaptureFile err:", err)
+		}
+		ie.SetCapture(capture)
+	}
 	ie.Start()
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
@@ -141,6 +158,11 @@ func main() {
 	// 	//var ips []string = []string{"127.0.0.1"}
 	// }
 
+	config := icmpengine.PingerConfigT{
+		SortRTTs:    true,
+		SummaryOnly: *summary,
+	}
+
 	sCh := make(chan icmpengine.PingerResults, len(ips))
 	pwg := new(sync.WaitGroup)
 	pDone := make(chan struct{}, 2)
@@ -163,7 +185,7 @@ func main() {
 			logger.Info(fmt.Sprintf("main starting ie.Pinger, index:%d\tip:[%s]\tcount:%d\tinterval:%s", i, destNetAddr.String(), *count, (*interval).String()))
 		}
 		if *blocking {
-			r := ie.Pinger(destNetAddr, icmpengine.Sequence(*count), *interval, true, pDone)
+			r := ie.PingerWithConfig(destNetAddr, icmpengine.Sequence(*count), *interval, pDone, config)
 
 			if debugLevel > 10 {
 				ie.Log.Info(fmt.Sprintf("main:[%s] \tsuccesses:%d \tfailures:%d \tooo:%d \tcount:%d", r.IP.String(), r.Successes, r.Failures, r.OutOfOrder, r.Count))
@@ -172,7 +194,7 @@ func main() {
 			}
 		} else {
 			pwg.Add(1)
-			go ie.PingerWithStatsChannel(destNetAddr, icmpengine.Sequence(*count), *interval, true, pDone, pwg, sCh)
+			go ie.PingerWithConfigAndStatsChannel(destNetAddr, icmpengine.Sequence(*count), *interval, pDone, config, pwg, sCh)
 		}
 	}
 
@@ -186,6 +208,7 @@ func main() {
 				ie.Log.Info(fmt.Sprintf("icmpengine main:%s \tsuccesses:%d \tfailures:%d \tooo:%d \tcount:%d", r.IP.String(), r.Successes, r.Failures, r.OutOfOrder, r.Count))
 				ie.Log.Info(fmt.Sprintf("icmpengine main:%s \tmin:%s \tmax:%s \tmean:%s \tsum:%s \tPingerDuration:%s", r.IP.String(), r.Min.String(), r.Max.String(), r.Mean.String(), r.Sum.String(), r.PingerDuration.String()))
 				//ie.Log.Info(fmt.Sprintf("icmpengine main:%s \tmin:%s \tmax:%s \tmean:%s \tvariance:%s \tsum:%s \tPingerDuration:%s", r.IP.String(), r.Min.String(), r.Max.String(), r.Mean.String(), r.Variance.String(), r.Sum.String(), r.PingerDuration.String()))
+				ie.Log.Info(fmt.Sprintf("icmpengine main:%s \tp50:%s \tp90:%s \tp99:%s \tstddev:%s", r.IP.String(), r.Stats.Quantile(0.5).String(), r.Stats.Quantile(0.9).String(), r.Stats.Quantile(0.99).String(), r.Stats.StdDev().String()))
 			}
 			if debugLevel > 100 {
 				ie.Log.Info(fmt.Sprintf("icmpengine main:%s \tr.RTTs:", r.RTTs))
@@ -209,6 +232,13 @@ func main() {
 	}
 	wg.Wait()
 
+	if capture != nil {
+		if err := capture.Close(); err != nil {
+			logger.Error(fmt.Sprintf("main capture.Close() err:%s", err))
+		}
+		logger.Info(fmt.Sprintf("main captured packets:%d to:%s", capture.Packets, *pcap))
+	}
+
 	if debugLevel > 100 {
 		logger.Info("Completed.  Bye bye")
 	}
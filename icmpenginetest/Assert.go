@@ -0,0 +1,88 @@
+// Copyright 2021 Edgio Inc
+
+package icmpenginetest
+
+// Assert holds the assertion helpers for the PingerResults, and for the Calls and Events
+// recorded by the FakeEngine.  The helpers report with t.Errorf, so the test continues, and
+// return whether the assertion passed, so the caller can stop early if needed.
+//
+// The result helpers also work on the results from the real engine, e.g. with SimNetwork
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/edgioinc/icmpengine"
+	"inet.af/netaddr"
+)
+
+// AssertResults checks the successes and failures, and that the Count is their sum
+func AssertResults(t testing.TB, r icmpengine.PingerResults, successes int, failures int) (ok bool) {
+	t.Helper()
+	if r.Successes != successes || r.Failures != failures || r.Count != r.Successes+r.Failures {
+		t.Errorf(fmt.Sprintf("AssertResults [%s] Successes:%d Failures:%d Count:%d, want Successes:%d Failures:%d", r.IP, r.Successes, r.Failures, r.Count, successes, failures))
+		return false
+	}
+	return true
+}
+
+// AssertLoss checks the loss ratio ( Failures / Count ) is within the tolerance of want
+func AssertLoss(t testing.TB, r icmpengine.PingerResults, want float64, tolerance float64) (ok bool) {
+	t.Helper()
+	if r.Count == 0 {
+		t.Errorf(fmt.Sprintf("AssertLoss [%s] no probes", r.IP))
+		return false
+	}
+	loss := float64(r.Failures) / float64(r.Count)
+	if math.Abs(loss-want) > tolerance {
+		t.Errorf(fmt.Sprintf("AssertLoss [%s] loss:%0.3f, want:%0.3f +/- %0.3f", r.IP, loss, want, tolerance))
+		return false
+	}
+	return true
+}
+
+// AssertRTTs checks all the successful RTTs are between min and max inclusive
+func AssertRTTs(t testing.TB, r icmpengine.PingerResults, min time.Duration, max time.Duration) (ok bool) {
+	t.Helper()
+	if r.Successes == 0 {
+		t.Errorf(fmt.Sprintf("AssertRTTs [%s] no successes", r.IP))
+		return false
+	}
+	if r.Min < min || r.Max > max {
+		t.Errorf(fmt.Sprintf("AssertRTTs [%s] Min:%s Max:%s, want between:%s and %s", r.IP, r.Min, r.Max, min, max))
+		return false
+	}
+	return true
+}
+
+// AssertCalls checks the number of Pinger calls to the target
+func AssertCalls(t testing.TB, f *FakeEngine, IP netaddr.IP, want int) (ok bool) {
+	t.Helper()
+	var calls int
+	for _, c := range f.Calls() {
+		if c.IP == IP {
+			calls++
+		}
+	}
+	if calls != want {
+		t.Errorf(fmt.Sprintf("AssertCalls [%s] calls:%d, want:%d", IP, calls, want))
+		return false
+	}
+	return true
+}
+
+// AssertEvents checks the sequence of the event types for the target
+func AssertEvents(t testing.TB, f *FakeEngine, IP netaddr.IP, want ...EventType) (ok bool) {
+	t.Helper()
+	var got []EventType
+	for _, e := range f.Events(IP) {
+		got = append(got, e.Type)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf(fmt.Sprintf("AssertEvents [%s] events:%v, want:%v", IP, got, want))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,365 @@
+// Copyright 2021 Edgio Inc
+
+// Package icmpenginetest provides a fake icmpengine.Engine, with scripted per target
+// responses, and helpers to assert on the PingerResults and the probe events, so the
+// code built on icmpengine can be unit tested without sending any real pings
+package icmpenginetest
+
+// FakeEngine implements the icmpengine.Engine interface, so code which depends on the
+// interface can be given the FakeEngine in the tests, and the *ICMPEngine in production
+//
+// Each target has a script of Responses, either a Reply with an RTT, or a Loss, which are
+// used in order for the probes, and then repeated from the start.  So a script of
+// Reply(time.Millisecond), Loss() is 50% loss.  The position in the script is kept across
+// the Pingers to the same target.  Targets without a script use the Default responses.
+// ScriptError makes the Pingers to a target fail, e.g. with icmpengine.ErrEngineBusy.
+//
+// The results are built with PingerResults.AddSuccess and AddFailure, the same as the real
+// Pinger, so the Min/Max/Mean/Variance and Stats match what the engine would return.
+//
+// By default the fake doesn't wait the interval, so the tests run instantly, and the
+// PingerDuration is packets*interval.  With RealTime the fake waits the interval between
+// the probes, so the DoneCh and context cancellation can be tested.
+//
+// Every Pinger is recorded as a Call, and every probe as an Event, for the assertions,
+// see Assert.go.  PingerConfigT.DropProb and FakeSuccess are ignored, use Loss() instead.
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/edgioinc/icmpengine"
+	"inet.af/netaddr"
+)
+
+const (
+	// DefaultRTTCst is the RTT of the Default response
+	DefaultRTTCst = time.Millisecond
+)
+
+// Response is the scripted response to a single probe
+type Response struct {
+	RTT  time.Duration
+	Lost bool
+}
+
+// Reply is a successful Response with the RTT
+func Reply(rtt time.Duration) Response {
+	return Response{RTT: rtt}
+}
+
+// Loss is a lost probe, which is a failure
+func Loss() Response {
+	return Response{Lost: true}
+}
+
+// EventType is the type of the probe Event
+type EventType int
+
+const (
+	// EventStart is a Pinger starting
+	EventStart EventType = iota
+	// EventSuccess is a probe reply
+	EventSuccess
+	// EventExpired is a lost probe
+	EventExpired
+	// EventDone is a Pinger finishing, with the Err if any
+	EventDone
+)
+
+var eventTypeStrings = map[EventType]string{
+	EventStart:   "start",
+	EventSuccess: "success",
+	EventExpired: "expired",
+	EventDone:    "done",
+}
+
+func (e EventType) String() string {
+	if s, ok := eventTypeStrings[e]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// Event is a recorded Pinger event
+type Event struct {
+	Type EventType
+	IP   netaddr.IP
+	Seq  icmpengine.Sequence
+	RTT  time.Duration
+	Err  error
+}
+
+// Call is a recorded Pinger call, with the results returned
+type Call struct {
+	Method   string
+	IP       netaddr.IP
+	Packets  icmpengine.Sequence
+	Interval time.Duration
+	Config   icmpengine.PingerConfigT
+	Results  icmpengine.PingerResults
+	Err      error
+}
+
+// script is the responses for a target, and the position of the next response
+type script struct {
+	responses []Response
+	next      int
+	err       error
+}
+
+// FakeEngine is the fake icmpengine.Engine
+// Default and RealTime should be set before the first Pinger
+type FakeEngine struct {
+	sync.Mutex
+	Default  []Response
+	RealTime bool
+	scripts  map[netaddr.IP]*script
+	running  map[netaddr.IP]int
+	sessions int
+	calls    []Call
+	events   []Event
+}
+
+// the FakeEngine must always implement the Engine interface
+var _ icmpengine.Engine = (*FakeEngine)(nil)
+
+// NewFakeEngine creates the FakeEngine, where all targets reply with DefaultRTTCst
+func NewFakeEngine() (f *FakeEngine) {
+	return &FakeEngine{
+		Default: []Response{Reply(DefaultRTTCst)},
+		scripts: make(map[netaddr.IP]*script),
+		running: make(map[netaddr.IP]int),
+	}
+}
+
+// Script sets the responses for the target, replacing any previous script
+func (f *FakeEngine) Script(IP netaddr.IP, responses ...Response) {
+	f.Lock()
+	defer f.Unlock()
+	f.scripts[IP] = &script{responses: responses}
+}
+
+// ScriptError makes the Pingers to the target return the err, without any probes
+// The Pingers without an error result return the empty results
+func (f *FakeEngine) ScriptError(IP netaddr.IP, err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.scripts[IP] = &script{err: err}
+}
+
+// Reset removes all the scripts, calls and events
+func (f *FakeEngine) Reset() {
+	f.Lock()
+	defer f.Unlock()
+	f.scripts = make(map[netaddr.IP]*script)
+	f.calls = nil
+	f.events = nil
+}
+
+// Calls returns a copy of the recorded calls, in the order the Pingers finished
+func (f *FakeEngine) Calls() (calls []Call) {
+	f.Lock()
+	defer f.Unlock()
+	return append(calls, f.calls...)
+}
+
+// Events returns a copy of the recorded events for the target, or for all targets if IP is zero
+func (f *FakeEngine) Events(IP netaddr.IP) (events []Event) {
+	f.Lock()
+	defer f.Unlock()
+	for _, e := range f.events {
+		if IP.IsZero() || e.IP == IP {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// next returns the next response for the target
+func (f *FakeEngine) next(IP netaddr.IP) (r Response) {
+	f.Lock()
+	defer f.Unlock()
+	s, exists := f.scripts[IP]
+	if !exists || len(s.responses) == 0 {
+		if len(f.Default) == 0 {
+			return Loss()
+		}
+		s = &script{responses: f.Default}
+		f.scripts[IP] = s
+	}
+	r = s.responses[s.next%len(s.responses)]
+	s.next++
+	return r
+}
+
+// record records the event
+func (f *FakeEngine) record(e Event) {
+	f.Lock()
+	defer f.Unlock()
+	f.events = append(f.events, e)
+}
+
+// start records the Pinger start, and returns the scripted error for the target
+func (f *FakeEngine) start(IP netaddr.IP) (err error) {
+	f.Lock()
+	defer f.Unlock()
+	if s, exists := f.scripts[IP]; exists && s.err != nil {
+		return s.err
+	}
+	f.running[IP]++
+	f.sessions++
+	f.events = append(f.events, Event{Type: EventStart, IP: IP})
+	return nil
+}
+
+// done records the Pinger end, and the Call
+func (f *FakeEngine) done(call Call, started bool) {
+	f.Lock()
+	defer f.Unlock()
+	if started {
+		f.running[call.IP]--
+		if f.running[call.IP] == 0 {
+			delete(f.running, call.IP)
+		}
+		f.sessions--
+	}
+	f.events = append(f.events, Event{Type: EventDone, IP: call.IP, Err: call.Err})
+	f.calls = append(f.calls, call)
+}
+
+// pinger is the fake Pinger, which all the Engine Pinger methods call
+func (f *FakeEngine) pinger(ctx context.Context, method string, IP netaddr.IP, packets icmpengine.Sequence, interval time.Duration, DoneCh chan struct{}, config icmpengine.PingerConfigT) (results icmpengine.PingerResults, err error) {
+
+	results.IP = IP
+	call := Call{Method: method, IP: IP, Packets: packets, Interval: interval, Config: config}
+	if err = f.start(IP); err != nil {
+		call.Err = err
+		call.Results = results
+		f.done(call, false)
+		return results, err
+	}
+
+	results.Stats = icmpengine.NewStreamingStats()
+	if !config.SummaryOnly {
+		results.RTTs = make([]time.Duration, int(packets))
+	}
+	results.Seed = config.Seed
+
+	startTime := time.Now()
+	var i icmpengine.Sequence
+	for keepLooping := true; i < packets && keepLooping; i++ {
+
+		if i > 0 && f.RealTime {
+			timer := time.NewTimer(interval)
+			select {
+			case <-timer.C:
+			case <-DoneCh:
+				keepLooping = false
+			case <-ctx.Done():
+				keepLooping = false
+				err = ctx.Err()
+			}
+			timer.Stop()
+		} else {
+			select {
+			case <-DoneCh:
+				keepLooping = false
+			case <-ctx.Done():
+				keepLooping = false
+				err = ctx.Err()
+			default:
+			}
+		}
+		if !keepLooping {
+			break
+		}
+
+		now := time.Now()
+		if config.Rolling != nil {
+			config.Rolling.Sent(now)
+		}
+		r := f.next(IP)
+		if r.Lost {
+			results.AddFailure()
+			if config.Rolling != nil {
+				config.Rolling.Expired(now)
+			}
+			f.record(Event{Type: EventExpired, IP: IP, Seq: i})
+			continue
+		}
+		results.AddSuccess(i, r.RTT)
+		if config.Rolling != nil {
+			config.Rolling.Success(now, r.RTT)
+		}
+		f.record(Event{Type: EventSuccess, IP: IP, Seq: i, RTT: r.RTT})
+	}
+
+	results.Count = results.Successes + results.Failures
+	results.PingerDuration = time.Duration(results.Count) * interval
+	if f.RealTime {
+		results.PingerDuration = time.Since(startTime)
+	}
+	if config.SortRTTs && !config.SummaryOnly {
+		sort.Slice(results.RTTs, func(i, j int) bool { return results.RTTs[i] < results.RTTs[j] })
+	}
+
+	call.Results = results
+	call.Err = err
+	f.done(call, true)
+	return results, err
+}
+
+// Pinger is the fake icmpengine Pinger
+func (f *FakeEngine) Pinger(IP netaddr.IP, packets icmpengine.Sequence, interval time.Duration, sortRTTs bool, DoneCh chan struct{}) (results icmpengine.PingerResults) {
+	results, _ = f.pinger(context.Background(), "Pinger", IP, packets, interval, DoneCh, icmpengine.PingerConfigT{SortRTTs: sortRTTs})
+	return results
+}
+
+// PingerConfig is the fake icmpengine PingerConfig, where the dropProb is ignored
+func (f *FakeEngine) PingerConfig(IP netaddr.IP, packets icmpengine.Sequence, interval time.Duration, sortRTTs bool, DoneCh chan struct{}, dropProb float64) (results icmpengine.PingerResults) {
+	results, _ = f.pinger(context.Background(), "PingerConfig", IP, packets, interval, DoneCh, icmpengine.PingerConfigT{SortRTTs: sortRTTs, DropProb: dropProb})
+	return results
+}
+
+// PingerWithConfig is the fake icmpengine PingerWithConfig
+func (f *FakeEngine) PingerWithConfig(IP netaddr.IP, packets icmpengine.Sequence, interval time.Duration, DoneCh chan struct{}, config icmpengine.PingerConfigT) (results icmpengine.PingerResults) {
+	results, _ = f.pinger(context.Background(), "PingerWithConfig", IP, packets, interval, DoneCh, config)
+	return results
+}
+
+// PingerWithContext is the fake icmpengine PingerWithContext
+func (f *FakeEngine) PingerWithContext(ctx context.Context, IP netaddr.IP, packets icmpengine.Sequence, interval time.Duration, DoneCh chan struct{}, config icmpengine.PingerConfigT) (results icmpengine.PingerResults, err error) {
+	return f.pinger(ctx, "PingerWithContext", IP, packets, interval, DoneCh, config)
+}
+
+// TryPingerWithConfig is the fake icmpengine TryPingerWithConfig
+func (f *FakeEngine) TryPingerWithConfig(IP netaddr.IP, packets icmpengine.Sequence, interval time.Duration, DoneCh chan struct{}, config icmpengine.PingerConfigT) (results icmpengine.PingerResults, err error) {
+	return f.pinger(context.Background(), "TryPingerWithConfig", IP, packets, interval, DoneCh, config)
+}
+
+// PingerWithStatsChannel is the fake icmpengine PingerWithStatsChannel
+func (f *FakeEngine) PingerWithStatsChannel(IP netaddr.IP, packets icmpengine.Sequence, interval time.Duration, sortRTTs bool, DoneCh chan struct{}, wg *sync.WaitGroup, pingerResultsCh chan<- icmpengine.PingerResults) {
+	defer wg.Done()
+	results, _ := f.pinger(context.Background(), "PingerWithStatsChannel", IP, packets, interval, DoneCh, icmpengine.PingerConfigT{SortRTTs: sortRTTs})
+	pingerResultsCh <- results
+}
+
+// PingerWithConfigAndStatsChannel is the fake icmpengine PingerWithConfigAndStatsChannel
+func (f *FakeEngine) PingerWithConfigAndStatsChannel(IP netaddr.IP, packets icmpengine.Sequence, interval time.Duration, DoneCh chan struct{}, config icmpengine.PingerConfigT, wg *sync.WaitGroup, pingerResultsCh chan<- icmpengine.PingerResults) {
+	defer wg.Done()
+	results, _ := f.pinger(context.Background(), "PingerWithConfigAndStatsChannel", IP, packets, interval, DoneCh, config)
+	pingerResultsCh <- results
+}
+
+// Status returns the running fake Pingers as the Sessions and Targets
+func (f *FakeEngine) Status() (status icmpengine.EngineStatus) {
+	f.Lock()
+	defer f.Unlock()
+	status.Sessions = f.sessions
+	status.Targets = len(f.running)
+	status.ReceiversRunning = true
+	return status
+}
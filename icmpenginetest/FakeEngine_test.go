@@ -0,0 +1,119 @@
+// Copyright 2021 Edgio Inc
+
+package icmpenginetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edgioinc/icmpengine"
+	"inet.af/netaddr"
+)
+
+// recorderTB records the errors, so the assertion failures can be tested
+type recorderTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorderTB) Helper() {}
+
+func (r *recorderTB) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// healthy is an example of consumer code, which only depends on the Engine interface
+func healthy(e icmpengine.Engine, IP netaddr.IP) bool {
+	results := e.Pinger(IP, 4, time.Second, false, make(chan struct{}))
+	return results.Successes > results.Failures
+}
+
+// TestFakeEngineScript checks the scripted responses, which repeat, and the default responses
+func TestFakeEngineScript(t *testing.T) {
+
+	f := NewFakeEngine()
+	lossy := netaddr.MustParseIP("192.0.2.1")
+	f.Script(lossy, Reply(10*time.Millisecond), Loss(), Loss(), Reply(30*time.Millisecond))
+
+	results := f.Pinger(lossy, 8, time.Second, false, make(chan struct{}))
+	AssertResults(t, results, 4, 4)
+	AssertLoss(t, results, 0.5, 0)
+	AssertRTTs(t, results, 10*time.Millisecond, 30*time.Millisecond)
+	if results.Mean != 20*time.Millisecond || results.PingerDuration != 8*time.Second || results.RTTs[1] != 0 || results.RTTs[3] != 30*time.Millisecond {
+		t.Errorf(fmt.Sprintf("TestFakeEngineScript Mean:%s PingerDuration:%s RTTs:%v", results.Mean, results.PingerDuration, results.RTTs))
+	}
+	if healthy(f, lossy) {
+		t.Errorf("TestFakeEngineScript lossy target is healthy")
+	}
+
+	clean := netaddr.MustParseIP("2001:db8::1")
+	if !healthy(f, clean) {
+		t.Errorf("TestFakeEngineScript default target is not healthy")
+	}
+	AssertCalls(t, f, lossy, 2)
+	AssertCalls(t, f, clean, 1)
+	AssertEvents(t, f, clean, EventStart, EventSuccess, EventSuccess, EventSuccess, EventSuccess, EventDone)
+
+	// the assertions fail on the wrong results
+	r := &recorderTB{}
+	if AssertResults(r, results, 8, 0) || AssertLoss(r, results, 0, 0.1) || AssertRTTs(r, results, 0, time.Millisecond) || AssertCalls(r, f, clean, 2) || AssertEvents(r, f, clean, EventStart) {
+		t.Errorf("TestFakeEngineScript assertion passed")
+	}
+	if len(r.errors) != 5 {
+		t.Errorf(fmt.Sprintf("TestFakeEngineScript errors:%v", r.errors))
+	}
+}
+
+// TestFakeEngineError checks the scripted errors, and the context cancellation
+func TestFakeEngineError(t *testing.T) {
+
+	f := NewFakeEngine()
+	busy := netaddr.MustParseIP("192.0.2.1")
+	f.ScriptError(busy, icmpengine.ErrEngineBusy)
+
+	results, err := f.TryPingerWithConfig(busy, 4, time.Second, make(chan struct{}), icmpengine.PingerConfigT{})
+	if err != icmpengine.ErrEngineBusy || results.Count != 0 {
+		t.Errorf(fmt.Sprintf("TestFakeEngineError err:%v Count:%d", err, results.Count))
+	}
+	AssertEvents(t, f, busy, EventDone)
+
+	f.RealTime = true
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	slow := netaddr.MustParseIP("192.0.2.2")
+	results, err = f.PingerWithContext(ctx, slow, 100, 20*time.Millisecond, make(chan struct{}), icmpengine.PingerConfigT{SummaryOnly: true})
+	if err != context.DeadlineExceeded || results.Successes == 0 || results.Successes >= 100 || results.RTTs != nil {
+		t.Errorf(fmt.Sprintf("TestFakeEngineError err:%v Successes:%d", err, results.Successes))
+	}
+	if status := f.Status(); status.Sessions != 0 {
+		t.Errorf(fmt.Sprintf("TestFakeEngineError Sessions:%d", status.Sessions))
+	}
+}
+
+// TestFakeEngineStatsChannel checks the concurrent Pingers with the stats channel
+func TestFakeEngineStatsChannel(t *testing.T) {
+
+	f := NewFakeEngine()
+	f.Default = []Response{Reply(5 * time.Millisecond), Loss()}
+
+	IPs := []netaddr.IP{netaddr.MustParseIP("192.0.2.1"), netaddr.MustParseIP("192.0.2.2"), netaddr.MustParseIP("2001:db8::1")}
+	resultsCh := make(chan icmpengine.PingerResults, len(IPs))
+	wg := new(sync.WaitGroup)
+	for _, IP := range IPs {
+		wg.Add(1)
+		go f.PingerWithConfigAndStatsChannel(IP, 10, time.Millisecond, make(chan struct{}), icmpengine.PingerConfigT{}, wg, resultsCh)
+	}
+	wg.Wait()
+	close(resultsCh)
+
+	for results := range resultsCh {
+		AssertResults(t, results, 5, 5)
+		AssertRTTs(t, results, 5*time.Millisecond, 5*time.Millisecond)
+	}
+	if calls := f.Calls(); len(calls) != len(IPs) || calls[0].Method != "PingerWithConfigAndStatsChannel" {
+		t.Errorf(fmt.Sprintf("TestFakeEngineStatsChannel calls:%d", len(calls)))
+	}
+}